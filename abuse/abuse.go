@@ -0,0 +1,261 @@
+// Package abuse temporarily bans client IPs that repeatedly open control
+// channels without completing a test, which is how scanners and broken
+// clients behave.
+package abuse
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// ErrBanned is returned by Accept when a connection is rejected.
+var ErrBanned = errors.New("client IP is temporarily banned")
+
+// client is the recent history of a single client IP.
+type client struct {
+	incomplete int
+	first      time.Time // Of the first incomplete test in the window.
+	banned     time.Time // The end of the ban, if the client is banned.
+}
+
+// Ban is a client IP that is banned.
+type Ban struct {
+	IP string
+	// Until is when the ban is lifted.
+	Until time.Time
+	// Incomplete is the number of incomplete tests that got the client
+	// banned.
+	Incomplete int
+}
+
+// Detector bans clients with threshold incomplete tests within a window for
+// a cooldown. A nil *Detector bans nobody.
+type Detector struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	clock     clock.Clock
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// New creates a Detector that bans a client IP for cooldown once it has
+// started threshold tests within window without completing any of them.
+func New(threshold int, window, cooldown time.Duration) *Detector {
+	return &Detector{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		clock:     clock.Real,
+		clients:   map[string]*client{},
+	}
+}
+
+// WithClock makes d tell the time with c, e.g. a fake clock in tests, and
+// returns d.
+func (d *Detector) WithClock(c clock.Clock) *Detector {
+	d.clock = c
+	return d
+}
+
+// Observe records whether the test of the client at ip was complete. A
+// complete test clears the client's history, and the threshold-th incomplete
+// test in a row within the window bans it.
+func (d *Detector) Observe(ip string, complete bool) {
+	if d == nil {
+		return
+	}
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+	c, ok := d.clients[ip]
+	if complete {
+		if ok && !c.banned.After(now) {
+			delete(d.clients, ip)
+		}
+		return
+	}
+	if !ok || (now.Sub(c.first) > d.window && !c.banned.After(now)) {
+		c = &client{first: now}
+		d.clients[ip] = c
+	}
+	c.incomplete++
+	if c.incomplete >= d.threshold && !c.banned.After(now) {
+		c.banned = now.Add(d.cooldown)
+		metrics.AbuseBans.Inc()
+	}
+	d.updateMetrics(now)
+}
+
+// sweep forgets clients whose window and ban are over. It must be called
+// with d.mu held.
+func (d *Detector) sweep(now time.Time) {
+	for ip, c := range d.clients {
+		if now.Sub(c.first) > d.window && !c.banned.After(now) {
+			delete(d.clients, ip)
+		}
+	}
+}
+
+// updateMetrics exports the number of banned clients. It must be called with
+// d.mu held.
+func (d *Detector) updateMetrics(now time.Time) {
+	banned := 0
+	for _, c := range d.clients {
+		if c.banned.After(now) {
+			banned++
+		}
+	}
+	metrics.AbuseBanned.Set(float64(banned))
+}
+
+// Banned reports whether the client at ip is banned.
+func (d *Detector) Banned(ip string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[ip]
+	return ok && c.banned.After(d.clock.Now())
+}
+
+// Rejects reports whether the client at ip is banned, and counts it if so.
+// The label names the server in the metric.
+func (d *Detector) Rejects(ip, label string) bool {
+	if !d.Banned(ip) {
+		return false
+	}
+	metrics.AbuseRejectedConnections.WithLabelValues(label).Inc()
+	return true
+}
+
+// Bans returns the banned clients, sorted by IP.
+func (d *Detector) Bans() []Ban {
+	if d == nil {
+		return nil
+	}
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bans := []Ban{}
+	for ip, c := range d.clients {
+		if c.banned.After(now) {
+			bans = append(bans, Ban{IP: ip, Until: c.banned, Incomplete: c.incomplete})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Unban lifts the ban of the client at ip and clears its history, and
+// reports whether it was banned.
+func (d *Detector) Unban(ip string) bool {
+	if d == nil {
+		return false
+	}
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[ip]
+	delete(d.clients, ip)
+	d.updateMetrics(now)
+	return ok && c.banned.After(now)
+}
+
+// ServeHTTP lists the banned clients as JSON, and lifts the ban of the client
+// in the "ip" parameter of DELETE requests.
+func (d *Detector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Bans())
+	case http.MethodDelete:
+		if !d.Unban(r.URL.Query().Get("ip")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// hostOf returns the IP part of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Accepter is implemented by listeners' gatekeepers, such as the one used by
+// the ndt5 plain server.
+type Accepter interface {
+	Accept(l net.Listener) (net.Conn, error)
+}
+
+type banningAccepter struct {
+	detector *Detector
+	next     Accepter
+	label    string
+	onBanned func(ip string)
+}
+
+// Accept accepts a connection using next, then closes it and returns
+// ErrBanned if the client is banned.
+func (a *banningAccepter) Accept(l net.Listener) (net.Conn, error) {
+	conn, err := a.next.Accept(l)
+	if err != nil {
+		return nil, err
+	}
+	if ip := hostOf(conn.RemoteAddr().String()); a.detector.Rejects(ip, a.label) {
+		if a.onBanned != nil {
+			a.onBanned(ip)
+		}
+		conn.Close()
+		return nil, ErrBanned
+	}
+	return conn, nil
+}
+
+// Accepter wraps next so that connections from banned clients are closed as
+// soon as they are accepted. The label names the server in the rejection
+// metric. If onBanned is not nil, it is called with the IP of every rejected
+// client.
+func (d *Detector) Accepter(next Accepter, label string, onBanned func(ip string)) Accepter {
+	if d == nil {
+		return next
+	}
+	return &banningAccepter{detector: d, next: next, label: label, onBanned: onBanned}
+}
+
+// Then wraps next so that requests from banned clients are answered with 403
+// Forbidden. The label names the server in the rejection metric. If onBanned
+// is not nil, it is called with the IP of every rejected client.
+func (d *Detector) Then(next http.Handler, label string, onBanned func(ip string)) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := hostOf(r.RemoteAddr); d.Rejects(ip, label) {
+			if onBanned != nil {
+				onBanned(ip)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package abuse
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+)
+
+func TestDetector_Observe(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := New(3, time.Minute, time.Hour).WithClock(c)
+	d.Observe("192.0.2.1", false)
+	d.Observe("192.0.2.1", false)
+	// A complete test clears the history of the client.
+	d.Observe("192.0.2.1", true)
+	d.Observe("192.0.2.1", false)
+	d.Observe("192.0.2.1", false)
+	if d.Banned("192.0.2.1") {
+		t.Fatal("a client should not be banned below the threshold")
+	}
+	d.Observe("192.0.2.1", false)
+	if !d.Banned("192.0.2.1") || d.Banned("192.0.2.2") {
+		t.Fatal("only the client over the threshold should be banned")
+	}
+	// Neither a complete test nor the end of the window lifts the ban.
+	d.Observe("192.0.2.1", true)
+	c.Advance(2 * time.Minute)
+	d.Observe("192.0.2.1", false)
+	if !d.Banned("192.0.2.1") {
+		t.Fatal("the ban should last for the cooldown")
+	}
+	c.Advance(time.Hour)
+	if d.Banned("192.0.2.1") {
+		t.Fatal("the ban should be lifted after the cooldown")
+	}
+}
+
+func TestDetector_Window(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := New(2, time.Minute, time.Hour).WithClock(c)
+	d.Observe("192.0.2.1", false)
+	c.Advance(2 * time.Minute)
+	d.Observe("192.0.2.1", false)
+	if d.Banned("192.0.2.1") {
+		t.Error("incomplete tests outside the window should not count")
+	}
+}
+
+func TestDetector_Nil(t *testing.T) {
+	var d *Detector
+	d.Observe("192.0.2.1", false)
+	if d.Banned("192.0.2.1") || d.Unban("192.0.2.1") || d.Bans() != nil {
+		t.Error("a nil Detector should ban nobody")
+	}
+}
+
+func TestDetector_ServeHTTP(t *testing.T) {
+	d := New(1, time.Minute, time.Hour)
+	d.Observe("192.0.2.1", false)
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/abuse/bans", nil))
+	var bans []Ban
+	if err := json.Unmarshal(rec.Body.Bytes(), &bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" || bans[0].Incomplete != 1 {
+		t.Errorf("GET returned %+v", bans)
+	}
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rec = httptest.NewRecorder()
+		d.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/abuse/bans?ip=192.0.2.1", nil))
+		if rec.Code != want {
+			t.Errorf("DELETE got status %d, want %d", rec.Code, want)
+		}
+	}
+	if d.Banned("192.0.2.1") {
+		t.Error("DELETE should lift the ban")
+	}
+}
+
+type fakeAccepter struct {
+	conn net.Conn
+}
+
+func (a *fakeAccepter) Accept(net.Listener) (net.Conn, error) {
+	return a.conn, nil
+}
+
+type fakeConn struct {
+	net.Conn
+	addr   net.Addr
+	closed bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+func (c *fakeConn) Close() error         { c.closed = true; return nil }
+
+func TestDetector_Accepter(t *testing.T) {
+	d := New(1, time.Minute, time.Hour)
+	d.Observe("192.0.2.1", false)
+	banned := []string{}
+	conn := &fakeConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	tx := d.Accepter(&fakeAccepter{conn: conn}, "test", func(ip string) { banned = append(banned, ip) })
+	if _, err := tx.Accept(nil); err != ErrBanned || !conn.closed {
+		t.Errorf("Accept() = %v, closed=%t, want ErrBanned", err, conn.closed)
+	}
+	if len(banned) != 1 || banned[0] != "192.0.2.1" {
+		t.Errorf("onBanned was called with %v, want [192.0.2.1]", banned)
+	}
+	conn = &fakeConn{addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}}
+	tx = d.Accepter(&fakeAccepter{conn: conn}, "test", nil)
+	if c, err := tx.Accept(nil); err != nil || c != conn {
+		t.Errorf("Accept() = %v, want the connection", err)
+	}
+}
+
+func TestDetector_Then(t *testing.T) {
+	d := New(1, time.Minute, time.Hour)
+	d.Observe("192.0.2.1", false)
+	h := d.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "test", nil)
+	for addr, want := range map[string]int{
+		"192.0.2.1:1234":    http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ndt7/download", nil)
+		req.RemoteAddr = addr
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request from %s got status %d, want %d", addr, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package admin serves the HTTP API that operators use to inspect and control
+// a running server: the tests that are running, the depth of the queues, the
+// clients that are banned, and whether new tests are accepted. It must be
+// served on its own listener, which should not be reachable by clients.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/m-lab/ndt-server/abuse"
+	"github.com/m-lab/ndt-server/flowlimit"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/privacy"
+)
+
+// Drainer is a server that can stop accepting new tests, and let its running
+// tests finish, until it is resumed.
+type Drainer interface {
+	Drain()
+	Resume()
+	Draining() bool
+}
+
+// API is the state that the admin API exposes. Any of its fields may be nil.
+type API struct {
+	// Tests are the running tests of every protocol.
+	Tests *live.Registry
+	// Queue is the queue of the ndt5 tests.
+	Queue *queue.Queue
+	// Flows limits the flows of every protocol.
+	Flows *flowlimit.Limiter
+	// Bans are the clients banned for abuse.
+	Bans *abuse.Detector
+	// Drainers are drained and resumed together.
+	Drainers []Drainer
+	// Debug serves the net/http/pprof profiles and the expvar variables.
+	Debug bool
+}
+
+// QueueStatus is the depth of the queues.
+type QueueStatus struct {
+	// Active and Waiting count the ndt5 tests that are running and waiting
+	// in the queue.
+	Active, Waiting int
+	// ActiveFlows and WaitingFlows count the flows, of every protocol, that
+	// are running and waiting for the flow limit.
+	ActiveFlows, WaitingFlows int
+}
+
+// DrainStatus reports whether the server is in lame duck mode.
+type DrainStatus struct {
+	Draining bool
+	// Running is the number of tests that are still running.
+	Running int
+}
+
+// Handler returns the handler of the admin API. Every request must present
+// token as a bearer token in its Authorization header.
+//
+//	GET    /tests          lists the running tests.
+//	DELETE /tests?uuid=    cancels a running test.
+//	GET    /queue          returns the depth of the queues.
+//	GET    /drain          reports whether the server is in lame duck mode.
+//	POST   /drain          enters lame duck mode.
+//	DELETE /drain          leaves lame duck mode.
+//	GET    /abuse/bans     lists the banned clients.
+//	DELETE /abuse/bans?ip= lifts a ban.
+//	GET    /debug/pprof/   lists the profiles, if Debug is set.
+//	GET    /debug/vars     returns the expvar variables, if Debug is set.
+//
+// In lame duck mode, the server is not ready, and new tests are turned away as
+// if the server were busy while the running tests finish. Load balancers stop
+// sending clients to it, so it can then be upgraded or restarted safely.
+func (a *API) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tests", a.serveTests)
+	mux.HandleFunc("/queue", a.serveQueue)
+	mux.HandleFunc("/drain", a.serveDrain)
+	if a.Bans != nil {
+		mux.Handle("/abuse/bans", a.Bans)
+	}
+	if a.Debug {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	return authorize(mux, token)
+}
+
+// authorize wraps next so that requests without the bearer token are answered
+// with 401 Unauthorized.
+func authorize(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *API) serveTests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tests := a.Tests.List()
+		if tests == nil {
+			tests = []live.Status{}
+		}
+		for i := range tests {
+			tests[i].ClientIP = privacy.IP(tests[i].ClientIP)
+		}
+		writeJSON(w, tests)
+	case http.MethodDelete:
+		if !a.Tests.Cancel(r.URL.Query().Get("uuid")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) serveQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var s QueueStatus
+	s.Active, s.Waiting = a.Queue.Len()
+	s.ActiveFlows, s.WaitingFlows = a.Flows.Len()
+	writeJSON(w, s)
+}
+
+func (a *API) serveDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		for _, d := range a.Drainers {
+			d.Drain()
+		}
+	case http.MethodDelete:
+		for _, d := range a.Drainers {
+			d.Resume()
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s := DrainStatus{Running: a.Tests.Len()}
+	for _, d := range a.Drainers {
+		s.Draining = s.Draining || d.Draining()
+	}
+	if s.Draining {
+		metrics.Draining.Set(1)
+	} else {
+		metrics.Draining.Set(0)
+	}
+	writeJSON(w, s)
+}
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/drain"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+)
+
+func serve(h http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPI_authorize(t *testing.T) {
+	h := (&API{}).Handler("secret")
+	for token, want := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		if rec := serve(h, http.MethodGet, "/queue", token); rec.Code != want {
+			t.Errorf("token %q got status %d, want %d", token, rec.Code, want)
+		}
+	}
+	// Without a token, nobody is authorized.
+	if rec := serve((&API{}).Handler(""), http.MethodGet, "/queue", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("empty token got status %d, want 401", rec.Code)
+	}
+}
+
+func TestAPI_tests(t *testing.T) {
+	r := live.NewRegistry()
+	canceled := false
+	test := r.Add("uuid", "192.0.2.1", "ndt7+wss", func() { canceled = true })
+	defer test.Done()
+	h := (&API{Tests: r}).Handler("secret")
+
+	rec := serve(h, http.MethodGet, "/tests", "secret")
+	var tests []live.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &tests); err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 1 || tests[0].UUID != "uuid" {
+		t.Errorf("GET /tests returned %+v", tests)
+	}
+	if rec := serve(h, http.MethodDelete, "/tests?uuid=other", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown test got status %d, want 404", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, "/tests?uuid=uuid", "secret"); rec.Code != http.StatusNoContent || !canceled {
+		t.Errorf("DELETE got status %d, canceled=%t", rec.Code, canceled)
+	}
+}
+
+func TestAPI_drain(t *testing.T) {
+	// ndt7 tests are drained by a Tracker, and ndt5 tests by their queue.
+	a, b := &drain.Tracker{}, queue.New(1, 1, time.Minute)
+	h := (&API{Drainers: []Drainer{a, b}}).Handler("secret")
+	status := func(rec *httptest.ResponseRecorder) DrainStatus {
+		var s DrainStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if s := status(serve(h, http.MethodPost, "/drain", "secret")); !s.Draining || !a.Draining() || !b.Draining() {
+		t.Errorf("POST /drain returned %+v", s)
+	}
+	if s := status(serve(h, http.MethodGet, "/drain", "secret")); !s.Draining {
+		t.Errorf("GET /drain returned %+v", s)
+	}
+	if s := status(serve(h, http.MethodDelete, "/drain", "secret")); s.Draining || a.Draining() || b.Draining() {
+		t.Errorf("DELETE /drain returned %+v", s)
+	}
+}
+
+func TestAPI_debug(t *testing.T) {
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/vars"} {
+		if rec := serve((&API{}).Handler("secret"), http.MethodGet, target, "secret"); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s without Debug got status %d, want 404", target, rec.Code)
+		}
+		if rec := serve((&API{Debug: true}).Handler("secret"), http.MethodGet, target, "secret"); rec.Code != http.StatusOK {
+			t.Errorf("GET %s got status %d, want 200", target, rec.Code)
+		}
+		if rec := serve((&API{Debug: true}).Handler("secret"), http.MethodGet, target, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token got status %d, want 401", target, rec.Code)
+		}
+	}
+}
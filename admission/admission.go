@@ -0,0 +1,89 @@
+// Package admission checks the signed access tokens that clients present to
+// be admitted to a test. Tokens are JWTs issued by an external scheduling
+// service, such as the locate service, which may bind a token to the IP of the
+// client it was issued to with a "client_ip" claim.
+package admission
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrRejected is wrapped by every error returned by Check.
+var ErrRejected = errors.New("access token rejected")
+
+// Verifier verifies the signature of a token and validates its claims. It is
+// implemented by the m-lab/access token.Verifier.
+type Verifier interface {
+	Verify(token string, exp jwt.Expected) (*jwt.Claims, error)
+}
+
+// Checker admits clients with a valid token. A nil *Checker admits every
+// client.
+type Checker struct {
+	verifier Verifier
+	machine  string
+}
+
+// New creates a Checker that accepts tokens signed for v. If machine is not
+// empty, tokens must also name it in their audience.
+func New(v Verifier, machine string) *Checker {
+	return &Checker{verifier: v, machine: machine}
+}
+
+// Check returns an error unless token is a valid, unexpired token for this
+// server, issued to clientIP if it names a client.
+func (c *Checker) Check(token, clientIP string) error {
+	if c == nil {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("%w: no token", ErrRejected)
+	}
+	exp := jwt.Expected{Time: time.Now()}
+	if c.machine != "" {
+		exp.Audience = jwt.Audience{c.machine}
+	}
+	claims, err := c.verifier.Verify(token, exp)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	if claims.Expiry == nil {
+		return fmt.Errorf("%w: no expiry", ErrRejected)
+	}
+	claimed, err := clientIPClaim(token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	if claimed != "" && !net.ParseIP(claimed).Equal(net.ParseIP(clientIP)) {
+		return fmt.Errorf("%w: issued to %s, not %s", ErrRejected, claimed, clientIP)
+	}
+	return nil
+}
+
+// clientIPClaim returns the "client_ip" claim of a signed token. It must only
+// be called once the signature has been verified.
+func clientIPClaim(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token is not a signed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	var claims struct {
+		ClientIP string `json:"client_ip"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+	return claims.ClientIP, nil
+}
@@ -0,0 +1,95 @@
+package admission
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type fakeVerifier struct {
+	claims *jwt.Claims
+	err    error
+	exp    jwt.Expected
+}
+
+func (f *fakeVerifier) Verify(token string, exp jwt.Expected) (*jwt.Claims, error) {
+	f.exp = exp
+	return f.claims, f.err
+}
+
+func fakeToken(payload string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestChecker_Check(t *testing.T) {
+	valid := &jwt.Claims{Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+	tests := []struct {
+		name     string
+		verifier *fakeVerifier
+		token    string
+		clientIP string
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			verifier: &fakeVerifier{claims: valid},
+			token:    fakeToken(`{"aud":"mlab1"}`),
+			clientIP: "192.0.2.1",
+		},
+		{
+			name:     "valid-client-ip",
+			verifier: &fakeVerifier{claims: valid},
+			token:    fakeToken(`{"client_ip":"2001:db8::1"}`),
+			clientIP: "2001:db8:0::1",
+		},
+		{
+			name:     "wrong-client-ip",
+			verifier: &fakeVerifier{claims: valid},
+			token:    fakeToken(`{"client_ip":"192.0.2.2"}`),
+			clientIP: "192.0.2.1",
+			wantErr:  true,
+		},
+		{
+			name:     "missing",
+			verifier: &fakeVerifier{claims: valid},
+			clientIP: "192.0.2.1",
+			wantErr:  true,
+		},
+		{
+			name:     "bad-signature",
+			verifier: &fakeVerifier{err: errors.New("bad signature")},
+			token:    fakeToken(`{}`),
+			clientIP: "192.0.2.1",
+			wantErr:  true,
+		},
+		{
+			name:     "no-expiry",
+			verifier: &fakeVerifier{claims: &jwt.Claims{}},
+			token:    fakeToken(`{}`),
+			clientIP: "192.0.2.1",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := New(tt.verifier, "mlab1").Check(tt.token, tt.clientIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrRejected) {
+				t.Errorf("Check() = %v, want ErrRejected", err)
+			}
+			if tt.token != "" && (len(tt.verifier.exp.Audience) != 1 || tt.verifier.exp.Audience[0] != "mlab1") {
+				t.Errorf("Verify() expected audience %v", tt.verifier.exp.Audience)
+			}
+		})
+	}
+
+	var nilChecker *Checker
+	if err := nilChecker.Check("", "192.0.2.1"); err != nil {
+		t.Errorf("nil Check() = %v", err)
+	}
+}
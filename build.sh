@@ -13,10 +13,16 @@ versionflags="-X github.com/m-lab/ndt-server/version.Version=$VERSION"
 
 COMMIT=$(git log -1 --format=%h)
 versionflags="${versionflags} -X github.com/m-lab/go/prometheusx.GitShortCommit=${COMMIT}"
+
+BUILD_TIME=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+versionflags="${versionflags} -X github.com/m-lab/ndt-server/version.BuildTime=${BUILD_TIME}"
 go install -v                                                          \
     -tags netgo                                                        \
     -ldflags "$versionflags -extldflags \"-static\""                   \
     .
 
+# Install the ndt5 client tools
+go install -v ./cmd/ndt-client ./cmd/ndt-load
+
 # Install generate-schemas
 cd ./cmd/generate-schemas && go install -v .
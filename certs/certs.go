@@ -0,0 +1,172 @@
+// Package certs serves TLS certificates from files and reloads them when they
+// are replaced on disk, so that renewed certificates are used without
+// restarting the server.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+)
+
+// Pair is a certificate and key file pair that is reloaded when either file
+// changes. Handshakes that are already running keep the certificate they
+// started with.
+type Pair struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime [2]time.Time
+}
+
+// Open reads the certificate in certFile and its key in keyFile.
+func Open(certFile, keyFile string) (*Pair, error) {
+	p := &Pair{certFile: certFile, keyFile: keyFile}
+	if err := p.Load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Load rereads the certificate and key. If they are invalid, e.g. because
+// only one of them has been replaced so far, the previous certificate stays in
+// use.
+func (p *Pair) Load() error {
+	_, err := p.reload(true)
+	return err
+}
+
+// Reload rereads the certificate and key if the modification time of either
+// file has changed, and reports whether it did.
+func (p *Pair) Reload() (bool, error) {
+	return p.reload(false)
+}
+
+func (p *Pair) reload(force bool) (bool, error) {
+	var modTime [2]time.Time
+	for i, path := range []string{p.certFile, p.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTime[i] = fi.ModTime()
+	}
+	p.mu.RLock()
+	current := p.cert != nil && modTime == p.modTime
+	p.mu.RUnlock()
+	if current && !force {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", p.certFile, err)
+	}
+	// Parse the leaf once here rather than on every handshake that checks
+	// its names.
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", p.certFile, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = &cert
+	p.modTime = modTime
+	return true, nil
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (p *Pair) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := p.Reload()
+			if err != nil {
+				logging.Logger.WithError(err).WithField("path", p.certFile).Warn("Could not reload")
+			} else if reloaded {
+				logging.Logger.WithField("path", p.certFile).Info("Reloaded")
+			}
+		}
+	}
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as
+// tls.Config.GetCertificate.
+func (p *Pair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cert, nil
+}
+
+// Set is a list of certificate pairs, one of which is chosen for each client
+// by the server name it asks for (SNI).
+type Set []*Pair
+
+// OpenSet reads the certificate in each of certFiles and its key in the
+// keyFiles entry at the same index.
+func OpenSet(certFiles, keyFiles []string) (Set, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("%d certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+	s := Set{}
+	for i := range certFiles {
+		p, err := Open(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, p)
+	}
+	return s, nil
+}
+
+// Load rereads every pair. It returns the first error, after trying them all.
+func (s Set) Load() error {
+	var first error
+	for _, p := range s {
+		if err := p.Load(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Watch calls Reload on every pair every interval until ctx is done.
+func (s Set) Watch(ctx context.Context, interval time.Duration) {
+	var wg sync.WaitGroup
+	for _, p := range s {
+		wg.Add(1)
+		go func(p *Pair) {
+			defer wg.Done()
+			p.Watch(ctx, interval)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// GetCertificate returns the first certificate that supports hello, which
+// includes being valid for the server name it asks for, or else the first
+// certificate of the set. It is meant to be used as tls.Config.GetCertificate.
+func (s Set) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(s) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	for _, p := range s {
+		cert, _ := p.GetCertificate(hello)
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s[0].GetCertificate(hello)
+}
@@ -0,0 +1,124 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+// writePair writes a self-signed certificate for host with the given serial
+// number and its key to certFile and keyFile.
+func writePair(t *testing.T, certFile, keyFile string, serial int64, host string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rtx.Must(err, "Could not generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	rtx.Must(err, "Could not create certificate")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	rtx.Must(err, "Could not marshal key")
+	rtx.Must(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600), "Could not write cert")
+	rtx.Must(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600), "Could not write key")
+}
+
+func serial(t *testing.T, p *Pair) int64 {
+	cert, err := p.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	rtx.Must(err, "Could not parse certificate")
+	return x.SerialNumber.Int64()
+}
+
+func TestPair(t *testing.T) {
+	d := t.TempDir()
+	certFile, keyFile := filepath.Join(d, "cert.pem"), filepath.Join(d, "key.pem")
+	writePair(t, certFile, keyFile, 1, "localhost")
+	p, err := Open(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(t, p); got != 1 {
+		t.Errorf("serial = %d, want 1", got)
+	}
+	if reloaded, err := p.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of unchanged files = %t, %v, want false, nil", reloaded, err)
+	}
+
+	// Replace the certificate, but not yet the key.
+	writePair(t, certFile, filepath.Join(d, "other.pem"), 2, "localhost")
+	future := time.Now().Add(time.Minute)
+	rtx.Must(os.Chtimes(certFile, future, future), "Could not change mtime")
+	if _, err := p.Reload(); err == nil {
+		t.Error("Reload() of a mismatched pair succeeded")
+	}
+	if got := serial(t, p); got != 1 {
+		t.Errorf("serial after failed reload = %d, want 1", got)
+	}
+
+	rtx.Must(os.Rename(filepath.Join(d, "other.pem"), keyFile), "Could not replace key")
+	if reloaded, err := p.Reload(); !reloaded || err != nil {
+		t.Errorf("Reload() of a new pair = %t, %v, want true, nil", reloaded, err)
+	}
+	if got := serial(t, p); got != 2 {
+		t.Errorf("serial after reload = %d, want 2", got)
+	}
+}
+
+func TestSet(t *testing.T) {
+	d := t.TempDir()
+	var certFiles, keyFiles []string
+	for i, host := range []string{"ndt.example.org", "ndt7.example.org"} {
+		certFiles = append(certFiles, filepath.Join(d, host+".crt"))
+		keyFiles = append(keyFiles, filepath.Join(d, host+".key"))
+		writePair(t, certFiles[i], keyFiles[i], int64(i+1), host)
+	}
+	s, err := OpenSet(certFiles, keyFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSet(certFiles, keyFiles[:1]); err == nil {
+		t.Error("OpenSet() of mismatched lists succeeded")
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"ndt.example.org", "ndt.example.org"},
+		{"ndt7.example.org", "ndt7.example.org"},
+		{"unknown.example.org", "ndt.example.org"},
+		{"", "ndt.example.org"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tls.Server(server, &tls.Config{GetCertificate: s.GetCertificate}).Handshake()
+		}()
+		conn := tls.Client(client, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.ConnectionState().PeerCertificates[0].DNSNames[0]; got != tt.want {
+			t.Errorf("certificate for %q is for %q, want %q", tt.serverName, got, tt.want)
+		}
+		conn.Close()
+	}
+}
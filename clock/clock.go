@@ -0,0 +1,200 @@
+// Package clock abstracts the passage of time, so that code with timers,
+// deadlines, and transfer windows can be tested deterministically with a Fake
+// clock instead of real sleeps.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers and tickers.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a *time.Timer, or a timer of a Fake clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a *time.Ticker, or a ticker of a Fake clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) NewTimer(d time.Duration) Timer  { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Fake is a Clock whose time only passes when Advance is called. Its timers
+// and tickers fire, like those of the time package, by sending the time on a
+// channel with room for one value; the ticks that a ticker's receiver is too
+// slow for are dropped.
+//
+// Like the time package, a Fake has a wall clock, which Step may step, and a
+// monotonic clock, which only Advance moves. The times that Now returns carry
+// their monotonic reading, which Since uses; other times are compared with
+// the wall clock.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time // The monotonic clock.
+	wall    time.Duration
+	waiters []*waiter
+	// readings are the monotonic readings of the times that Now returned.
+	readings map[time.Time]time.Time
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, readings: map[time.Time]time.Time{}}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// waiter is a timer, or a ticker if period is not zero.
+type waiter struct {
+	f      *Fake
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// Now returns the time of f's wall clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.now.Add(f.wall)
+	f.readings[t] = f.now
+	return t
+}
+
+// Since returns the time elapsed on f since t, from the monotonic clock if t
+// was returned by Now, and otherwise from the wall clock.
+func (f *Fake) Since(t time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if m, ok := f.readings[t]; ok {
+		return f.now.Sub(m)
+	}
+	return f.now.Add(f.wall).Sub(t)
+}
+
+// Step steps the wall clock of f by d, which may be negative, as NTP may step
+// the clock of a server. The monotonic clock, and so Since and the timers and
+// tickers of f, are unaffected.
+func (f *Fake) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wall += d
+}
+
+// NewTimer returns a Timer that fires once f has advanced by d.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(d, 0)
+}
+
+// NewTicker returns a Ticker that fires every time f has advanced by d. It
+// panics if d is not positive.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(d, d)}
+}
+
+func (f *Fake) add(d, period time.Duration) *waiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &waiter{f: f, at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	return w
+}
+
+// remove removes w from f's waiters, and reports whether it was there. It must
+// be called with f.mu held.
+func (f *Fake) remove(w *waiter) bool {
+	for i, x := range f.waiters {
+		if x == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the time of f forward by d, firing the timers and tickers that
+// are due in the order that they are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+		if len(f.waiters) == 0 || f.waiters[0].at.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.at
+		select {
+		case w.c <- f.now.Add(f.wall):
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	f.now = end
+}
+
+// BlockUntil waits until n timers and tickers are running on f, so that a
+// test can advance f once the code under test is waiting for it.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+func (w *waiter) C() <-chan time.Time {
+	return w.c
+}
+
+// Stop stops the timer or ticker, and reports whether it was running.
+func (w *waiter) Stop() bool {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+	return w.f.remove(w)
+}
+
+// fakeTicker is a waiter whose Stop has the signature of Ticker's.
+type fakeTicker struct{ *waiter }
+
+func (t fakeTicker) Stop() { t.waiter.Stop() }
@@ -0,0 +1,73 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	timer := f.NewTimer(10 * time.Second)
+	ticker := f.NewTicker(3 * time.Second)
+	f.BlockUntil(2)
+
+	f.Advance(9 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("The timer fired early")
+	default:
+	}
+	// Ticks that are not received are dropped.
+	if got := <-ticker.C(); !got.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("The ticker fired at %v, want %v", got, start.Add(3*time.Second))
+	}
+	select {
+	case <-ticker.C():
+		t.Error("The ticker did not drop ticks")
+	default:
+	}
+
+	f.Advance(time.Second)
+	if got := <-timer.C(); !got.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("The timer fired at %v, want %v", got, start.Add(10*time.Second))
+	}
+	if timer.Stop() {
+		t.Error("Stop() of a timer that fired = true")
+	}
+	if d := f.Since(start); d != 10*time.Second {
+		t.Errorf("Since() = %v, want 10s", d)
+	}
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("A stopped ticker fired")
+	default:
+	}
+}
+
+func TestFake_Step(t *testing.T) {
+	f := NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := f.Now()
+	timer := f.NewTimer(10 * time.Second)
+	f.Advance(5 * time.Second)
+	f.Step(-time.Hour)
+	if got, want := f.Now(), start.Add(5*time.Second-time.Hour); !got.Equal(want) {
+		t.Errorf("Now() after Step = %v, want %v", got, want)
+	}
+	if d := f.Since(start); d != 5*time.Second {
+		t.Errorf("Since() after Step = %v, want 5s", d)
+	}
+	// Times that Now did not return have no monotonic reading.
+	if d := f.Since(start.Round(0).Add(time.Nanosecond)); d != 5*time.Second-time.Hour-time.Nanosecond {
+		t.Errorf("Since() of a time without monotonic reading = %v", d)
+	}
+	f.Advance(5 * time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Error("Step delayed a timer")
+	}
+}
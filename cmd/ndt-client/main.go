@@ -0,0 +1,85 @@
+// ndt-client runs an ndt5 test against a server and prints its results as
+// JSON. It is meant for smoke-testing deployments, e.g.
+//
+//	ndt-client -server ndt.example.org:3010 -protocol wss
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/m-lab/ndt-server/ndt5/client"
+)
+
+var (
+	server   = flag.String("server", "localhost:3001", "The host and port of the server's raw, WS, or WSS ndt5 port")
+	proto    = flag.String("protocol", "raw", "The protocol of the connections. Valid values: raw, ws, wss")
+	duration = flag.Duration("duration", client.DefaultDuration, "How long the c2s test uploads")
+	insecure = flag.Bool("insecure", false, "Whether to skip the verification of the server's certificate with -protocol wss")
+	tests    = flag.String("tests", "c2s,s2c,meta", "Comma-separated tests to run. Valid values: c2s, s2c, meta")
+	token    = flag.String("access_token", "", "The access token to send to servers that require one")
+)
+
+var testBits = map[string]int{
+	"c2s":  client.TestC2S,
+	"s2c":  client.TestS2C,
+	"meta": client.TestMETA,
+}
+
+// parseTests returns the bits of the comma-separated tests.
+func parseTests(s string) (int, error) {
+	bits := 0
+	for _, name := range strings.Split(s, ",") {
+		bit, ok := testBits[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown test %q", name)
+		}
+		bits |= bit
+	}
+	return bits, nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ndt-client: ")
+
+	bits, err := parseTests(*tests)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := client.Protocol(*proto)
+	if p != client.Raw && p != client.WS && p != client.WSS {
+		log.Fatalf("unknown protocol %q", *proto)
+	}
+	c := &client.Client{
+		Protocol:    p,
+		Server:      *server,
+		AccessToken: *token,
+		Duration:    *duration,
+		Metadata:    map[string]string{"client.application": "ndt-client"},
+	}
+	if *insecure {
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	result, err := c.Run(ctx, bits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+// ndt-load runs many concurrent ndt5 clients against a server and reports the
+// throughput, error rate, and latencies it achieved, for capacity planning.
+//
+//	ndt-load -server ndt.example.org:3001 -clients 50 -ramp 1m -for 10m
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/client"
+)
+
+var (
+	server   = flag.String("server", "localhost:3001", "The host and port of the server's ndt5 port. WS and WSS clients use the -ws_server and -wss_server instead")
+	wsServer = flag.String("ws_server", "localhost:3002", "The host and port of the server's ndt5 WS port")
+	wssSrv   = flag.String("wss_server", "localhost:3010", "The host and port of the server's ndt5 WSS port")
+	clients  = flag.Int("clients", 10, "The number of concurrent clients")
+	ramp     = flag.Duration("ramp", 10*time.Second, "The time over which the clients are started, evenly spaced")
+	think    = flag.Duration("think", time.Second, "How long each client waits between its tests")
+	runFor   = flag.Duration("for", time.Minute, "How long to start new tests for. Tests in progress are allowed to finish")
+	duration = flag.Duration("duration", client.DefaultDuration, "How long the c2s tests upload")
+	mix      = flag.String("mix", "raw:1", "Comma-separated protocol:weight pairs, e.g. raw:2,wss:1, to pick the protocol of each test. Valid protocols: raw, ws, wss")
+	insecure = flag.Bool("insecure", false, "Whether to skip the verification of the server's certificate by WSS clients")
+)
+
+// loader runs the clients of a load test.
+type loader struct {
+	clients map[client.Protocol]*client.Client
+	mix     *protocolMix
+	think   time.Duration
+
+	mu      sync.Mutex
+	samples []sample
+}
+
+// runClient runs tests until stop is done, waiting think between them.
+func (l *loader) runClient(ctx, stop context.Context, rnd *rand.Rand) {
+	for stop.Err() == nil {
+		p := l.mix.pick(rnd)
+		start := time.Now()
+		r, err := l.clients[p].Run(ctx, client.TestC2S|client.TestS2C)
+		s := sample{protocol: p, elapsed: time.Since(start), err: err}
+		if err == nil {
+			s.c2s, s.s2c = r.C2S, r.S2C
+		}
+		l.mu.Lock()
+		l.samples = append(l.samples, s)
+		l.mu.Unlock()
+		select {
+		case <-stop.Done():
+		case <-time.After(l.think):
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ndt-load: ")
+
+	m, err := parseMix(*mix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *clients <= 0 {
+		log.Fatal("-clients must be positive")
+	}
+	var tlsConfig *tls.Config
+	if *insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	l := &loader{
+		clients: map[client.Protocol]*client.Client{
+			client.Raw: {Protocol: client.Raw, Server: *server, Duration: *duration},
+			client.WS:  {Protocol: client.WS, Server: *wsServer, Duration: *duration},
+			client.WSS: {Protocol: client.WSS, Server: *wssSrv, Duration: *duration, TLSConfig: tlsConfig},
+		},
+		mix:   m,
+		think: *think,
+	}
+
+	// An interrupt aborts the tests in progress, while the end of -for only
+	// stops new tests from starting.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	stop, stopCancel := context.WithTimeout(ctx, *runFor)
+	defer stopCancel()
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < *clients; i++ {
+		delay := *ramp * time.Duration(i) / time.Duration(*clients)
+		rnd := rand.New(rand.NewSource(start.UnixNano() + int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-stop.Done():
+				return
+			case <-time.After(delay):
+			}
+			l.runClient(ctx, stop, rnd)
+		}()
+	}
+	wg.Wait()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summarize(l.samples, time.Since(start))); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/client"
+)
+
+// protocolMix picks the protocols of tests at random, in proportion to their
+// weights.
+type protocolMix struct {
+	protocols []client.Protocol
+	weights   []int
+	total     int
+}
+
+// parseMix parses comma-separated protocol:weight pairs. A protocol without a
+// weight has weight 1.
+func parseMix(s string) (*protocolMix, error) {
+	m := &protocolMix{}
+	for _, pair := range strings.Split(s, ",") {
+		name, w, found := strings.Cut(strings.TrimSpace(pair), ":")
+		weight := 1
+		if found {
+			var err error
+			weight, err = strconv.Atoi(w)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in %q", pair)
+			}
+		}
+		p := client.Protocol(name)
+		if p != client.Raw && p != client.WS && p != client.WSS {
+			return nil, fmt.Errorf("unknown protocol %q", name)
+		}
+		m.protocols = append(m.protocols, p)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	if m.total == 0 {
+		return nil, fmt.Errorf("no protocol has a positive weight in %q", s)
+	}
+	return m, nil
+}
+
+func (m *protocolMix) pick(rnd *rand.Rand) client.Protocol {
+	n := rnd.Intn(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.protocols[i]
+		}
+		n -= w
+	}
+	panic("unreachable")
+}
+
+// sample is the outcome of one test.
+type sample struct {
+	protocol client.Protocol
+	elapsed  time.Duration
+	err      error
+	c2s, s2c *client.Measurement
+}
+
+// Percentiles of a distribution.
+type Percentiles struct {
+	P50, P90, P99, Max float64
+}
+
+// percentiles returns the percentiles of values, which it sorts.
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sort.Float64s(values)
+	at := func(p float64) float64 {
+		return values[int(p*float64(len(values)-1))]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+// Report summarizes a load test.
+type Report struct {
+	Elapsed   string
+	Tests     int
+	Errors    int
+	ErrorRate float64
+	// ErrorsByMessage counts the errors by their message.
+	ErrorsByMessage map[string]int `json:",omitempty"`
+	TestsByProtocol map[client.Protocol]int
+	// The throughput achieved by all clients together, over the whole test.
+	C2SMbps, S2CMbps float64
+	// The rates of the successful tests, as measured by the server.
+	C2STestMbps, S2CTestMbps Percentiles
+	// The durations of the successful tests, login to logout, in seconds.
+	TestSeconds Percentiles
+}
+
+// summarize reports on the samples of a load test that ran for elapsed.
+func summarize(samples []sample, elapsed time.Duration) *Report {
+	r := &Report{
+		Elapsed:         elapsed.Round(time.Millisecond).String(),
+		Tests:           len(samples),
+		TestsByProtocol: map[client.Protocol]int{},
+	}
+	var c2sBytes, s2cBytes int64
+	var c2s, s2c, seconds []float64
+	for _, s := range samples {
+		r.TestsByProtocol[s.protocol]++
+		if s.err != nil {
+			if r.ErrorsByMessage == nil {
+				r.ErrorsByMessage = map[string]int{}
+			}
+			r.Errors++
+			r.ErrorsByMessage[s.err.Error()]++
+			continue
+		}
+		seconds = append(seconds, s.elapsed.Seconds())
+		if s.c2s != nil {
+			c2sBytes += s.c2s.Bytes
+			c2s = append(c2s, s.c2s.ServerKbps/1000)
+		}
+		if s.s2c != nil {
+			s2cBytes += s.s2c.Bytes
+			s2c = append(s2c, s.s2c.ServerKbps/1000)
+		}
+	}
+	if r.Tests > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Tests)
+	}
+	if elapsed > 0 {
+		r.C2SMbps = float64(c2sBytes) * 8 / 1e6 / elapsed.Seconds()
+		r.S2CMbps = float64(s2cBytes) * 8 / 1e6 / elapsed.Seconds()
+	}
+	r.C2STestMbps = percentiles(c2s)
+	r.S2CTestMbps = percentiles(s2c)
+	r.TestSeconds = percentiles(seconds)
+	return r
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/client"
+)
+
+func Test_parseMix(t *testing.T) {
+	m, err := parseMix("raw:3, wss:1,ws:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[client.Protocol]int{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		counts[m.pick(rnd)]++
+	}
+	if counts[client.WS] != 0 || counts[client.Raw] < 2700 || counts[client.WSS] < 800 {
+		t.Errorf("pick() counts = %v", counts)
+	}
+	for _, s := range []string{"", "tcp", "raw:x", "raw:-1", "raw:0"} {
+		if _, err := parseMix(s); err == nil {
+			t.Errorf("parseMix(%q) did not fail", s)
+		}
+	}
+}
+
+func Test_summarize(t *testing.T) {
+	samples := []sample{
+		{protocol: client.Raw, elapsed: time.Second, c2s: &client.Measurement{ServerKbps: 8000, Bytes: 1e6}},
+		{protocol: client.Raw, elapsed: 3 * time.Second, s2c: &client.Measurement{ServerKbps: 4000, Bytes: 2e6}},
+		{protocol: client.WSS, err: errors.New("busy")},
+	}
+	r := summarize(samples, 2*time.Second)
+	if r.Tests != 3 || r.Errors != 1 || r.ErrorsByMessage["busy"] != 1 || r.TestsByProtocol[client.Raw] != 2 {
+		t.Errorf("summarize() counts = %+v", r)
+	}
+	if r.C2SMbps != 4 || r.S2CMbps != 8 || r.C2STestMbps.P50 != 8 || r.S2CTestMbps.Max != 4 {
+		t.Errorf("summarize() rates = %+v", r)
+	}
+	if r.TestSeconds.P50 != 1 || r.TestSeconds.Max != 3 {
+		t.Errorf("summarize() TestSeconds = %+v", r.TestSeconds)
+	}
+}
@@ -0,0 +1,384 @@
+// Package config sets command-line flags from environment variables and from
+// a config file, for deployments with more flags than fit comfortably on a
+// command line, and sets them again when the file changes. Flags given on the
+// command line take precedence over environment variables, which take
+// precedence over the config file.
+//
+// Config files are YAML mappings of flag names to values. Since flag names
+// are dotted, nested mappings are joined with dots, so that
+//
+//	results:
+//	  writers: [file, kafka]
+//	  kafka:
+//	    brokers: [kafka-1:9092, kafka-2:9092]
+//	ndt5_addr: ":3001"
+//
+// sets -results.writers=file,kafka, -results.kafka.brokers, and -ndt5_addr.
+// Sequences, whether in block or flow style, are joined with commas, as the
+// flags that take lists expect. Only this subset of YAML is supported: there
+// are no anchors, multi-line strings, or sequences of mappings.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/go/flagx"
+)
+
+// entry is the value of a flag in a config file.
+type entry struct {
+	name  string
+	value string
+	line  int
+}
+
+// pending is a key without a value, whose value is the mapping or the
+// sequence on the following lines.
+type pending struct {
+	name   string
+	indent int
+	line   int
+	items  []string
+	isList bool
+}
+
+// level is an open mapping: its keys are indented by indent and their names
+// start with prefix.
+type level struct {
+	indent int
+	prefix string
+}
+
+// syntaxError reports a line of a config file that can't be parsed.
+type syntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// stripComment returns s without its comment, if any.
+func stripComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// scalar returns the value of the YAML scalar s.
+func scalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "~" || s == "null":
+		return "", nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", errors.New("unterminated string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return "", errors.New("unterminated sequence")
+		}
+		var items []string
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			v, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return s, nil
+}
+
+// parse returns the flag values of the config file read from r.
+func parse(r io.Reader) ([]entry, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	levels := []level{{indent: 0}}
+	var open *pending
+	finish := func() {
+		if open != nil {
+			entries = append(entries, entry{open.name, strings.Join(open.items, ","), open.line})
+			open = nil
+		}
+	}
+	for i, raw := range strings.Split(string(b), "\n") {
+		n := i + 1
+		line := strings.TrimRight(stripComment(strings.TrimSuffix(raw, "\r")), " \t")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, &syntaxError{n, "tabs can't be used for indentation"}
+		}
+		indent := len(line) - len(text)
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if open == nil || indent < open.indent || (open.isList && indent != open.indent) {
+				return nil, &syntaxError{n, "sequence item without a key"}
+			}
+			v, err := scalar(text[1:])
+			if err != nil {
+				return nil, &syntaxError{n, err.Error()}
+			}
+			if open.items == nil {
+				open.indent = indent
+			}
+			open.items = append(open.items, v)
+			open.isList = true
+			continue
+		}
+		if open != nil && !open.isList && indent > open.indent {
+			levels = append(levels, level{indent: indent, prefix: open.name + "."})
+			open = nil
+		}
+		finish()
+		for len(levels) > 1 && levels[len(levels)-1].indent > indent {
+			levels = levels[:len(levels)-1]
+		}
+		top := levels[len(levels)-1]
+		if top.indent != indent {
+			return nil, &syntaxError{n, "unexpected indentation"}
+		}
+
+		colon := strings.Index(text, ": ")
+		if strings.HasSuffix(text, ":") && (colon < 0 || colon == len(text)-2) {
+			colon = len(text) - 1
+		}
+		if colon <= 0 {
+			return nil, &syntaxError{n, "expected a key: value pair"}
+		}
+		key := strings.TrimSpace(text[:colon])
+		value := strings.TrimSpace(text[colon+1:])
+		if value == "" {
+			open = &pending{name: top.prefix + key, indent: indent, line: n}
+			continue
+		}
+		v, err := scalar(value)
+		if err != nil {
+			return nil, &syntaxError{n, err.Error()}
+		}
+		entries = append(entries, entry{top.prefix + key, v, n})
+	}
+	finish()
+
+	seen := map[string]int{}
+	for _, e := range entries {
+		if l, ok := seen[e.name]; ok {
+			return nil, &syntaxError{e.line, fmt.Sprintf("%s is already set on line %d", e.name, l)}
+		}
+		seen[e.name] = e.line
+	}
+	return entries, nil
+}
+
+// Load sets the flags of fs to the values in the config file at path. Flags
+// that were given on the command line, or that have a value in the
+// environment, keep that value. Every unknown flag and invalid value in the
+// file is reported.
+func Load(fs *flag.FlagSet, path string) error {
+	entries, err := read(path)
+	if err != nil {
+		return err
+	}
+	errs := unknown(fs, path, entries)
+	for _, e := range entries {
+		if fs.Lookup(e.name) == nil || overridden(fs, e.name) {
+			continue
+		}
+		if err := fs.Lookup(e.name).Value.Set(e.value); err != nil {
+			errs = append(errs, invalid(path, e, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// read returns the flag values of the config file at path.
+func read(path string) ([]entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// unknown returns an error for every entry of the config file at path that is
+// not a flag of fs.
+func unknown(fs *flag.FlagSet, path string, entries []entry) []error {
+	var errs []error
+	for _, e := range entries {
+		if fs.Lookup(e.name) == nil {
+			errs = append(errs, fmt.Errorf("%s: line %d: unknown flag %q", path, e.line, e.name))
+		}
+	}
+	return errs
+}
+
+// overridden reports whether the flag name was given on the command line or
+// has a value in the environment, which take precedence over config files.
+func overridden(fs *flag.FlagSet, name string) bool {
+	if _, ok := flagx.AssignedFlags(fs)[name]; ok {
+		return true
+	}
+	for _, env := range []string{EnvName(name), flagx.MakeShellVariableName(name)} {
+		if _, ok := os.LookupEnv(env); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func invalid(path string, e entry, err error) error {
+	return fmt.Errorf("%s: line %d: invalid value %q for -%s: %v", path, e.line, e.value, e.name, err)
+}
+
+// Change is a flag whose value was changed by a Reloader.
+type Change struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// Reloader sets flags from a config file again while the server runs, e.g. on
+// SIGHUP. Only the flags that the server can apply without a restart are
+// reloaded.
+type Reloader struct {
+	fs         *flag.FlagSet
+	path       string
+	reloadable []string
+	// initial are the values in the file of the other flags when the server
+	// started, by name.
+	initial map[string]string
+}
+
+// NewReloader returns a Reloader of the reloadable flags of fs from the config
+// file at path, which the flags were loaded from.
+func NewReloader(fs *flag.FlagSet, path string, reloadable ...string) (*Reloader, error) {
+	r := &Reloader{fs: fs, path: path, initial: map[string]string{}}
+	for _, name := range reloadable {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	r.reloadable = append(r.reloadable, reloadable...)
+	sort.Strings(r.reloadable)
+	entries, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !r.isReloadable(e.name) {
+			r.initial[e.name] = e.value
+		}
+	}
+	return r, nil
+}
+
+func (r *Reloader) isReloadable(name string) bool {
+	i := sort.SearchStrings(r.reloadable, name)
+	return i < len(r.reloadable) && r.reloadable[i] == name
+}
+
+// Reload sets the reloadable flags to their values in the config file, or to
+// their defaults if the file no longer sets them, and returns the flags whose
+// values changed. Flags given on the command line or in the environment keep
+// their values. If the file can't be read or has an invalid value, no flag is
+// changed.
+//
+// Restart lists the other flags whose values in the file changed since the
+// server started, which the server ignores until it restarts.
+func (r *Reloader) Reload() (changes []Change, restart []string, err error) {
+	entries, err := read(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if errs := unknown(r.fs, r.path, entries); len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	values := map[string]entry{}
+	for _, e := range entries {
+		values[e.name] = e
+	}
+	for _, e := range entries {
+		if v, ok := r.initial[e.name]; !r.isReloadable(e.name) && (!ok || v != e.value) {
+			restart = append(restart, e.name)
+		}
+	}
+	for name := range r.initial {
+		if _, ok := values[name]; !ok {
+			restart = append(restart, name)
+		}
+	}
+	sort.Strings(restart)
+
+	var errs []error
+	for _, name := range r.reloadable {
+		if overridden(r.fs, name) {
+			continue
+		}
+		fl := r.fs.Lookup(name)
+		e, ok := values[name]
+		if !ok {
+			e = entry{name: name, value: fl.DefValue}
+		}
+		old := fl.Value.String()
+		if err := fl.Value.Set(e.value); err != nil {
+			// Some flag values, e.g. ints, change even when Set fails.
+			fl.Value.Set(old)
+			errs = append(errs, invalid(r.path, e, err))
+			continue
+		}
+		if v := fl.Value.String(); v != old {
+			changes = append(changes, Change{Name: name, Old: old, New: v})
+		}
+	}
+	if len(errs) > 0 {
+		r.Revert(changes)
+		return nil, nil, errors.Join(errs...)
+	}
+	return changes, restart, nil
+}
+
+// Revert sets the flags of changes back to their old values, e.g. when the
+// new values turn out to be invalid together.
+func (r *Reloader) Revert(changes []Change) {
+	for _, c := range changes {
+		r.fs.Lookup(c.Name).Value.Set(c.Old)
+	}
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "nested",
+			config: `# ndt-server
+---
+ndt5_addr: ":3001"   # raw ndt5
+results:
+  writers: [file, "kafka"]
+  kafka:
+    brokers: [kafka-1:9092, "kafka-2:9092"]
+    topic: 'it''s'
+  compress: false
+label:
+- type=virtual
+- site=lga01
+cert:
+`,
+			want: map[string]string{
+				"ndt5_addr":             ":3001",
+				"results.writers":       "file,kafka",
+				"results.kafka.brokers": "kafka-1:9092,kafka-2:9092",
+				"results.kafka.topic":   "it's",
+				"results.compress":      "false",
+				"label":                 "type=virtual,site=lga01",
+				"cert":                  "",
+			},
+		},
+		{
+			name:   "dotted",
+			config: "results.rotation: hourly\ngeoip.db: /data/city.mmdb # comment\nurl: http://a/#anchor\n",
+			want: map[string]string{
+				"results.rotation": "hourly",
+				"geoip.db":         "/data/city.mmdb",
+				"url":              "http://a/#anchor",
+			},
+		},
+		{
+			name:   "indented-sequence",
+			config: "writers:\n  - file\n  - stdout\ndebug: true\n",
+			want:   map[string]string{"writers": "file,stdout", "debug": "true"},
+		},
+		{
+			name:    "duplicate",
+			config:  "results:\n  writers: file\nresults.writers: stdout\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad-indentation",
+			config:  "results:\n    writers: file\n  rotation: daily\n",
+			wantErr: true,
+		},
+		{
+			name:    "not-a-mapping",
+			config:  "just some text\n",
+			wantErr: true,
+		},
+		{
+			name:    "sequence-without-key",
+			config:  "- file\n",
+			wantErr: true,
+		},
+		{
+			name:    "tabs",
+			config:  "results:\n\twriters: file\n",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated",
+			config:  "cert: \"a.pem\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parse(strings.NewReader(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := map[string]string{}
+			for _, e := range entries {
+				got[e.name] = e.value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("ndt7_addr", ":443", "")
+	writers := fs.String("results.writers", "", "")
+	interval := fs.Duration("results.upload-interval", time.Minute, "")
+	fromEnv := fs.String("results.prefix", "ndt", "")
+	if err := fs.Parse([]string{"-ndt7_addr=:8443"}); err != nil {
+		t.Fatal(err)
+	}
+	// As set by flagx.ArgsFromEnv.
+	t.Setenv("RESULTS_PREFIX", "env")
+	*fromEnv = "env"
+
+	path := filepath.Join(t.TempDir(), "ndt-server.yaml")
+	config := "ndt7_addr: :4443\nresults:\n  writers: [file, stdout]\n  upload-interval: 10m\n  prefix: file\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(fs, path); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if *addr != ":8443" {
+		t.Errorf("-ndt7_addr = %q, want the command-line value", *addr)
+	}
+	if *writers != "file,stdout" || *interval != 10*time.Minute {
+		t.Errorf("-results.writers = %q, -results.upload-interval = %v", *writers, *interval)
+	}
+	if *fromEnv != "env" {
+		t.Errorf("-results.prefix = %q, want the environment value", *fromEnv)
+	}
+
+	bad := "results:\n  upload-interval: often\n  writer: file\n"
+	if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := Load(fs, path)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), `unknown flag "results.writer"`) {
+		t.Errorf("Load() = %v, want errors for both lines", err)
+	}
+	if err := Load(fs, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("Load() of a missing file succeeded")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	a := fs.Int("a", 0, "")
+	b := fs.String("b", "default", "")
+	c := fs.Int("c", 0, "")
+	d := fs.Int("d", 0, "")
+	if err := fs.Parse([]string{"-d=1"}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ndt-server.yaml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a: 1\nb: x\nc: 1\nd: 2\n")
+	if err := Load(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(fs, path, "a", "b", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReloader(fs, path, "e"); err == nil {
+		t.Error("NewReloader() accepted an unknown flag")
+	}
+
+	write("a: 2\nc: 2\nd: 3\n")
+	changes, restart, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{Name: "a", Old: "1", New: "2"}, {Name: "b", Old: "x", New: "default"}}
+	if !reflect.DeepEqual(changes, want) || !reflect.DeepEqual(restart, []string{"c"}) {
+		t.Errorf("Reload() = %v, %v, want %v, [c]", changes, restart, want)
+	}
+	if *a != 2 || *b != "default" || *c != 1 || *d != 1 {
+		t.Errorf("flags are a=%d b=%q c=%d d=%d after Reload()", *a, *b, *c, *d)
+	}
+
+	write("a: 3\nb: y\nc: nope\n")
+	if changes, _, err = r.Reload(); err != nil || len(changes) != 2 {
+		t.Fatalf("Reload() = %v, %v", changes, err)
+	}
+	r.Revert(changes)
+	if *a != 2 || *b != "default" {
+		t.Errorf("flags are a=%d b=%q after Revert()", *a, *b)
+	}
+
+	write("a: nope\nb: z\n")
+	if _, _, err := r.Reload(); err == nil {
+		t.Error("Reload() accepted an invalid value")
+	}
+	write("a: 4\nunknown: 1\n")
+	if _, _, err := r.Reload(); err == nil {
+		t.Error("Reload() accepted an unknown flag")
+	}
+	if *a != 2 || *b != "default" {
+		t.Errorf("a failed Reload() changed flags to a=%d b=%q", *a, *b)
+	}
+}
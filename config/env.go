@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/m-lab/go/flagx"
+)
+
+// EnvPrefix starts the name of the environment variable of every flag.
+const EnvPrefix = "NDT_"
+
+// EnvName returns the name of the environment variable of the flag name, e.g.
+// NDT_RESULTS_WRITERS for -results.writers.
+func EnvName(name string) string {
+	return EnvPrefix + flagx.MakeShellVariableName(name)
+}
+
+// FromEnv sets the flags of fs that were not given on the command line to the
+// values of their environment variables, named by EnvName. Every invalid value
+// is reported.
+//
+// The variables without the prefix, e.g. RESULTS_WRITERS, that
+// flagx.ArgsFromEnv reads are still supported, but the prefixed variables take
+// precedence when FromEnv is called after it.
+func FromEnv(fs *flag.FlagSet) error {
+	assigned := flagx.AssignedFlags(fs)
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := assigned[f.Name]; ok {
+			return
+		}
+		v, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q of %s for -%s: %v", v, EnvName(f.Name), f.Name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("ndt5.ratelimit.tests-per-hour"); got != "NDT_NDT5_RATELIMIT_TESTS_PER_HOUR" {
+		t.Errorf("EnvName() = %q", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("ndt7_addr", ":443", "")
+	writers := fs.String("results.writers", "", "")
+	fs.Duration("results.upload-interval", time.Minute, "")
+	if err := fs.Parse([]string{"-ndt7_addr=:8443"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NDT_NDT7_ADDR", ":4443")
+	t.Setenv("NDT_RESULTS_WRITERS", "file,stdout")
+	if err := FromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":8443" || *writers != "file,stdout" {
+		t.Errorf("FromEnv() set -ndt7_addr=%q -results.writers=%q", *addr, *writers)
+	}
+	if !overridden(fs, "results.writers") || overridden(fs, "results.upload-interval") {
+		t.Error("config files should not override flags set by the environment")
+	}
+
+	t.Setenv("NDT_RESULTS_UPLOAD_INTERVAL", "often")
+	if err := FromEnv(fs); err == nil {
+		t.Error("FromEnv() accepted an invalid duration")
+	}
+}
@@ -3,11 +3,17 @@ package data
 import (
 	"time"
 
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/ndt5/analysis"
 	"github.com/m-lab/ndt-server/ndt5/c2s"
 	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/ndt5/latency"
+	"github.com/m-lab/ndt-server/ndt5/mid"
 	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt5/sfw"
 
 	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/privacy"
 )
 
 // NDTResult is preserved for legacy compatibility with an older unified version
@@ -38,14 +44,26 @@ type NDT5Result struct {
 	ServerPort int
 	ClientIP   string
 	ClientPort int
+	// ClientGeo is the approximate location of ClientIP, if it is known.
+	ClientGeo *geoip.Geolocation `json:",omitempty"`
+	// ClientASN is the autonomous system of ClientIP, if it is known.
+	ClientASN *geoip.ASN `json:",omitempty"`
+	// Anonymization is the policy with which ClientIP and ClientGeo were
+	// anonymized, e.g. "netblock-v1", or empty if they were not.
+	Anonymization string `json:",omitempty"`
 
 	StartTime time.Time
 	EndTime   time.Time
 
 	// ndt5
 	Control *control.ArchivalData `json:",omitempty"`
+	MID     *mid.ArchivalData     `json:",omitempty"`
+	SFW     *sfw.ArchivalData     `json:",omitempty"`
+	Latency *latency.ArchivalData `json:",omitempty"`
 	C2S     *c2s.ArchivalData     `json:",omitempty"`
 	S2C     *s2c.ArchivalData     `json:",omitempty"`
+	// Analysis diagnoses the client's path from the results of the tests.
+	Analysis *analysis.Verdicts `json:",omitempty"`
 }
 
 // NDT7Result is the struct that is serialized as JSON to disk as the archival
@@ -62,6 +80,13 @@ type NDT7Result struct {
 	ServerPort int
 	ClientIP   string
 	ClientPort int
+	// ClientGeo is the approximate location of ClientIP, if it is known.
+	ClientGeo *geoip.Geolocation `json:",omitempty"`
+	// ClientASN is the autonomous system of ClientIP, if it is known.
+	ClientASN *geoip.ASN `json:",omitempty"`
+	// Anonymization is the policy with which ClientIP and ClientGeo were
+	// anonymized, e.g. "netblock-v1", or empty if they were not.
+	Anonymization string `json:",omitempty"`
 
 	StartTime time.Time
 	EndTime   time.Time
@@ -70,3 +95,54 @@ type NDT7Result struct {
 	Upload   *model.ArchivalData `json:",omitempty"`
 	Download *model.ArchivalData `json:",omitempty"`
 }
+
+// Anonymized returns r, or a copy of r with the client IPs and location
+// anonymized if client IPs are anonymized. r itself is not modified.
+func (r *NDT5Result) Anonymized() *NDT5Result {
+	if r == nil || !privacy.Enabled() {
+		return r
+	}
+	a := *r
+	a.ClientIP = privacy.IP(r.ClientIP)
+	a.ClientGeo = r.ClientGeo.Coarse()
+	a.Anonymization = privacy.Policy()
+	if r.C2S != nil {
+		c2s := *r.C2S
+		c2s.ClientIP = privacy.IP(c2s.ClientIP)
+		a.C2S = &c2s
+	}
+	if r.S2C != nil {
+		s2c := *r.S2C
+		s2c.ClientIP = privacy.IP(s2c.ClientIP)
+		a.S2C = &s2c
+	}
+	if r.MID != nil {
+		mid := *r.MID
+		mid.ClientIP = privacy.IP(mid.ClientIP)
+		a.MID = &mid
+	}
+	if r.SFW != nil {
+		sfw := *r.SFW
+		sfw.ClientIP = privacy.IP(sfw.ClientIP)
+		a.SFW = &sfw
+	}
+	if r.Latency != nil {
+		latency := *r.Latency
+		latency.ClientIP = privacy.IP(latency.ClientIP)
+		a.Latency = &latency
+	}
+	return &a
+}
+
+// Anonymized returns r, or a copy of r with the client IP and location
+// anonymized if client IPs are anonymized. r itself is not modified.
+func (r *NDT7Result) Anonymized() *NDT7Result {
+	if r == nil || !privacy.Enabled() {
+		return r
+	}
+	a := *r
+	a.ClientIP = privacy.IP(r.ClientIP)
+	a.ClientGeo = r.ClientGeo.Coarse()
+	a.Anonymization = privacy.Policy()
+	return &a
+}
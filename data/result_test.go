@@ -0,0 +1,43 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/privacy"
+)
+
+func TestNDT5Result_Anonymized(t *testing.T) {
+	r := &NDT5Result{
+		ClientIP:  "192.0.2.13",
+		ClientGeo: &geoip.Geolocation{CountryCode: "US", Latitude: 40.7},
+		S2C:       &s2c.ArchivalData{ClientIP: "192.0.2.13"},
+	}
+	if r.Anonymized() != r {
+		t.Error("Anonymized() copied the result without anonymization")
+	}
+
+	privacy.Configure(anonymize.Netblock)
+	defer privacy.Configure(anonymize.None)
+	a := r.Anonymized()
+	if a.ClientIP != "192.0.2.0" || a.S2C.ClientIP != "192.0.2.0" || a.Anonymization != "netblock-v1" {
+		t.Errorf("Anonymized() = %+v, S2C = %+v", a, a.S2C)
+	}
+	if a.ClientGeo.CountryCode != "US" || a.ClientGeo.Latitude != 0 {
+		t.Errorf("Anonymized() location = %+v", a.ClientGeo)
+	}
+	if r.ClientIP != "192.0.2.13" || r.S2C.ClientIP != "192.0.2.13" || r.ClientGeo.Latitude == 0 {
+		t.Error("Anonymized() modified the result")
+	}
+}
+
+func TestNDT7Result_Anonymized(t *testing.T) {
+	privacy.Configure(anonymize.Netblock)
+	defer privacy.Configure(anonymize.None)
+	r := &NDT7Result{ClientIP: "2001:db8:1:2::1"}
+	if a := r.Anonymized(); a.ClientIP != "2001:db8:1::" || a.Anonymization != "netblock-v1" || r.ClientIP != "2001:db8:1:2::1" {
+		t.Errorf("Anonymized() = %+v", a)
+	}
+}
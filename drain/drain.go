@@ -0,0 +1,104 @@
+// Package drain tracks in-flight tests so that the server can stop accepting
+// new tests and let the running ones finish before it shuts down.
+package drain
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Tracker counts in-flight tests. The zero value is ready to use.
+type Tracker struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{} // Closed once draining and no tests are active.
+}
+
+// Start registers a new test. It returns false, and the test must not run, if
+// the Tracker is draining. Every successful Start must be followed by Done.
+func (t *Tracker) Start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// Done marks a test started with Start as complete.
+func (t *Tracker) Done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// Drain stops new tests from starting. Tests that are already running are
+// unaffected.
+func (t *Tracker) Drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// Resume lets new tests start again after Drain.
+func (t *Tracker) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = false
+}
+
+// Draining reports whether Drain has been called.
+func (t *Tracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Active returns the number of running tests.
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Wait drains the Tracker and waits until all running tests are done or ctx
+// expires, in which case it returns the context's error.
+func (t *Tracker) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Then wraps next so that every request is tracked as a test, and requests
+// that arrive while draining are answered with 503 Service Unavailable.
+func (t *Tracker) Then(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.Start() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer t.Done()
+		next.ServeHTTP(w, r)
+	})
+}
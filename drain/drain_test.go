@@ -0,0 +1,65 @@
+package drain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	tr := &Tracker{}
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() with no tests = %v", err)
+	}
+	tr = &Tracker{}
+	if !tr.Start() || tr.Active() != 1 {
+		t.Fatal("Start() should succeed before draining")
+	}
+	tr.Drain()
+	if tr.Start() || !tr.Draining() {
+		t.Error("Start() should fail while draining")
+	}
+	tr.Resume()
+	if !tr.Start() || tr.Draining() {
+		t.Error("Start() should succeed after Resume()")
+	}
+	tr.Done()
+	tr.Drain()
+
+	// Wait times out while the test is still running.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tr.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() = %v, want DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tr.Done()
+	}()
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+}
+
+func TestTracker_Then(t *testing.T) {
+	tr := &Tracker{}
+	h := tr.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tr.Active() != 1 {
+			t.Error("the request should be tracked while it runs")
+		}
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || tr.Active() != 0 {
+		t.Errorf("got status %d with %d active tests", rec.Code, tr.Active())
+	}
+	tr.Drain()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while draining, want 503", rec.Code)
+	}
+}
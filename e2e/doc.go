@@ -0,0 +1,7 @@
+// Package e2e tests the ndt-server binary end to end: it builds and starts the
+// server with its raw, WS, and WSS ndt5 servers on ephemeral ports, and runs
+// real clients against them. The tests take a while and need a Go toolchain
+// to build the server, so they only run with the e2e build tag:
+//
+//	go test -tags e2e ./e2e
+package e2e
@@ -0,0 +1,298 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/client"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// server is an ndt-server process.
+type server struct {
+	raw, ws, wss string
+	// roots trust the certificate of the WSS server.
+	roots *x509.CertPool
+}
+
+// srv is started by TestMain.
+var srv *server
+
+// openPorts returns n free ports on the loopback interface. They are closed,
+// and hopefully remain free until the server listens on them.
+func openPorts(n int) ([]string, error) {
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs, nil
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key in dir,
+// and returns a pool that trusts it.
+func writeCert(dir string) (*x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	return roots, nil
+}
+
+// startServer builds the server in dir and starts it. Its ndt5 queue admits
+// one test at a time, and one waiting client. It returns once the server is
+// healthy.
+func startServer(ctx context.Context, dir string) (*server, error) {
+	bin := filepath.Join(dir, "ndt-server")
+	build := exec.Command("go", "build", "-o", bin, "github.com/m-lab/ndt-server")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		return nil, fmt.Errorf("could not build the server: %w", err)
+	}
+	roots, err := writeCert(dir)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := openPorts(7)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{raw: ports[0], ws: ports[1], wss: ports[2], roots: roots}
+	cmd := exec.CommandContext(ctx, bin,
+		"-ndt5_addr", s.raw,
+		"-ndt5_ws_addr", s.ws,
+		"-ndt5_wss_addr", s.wss,
+		"-ndt7_addr", ports[3],
+		"-ndt7_addr_cleartext", ports[4],
+		"-health_addr", ports[5],
+		"-prometheusx.listen-address", ports[6],
+		"-cert", filepath.Join(dir, "cert.pem"),
+		"-key", filepath.Join(dir, "key.pem"),
+		"-datadir", filepath.Join(dir, "data"),
+		"-ndt5.queue.max-active", "1",
+		"-ndt5.queue.max-waiting", "1",
+		"-ndt5.queue.timeout", "30s",
+		"-log.level", "warn",
+	)
+	// The server serves its HTML from the root of the repository.
+	cmd.Dir = ".."
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		resp, err := http.Get("http://" + ports[5] + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return s, nil
+			}
+		}
+	}
+	return nil, errors.New("the server did not become healthy")
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "ndt-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err = startServer(ctx, dir)
+	code := 1
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		code = m.Run()
+	}
+	cancel()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newClient returns a client of srv over p with a short c2s test.
+func newClient(p client.Protocol) *client.Client {
+	c := &client.Client{
+		Protocol:  p,
+		Duration:  2 * time.Second,
+		TLSConfig: &tls.Config{RootCAs: srv.roots},
+		Metadata:  map[string]string{"client.application": "e2e"},
+	}
+	switch p {
+	case client.Raw:
+		c.Server = srv.raw
+	case client.WS:
+		c.Server = srv.ws
+	case client.WSS:
+		c.Server = srv.wss
+	}
+	return c
+}
+
+func TestRun(t *testing.T) {
+	for _, p := range []client.Protocol{client.Raw, client.WS, client.WSS} {
+		t.Run(string(p), func(t *testing.T) {
+			r, err := newClient(p).Run(context.Background(), client.TestC2S|client.TestS2C|client.TestMETA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.C2S == nil || r.C2S.ServerKbps <= 0 || r.S2C == nil || r.S2C.Bytes == 0 {
+				t.Errorf("Run() C2S, S2C = %+v, %+v", r.C2S, r.S2C)
+			}
+			if r.UUID() == "" {
+				t.Errorf("Run() results have no UUID: %v", r.Results)
+			}
+		})
+	}
+}
+
+// rawLogin sends a login with the given type and body on a new raw control
+// connection, and returns the messages that the server sends back until it
+// closes the connection.
+func rawLogin(t *testing.T, kind protocol.MessageType, body string) []protocol.MessageType {
+	conn, err := net.DialTimeout("tcp", srv.raw, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, len("123456 654321"))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append([]byte{byte(kind), byte(len(body) >> 8), byte(len(body))}, body...))
+	types := []protocol.MessageType{}
+	for {
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return types
+		}
+		if _, err := io.ReadFull(r, make([]byte, int(header[1])<<8+int(header[2]))); err != nil {
+			return types
+		}
+		types = append(types, protocol.MessageType(header[0]))
+	}
+}
+
+func TestMalformedLogin(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		kind protocol.MessageType
+		body string
+	}{
+		{"non-numeric-tests", protocol.MsgExtendedLogin, `{"msg":"v3.7.0","tests":"all"}`},
+		{"long-login", protocol.MsgLogin, "\x16\x00"},
+		{"no-test-status", protocol.MsgExtendedLogin, `{"msg":"v3.7.0","tests":"6"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rawLogin(t, tt.kind, tt.body)
+			if len(got) != 2 || got[0] != protocol.MsgError || got[1] != protocol.MsgLogout {
+				t.Errorf("the server sent %v, want MsgError and MsgLogout", got)
+			}
+		})
+	}
+	// The server still serves tests.
+	if _, err := newClient(client.Raw).Run(context.Background(), client.TestS2C); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	for _, p := range []client.Protocol{client.Raw, client.WSS} {
+		t.Run(string(p), func(t *testing.T) {
+			c := newClient(p)
+			c.Duration = time.Minute
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			if _, err := c.Run(ctx, client.TestC2S); err == nil {
+				t.Fatal("Run() of an interrupted test did not fail")
+			}
+			// The test's place in the queue is released, so the next client
+			// runs before its queue timeout.
+			if _, err := newClient(p).Run(context.Background(), client.TestS2C); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	// The first client runs, the second waits in the queue, and the third
+	// finds it full.
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = newClient(client.Raw).Run(context.Background(), client.TestC2S)
+		}(i)
+		time.Sleep(time.Second)
+	}
+	_, err := newClient(client.WS).Run(context.Background(), client.TestC2S)
+	if !errors.Is(err, client.ErrServerBusy) {
+		t.Errorf("Run() of the third client = %v, want %v", err, client.ErrServerBusy)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Run() of client %d = %v", i, err)
+		}
+	}
+}
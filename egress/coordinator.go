@@ -0,0 +1,122 @@
+package egress
+
+import (
+	"context"
+	"sync"
+)
+
+// Coordinator interleaves the writes of the tests that send at the same time,
+// so that none of them systematically gets more of the server's CPU and
+// network than the others. Writes go in rounds, in which every sender may
+// write once. A round ends when every sender wrote in it, or is still
+// writing, so a sender whose client can't take more data does not hold the
+// others back.
+type Coordinator struct {
+	mu    sync.Mutex
+	turns map[*Turn]struct{}
+	// next is closed when the round ends.
+	next chan struct{}
+}
+
+// NewCoordinator returns a Coordinator without senders.
+func NewCoordinator() *Coordinator {
+	return &Coordinator{turns: map[*Turn]struct{}{}, next: make(chan struct{})}
+}
+
+// Turn is a sender of a Coordinator. A Turn must only be used by one
+// goroutine.
+type Turn struct {
+	c       *Coordinator
+	wrote   bool // Whether the sender wrote in this round.
+	writing bool
+	max     int
+	done    bool
+}
+
+// Join adds a sender to c, which must call Done when it stops sending.
+func (c *Coordinator) Join() *Turn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &Turn{c: c, max: len(c.turns) + 1}
+	for other := range c.turns {
+		if other.max < t.max {
+			other.max = t.max
+		}
+	}
+	c.turns[t] = struct{}{}
+	return t
+}
+
+// advance starts the next round if the current one is over. c.mu must be
+// held.
+func (c *Coordinator) advance() {
+	for t := range c.turns {
+		if !t.wrote && !t.writing {
+			return
+		}
+	}
+	for t := range c.turns {
+		t.wrote = false
+	}
+	close(c.next)
+	c.next = make(chan struct{})
+}
+
+// Begin blocks until t may write in this round, or until ctx is done, in
+// which case it returns the error of ctx. The write must be followed by a call
+// to End. A nil *Turn may always write.
+func (t *Turn) Begin(ctx context.Context) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	t.c.mu.Lock()
+	for t.wrote {
+		next := t.c.next
+		t.c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-next:
+		}
+		t.c.mu.Lock()
+	}
+	defer t.c.mu.Unlock()
+	t.wrote = true
+	t.writing = true
+	t.c.advance()
+	return ctx.Err()
+}
+
+// End marks the end of the write started by Begin.
+func (t *Turn) End() {
+	if t == nil {
+		return
+	}
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.writing = false
+}
+
+// Done removes t from its Coordinator. Calling Done more than once has no
+// effect.
+func (t *Turn) Done() {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	delete(t.c.turns, t)
+	t.c.advance()
+}
+
+// MaxConcurrent returns the largest number of senders, including t, that c
+// had at once while t was sending.
+func (t *Turn) MaxConcurrent() int {
+	if t == nil {
+		return 0
+	}
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.max
+}
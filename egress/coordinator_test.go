@@ -0,0 +1,68 @@
+package egress
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// blocked reports whether t has to wait to begin a write.
+func blocked(t *Turn) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := t.Begin(ctx); err != nil {
+		return true
+	}
+	t.End()
+	return false
+}
+
+func TestCoordinator(t *testing.T) {
+	c := NewCoordinator()
+	a, b := c.Join(), c.Join()
+	if blocked(a) {
+		t.Fatal("a can't write in the first round")
+	}
+	if !blocked(a) {
+		t.Error("a wrote twice in a round")
+	}
+	if blocked(b) || blocked(a) {
+		t.Error("the round did not end when both senders wrote")
+	}
+
+	// A sender that is still writing does not hold the others back.
+	if err := b.Begin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if blocked(a) || blocked(a) {
+		t.Error("a waited for b to finish writing")
+	}
+	b.End()
+
+	// Nor does a sender that left.
+	b.Done()
+	b.Done()
+	if blocked(a) || blocked(a) {
+		t.Error("a waited for b after it left")
+	}
+	if got := a.MaxConcurrent(); got != 2 {
+		t.Errorf("MaxConcurrent() = %d, want 2", got)
+	}
+	d := c.Join()
+	if got := d.MaxConcurrent(); got != 2 {
+		t.Errorf("MaxConcurrent() = %d, want 2", got)
+	}
+	a.Done()
+	d.Done()
+	if len(c.turns) != 0 {
+		t.Errorf("%d senders left after Done", len(c.turns))
+	}
+}
+
+func TestTurn_nil(t *testing.T) {
+	var turn *Turn
+	if blocked(turn) || turn.MaxConcurrent() != 0 {
+		t.Error("a nil Turn can't always write")
+	}
+	turn.Done()
+}
@@ -0,0 +1,111 @@
+// Package egress caps the aggregate rate at which the server sends the data of
+// tests, so that a server on a shared link can bound the bandwidth that the
+// measurements use, and interleaves the writes of the tests that send at the
+// same time. The tests that send at the same time share the rate equally.
+package egress
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// burst is how long a sender may send at its share of the rate without
+// waiting, so that it can write in chunks larger than its share allows in a
+// single instant.
+const burst = 10 * time.Millisecond
+
+// Limiter caps the aggregate rate of its senders. Each sender has a token
+// bucket that fills at the rate of the Limiter divided by the number of
+// senders, so that their sum never exceeds the rate. A nil *Limiter doesn't
+// cap the rate.
+type Limiter struct {
+	rate float64 // Bytes per second.
+
+	mu      sync.Mutex
+	senders int
+}
+
+// New returns a Limiter of bitsPerSecond.
+func New(bitsPerSecond float64) *Limiter {
+	return &Limiter{rate: bitsPerSecond / 8}
+}
+
+// Mbps returns the rate of l in Mbit/s, or 0 if l is nil.
+func (l *Limiter) Mbps() float64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate * 8 / 1e6
+}
+
+// share returns the rate in bytes per second of each sender.
+func (l *Limiter) share() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate / float64(l.senders)
+}
+
+// Sender is a test sending data under the cap of a Limiter. A Sender must
+// only be used by one goroutine. A nil *Sender sends at any rate.
+type Sender struct {
+	l      *Limiter
+	tokens float64
+	last   time.Time
+	done   bool
+}
+
+// Join adds a sender to l, which reduces the share of the others, and returns
+// it. The sender must call Done when it stops sending.
+func (l *Limiter) Join() *Sender {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.senders++
+	return &Sender{l: l, last: time.Now()}
+}
+
+// Wait blocks until s may send n bytes, or until ctx is done, in which case
+// it returns the error of ctx.
+func (s *Sender) Wait(ctx context.Context, n int) error {
+	if s == nil {
+		return ctx.Err()
+	}
+	share := s.l.share()
+	now := time.Now()
+	max := share * burst.Seconds()
+	if max < float64(n) {
+		max = float64(n)
+	}
+	s.tokens += now.Sub(s.last).Seconds() * share
+	if s.tokens > max {
+		s.tokens = max
+	}
+	s.last = now
+	s.tokens -= float64(n)
+	if s.tokens >= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(time.Duration(-s.tokens / share * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Done removes s from its Limiter, whose other senders then get a larger
+// share. Calling Done more than once has no effect.
+func (s *Sender) Done() {
+	if s == nil || s.done {
+		return
+	}
+	s.done = true
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	s.l.senders--
+}
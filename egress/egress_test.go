@@ -0,0 +1,73 @@
+package egress
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// send sends total bytes in chunks of 10kB through s, and returns how long it
+// took.
+func send(t *testing.T, s *Sender, total int) time.Duration {
+	start := time.Now()
+	for sent := 0; sent < total; sent += 10000 {
+		if err := s.Wait(context.Background(), 10000); err != nil {
+			t.Error(err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestLimiter(t *testing.T) {
+	l := New(8e6) // 1MB/s.
+	if l.Mbps() != 8 {
+		t.Errorf("Mbps() = %v, want 8", l.Mbps())
+	}
+	s := l.Join()
+	if d := send(t, s, 100000); d < 80*time.Millisecond || d > 300*time.Millisecond {
+		t.Errorf("one sender sent 100kB at 1MB/s in %v, want about 100ms", d)
+	}
+	s.Done()
+	s.Done() // Extra calls must not change the share of the others.
+
+	// Two senders get half the rate each.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		s := l.Join()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Done()
+			if d := send(t, s, 50000); d < 80*time.Millisecond || d > 300*time.Millisecond {
+				t.Errorf("each of two senders sent 50kB at 1MB/s in %v, want about 100ms", d)
+			}
+		}()
+	}
+	wg.Wait()
+	if l.senders != 0 {
+		t.Errorf("%d senders left after Done", l.senders)
+	}
+}
+
+func TestSender_Wait_canceled(t *testing.T) {
+	s := New(8).Join() // 1B/s.
+	defer s.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestLimiter_nil(t *testing.T) {
+	var l *Limiter
+	s := l.Join()
+	if s != nil || l.Mbps() != 0 {
+		t.Errorf("nil Limiter returned sender %v and rate %v", s, l.Mbps())
+	}
+	if err := s.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+	s.Done()
+}
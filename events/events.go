@@ -0,0 +1,191 @@
+// Package events serves the lifecycle events of every test as lines of JSON
+// on a Unix domain socket, in the style of the tcp-info eventsocket, so that
+// sidecar services such as traceroute or packet capture can react to each
+// test without polling logs.
+//
+// An "open" event is sent when a test starts, a "close" event when it ends,
+// and a "result" event with the archival record of the test once it is saved:
+//
+//	{"Event":"open","Timestamp":"...","UUID":"...","ClientIP":"192.0.2.1","Protocol":"ndt7+wss"}
+//
+// Events are dropped, rather than delaying the tests, when clients are too
+// slow to read them.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/privacy"
+	"github.com/m-lab/ndt-server/results"
+)
+
+// Kind is the kind of an Event.
+type Kind string
+
+// The kinds of events.
+const (
+	// Open is sent when a test starts.
+	Open = Kind("open")
+	// Close is sent when a test ends.
+	Close = Kind("close")
+	// Result is sent when the result of a test is saved.
+	Result = Kind("result")
+)
+
+// Event is sent to the clients as a line of JSON. The Event, Timestamp and
+// UUID fields are always set.
+type Event struct {
+	Event     Kind
+	Timestamp time.Time
+	UUID      string
+	// ClientIP and Protocol, e.g. "ndt5+plain" or "ndt7+wss", are set in
+	// open and close events.
+	ClientIP string `json:",omitempty"`
+	Protocol string `json:",omitempty"`
+	// Datatype, e.g. "ndt5" or "ndt7", and Data, the archival record of the
+	// test, are set in result events.
+	Datatype string      `json:",omitempty"`
+	Data     interface{} `json:",omitempty"`
+}
+
+// writeTimeout is how long a client may take to read an event before it is
+// disconnected.
+const writeTimeout = time.Second
+
+// Server sends events to the clients connected to its socket. A nil *Server
+// sends nothing.
+type Server struct {
+	filename string
+	events   chan *Event
+	listener net.Listener
+
+	mu      sync.Mutex
+	clients map[net.Conn]struct{}
+}
+
+// New creates a Server that serves clients on the Unix domain socket at
+// filename.
+func New(filename string) *Server {
+	return &Server{
+		filename: filename,
+		events:   make(chan *Event, 100),
+		clients:  map[net.Conn]struct{}{},
+	}
+}
+
+// Listen creates the socket, replacing any stale socket left by an unclean
+// shutdown. Clients may connect once it returns, and are sent events once
+// Serve is called.
+func (s *Server) Listen() error {
+	os.Remove(s.filename)
+	l, err := net.Listen("unix", s.filename)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+// Serve accepts clients and sends them events until ctx is done.
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+	go s.send(ctx)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			for c := range s.clients {
+				c.Close()
+				delete(s.clients, c)
+			}
+			s.mu.Unlock()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// send writes every event to every client until ctx is done. Clients that
+// fail to read an event in time are disconnected.
+func (s *Server) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				logging.Logger.WithError(err).WithField("uuid", e.UUID).Warn("Could not encode event")
+				continue
+			}
+			s.mu.Lock()
+			for c := range s.clients {
+				c.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if _, err := fmt.Fprintf(c, "%s\n", b); err != nil {
+					c.Close()
+					delete(s.clients, c)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// emit queues e to be sent, or drops it if the queue is full.
+func (s *Server) emit(e *Event) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		metrics.EventsDropped.Inc()
+	}
+}
+
+// TestStarted sends an open event. With TestDone, it makes s a live.Observer.
+func (s *Server) TestStarted(t live.Status) {
+	s.emit(&Event{Event: Open, Timestamp: time.Now(), UUID: t.UUID, ClientIP: privacy.IP(t.ClientIP), Protocol: t.Protocol})
+}
+
+// TestDone sends a close event.
+func (s *Server) TestDone(t live.Status) {
+	s.emit(&Event{Event: Close, Timestamp: time.Now(), UUID: t.UUID, ClientIP: privacy.IP(t.ClientIP), Protocol: t.Protocol})
+}
+
+// Results returns a results.Writer that sends a result event for every saved
+// result.
+func (s *Server) Results() results.Writer {
+	if s == nil {
+		return results.NullWriter()
+	}
+	return resultWriter{s}
+}
+
+type resultWriter struct {
+	s *Server
+}
+
+func (w resultWriter) Write(ctx context.Context, r *results.Result) error {
+	w.s.emit(&Event{Event: Result, Timestamp: time.Now(), UUID: r.UUID, Datatype: r.Datatype, Data: r.Data})
+	return nil
+}
+
+func (w resultWriter) Close() error { return nil }
@@ -0,0 +1,80 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/results"
+)
+
+func TestServer(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events.sock")
+	s := New(filename)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Serve(ctx) }()
+
+	conn, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait until the client is registered before sending events.
+	for {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	r := live.NewRegistry().WithObserver(s)
+	test := r.Add("uuid", "192.0.2.1", "ndt7+wss", func() {})
+	s.Results().Write(ctx, &results.Result{Datatype: "ndt7", UUID: "uuid", Data: map[string]int{"x": 1}})
+	test.Done()
+
+	scanner := bufio.NewScanner(conn)
+	for _, want := range []Kind{Open, Result, Close} {
+		if !scanner.Scan() {
+			t.Fatalf("no %s event: %v", want, scanner.Err())
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Event != want || e.UUID != "uuid" {
+			t.Errorf("got event %+v, want %s", e, want)
+		}
+		if want == Result && e.Datatype != "ndt7" {
+			t.Errorf("result event has Datatype %q, want ndt7", e.Datatype)
+		}
+		if want == Open && (e.ClientIP != "192.0.2.1" || e.Protocol != "ndt7+wss") {
+			t.Errorf("open event is %+v", e)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
+
+func TestServer_Nil(t *testing.T) {
+	var s *Server
+	s.TestStarted(live.Status{UUID: "uuid"})
+	s.TestDone(live.Status{UUID: "uuid"})
+	if err := s.Results().Write(context.Background(), &results.Result{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,274 @@
+// Package flowlimit limits the number of measurement flows that run at the
+// same time on the whole server, whatever their protocol, so that a saturated
+// machine sheds load instead of measuring every client poorly.
+package flowlimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// ErrSaturated is returned by Join when a flow can neither run nor wait.
+var ErrSaturated = errors.New("server is running as many flows as it can")
+
+// Policy decides what happens to flows that arrive when the limit is reached.
+type Policy string
+
+const (
+	// Queue makes flows over the limit wait for a running flow to end.
+	Queue = Policy("queue")
+	// Reject turns flows over the limit away immediately.
+	Reject = Policy("reject")
+)
+
+// ParsePolicy returns the Policy named s.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Queue, Reject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown flow limit policy %q", s)
+}
+
+// Limiter admits up to a fixed number of concurrent flows. Under the Queue
+// policy, as many flows as may run can also wait to be admitted. A nil
+// *Limiter admits every flow immediately.
+type Limiter struct {
+	max     int
+	policy  Policy
+	timeout time.Duration
+
+	mu      sync.Mutex
+	active  int
+	waiting []*Flow
+}
+
+// New creates a Limiter that runs at most max flows at once. Flows over the
+// limit are handled according to policy, and wait for at most timeout.
+func New(max int, policy Policy, timeout time.Duration) *Limiter {
+	metrics.FlowLimit.Set(float64(max))
+	return &Limiter{max: max, policy: policy, timeout: timeout}
+}
+
+// Flow is a measurement flow admitted, or waiting to be admitted, by a
+// Limiter.
+type Flow struct {
+	l     *Limiter
+	ready chan struct{}
+	done  bool
+}
+
+// Join adds a flow to l. The flow may run once its Ready channel is closed,
+// and must call Done when it is over or when it gives up waiting.
+func (l *Limiter) Join() (*Flow, error) {
+	f := &Flow{l: l, ready: make(chan struct{})}
+	if l == nil {
+		close(f.ready)
+		return f, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.updateMetrics()
+	if len(l.waiting) == 0 && l.active < l.max {
+		l.active++
+		close(f.ready)
+		return f, nil
+	}
+	if l.policy != Queue || len(l.waiting) >= l.max {
+		return nil, ErrSaturated
+	}
+	l.waiting = append(l.waiting, f)
+	return f, nil
+}
+
+// Ready returns a channel that is closed once the flow may run.
+func (f *Flow) Ready() <-chan struct{} {
+	return f.ready
+}
+
+// Done releases f, admitting the next waiting flow if f was admitted. Calling
+// Done more than once has no effect.
+func (f *Flow) Done() {
+	if f.l == nil {
+		return
+	}
+	l := f.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.done {
+		return
+	}
+	defer l.updateMetrics()
+	f.done = true
+	for i, w := range l.waiting {
+		if w == f {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return
+		}
+	}
+	l.active--
+	for l.active < l.max && len(l.waiting) > 0 {
+		next := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		l.active++
+		close(next.ready)
+	}
+}
+
+// updateMetrics exports the number of flows. It must be called with l.mu
+// held.
+func (l *Limiter) updateMetrics() {
+	metrics.Flows.WithLabelValues("active").Set(float64(l.active))
+	metrics.Flows.WithLabelValues("waiting").Set(float64(len(l.waiting)))
+}
+
+// Timeout returns how long a flow may wait to be admitted.
+func (l *Limiter) Timeout() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.timeout
+}
+
+// Len returns the number of running and waiting flows.
+func (l *Limiter) Len() (active, waiting int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active, len(l.waiting)
+}
+
+// Saturated reports whether a new flow would not be admitted immediately.
+// Load balancers should stop sending clients to a saturated server.
+func (l *Limiter) Saturated() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active >= l.max
+}
+
+// Then wraps next so that every request runs as a flow. Requests that can't
+// be admitted, or that wait for longer than the timeout, are answered with 503
+// Service Unavailable. The label names the server in the rejection metric.
+func (l *Limiter) Then(next http.Handler, label string) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := l.Join()
+		if err != nil {
+			metrics.FlowRejections.WithLabelValues(label).Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer f.Done()
+		timeout := time.NewTimer(l.timeout)
+		defer timeout.Stop()
+		select {
+		case <-f.Ready():
+		case <-timeout.C:
+			metrics.FlowRejections.WithLabelValues(label).Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Interface returns the name of the network interface that carries the
+// traffic of addr, a listen address such as ":443": the interface with the IP
+// of addr, or, if addr listens on every IP, the interface of the IPv4 default
+// route in routes, usually /proc/net/route.
+func Interface(addr, routes string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+		for _, iface := range ifaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+					return iface.Name, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no interface has the IP of %s", addr)
+	}
+	b, err := os.ReadFile(routes)
+	if err != nil {
+		return "", err
+	}
+	// The fields are Iface, Destination, Gateway, Flags, RefCnt, Use, Metric
+	// and Mask, in hexadecimal, after a line of headers.
+	name, metric := "", uint64(0)
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(f[3], 16, 16)
+		if err != nil || flags&0x1 == 0 { // RTF_UP
+			continue
+		}
+		m, err := strconv.ParseUint(f[6], 10, 32)
+		if err == nil && (name == "" || m < metric) {
+			name, metric = f[0], m
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("no default route in %s", routes)
+	}
+	return name, nil
+}
+
+// LinkSpeed returns the speed, in Mbit/s, of the named network interface, as
+// listed in dir, usually /sys/class/net. Virtual interfaces, such as veth,
+// bridge and bond interfaces, are refused: whatever speed they report is not
+// that of the link that carries their traffic.
+func LinkSpeed(dir, name string) (int, error) {
+	// Every interface in dir links to its device, which is under
+	// devices/virtual unless it is a physical device.
+	device, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	if strings.Contains(filepath.ToSlash(device), "/devices/virtual/") {
+		return 0, fmt.Errorf("interface %s is virtual", name)
+	}
+	b, err := os.ReadFile(filepath.Join(device, "speed"))
+	if err != nil {
+		return 0, err
+	}
+	speed, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	if speed <= 0 {
+		return 0, fmt.Errorf("interface %s does not report its speed", name)
+	}
+	return speed, nil
+}
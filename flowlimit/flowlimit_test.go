@@ -0,0 +1,161 @@
+package flowlimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func isReady(f *Flow) bool {
+	select {
+	case <-f.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLimiter_Queue(t *testing.T) {
+	l := New(1, Queue, time.Minute)
+	first, err := l.Join()
+	if err != nil || !isReady(first) || !l.Saturated() {
+		t.Fatalf("first Join() = %v, ready=%t", err, isReady(first))
+	}
+	second, err := l.Join()
+	if err != nil || isReady(second) {
+		t.Fatalf("second Join() = %v, ready=%t", err, isReady(second))
+	}
+	// As many flows may wait as may run.
+	if _, err := l.Join(); err != ErrSaturated {
+		t.Errorf("Join() with a full queue = %v, want ErrSaturated", err)
+	}
+	first.Done()
+	first.Done() // Extra calls must not admit more flows.
+	if !isReady(second) {
+		t.Error("second should be admitted after first is done")
+	}
+	if active, waiting := l.Len(); active != 1 || waiting != 0 {
+		t.Errorf("Len() = %d, %d, want 1, 0", active, waiting)
+	}
+	second.Done()
+	if l.Saturated() {
+		t.Error("an idle Limiter should not be saturated")
+	}
+}
+
+func TestLimiter_Reject(t *testing.T) {
+	l := New(1, Reject, time.Minute)
+	first, _ := l.Join()
+	if _, err := l.Join(); err != ErrSaturated {
+		t.Errorf("Join() over the limit = %v, want ErrSaturated", err)
+	}
+	first.Done()
+	if f, err := l.Join(); err != nil || !isReady(f) {
+		t.Errorf("Join() after Done = %v", err)
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *Limiter
+	f, err := l.Join()
+	if err != nil || !isReady(f) || l.Saturated() {
+		t.Error("a nil Limiter should admit every flow")
+	}
+	f.Done()
+	if l.Timeout() != 0 {
+		t.Error("a nil Limiter should have no timeout")
+	}
+}
+
+func TestLimiter_Then(t *testing.T) {
+	l := New(1, Queue, 10*time.Millisecond)
+	h := l.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if active, _ := l.Len(); active != 1 {
+			t.Error("the request should run as a flow")
+		}
+	}), "test")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if active, _ := l.Len(); rec.Code != http.StatusOK || active != 0 {
+		t.Errorf("got status %d with %d active flows", rec.Code, active)
+	}
+	// A request that waits for longer than the timeout is turned away.
+	f, _ := l.Join()
+	defer f.Done()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while saturated, want 503", rec.Code)
+	}
+	if _, waiting := l.Len(); waiting != 0 {
+		t.Errorf("%d flows still waiting after the timeout", waiting)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	routes := filepath.Join(t.TempDir(), "route")
+	os.WriteFile(routes, []byte(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth1	0000FEA9	00000000	0001	0	0	1002	0000FFFF	0	0	0
+eth1	00000000	0101A8C0	0003	0	0	200	00000000	0	0	0
+eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+eth2	00000000	0100000A	0002	0	0	0	00000000	0	0	0
+`), 0644)
+	tests := []struct {
+		addr, routes, want string
+	}{
+		// The default route with the lowest metric that is up.
+		{":443", routes, "eth0"},
+		{"0.0.0.0:443", routes, "eth0"},
+		{"127.0.0.1:443", "", "lo"},
+		{":443", filepath.Join(t.TempDir(), "missing"), ""},
+		{"443", routes, ""},
+	}
+	for _, tt := range tests {
+		got, err := Interface(tt.addr, tt.routes)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("Interface(%q) = %q, %v, want %q", tt.addr, got, err, tt.want)
+		}
+	}
+}
+
+func TestLinkSpeed(t *testing.T) {
+	// Like /sys/class/net, where every interface links to its device.
+	root := t.TempDir()
+	dir := filepath.Join(root, "class", "net")
+	os.MkdirAll(dir, 0755)
+	devices := map[string]string{
+		"eth0":  "devices/pci0000:00/0000:00:03.0/net/eth0",
+		"eth1":  "devices/pci0000:00/0000:00:04.0/net/eth1",
+		"veth0": "devices/virtual/net/veth0",
+		"br0":   "devices/virtual/net/br0",
+		"bond0": "devices/virtual/net/bond0",
+	}
+	speeds := map[string]string{"eth0": "10000\n", "eth1": "-1\n", "veth0": "10000\n", "br0": "", "bond0": "20000\n"}
+	for name, device := range devices {
+		os.MkdirAll(filepath.Join(root, device), 0755)
+		if speeds[name] != "" {
+			os.WriteFile(filepath.Join(root, device, "speed"), []byte(speeds[name]), 0644)
+		}
+		os.Symlink(filepath.Join("..", "..", device), filepath.Join(dir, name))
+	}
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"eth0", 10000},
+		{"eth1", 0}, // Down, so its speed is unknown.
+		{"veth0", 0},
+		{"br0", 0},
+		{"bond0", 0},
+		{"eth9", 0},
+	}
+	for _, tt := range tests {
+		got, err := LinkSpeed(dir, tt.name)
+		if got != tt.want || (err != nil) != (tt.want == 0) {
+			t.Errorf("LinkSpeed(%q) = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package geoip annotates client IPs with their location and network, using
+// MaxMind GeoLite2 or GeoIP2 City, Country and ASN databases.
+package geoip
+
+import (
+	"math"
+	"net"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/mmdb"
+	"github.com/m-lab/ndt-server/privacy"
+)
+
+// Geolocation is the approximate location of a client IP.
+type Geolocation struct {
+	ContinentCode       string `json:",omitempty"`
+	CountryCode         string `json:",omitempty"`
+	CountryName         string `json:",omitempty"`
+	Subdivision1ISOCode string `json:",omitempty"`
+	Subdivision1Name    string `json:",omitempty"`
+	// Latitude and Longitude are rounded to the Locator's precision. They
+	// are only set when the database has them.
+	Latitude         float64 `json:",omitempty"`
+	Longitude        float64 `json:",omitempty"`
+	AccuracyRadiusKm int64   `json:",omitempty"`
+}
+
+// Coarse returns a copy of g with only its continent and country, or nil if g
+// is nil.
+func (g *Geolocation) Coarse() *Geolocation {
+	if g == nil {
+		return nil
+	}
+	return &Geolocation{
+		ContinentCode: g.ContinentCode,
+		CountryCode:   g.CountryCode,
+		CountryName:   g.CountryName,
+	}
+}
+
+// ASN is the autonomous system that announces a client IP.
+type ASN struct {
+	ASNumber uint32
+	ASName   string `json:",omitempty"`
+}
+
+// Locator looks up client IPs. A nil *Locator locates nothing.
+type Locator struct {
+	city      *mmdb.DB
+	asn       *mmdb.DB
+	precision int
+	policy    *Policy
+}
+
+// New creates a Locator that looks up locations in city and networks in asn,
+// and rounds coordinates to precision decimal places. Either database may be
+// nil.
+func New(city, asn *mmdb.DB, precision int) *Locator {
+	return &Locator{city: city, asn: asn, precision: precision}
+}
+
+// names are the localized names of a place.
+type names struct {
+	English string `maxminddb:"en"`
+}
+
+// cityRecord is the part of a GeoLite2 or GeoIP2 City or Country record that
+// is used. Latitude and Longitude are pointers so that only coordinates that
+// the database has are reported.
+type cityRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude       *float64 `maxminddb:"latitude"`
+		Longitude      *float64 `maxminddb:"longitude"`
+		AccuracyRadius uint16   `maxminddb:"accuracy_radius"`
+	} `maxminddb:"location"`
+}
+
+// asnRecord is a GeoLite2 or GeoIP2 ASN record.
+type asnRecord struct {
+	Number       uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Locate returns the location of ip, or nil if it is unknown.
+func (l *Locator) Locate(ip string) *Geolocation {
+	if l == nil {
+		return nil
+	}
+	var record cityRecord
+	if !lookup(l.city, ip, &record) {
+		return nil
+	}
+	g := &Geolocation{
+		ContinentCode:    record.Continent.Code,
+		CountryCode:      record.Country.ISOCode,
+		CountryName:      record.Country.Names.English,
+		AccuracyRadiusKm: int64(record.Location.AccuracyRadius),
+	}
+	if len(record.Subdivisions) > 0 {
+		g.Subdivision1ISOCode = record.Subdivisions[0].ISOCode
+		g.Subdivision1Name = record.Subdivisions[0].Names.English
+	}
+	if lat, lon := record.Location.Latitude, record.Location.Longitude; lat != nil && lon != nil {
+		g.Latitude = l.round(*lat)
+		g.Longitude = l.round(*lon)
+	}
+	return g
+}
+
+// ASN returns the autonomous system that announces ip, or nil if it is
+// unknown.
+func (l *Locator) ASN(ip string) *ASN {
+	if l == nil {
+		return nil
+	}
+	var record asnRecord
+	if !lookup(l.asn, ip, &record) || record.Number == 0 {
+		return nil
+	}
+	return &ASN{ASNumber: record.Number, ASName: record.Organization}
+}
+
+// lookup decodes the record for ip in db into result, and reports whether
+// there was one.
+func lookup(db *mmdb.DB, ip string, result interface{}) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	ok, err := db.Lookup(addr, result)
+	if err != nil {
+		logging.Logger.WithError(err).WithField("ip", privacy.IP(ip)).Warn("Could not look up")
+		return false
+	}
+	return ok
+}
+
+// round rounds a coordinate to the Locator's precision.
+func (l *Locator) round(x float64) float64 {
+	scale := math.Pow(10, float64(l.precision))
+	return math.Round(x*scale) / scale
+}
@@ -0,0 +1,121 @@
+package geoip
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/ndt-server/mmdb"
+	"github.com/m-lab/ndt-server/mmdb/mmdbtest"
+)
+
+func TestLocator_Locate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	db := mmdbtest.Build(24, map[string]interface{}{
+		"192.0.2.0/24": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "NA"},
+			"country": map[string]interface{}{
+				"iso_code": "US",
+				"names":    map[string]interface{}{"en": "United States", "de": "USA"},
+			},
+			"subdivisions": []interface{}{
+				map[string]interface{}{"iso_code": "NY", "names": map[string]interface{}{"en": "New York"}},
+			},
+			"location": map[string]interface{}{
+				"latitude":        40.7128,
+				"longitude":       -74.0061,
+				"accuracy_radius": uint64(20),
+			},
+		},
+		"2001:db8::/32": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+		},
+	})
+	if err := os.WriteFile(path, db, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := mmdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(d, nil, 1)
+	tests := []struct {
+		ip   string
+		want *Geolocation
+	}{
+		{
+			ip: "192.0.2.1",
+			want: &Geolocation{
+				ContinentCode:       "NA",
+				CountryCode:         "US",
+				CountryName:         "United States",
+				Subdivision1ISOCode: "NY",
+				Subdivision1Name:    "New York",
+				Latitude:            40.7,
+				Longitude:           -74,
+				AccuracyRadiusKm:    20,
+			},
+		},
+		{ip: "2001:db8::1", want: &Geolocation{CountryCode: "DE"}},
+		{ip: "198.51.100.1"},
+		{ip: "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := l.Locate(tt.ip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Locate(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	var nilLocator *Locator
+	if got := nilLocator.Locate("192.0.2.1"); got != nil {
+		t.Errorf("nil Locate() = %+v", got)
+	}
+}
+
+func TestLocator_ASN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	db := mmdbtest.Build(28, map[string]interface{}{
+		"192.0.2.0/24": map[string]interface{}{
+			"autonomous_system_number":       uint64(64496),
+			"autonomous_system_organization": "Example Networks",
+		},
+	})
+	if err := os.WriteFile(path, db, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := mmdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(nil, d, 1)
+	want := &ASN{ASNumber: 64496, ASName: "Example Networks"}
+	if got := l.ASN("192.0.2.1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ASN() = %+v, want %+v", got, want)
+	}
+	if got := l.ASN("198.51.100.1"); got != nil {
+		t.Errorf("ASN() of an unknown IP = %+v", got)
+	}
+	if got := l.Locate("192.0.2.1"); got != nil {
+		t.Errorf("Locate() without a location database = %+v", got)
+	}
+}
+
+func TestGeolocation_Coarse(t *testing.T) {
+	g := &Geolocation{
+		ContinentCode:       "NA",
+		CountryCode:         "US",
+		CountryName:         "United States",
+		Subdivision1ISOCode: "NY",
+		Subdivision1Name:    "New York",
+		Latitude:            40.7,
+		Longitude:           -74,
+		AccuracyRadiusKm:    10,
+	}
+	want := &Geolocation{ContinentCode: "NA", CountryCode: "US", CountryName: "United States"}
+	if got := g.Coarse(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Coarse() = %+v, want %+v", got, want)
+	}
+	if got := (*Geolocation)(nil).Coarse(); got != nil {
+		t.Errorf("Coarse() of nil = %+v", got)
+	}
+}
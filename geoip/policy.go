@@ -0,0 +1,116 @@
+package geoip
+
+import (
+	"strings"
+	"sync"
+)
+
+// UnknownCountry is the country code of clients whose country is unknown.
+const UnknownCountry = "ZZ"
+
+// Decision is what a Policy decides for a client.
+type Decision string
+
+const (
+	// Admit lets the client run its tests.
+	Admit = Decision("admit")
+	// Deny turns the client away because of its country.
+	Deny = Decision("deny")
+	// Defer turns a deprioritized client away because the server is busy.
+	Defer = Decision("defer")
+)
+
+// Policy restricts tests by the country of the client, e.g. for regulatory or
+// capacity reasons. Countries are ISO 3166-1 alpha-2 codes, and clients whose
+// country is unknown are from UnknownCountry. A nil *Policy admits every
+// client.
+type Policy struct {
+	busy func() bool
+
+	mu           sync.RWMutex
+	allow        map[string]bool
+	deny         map[string]bool
+	deprioritize map[string]bool
+}
+
+// NewPolicy creates a Policy that denies the clients of the deny countries
+// and, if allow is not empty, of every country not in allow. The clients of
+// the deprioritize countries are only admitted while busy returns false.
+func NewPolicy(allow, deny, deprioritize []string, busy func() bool) *Policy {
+	p := &Policy{busy: busy}
+	p.Set(allow, deny, deprioritize)
+	return p
+}
+
+// Set replaces the countries of p, for the clients that are located after it
+// returns.
+func (p *Policy) Set(allow, deny, deprioritize []string) {
+	if p == nil {
+		return
+	}
+	set := func(codes []string) map[string]bool {
+		m := map[string]bool{}
+		for _, c := range codes {
+			if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+				m[c] = true
+			}
+		}
+		return m
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow, p.deny, p.deprioritize = set(allow), set(deny), set(deprioritize)
+}
+
+// Decide returns the Decision for a client from country.
+func (p *Policy) Decide(country string) Decision {
+	if p == nil {
+		return Admit
+	}
+	if country == "" {
+		country = UnknownCountry
+	}
+	p.mu.RLock()
+	denied := p.deny[country] || (len(p.allow) > 0 && !p.allow[country])
+	deprioritized := p.deprioritize[country]
+	p.mu.RUnlock()
+	if denied {
+		return Deny
+	}
+	if deprioritized && p.busy != nil && p.busy() {
+		return Defer
+	}
+	return Admit
+}
+
+// Explanation returns the message that tells a client why it was turned away
+// with d.
+func (d Decision) Explanation() string {
+	switch d {
+	case Deny:
+		return "This server does not offer tests to clients in your country"
+	case Defer:
+		return "This server is busy, please try again later"
+	}
+	return ""
+}
+
+// WithPolicy makes l decide whether clients may run tests with p, and returns
+// l.
+func (l *Locator) WithPolicy(p *Policy) *Locator {
+	l.policy = p
+	return l
+}
+
+// Decide returns the Decision of l's Policy for a client located at g, and
+// the client's country.
+func (l *Locator) Decide(g *Geolocation) (Decision, string) {
+	country := UnknownCountry
+	if g != nil && g.CountryCode != "" {
+		country = g.CountryCode
+	}
+	if l == nil {
+		return Admit, country
+	}
+	return l.policy.Decide(country), country
+}
@@ -0,0 +1,70 @@
+package geoip
+
+import "testing"
+
+func TestPolicy_Decide(t *testing.T) {
+	busy := false
+	p := NewPolicy(nil, []string{"aa"}, []string{"BB", " "}, func() bool { return busy })
+	tests := []struct {
+		country string
+		busy    bool
+		want    Decision
+	}{
+		{"AA", false, Deny},
+		{"BB", false, Admit},
+		{"BB", true, Defer},
+		{"CC", true, Admit},
+		{"", false, Admit},
+	}
+	for _, tt := range tests {
+		busy = tt.busy
+		if got := p.Decide(tt.country); got != tt.want {
+			t.Errorf("Decide(%q) while busy=%t = %q, want %q", tt.country, tt.busy, got, tt.want)
+		}
+	}
+
+	// With an allow list, other countries and unknown ones are denied.
+	p = NewPolicy([]string{"AA", "BB"}, []string{"BB"}, nil, nil)
+	for country, want := range map[string]Decision{"AA": Admit, "BB": Deny, "CC": Deny, "": Deny} {
+		if got := p.Decide(country); got != want {
+			t.Errorf("Decide(%q) = %q, want %q", country, got, want)
+		}
+	}
+	if got := NewPolicy([]string{UnknownCountry}, nil, nil, nil).Decide(""); got != Admit {
+		t.Errorf("Decide(\"\") = %q, want clients of unknown countries to be allowed with ZZ", got)
+	}
+
+	var none *Policy
+	if none.Decide("AA") != Admit {
+		t.Error("a nil Policy should admit everyone")
+	}
+}
+
+func TestPolicy_Set(t *testing.T) {
+	p := NewPolicy(nil, []string{"AA"}, nil, nil)
+	p.Set([]string{"AA"}, nil, nil)
+	for country, want := range map[string]Decision{"AA": Admit, "BB": Deny} {
+		if got := p.Decide(country); got != want {
+			t.Errorf("Decide(%q) = %q, want %q", country, got, want)
+		}
+	}
+	var none *Policy
+	none.Set(nil, []string{"AA"}, nil)
+}
+
+func TestLocator_Decide(t *testing.T) {
+	l := New(nil, nil, 0).WithPolicy(NewPolicy(nil, []string{"AA"}, nil, nil))
+	if d, country := l.Decide(&Geolocation{CountryCode: "AA"}); d != Deny || country != "AA" {
+		t.Errorf("Decide() = %q, %q, want deny, AA", d, country)
+	}
+	if d, country := l.Decide(nil); d != Admit || country != UnknownCountry {
+		t.Errorf("Decide(nil) = %q, %q, want admit, %s", d, country, UnknownCountry)
+	}
+	var none *Locator
+	if d, _ := none.Decide(&Geolocation{CountryCode: "AA"}); d != Admit {
+		t.Error("a nil Locator should admit everyone")
+	}
+	if Deny.Explanation() == "" || Defer.Explanation() == "" || Admit.Explanation() != "" {
+		t.Error("only rejections should have explanations")
+	}
+}
@@ -0,0 +1,262 @@
+// Package iplist blocks clients by IP address, with a file of CIDR ranges
+// that are denied or allowed. The file is reloaded when it changes, so that
+// operators can block an abusive network without restarting the server.
+//
+// Every line of the file is empty, a comment that starts with '#', or an
+// action followed by a CIDR range or a single IP address:
+//
+//	# Block a network, except for one of its hosts.
+//	deny 192.0.2.0/24
+//	allow 192.0.2.7
+//
+// The most specific range that contains a client's IP decides whether it is
+// allowed. Clients that match no range are allowed, so a server that only
+// admits the allowed ranges must also deny 0.0.0.0/0 and ::/0.
+package iplist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// ErrBlocked is returned by Accept when a connection is rejected.
+var ErrBlocked = errors.New("client IP is blocked")
+
+// entry is a range of the list.
+type entry struct {
+	ipnet *net.IPNet
+	allow bool
+	// text is the range as written in the file, e.g. "deny 192.0.2.0/24",
+	// which names the entry in metrics.
+	text string
+}
+
+// parse reads the entries of a list, most specific first.
+func parse(data []byte) ([]entry, error) {
+	entries := []entry{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("line %d: want \"allow CIDR\" or \"deny CIDR\", got %q", n, line)
+		}
+		cidr := fields[1]
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		entries = append(entries, entry{ipnet: ipnet, allow: fields[0] == "allow", text: fields[0] + " " + fields[1]})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, _ := entries[i].ipnet.Mask.Size()
+		b, _ := entries[j].ipnet.Mask.Size()
+		return a > b
+	})
+	return entries, nil
+}
+
+// List is a list of denied and allowed ranges read from a file. A nil *List
+// allows every client.
+type List struct {
+	path string
+
+	mu      sync.RWMutex
+	entries []entry
+	modTime time.Time
+}
+
+// Open reads the list at path.
+func Open(path string) (*List, error) {
+	l := &List{path: path}
+	if err := l.Load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Load rereads the file. If the new file is invalid, the previous list stays
+// in use.
+func (l *List) Load() error {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	entries, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.path, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = entries
+	l.modTime = fi.ModTime()
+	return nil
+}
+
+// Reload rereads the file if its modification time has changed, and reports
+// whether it did.
+func (l *List) Reload() (bool, error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false, err
+	}
+	l.mu.RLock()
+	current := fi.ModTime().Equal(l.modTime)
+	l.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	if err := l.Load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := l.Reload()
+			if err != nil {
+				logging.Logger.WithError(err).WithField("path", l.path).Warn("Could not reload")
+			} else if reloaded {
+				logging.Logger.WithField("path", l.path).Info("Reloaded")
+			}
+		}
+	}
+}
+
+// Check reports whether the client at ip is allowed, and returns the entry
+// that decided it, or "" if no entry contains ip.
+func (l *List) Check(ip string) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return true, ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, e := range l.entries {
+		if e.ipnet.Contains(parsed) {
+			return e.allow, e.text
+		}
+	}
+	return true, ""
+}
+
+// Blocks reports whether the client at ip is blocked, and counts it if so.
+// The label names the server in the metric.
+func (l *List) Blocks(ip, label string) bool {
+	allowed, entry := l.Check(ip)
+	if allowed {
+		return false
+	}
+	metrics.BlockedConnections.WithLabelValues(label, entry).Inc()
+	return true
+}
+
+// hostOf returns the IP part of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Accepter is implemented by listeners' gatekeepers, such as the one used by
+// the ndt5 plain server.
+type Accepter interface {
+	Accept(l net.Listener) (net.Conn, error)
+}
+
+type blockingAccepter struct {
+	list      *List
+	next      Accepter
+	label     string
+	onBlocked func(ip string)
+}
+
+// Accept accepts a connection using next, then closes it and returns
+// ErrBlocked if the client is blocked.
+func (a *blockingAccepter) Accept(l net.Listener) (net.Conn, error) {
+	conn, err := a.next.Accept(l)
+	if err != nil {
+		return nil, err
+	}
+	if ip := hostOf(conn.RemoteAddr().String()); a.list.Blocks(ip, a.label) {
+		if a.onBlocked != nil {
+			a.onBlocked(ip)
+		}
+		conn.Close()
+		return nil, ErrBlocked
+	}
+	return conn, nil
+}
+
+// Accepter wraps next so that connections from blocked clients are closed as
+// soon as they are accepted. The label names the server in the metric. If
+// onBlocked is not nil, it is called with the IP of every blocked client.
+func (l *List) Accepter(next Accepter, label string, onBlocked func(ip string)) Accepter {
+	if l == nil {
+		return next
+	}
+	return &blockingAccepter{list: l, next: next, label: label, onBlocked: onBlocked}
+}
+
+// Then wraps next so that requests from blocked clients are answered with 403
+// Forbidden before they are upgraded to WebSockets. The label names the
+// server in the metric. If onBlocked is not nil, it is called with the IP of
+// every blocked client.
+func (l *List) Then(next http.Handler, label string, onBlocked func(ip string)) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := hostOf(r.RemoteAddr); l.Blocks(ip, label) {
+			if onBlocked != nil {
+				onBlocked(ip)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package iplist
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeList(t *testing.T, path, content string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime, modTime)
+}
+
+func TestList_Check(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iplist")
+	writeList(t, path, `
+# Block a network, except for one of its hosts.
+deny 192.0.2.0/24
+allow 192.0.2.7
+deny 2001:db8::/32
+`, time.Now())
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+		entry   string
+	}{
+		{"192.0.2.1", false, "deny 192.0.2.0/24"},
+		{"192.0.2.7", true, "allow 192.0.2.7"},
+		{"198.51.100.1", true, ""},
+		{"2001:db8::1", false, "deny 2001:db8::/32"},
+		{"not-an-ip", true, ""},
+	}
+	for _, tt := range tests {
+		if allowed, entry := l.Check(tt.ip); allowed != tt.allowed || entry != tt.entry {
+			t.Errorf("Check(%q) = %t, %q, want %t, %q", tt.ip, allowed, entry, tt.allowed, tt.entry)
+		}
+	}
+	var none *List
+	if allowed, _ := none.Check("192.0.2.1"); !allowed {
+		t.Error("a nil List should allow everything")
+	}
+}
+
+func TestList_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iplist")
+	start := time.Now().Add(-time.Hour)
+	writeList(t, path, "deny 192.0.2.0/24\n", start)
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := l.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of an unchanged file = %t, %v", reloaded, err)
+	}
+	writeList(t, path, "deny 198.51.100.0/24\n", start.Add(time.Minute))
+	if reloaded, err := l.Reload(); !reloaded || err != nil {
+		t.Errorf("Reload() of a changed file = %t, %v", reloaded, err)
+	}
+	if allowed, _ := l.Check("192.0.2.1"); !allowed {
+		t.Error("the old list should be replaced")
+	}
+	// An invalid file leaves the previous list in use.
+	writeList(t, path, "block 192.0.2.0/24\n", start.Add(2*time.Minute))
+	if _, err := l.Reload(); err == nil {
+		t.Error("Reload() of an invalid file should fail")
+	}
+	if allowed, _ := l.Check("198.51.100.1"); allowed {
+		t.Error("the previous list should stay in use")
+	}
+}
+
+func Test_parse(t *testing.T) {
+	for _, bad := range []string{"deny", "deny 192.0.2.0/33", "permit 192.0.2.0/24", "deny 192.0.2.0/24 extra"} {
+		if _, err := parse([]byte(bad)); err == nil {
+			t.Errorf("parse(%q) should fail", bad)
+		}
+	}
+}
+
+type fakeAccepter struct {
+	conn net.Conn
+}
+
+func (a *fakeAccepter) Accept(net.Listener) (net.Conn, error) {
+	return a.conn, nil
+}
+
+type fakeConn struct {
+	net.Conn
+	addr   net.Addr
+	closed bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+func (c *fakeConn) Close() error         { c.closed = true; return nil }
+
+func TestList_Accepter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iplist")
+	writeList(t, path, "deny 192.0.2.0/24\n", time.Now())
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := []string{}
+	conn := &fakeConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	tx := l.Accepter(&fakeAccepter{conn: conn}, "test", func(ip string) { blocked = append(blocked, ip) })
+	if _, err := tx.Accept(nil); err != ErrBlocked || !conn.closed {
+		t.Errorf("Accept() = %v, closed=%t, want ErrBlocked", err, conn.closed)
+	}
+	if len(blocked) != 1 || blocked[0] != "192.0.2.1" {
+		t.Errorf("onBlocked was called with %v, want [192.0.2.1]", blocked)
+	}
+	conn = &fakeConn{addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}}
+	tx = l.Accepter(&fakeAccepter{conn: conn}, "test", nil)
+	if c, err := tx.Accept(nil); err != nil || c != conn {
+		t.Errorf("Accept() = %v, want the connection", err)
+	}
+}
+
+func TestList_Then(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iplist")
+	writeList(t, path, "deny 192.0.2.0/24\n", time.Now())
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "test", nil)
+	for addr, want := range map[string]int{
+		"192.0.2.1:1234":    http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ndt_protocol", nil)
+		req.RemoteAddr = addr
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request from %s got status %d, want %d", addr, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package live keeps track of the tests that are running, so that operators
+// can see who is being measured right now and cancel a test if they must.
+package live
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Test is a running test, registered with Registry.Add. A nil *Test records
+// nothing.
+type Test struct {
+	uuid     string
+	clientIP string
+	protocol string
+	start    time.Time
+	cancel   context.CancelFunc
+	r        *Registry
+
+	mu       sync.Mutex
+	kind     string
+	measured time.Time
+	bytes    func() int64
+	base     int64
+}
+
+// Measure records that the kind subtest of t started, e.g. "download" or
+// "s2c", and that bytes returns the number of bytes it has transferred so
+// far.
+func (t *Test) Measure(kind string, bytes func() int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.kind = kind
+	t.measured = time.Now()
+	t.bytes = bytes
+	t.base = 0
+	if bytes != nil {
+		t.base = bytes()
+	}
+}
+
+// Done removes t from its Registry. Calling Done more than once has no
+// effect.
+func (t *Test) Done() {
+	if t == nil {
+		return
+	}
+	t.r.mu.Lock()
+	removed := t.r.tests[t.uuid] == t
+	if removed {
+		delete(t.r.tests, t.uuid)
+	}
+	t.r.mu.Unlock()
+	if removed && len(t.r.observers) > 0 {
+		s := t.status(time.Now())
+		for _, o := range t.r.observers {
+			o.TestDone(s)
+		}
+	}
+}
+
+// Status describes a running test.
+type Status struct {
+	UUID     string
+	ClientIP string
+	// Protocol is e.g. "ndt5+plain" or "ndt7+wss".
+	Protocol string
+	// Kind is the subtest that is running, or empty if none has started yet.
+	Kind string
+	// ElapsedSeconds is the time since the test started.
+	ElapsedSeconds float64
+	// RateMbps is the mean rate of the running subtest so far, or zero if it
+	// is unknown.
+	RateMbps float64
+}
+
+// status returns the Status of t at now.
+func (t *Test) status(now time.Time) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Status{
+		UUID:           t.uuid,
+		ClientIP:       t.clientIP,
+		Protocol:       t.protocol,
+		Kind:           t.kind,
+		ElapsedSeconds: now.Sub(t.start).Seconds(),
+	}
+	if t.bytes != nil {
+		if d := now.Sub(t.measured); d > 0 {
+			s.RateMbps = 8 * float64(t.bytes()-t.base) / d.Seconds() / 1e6
+		}
+	}
+	return s
+}
+
+// Observer is told when tests start and end, e.g. to announce them to other
+// services.
+type Observer interface {
+	TestStarted(Status)
+	TestDone(Status)
+}
+
+// Registry holds the running tests by UUID. A nil *Registry tracks nothing.
+type Registry struct {
+	mu        sync.Mutex
+	tests     map[string]*Test
+	observers []Observer
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{tests: map[string]*Test{}}
+}
+
+// WithObserver makes r also tell o about every test that is added or done,
+// and returns r. It must be called before tests are added.
+func (r *Registry) WithObserver(o Observer) *Registry {
+	r.observers = append(r.observers, o)
+	return r
+}
+
+// Add registers the test uuid of the client at clientIP, which Cancel stops
+// by calling cancel. The test must call Done once it is over.
+func (r *Registry) Add(uuid, clientIP, protocol string, cancel context.CancelFunc) *Test {
+	if r == nil {
+		return nil
+	}
+	t := &Test{
+		uuid:     uuid,
+		clientIP: clientIP,
+		protocol: protocol,
+		start:    time.Now(),
+		cancel:   cancel,
+		r:        r,
+	}
+	r.mu.Lock()
+	r.tests[uuid] = t
+	r.mu.Unlock()
+	if len(r.observers) > 0 {
+		s := t.status(t.start)
+		for _, o := range r.observers {
+			o.TestStarted(s)
+		}
+	}
+	return t
+}
+
+// List returns the status of the running tests, oldest first.
+func (r *Registry) List() []Status {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	tests := make([]*Test, 0, len(r.tests))
+	for _, t := range r.tests {
+		tests = append(tests, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(tests, func(i, j int) bool { return tests[i].start.Before(tests[j].start) })
+	now := time.Now()
+	statuses := make([]Status, len(tests))
+	for i, t := range tests {
+		statuses[i] = t.status(now)
+	}
+	return statuses
+}
+
+// Len returns the number of running tests.
+func (r *Registry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.tests)
+}
+
+// Cancel stops the test uuid, and reports whether it was running.
+func (r *Registry) Cancel(uuid string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	t, ok := r.tests[uuid]
+	r.mu.Unlock()
+	if ok {
+		t.cancel()
+	}
+	return ok
+}
+
+type testKey struct{}
+
+// NewContext returns a copy of ctx that carries t, so that the code that runs
+// the subtests of t can report them.
+func NewContext(ctx context.Context, t *Test) context.Context {
+	return context.WithValue(ctx, testKey{}, t)
+}
+
+// FromContext returns the Test carried by ctx, or nil.
+func FromContext(ctx context.Context) *Test {
+	t, _ := ctx.Value(testKey{}).(*Test)
+	return t
+}
@@ -0,0 +1,80 @@
+package live
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	test := r.Add("uuid", "192.0.2.1", "ndt7+wss", cancel)
+	bytes := int64(1000)
+	test.Measure("download", func() int64 { return bytes })
+	bytes = 2000
+	tests := r.List()
+	if len(tests) != 1 || r.Len() != 1 {
+		t.Fatalf("List() = %v, want one test", tests)
+	}
+	s := tests[0]
+	if s.UUID != "uuid" || s.ClientIP != "192.0.2.1" || s.Protocol != "ndt7+wss" || s.Kind != "download" {
+		t.Errorf("List() = %+v", s)
+	}
+	if s.RateMbps <= 0 || s.ElapsedSeconds <= 0 {
+		t.Errorf("List() = %+v, want a positive rate and elapsed time", s)
+	}
+	if r.Cancel("other") {
+		t.Error("Cancel() of an unknown test should fail")
+	}
+	if !r.Cancel("uuid") || ctx.Err() == nil {
+		t.Error("Cancel() should cancel the test")
+	}
+	test.Done()
+	test.Done()
+	if r.Len() != 0 {
+		t.Error("Done() should remove the test")
+	}
+}
+
+func TestRegistry_Nil(t *testing.T) {
+	var r *Registry
+	test := r.Add("uuid", "192.0.2.1", "ndt7+wss", func() {})
+	test.Measure("download", nil)
+	test.Done()
+	if r.List() != nil || r.Len() != 0 || r.Cancel("uuid") {
+		t.Error("a nil Registry should track nothing")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("FromContext() should return nil without a Test")
+	}
+	test := NewRegistry().Add("uuid", "192.0.2.1", "ndt5+plain", func() {})
+	if FromContext(NewContext(context.Background(), test)) != test {
+		t.Error("FromContext() should return the Test of NewContext()")
+	}
+}
+
+type recorder struct {
+	started, done []Status
+}
+
+func (r *recorder) TestStarted(s Status) { r.started = append(r.started, s) }
+func (r *recorder) TestDone(s Status)    { r.done = append(r.done, s) }
+
+func TestRegistry_WithObserver(t *testing.T) {
+	o := &recorder{}
+	r := NewRegistry().WithObserver(o)
+	test := r.Add("uuid", "192.0.2.1", "ndt5+plain", func() {})
+	test.Measure("s2c", nil)
+	test.Done()
+	test.Done()
+	if len(o.started) != 1 || o.started[0].UUID != "uuid" || o.started[0].Kind != "" {
+		t.Errorf("TestStarted() got %+v", o.started)
+	}
+	if len(o.done) != 1 || o.done[0].ClientIP != "192.0.2.1" || o.done[0].Kind != "s2c" {
+		t.Errorf("TestDone() got %+v", o.done)
+	}
+}
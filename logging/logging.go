@@ -3,13 +3,17 @@
 package logging
 
 import (
+	"context"
+	"fmt"
 	golog "log"
 	"net/http"
 	"os"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/json"
+	"github.com/apex/log/handlers/text"
 	"github.com/gorilla/handlers"
+	"github.com/m-lab/ndt-server/privacy"
 )
 
 // Logger is a logger that logs messages on the standard error
@@ -21,11 +25,64 @@ var Logger = log.Logger{
 	Level:   log.InfoLevel,
 }
 
+// Configure sets the minimum level of the messages that Logger emits, one of
+// debug, info, warn, error or fatal, and their format, json or text. It must
+// be called before Logger is used.
+func Configure(level, format string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		Logger.Handler = json.New(os.Stderr)
+	case "text":
+		Logger.Handler = text.New(os.Stderr)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	Logger.Level = l
+	return nil
+}
+
+// contextKey is the key of the logger in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries logger, which usually has the
+// fields that identify a test.
+func NewContext(ctx context.Context, logger log.Interface) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or Logger if there is none.
+func FromContext(ctx context.Context) log.Interface {
+	if l, ok := ctx.Value(contextKey{}).(log.Interface); ok {
+		return l
+	}
+	return &Logger
+}
+
 // MakeAccessLogHandler wraps |handler| with another handler that logs
 // access to each resource on the standard output. This is consistent with
 // the way in which Apache and Nginx are dockerised. We do not emit JSON
 // access logs, because access logs are a fairly standard format that
 // has been around for a long time now, so better to follow such standard.
 func MakeAccessLogHandler(handler http.Handler) http.Handler {
-	return handlers.LoggingHandler(golog.Writer(), handler)
+	if !privacy.Enabled() {
+		return handlers.LoggingHandler(golog.Writer(), handler)
+	}
+	// Access is logged with the anonymized address of the client, but
+	// handler still gets the request with the full address.
+	logged := handlers.LoggingHandler(golog.Writer(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.Context().Value(requestKey{}).(*http.Request))
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anonymized := r.WithContext(context.WithValue(r.Context(), requestKey{}, r))
+		anonymized.RemoteAddr = privacy.Addr(r.RemoteAddr)
+		logged.ServeHTTP(w, anonymized)
+	})
 }
+
+// requestKey is the key of the original request in the context of the
+// anonymized request of the access log.
+type requestKey struct{}
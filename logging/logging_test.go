@@ -2,12 +2,18 @@ package logging
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	apexlog "github.com/apex/log"
+	"github.com/m-lab/go/anonymize"
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/privacy"
 )
 
 type fakeHandler struct{}
@@ -38,3 +44,50 @@ func TestMakeAccessLogHandler(t *testing.T) {
 		t.Error("We should not have had an empty string")
 	}
 }
+
+func TestMakeAccessLogHandler_anonymized(t *testing.T) {
+	privacy.Configure(anonymize.Netblock)
+	defer privacy.Configure(anonymize.None)
+	buff := &bytes.Buffer{}
+	old := log.Writer()
+	defer log.SetOutput(old)
+	log.SetOutput(buff)
+	var got string
+	f := MakeAccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+	log.SetOutput(old)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.13:1234"
+	f.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "192.0.2.13:1234" {
+		t.Errorf("handler got RemoteAddr %q, want the full address", got)
+	}
+	if s := buff.String(); !strings.HasPrefix(s, "192.0.2.0 ") {
+		t.Errorf("access log = %q, want the anonymized address", s)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	old := Logger
+	defer func() { Logger = old }()
+	if err := Configure("debug", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if Logger.Level != apexlog.DebugLevel {
+		t.Errorf("Configure() set level %v, want debug", Logger.Level)
+	}
+	if Configure("loud", "json") == nil || Configure("info", "xml") == nil {
+		t.Error("Configure() accepted an invalid level or format")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) != &Logger {
+		t.Error("FromContext() without a logger should return Logger")
+	}
+	entry := Logger.WithField("uuid", "test")
+	if FromContext(NewContext(context.Background(), entry)) != entry {
+		t.Error("FromContext() did not return the logger of the context")
+	}
+}
@@ -1,6 +1,12 @@
 package metrics
 
 import (
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/m-lab/ndt-server/geoip"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -26,8 +32,187 @@ var (
 		},
 		[]string{"protocol", "direction", "monitoring"},
 	)
+	TestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "ndt_test_duration_seconds",
+			Help: "A histogram of how long each upload or download test lasted.",
+			Buckets: []float64{
+				.1, .25, .5, 1, 2.5,
+				5, 7.5, 9, 10, 11,
+				12.5, 15, 20, 30, 60},
+		},
+		[]string{"protocol", "direction"},
+	)
+	BytesTransferred = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_test_bytes_total",
+			Help: "Number of bytes transferred by upload and download tests, as reported by TCP_INFO.",
+		},
+		[]string{"protocol", "direction"},
+	)
+	RateLimitedConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_ratelimit_rejected_total",
+			Help: "Number of connections rejected because the client exceeded its test rate limit.",
+		},
+		[]string{"protocol"},
+	)
+	CountryDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_country_decisions_total",
+			Help: "Number of clients admitted or turned away by the country policy, by client country and decision (admit, deny or defer).",
+		},
+		[]string{"protocol", "country", "decision"},
+	)
+	BlockedConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_iplist_blocked_total",
+			Help: "Number of connections rejected by the IP list, by the entry that denied them.",
+		},
+		[]string{"protocol", "entry"},
+	)
+	AbuseBans = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ndt_abuse_bans_total",
+			Help: "Number of client IPs banned for repeatedly starting tests they never completed.",
+		},
+	)
+	AbuseBanned = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt_abuse_banned",
+			Help: "Number of client IPs currently banned for repeatedly starting tests they never completed.",
+		},
+	)
+	AbuseRejectedConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_abuse_rejected_total",
+			Help: "Number of connections rejected because their client IP is banned.",
+		},
+		[]string{"protocol"},
+	)
+	Draining = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt_draining",
+			Help: "Whether the server turns new tests away while running tests finish, in lame duck mode or before shutting down.",
+		},
+	)
+	EventsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ndt_events_dropped_total",
+			Help: "Number of test lifecycle events dropped because event socket clients were too slow.",
+		},
+	)
+	Traceroutes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_traceroutes_total",
+			Help: "Number of traceroutes toward clients after their tests, by result: ok, error, rate-limited, or busy.",
+		},
+		[]string{"result"},
+	)
+	PacketCaptures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_packet_captures_total",
+			Help: "Number of packet captures of tests, by result: ok, truncated, error, or busy.",
+		},
+		[]string{"result"},
+	)
+	RetentionFiles = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_retention_files_total",
+			Help: "Number of data files handled by the retention policy, by kind, e.g. ndt7 or pcap, and action: removed, compressed, or error.",
+		},
+		[]string{"kind", "action"},
+	)
+	RetentionReclaimedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_retention_reclaimed_bytes_total",
+			Help: "Number of bytes of disk space reclaimed by the retention policy, by kind and action: removed or compressed.",
+		},
+		[]string{"kind", "action"},
+	)
+	ResultsPublished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_results_published_total",
+			Help: "Number of results published to external systems, by writer and result: ok, error, or dropped.",
+		},
+		[]string{"writer", "result"},
+	)
+	SubnetLimitedConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_subnet_limited_total",
+			Help: "Number of tests rejected because the client's subnet exceeded its test rate limit (rate) or ran too many tests at once (concurrency).",
+		},
+		[]string{"protocol", "limit"},
+	)
+	FlowLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt_flow_limit",
+			Help: "The maximum number of measurement flows the server runs at once, or zero if there is no limit.",
+		},
+	)
+	Flows = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt_flows",
+			Help: "Number of measurement flows admitted by the server-wide limiter, by state (active or waiting).",
+		},
+		[]string{"state"},
+	)
+	FlowRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_flow_rejected_total",
+			Help: "Number of tests rejected because the server was running as many measurement flows as it could.",
+		},
+		[]string{"protocol"},
+	)
+	TLSHandshakes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_tls_handshakes_total",
+			Help: "Number of completed TLS handshakes, by negotiated TLS version.",
+		},
+		[]string{"version"},
+	)
+	ASNTestRate = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt_asn_test_rate_mbps",
+			Help:    "A histogram of test rates by client autonomous system, for the first networks seen.",
+			Buckets: []float64{1, 10, 25, 100, 250, 1000},
+		},
+		[]string{"direction", "asn"},
+	)
 )
 
+// MaxASNLabels is the number of distinct AS numbers used as ASNTestRate
+// labels. Tests from other networks are counted as "other".
+var MaxASNLabels = 50
+
+var asnLabels = struct {
+	sync.Mutex
+	seen map[uint32]bool
+}{seen: map[uint32]bool{}}
+
+// ASNLabel returns the ASNTestRate label for asn, which may be nil if the
+// client's network is unknown. To bound the number of series, only the first
+// MaxASNLabels networks seen get a label of their own.
+func ASNLabel(asn *geoip.ASN) string {
+	if asn == nil {
+		return "unknown"
+	}
+	asnLabels.Lock()
+	defer asnLabels.Unlock()
+	if !asnLabels.seen[asn.ASNumber] {
+		if len(asnLabels.seen) >= MaxASNLabels {
+			return "other"
+		}
+		asnLabels.seen[asn.ASNumber] = true
+	}
+	return strconv.FormatUint(uint64(asn.ASNumber), 10)
+}
+
+// ObserveASNTestRate records rate in the ASNTestRate histogram.
+func ObserveASNTestRate(direction string, asn *geoip.ASN, rate float64) {
+	ASNTestRate.WithLabelValues(direction, ASNLabel(asn)).Observe(rate)
+}
+
 // GetResultLabel returns one of four strings based on the combination of
 // whether the error ("okay" or "error") and the rate ("with-rate" (non-zero) or
 // "without-rate" (zero)).
@@ -42,3 +227,23 @@ func GetResultLabel(err error, rate float64) string {
 	}
 	return withErr + withResult
 }
+
+// ObserveTransfer records the duration and size of a single upload or download
+// test.
+func ObserveTransfer(proto, direction string, duration time.Duration, bytes int64) {
+	TestDuration.WithLabelValues(proto, direction).Observe(duration.Seconds())
+	BytesTransferred.WithLabelValues(proto, direction).Add(float64(bytes))
+}
+
+// ObserveTestRate records rate in the TestRate histogram. When possible, the
+// test UUID is attached as an exemplar so that an outlying rate can be traced
+// back to its archived result.
+func ObserveTestRate(proto, direction, isMon, uuid string, rate float64) {
+	o := TestRate.WithLabelValues(proto, direction, isMon)
+	eo, ok := o.(prometheus.ExemplarObserver)
+	if !ok || uuid == "" || utf8.RuneCountInString("uuid"+uuid) > prometheus.ExemplarMaxRunes {
+		o.Observe(rate)
+		return
+	}
+	eo.ObserveWithExemplar(rate, prometheus.Labels{"uuid": uuid})
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server/geoip"
+)
+
+func TestASNLabel(t *testing.T) {
+	defer func(max int) { MaxASNLabels = max }(MaxASNLabels)
+	MaxASNLabels = 2
+	tests := []struct {
+		asn  *geoip.ASN
+		want string
+	}{
+		{nil, "unknown"},
+		{&geoip.ASN{ASNumber: 64496}, "64496"},
+		{&geoip.ASN{ASNumber: 64497}, "64497"},
+		{&geoip.ASN{ASNumber: 64498}, "other"},
+		{&geoip.ASN{ASNumber: 64496}, "64496"},
+	}
+	for _, tt := range tests {
+		if got := ASNLabel(tt.asn); got != tt.want {
+			t.Errorf("ASNLabel(%+v) = %q, want %q", tt.asn, got, tt.want)
+		}
+	}
+}
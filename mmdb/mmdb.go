@@ -0,0 +1,98 @@
+// Package mmdb opens MaxMind DB files, the format of the GeoLite2 and GeoIP2
+// databases, with github.com/oschwald/maxminddb-golang, and reopens them when
+// they are replaced on disk.
+package mmdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is a database file that is reloaded when it changes. A nil *DB has no
+// records.
+type DB struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// Open reads the database at path.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload rereads the database if the file's modification time has changed,
+// and reports whether it did. If the new file is invalid, the previous
+// database stays in use.
+func (db *DB) Reload() (bool, error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	current := db.reader != nil && fi.ModTime().Equal(db.modTime)
+	db.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	// The database is read into memory rather than mapped, so that lookups
+	// that still use the previous reader need not be waited for.
+	buf, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	r, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", db.path, err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reader = r
+	db.modTime = fi.ModTime()
+	return true, nil
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (db *DB) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := db.Reload()
+			if err != nil {
+				logging.Logger.WithError(err).WithField("path", db.path).Warn("Could not reload")
+			} else if reloaded {
+				logging.Logger.WithField("path", db.path).Info("Reloaded")
+			}
+		}
+	}
+}
+
+// Lookup decodes the record for ip in the current database into result, as
+// maxminddb.Reader.Lookup does, and reports whether there was one.
+func (db *DB) Lookup(ip net.IP, result interface{}) (bool, error) {
+	if db == nil {
+		return false, nil
+	}
+	db.mu.RLock()
+	r := db.reader
+	db.mu.RUnlock()
+	_, ok, err := r.LookupNetwork(ip, result)
+	return ok, err
+}
@@ -0,0 +1,126 @@
+package mmdb
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/mmdb/mmdbtest"
+)
+
+// open writes buf to a file and opens it.
+func open(t *testing.T, buf []byte) (*DB, error) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Open(path)
+}
+
+func TestDB_Lookup(t *testing.T) {
+	v4 := map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+		"names":   []interface{}{"a", "b"},
+		"lat":     40.5,
+		"anycast": true,
+	}
+	v6 := map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}
+	networks := map[string]interface{}{
+		"198.51.100.0/24": v4,
+		"2001:db8::/32":   v6,
+	}
+	for _, size := range []uint{24, 28, 32} {
+		db, err := open(t, mmdbtest.Build(size, networks))
+		if err != nil {
+			t.Fatalf("Open() with %d-bit records: %v", size, err)
+		}
+		tests := []struct {
+			ip   string
+			want interface{}
+		}{
+			{"198.51.100.7", v4},
+			{"::ffff:198.51.100.7", v4},
+			{"2001:db8:1::1", v6},
+			{"192.0.2.1", nil},
+			{"2001:db9::1", nil},
+		}
+		for _, tt := range tests {
+			var got interface{}
+			ok, err := db.Lookup(net.ParseIP(tt.ip), &got)
+			if err != nil {
+				t.Errorf("Lookup(%s) with %d-bit records: %v", tt.ip, size, err)
+			}
+			if ok != (tt.want != nil) || tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup(%s) with %d-bit records = %v, %t, want %v", tt.ip, size, got, ok, tt.want)
+			}
+		}
+	}
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	if _, err := open(t, []byte("not a database")); err == nil {
+		t.Error("Open() should fail without metadata")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Open() should fail without a file")
+	}
+}
+
+func TestDB_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, mmdbtest.Build(24, map[string]interface{}{"192.0.2.0/24": "old"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := lookup(db, "192.0.2.1"); v != "old" {
+		t.Errorf("Lookup() = %v, want old", v)
+	}
+	if reloaded, err := db.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of an unchanged file = %t, %v", reloaded, err)
+	}
+	if err := os.WriteFile(path, mmdbtest.Build(24, map[string]interface{}{"192.0.2.0/24": "new"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := db.Reload(); !reloaded || err != nil {
+		t.Errorf("Reload() of a changed file = %t, %v", reloaded, err)
+	}
+	if v := lookup(db, "192.0.2.1"); v != "new" {
+		t.Errorf("Lookup() = %v, want new", v)
+	}
+
+	// A broken file leaves the previous database in place.
+	if err := os.WriteFile(path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, err := db.Reload(); err == nil {
+		t.Error("Reload() of a broken file should fail")
+	}
+	if v := lookup(db, "192.0.2.1"); v != "new" {
+		t.Errorf("Lookup() = %v, want new", v)
+	}
+
+	var nilDB *DB
+	var v string
+	if ok, err := nilDB.Lookup(net.ParseIP("192.0.2.1"), &v); ok || err != nil {
+		t.Errorf("nil Lookup() = %t, %v", ok, err)
+	}
+}
+
+// lookup returns the string record for ip in db.
+func lookup(db *DB, ip string) string {
+	var v string
+	db.Lookup(net.ParseIP(ip), &v)
+	return v
+}
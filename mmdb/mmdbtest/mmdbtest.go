@@ -0,0 +1,150 @@
+// Package mmdbtest builds small MaxMind DB files for tests.
+package mmdbtest
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+)
+
+// Data types used by encode.
+const (
+	typeString = 2
+	typeDouble = 3
+	typeUint32 = 6
+	typeMap    = 7
+	typeArray  = 11
+	typeBool   = 14
+)
+
+const dataSectionSeparator = 16
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// encode encodes v in the MaxMind DB data format.
+func encode(v interface{}) []byte {
+	ctrl := func(typ int, size int) []byte {
+		var b []byte
+		if typ > 7 {
+			b = []byte{0, byte(typ - 7)}
+		} else {
+			b = []byte{byte(typ << 5)}
+		}
+		switch {
+		case size < 29:
+			b[0] |= byte(size)
+		case size < 285:
+			b[0] |= 29
+			b = append(b, byte(size-29))
+		default:
+			b[0] |= 30
+			b = append(b, byte((size-285)>>8), byte(size-285))
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(typeString, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(ctrl(typeDouble, 8), math.Float64bits(v))
+	case uint64:
+		return binary.BigEndian.AppendUint32(ctrl(typeUint32, 4), uint32(v))
+	case bool:
+		if v {
+			return ctrl(typeBool, 1)
+		}
+		return ctrl(typeBool, 0)
+	case []interface{}:
+		b := ctrl(typeArray, len(v))
+		for _, e := range v {
+			b = append(b, encode(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := ctrl(typeMap, len(v))
+		for _, k := range keys {
+			b = append(b, encode(k)...)
+			b = append(b, encode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// Build returns an IPv6 database that maps each network to its record.
+func Build(recordSize uint, networks map[string]interface{}) []byte {
+	const empty = -1
+	// Records are node indexes, empty, or -2-i for the data of the i-th
+	// network.
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var offsets []int
+	for cidr, record := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		// IPv4 networks are stored as ::a.b.c.d.
+		ip := make(net.IP, net.IPv6len)
+		copy(ip[net.IPv6len-len(n.IP):], n.IP)
+		ones, bits := n.Mask.Size()
+		ones += 128 - bits
+		offsets = append(offsets, len(data))
+		data = append(data, encode(record)...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	count := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == empty:
+			return uint32(count)
+		case r < 0:
+			return uint32(count + dataSectionSeparator + offsets[-2-r])
+		}
+		return uint32(r)
+	}
+	var buf []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>20)&0xf0|byte(r>>24)&0x0f,
+				byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			buf = binary.BigEndian.AppendUint32(buf, l)
+			buf = binary.BigEndian.AppendUint32(buf, r)
+		}
+	}
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	return append(buf, encode(map[string]interface{}{
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"database_type":               "Test",
+		"ip_version":                  uint64(6),
+		"node_count":                  uint64(count),
+		"record_size":                 uint64(recordSize),
+		"build_epoch":                 uint64(1700000000),
+	})...)
+}
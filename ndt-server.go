@@ -1,35 +1,81 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	golog "log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/access/token"
+	"github.com/m-lab/go/anonymize"
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/abuse"
+	"github.com/m-lab/ndt-server/admin"
+	"github.com/m-lab/ndt-server/admission"
+	"github.com/m-lab/ndt-server/certs"
+	"github.com/m-lab/ndt-server/config"
+	"github.com/m-lab/ndt-server/drain"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/flowlimit"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/iplist"
+	"github.com/m-lab/ndt-server/live"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
-	ndt5handler "github.com/m-lab/ndt-server/ndt5/handler"
-	"github.com/m-lab/ndt-server/ndt5/plain"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/mmdb"
+	"github.com/m-lab/ndt-server/ndt5/latency"
+	"github.com/m-lab/ndt-server/ndt5/legacy"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/ndt5/singleserving"
+	"github.com/m-lab/ndt-server/ndt5/ws"
 	"github.com/m-lab/ndt-server/ndt7/handler"
 	"github.com/m-lab/ndt-server/ndt7/listener"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/netx/forwarded"
+	"github.com/m-lab/ndt-server/pcap"
 	"github.com/m-lab/ndt-server/platformx"
+	"github.com/m-lab/ndt-server/privacy"
+	"github.com/m-lab/ndt-server/ratelimit"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/results/bigquery"
+	"github.com/m-lab/ndt-server/results/gcs"
+	"github.com/m-lab/ndt-server/results/kafka"
+	"github.com/m-lab/ndt-server/results/parquet"
+	"github.com/m-lab/ndt-server/results/push"
+	"github.com/m-lab/ndt-server/results/s3"
+	"github.com/m-lab/ndt-server/results/webhook"
+	"github.com/m-lab/ndt-server/retention"
+	"github.com/m-lab/ndt-server/traceroute"
+	"github.com/m-lab/ndt-server/tracing"
 	"github.com/m-lab/ndt-server/version"
 	"github.com/m-lab/tcp-info/eventsocket"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -39,19 +85,105 @@ var (
 	ndt5Addr          = flag.String("ndt5_addr", ":3001", "The address and port to use for the unencrypted ndt5 test")
 	ndt5WsAddr        = flag.String("ndt5_ws_addr", "127.0.0.1:3002", "The address and port to use for the ndt5 WS test")
 	ndt5WssAddr       = flag.String("ndt5_wss_addr", ":3010", "The address and port to use for the ndt5 WSS test")
+	ndt5TLSAddr       = flag.String("ndt5_tls_addr", "", "The address and port to use for raw ndt5 tests over TLS, with the -cert and -key. Empty means no such server")
+	ndt5UDPAddr       = flag.String("ndt5_udp_addr", "", "The UDP address and port to use for the ndt5 latency test. Empty means that the test is not offered")
 	healthAddr        = flag.String("health_addr", "127.0.0.1:8000", "The address and port to use for health checks")
-	certFile          = flag.String("cert", "", "The file with server certificates in PEM format.")
-	keyFile           = flag.String("key", "", "The file with server key in PEM format.")
+	adminAddr         = flag.String("admin.addr", "", "The address and port of the admin API, which lists and cancels running tests, reports the queues, and drains the server. It must not be reachable by clients. Empty means no admin API")
+	adminTokenFile    = flag.String("admin.token-file", "", "A file with the secret that requests to the admin API must present as a bearer token. Required with -admin.addr")
+	eventsSocket      = flag.String("events.socket", "", "The Unix domain socket on which to serve an event, as a line of JSON, when every test opens, closes, and has its result saved, for sidecar services. Empty means no events")
+	tracerouteCommand = flag.String("traceroute.command", "", "The command, e.g. \"scamper -O json -i\", that traces the path toward the client of every test once it is over. The client IP is appended to its arguments, and its output is saved in the datadir. Empty means no traceroutes")
+	tracerouteEvery   = flag.Duration("traceroute.interval", 10*time.Minute, "The minimum time between two traceroutes toward the same client")
+	tracerouteTimeout = flag.Duration("traceroute.timeout", time.Minute, "The maximum duration of a traceroute")
+	pcapInterface     = flag.String("pcap.interface", "", "The network interface on which to capture the packet headers of every test with tcpdump, saved in the datadir. Empty means no captures")
+	pcapTcpdump       = flag.String("pcap.tcpdump", "tcpdump", "The tcpdump binary used by -pcap.interface")
+	pcapSnaplen       = flag.Int("pcap.snaplen", 128, "The number of bytes captured from every packet, enough for the headers")
+	pcapMaxBytes      = flag.Int64("pcap.max-bytes", 10<<20, "The maximum size of the capture of a test. Larger captures are truncated")
+	debug             = flag.Bool("debug", false, "Serve the net/http/pprof profiles under /debug/pprof/ and the expvar variables under /debug/vars on the admin API, and write the stacks of every goroutine to stderr on SIGQUIT instead of exiting")
+	metricsCert       = flag.String("metrics.cert", "", "The file with the certificate in PEM format that the Prometheus metrics server, on -prometheusx.listen-address, uses to serve HTTPS. Empty means plain HTTP")
+	metricsKey        = flag.String("metrics.key", "", "The file with the key of -metrics.cert in PEM format")
+	metricsAuthFile   = flag.String("metrics.basic-auth-file", "", "A file of user:password lines, one of which requests to the Prometheus metrics server must present with HTTP basic auth. Empty means no authentication")
+	certFile          = flag.String("cert", "", "The file with server certificates in PEM format. A comma-separated list serves each client the first certificate valid for the hostname it asks for (SNI), or else the first certificate")
+	keyFile           = flag.String("key", "", "The file with server key in PEM format. A comma-separated list gives the keys of the -cert list, in the same order")
+	autocertHosts     = flag.String("autocert.hostname", "", "Comma-separated hostnames to obtain and renew certificates for with ACME (e.g. Let's Encrypt), instead of using -cert and -key. The ACME challenges are answered on the ndt7 cleartext port, which must be reachable on port 80, or by the TLS servers")
+	autocertCacheDir  = flag.String("autocert.cache-dir", "/var/cache/ndt-server/autocert", "The directory to keep certificates obtained by -autocert.hostname in")
+	autocertEmail     = flag.String("autocert.email", "", "The contact email address given to the ACME certificate authority")
+	certReload        = flag.Duration("cert.reload-interval", time.Minute, "How often to check the -cert and -key files for changes. New certificates are also loaded on SIGHUP")
 	tlsVersion        = flag.String("tls.version", "", "Minimum TLS version. Valid values: 1.2 or 1.3")
+	tlsCipherSuites   = flag.String("tls.cipher-suites", "", "Comma-separated names of the TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the suites Go considers secure are valid. TLS 1.3 suites are not configurable. Empty means the Go defaults")
+	tlsCurves         = flag.String("tls.curves", "", "Comma-separated names of the elliptic curves to use in key exchanges, in order of preference. Valid values: X25519, CurveP256, CurveP384, CurveP521. Empty means the Go defaults")
+	configFile        = flag.String("config", "", "A YAML file that sets flags, e.g. \"results: {writers: file}\" or \"results.writers: file\" for -results.writers=file. Flags given on the command line or in the environment, e.g. NDT_RESULTS_WRITERS, take precedence. On SIGHUP, the rate limits, country and origin policies, and result writers of the file are applied again")
+	configCheck       = flag.Bool("config.check", false, "Validate the flags, including the -config file, and exit without serving, with status 1 if they are invalid")
 	dataDir           = flag.String("datadir", "/var/spool/ndt", "The directory in which to write data files")
 	htmlDir           = flag.String("htmldir", "html", "The directory from which to serve static web content.")
 	compress          = flag.Bool("compress-results", true, "Whether to compress result files")
+	resultWriters     = flag.String("results.writers", "", "Comma-separated list of additional places to save every result. Valid values: file (rotating JSONL archive in the datadir), parquet (rotating Parquet archive in the datadir), stdout, kafka (a topic of the cluster of -results.kafka.brokers), webhook (POSTed to the -results.webhook.urls), statsd and influx (summaries sent to -results.statsd.addr and -results.influx.addr), bigquery (rows streamed into the tables of -results.bigquery.dataset)")
+	kafkaBrokers      = flag.String("results.kafka.brokers", "", "Comma-separated host:port addresses of Kafka brokers, e.g. localhost:9092, of the cluster to which the kafka result writer publishes results")
+	kafkaTopic        = flag.String("results.kafka.topic", "ndt", "The Kafka topic to which the kafka result writer publishes results")
+	statsdAddr        = flag.String("results.statsd.addr", "localhost:8125", "The UDP address of the statsd daemon to which the statsd result writer sends a summary of every test")
+	influxAddr        = flag.String("results.influx.addr", "localhost:8089", "The UDP address of the InfluxDB or Telegraf listener to which the influx result writer sends a summary of every test in line protocol")
+	bigqueryProject   = flag.String("results.bigquery.project", "", "The GCP project of the BigQuery dataset into which the bigquery result writer streams results")
+	bigqueryDataset   = flag.String("results.bigquery.dataset", "", "The BigQuery dataset into which the bigquery result writer streams results, with one table per datatype, e.g. ndt7")
+	webhookURLs       = flag.String("results.webhook.urls", "", "Comma-separated https URLs to which the webhook result writer POSTs every result")
+	webhookSecret     = flag.String("results.webhook.secret-file", "", "A file with the secret with which the webhook result writer signs every result, in the X-Ndt-Signature-256 header")
+	webhookDeadLetter = flag.String("results.webhook.dead-letter", "", "The file to which the webhook result writer appends the results it could not deliver. Empty means webhook-dead-letters.jsonl in the datadir")
+	archiveRotation   = flag.String("results.rotation", "daily", "How often to start a new results archive file. Valid values: hourly or daily")
+	uploadBackend     = flag.String("results.backend", "", "Upload completed results archive files to this object store and remove them locally. Valid values: gcs, s3")
+	uploadBucket      = flag.String("results.bucket", "", "The bucket to upload results archive files to")
+	uploadPrefix      = flag.String("results.prefix", "ndt", "The prefix for the names of uploaded results archive files")
+	queueMaxActive    = flag.Int("ndt5.queue.max-active", 0, "The maximum number of concurrent ndt5 tests. Clients over the limit wait in a queue. Zero means no limit")
+	queueMaxWaiting   = flag.Int("ndt5.queue.max-waiting", 100, "The maximum number of ndt5 clients waiting in the queue. Clients that arrive when the queue is full are told the server is busy")
+	queueTimeout      = flag.Duration("ndt5.queue.timeout", time.Minute, "The maximum time an ndt5 client waits in the queue")
+	flowsMax          = flag.Int("flows.max", -1, "The maximum number of measurement flows, i.e. ndt5 clients and ndt7 subtests, that the server runs at once over every protocol. A negative value derives the limit from -flows.mbps-per-flow and the speed of the network interface of -ndt7_addr, or of the default route if -ndt7_addr listens on every IP. Zero means no limit")
+	flowsMbps         = flag.Float64("flows.mbps-per-flow", 100, "The link capacity, in Mbit/s, to reserve for each flow when -flows.max is derived from the interface speed")
+	flowsPolicy       = flag.String("flows.policy", "queue", "What happens to tests that arrive when -flows.max flows are running. Valid values: queue (wait for a running flow to end), reject (the client is told the server is busy)")
+	flowsTimeout      = flag.Duration("flows.timeout", 30*time.Second, "The maximum time an ndt7 test waits for a flow with -flows.policy=queue. ndt5 clients wait for at most -ndt5.queue.timeout")
+	gracePeriod       = flag.Duration("shutdown.grace-period", 30*time.Second, "How long to wait for running tests to finish when shutting down")
+	rateLimit         = flag.Float64("ndt5.ratelimit.tests-per-hour", 0, "The average number of ndt5 tests a single client IP may start per hour. Zero means no limit")
+	rateLimitBurst    = flag.Int("ndt5.ratelimit.burst", 5, "The number of ndt5 tests a single client IP may start in a row before it is limited")
+	subnetRateLimit   = flag.Float64("ratelimit.subnet.tests-per-hour", 0, "The average number of tests, i.e. ndt5 clients and ndt7 subtests, that the clients of a single subnet may start per hour. Zero means no limit")
+	subnetBurst       = flag.Int("ratelimit.subnet.burst", 20, "The number of tests the clients of a single subnet may start in a row before they are limited")
+	subnetConcurrent  = flag.Int("ratelimit.subnet.max-concurrent", 0, "The maximum number of tests the clients of a single subnet may run at once. Zero means no limit")
+	subnetIPv4Prefix  = flag.Int("ratelimit.subnet.ipv4-prefix", 24, "The prefix length of the IPv4 subnets that the -ratelimit.subnet limits apply to")
+	subnetIPv6Prefix  = flag.Int("ratelimit.subnet.ipv6-prefix", 64, "The prefix length of the IPv6 subnets that the -ratelimit.subnet limits apply to")
+	ipListFile        = flag.String("iplist.file", "", "A file of CIDR ranges to deny or allow, one \"deny CIDR\" or \"allow CIDR\" per line, whose most specific match decides whether a client may connect. Empty means every client is allowed")
+	ipListReload      = flag.Duration("iplist.reload-interval", time.Minute, "How often to check the -iplist.file for changes. The file is also reloaded on SIGHUP")
+	abuseThreshold    = flag.Int("abuse.threshold", 0, "The number of ndt5 control channels a single client IP may open within -abuse.window without completing a test before it is banned from every protocol. Zero means clients are never banned")
+	abuseWindow       = flag.Duration("abuse.window", 10*time.Minute, "The period over which the incomplete tests of a client are counted against -abuse.threshold")
+	abuseCooldown     = flag.Duration("abuse.cooldown", time.Hour, "How long a client exceeding -abuse.threshold stays banned")
+	s3Endpoint        = flag.String("results.s3.endpoint", "https://s3.amazonaws.com", "The base URL of the S3-compatible object store used by -results.backend=s3")
+	s3Region          = flag.String("results.s3.region", "us-east-1", "The region of the bucket used by -results.backend=s3")
+	uploadInterval    = flag.Duration("results.upload-interval", 5*time.Minute, "How often to look for completed results archive files to upload")
+	retentionMaxAge   = flag.Duration("retention.max-age", 0, "How long to keep the results, traceroutes, and packet captures in the datadir, counted from the end of the day they were saved. Older files are removed, whether or not they were uploaded. Zero means files are kept forever")
+	retentionPcap     = flag.Duration("retention.pcap.max-age", 0, "How long to keep packet captures, which are much larger than the other files. Zero means -retention.max-age")
+	retentionTrace    = flag.Duration("retention.traceroute.max-age", 0, "How long to keep traceroutes. Zero means -retention.max-age")
+	retentionCompress = flag.Duration("retention.compress-after", 0, "How long to keep the files in the datadir as they were saved before compressing them with gzip. Zero means files are never compressed")
+	retentionInterval = flag.Duration("retention.interval", time.Hour, "How often to apply the -retention policies to the datadir")
+	geoipDB           = flag.String("geoip.db", "", "A MaxMind GeoLite2 or GeoIP2 City or Country database used to annotate results with the client's location. Empty means no annotation")
+	geoipASNDB        = flag.String("geoip.asn-db", "", "A MaxMind GeoLite2 or GeoIP2 ASN database used to annotate results with the client's network. Empty means no annotation")
+	geoipPrecision    = flag.Int("geoip.precision", 1, "The number of decimal places to keep in client latitudes and longitudes")
+	geoipReload       = flag.Duration("geoip.reload-interval", time.Minute, "How often to check the -geoip.db and -geoip.asn-db files for changes")
+	countriesAllow    = flag.String("geoip.allow-countries", "", "Comma-separated ISO 3166-1 alpha-2 codes of the only countries whose clients may run tests, located with -geoip.db. ZZ stands for clients whose country is unknown. Empty means every country")
+	countriesDeny     = flag.String("geoip.deny-countries", "", "Comma-separated ISO 3166-1 alpha-2 codes of the countries whose clients are told that tests are not offered to them")
+	countriesLow      = flag.String("geoip.deprioritize-countries", "", "Comma-separated ISO 3166-1 alpha-2 codes of the countries whose clients are told the server is busy, instead of waiting, while -flows.max flows are running")
+	logLevel          = flag.String("log.level", "info", "The minimum level of logged messages. Valid values: debug, info, warn, error, fatal")
+	logFormat         = flag.String("log.format", "json", "The format of logged messages. Valid values: json, text")
+	otlpEndpoint      = flag.String("tracing.otlp-endpoint", "", "The OTLP/HTTP traces endpoint of an OpenTelemetry collector, such as http://localhost:4318/v1/traces, to send spans of the ndt5 tests to. Empty means no tracing")
+	asnLabels         = flag.Int("geoip.asn-labels", 50, "The number of distinct client AS numbers to export as metric labels. Tests from other networks share the \"other\" label")
 	deploymentLabels  = flagx.KeyValue{}
 	tokenVerifyKey    = flagx.FileBytesArray{}
 	tokenRequired5    bool
 	tokenRequired7    bool
 	isLameDuck        bool
-	tokenMachine      string
+	// activeTests tracks running ndt7 tests so that they can finish
+	// before the server shuts down.
+	activeTests  = &drain.Tracker{}
+	tokenMachine string
+	// flows limits the measurement flows of every protocol, or is nil if
+	// there is no limit.
+	flows *flowlimit.Limiter
+	// trustedProxies are the reverse proxies allowed to report the client
+	// address of WebSocket-based tests.
+	trustedProxies forwarded.Trusted
 
 	// A metric to use to signal that the server is in lame duck mode.
 	lameDuck = promauto.NewGauge(prometheus.GaugeOpts{
@@ -69,6 +201,7 @@ func init() {
 	flag.BoolVar(&tokenRequired7, "ndt7.token.required", false, "Require access token in NDT7 requests")
 	flag.StringVar(&tokenMachine, "token.machine", "", "Use given machine name to verify token claims")
 	flag.Var(&deploymentLabels, "label", "Labels to identify the type of deployment.")
+	flag.Var(&trustedProxies, "trusted-proxies", "Comma-separated CIDRs of reverse proxies whose Forwarded or X-Forwarded-For headers identify the client of WS and WSS tests. Do not include loopback addresses: the raw ndt5 server forwards WebSocket clients from there")
 }
 
 func catchSigterm() {
@@ -101,26 +234,173 @@ func catchSigterm() {
 }
 
 func init() {
-	log.SetFlags(log.LUTC | log.LstdFlags | log.Lshortfile)
+	golog.SetFlags(golog.LUTC | golog.LstdFlags | golog.Lshortfile)
 }
 
-// httpServer creates a new *http.Server with explicit Read and Write timeouts.
-func httpServer(addr string, handler http.Handler) *http.Server {
-	tlsconf := &tls.Config{}
+// tlsConfig returns the TLS configuration selected by the -tls.version,
+// -tls.cipher-suites and -tls.curves flags. Every handshake of a server using
+// it is counted by negotiated version.
+func tlsConfig() *tls.Config {
+	config := &tls.Config{
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			metrics.TLSHandshakes.WithLabelValues(tlsVersionName(cs.Version)).Inc()
+			return nil
+		},
+	}
 	switch *tlsVersion {
 	case "1.3":
-		tlsconf = &tls.Config{
-			MinVersion: tls.VersionTLS13,
-		}
+		config.MinVersion = tls.VersionTLS13
 	case "1.2":
-		tlsconf = &tls.Config{
-			MinVersion: tls.VersionTLS12,
+		config.MinVersion = tls.VersionTLS12
+	}
+	var err error
+	config.CipherSuites, err = parseCipherSuites(*tlsCipherSuites)
+	rtx.Must(err, "Invalid -tls.cipher-suites")
+	config.CurvePreferences, err = parseCurves(*tlsCurves)
+	rtx.Must(err, "Invalid -tls.curves")
+	return config
+}
+
+// parseCipherSuites returns the IDs of the comma-separated cipher suite names
+// in s, or nil if s is empty.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := uint16(0), false
+		for _, cs := range tls.CipherSuites() {
+			if cs.Name == name {
+				id, ok = cs.ID, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
 		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseCurves returns the IDs of the comma-separated curve names in s, or nil
+// if s is empty.
+func parseCurves(s string) ([]tls.CurveID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []tls.CurveID
+	for _, name := range strings.Split(s, ",") {
+		id, ok := tls.CurveID(0), false
+		for _, c := range []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521} {
+			if c.String() == name {
+				id, ok = c, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsVersionName returns the TLSHandshakes label of version.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return "unknown"
+}
+
+// newAutocert returns a Manager that obtains the certificates of the
+// -autocert.hostname hosts, or nil if certificates come from files.
+func newAutocert() *autocert.Manager {
+	if *autocertHosts == "" {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(*autocertHosts, ",")...),
+		Cache:      autocert.DirCache(*autocertCacheDir),
+		Email:      *autocertEmail,
+	}
+}
+
+// serverTLSConfig returns the configuration of the TLS servers, which serves
+// the certificates of m, or else those in the -cert and -key files, which are
+// reloaded when they change until ctx is done. It returns nil if no
+// certificates are configured.
+func serverTLSConfig(ctx context.Context, m *autocert.Manager) *tls.Config {
+	config := tlsConfig()
+	switch {
+	case m != nil:
+		config.GetCertificate = m.GetCertificate
+		// Answer TLS-ALPN-01 challenges.
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	case *certFile != "" && *keyFile != "":
+		set, err := certs.OpenSet(strings.Split(*certFile, ","), strings.Split(*keyFile, ","))
+		rtx.Must(err, "Could not load -cert and -key")
+		go set.Watch(ctx, *certReload)
+		go reloadOnSIGHUP(ctx, "certificates", set.Load)
+		config.GetCertificate = set.GetCertificate
+	default:
+		return nil
 	}
+	return config
+}
+
+// reloadOnSIGHUP calls load whenever the process receives SIGHUP, until ctx
+// is done. The what names the reloaded files in logs.
+func reloadOnSIGHUP(ctx context.Context, what string, load func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if err := load(); err != nil {
+				logging.Logger.WithError(err).Warn("Could not reload " + what + " on SIGHUP")
+			} else {
+				logging.Logger.Info("Reloaded " + what + " on SIGHUP")
+			}
+		}
+	}
+}
+
+// dumpGoroutinesOnSIGQUIT writes the stacks of every goroutine to stderr
+// whenever the process receives SIGQUIT, until ctx is done. Unlike the default
+// handling of SIGQUIT, the process keeps running.
+func dumpGoroutinesOnSIGQUIT(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGQUIT)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			logging.Logger.Info("Dumping goroutines on SIGQUIT")
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+		}
+	}
+}
+
+// httpServer creates a new *http.Server with explicit Read and Write timeouts.
+func httpServer(addr string, handler http.Handler) *http.Server {
 	return &http.Server{
 		Addr:      addr,
 		Handler:   handler,
-		TLSConfig: tlsconf,
+		TLSConfig: tlsConfig(),
 		// NOTE: set absolute read and write timeouts for server connections.
 		// This prevents clients, or middleboxes, from opening a connection and
 		// holding it open indefinitely. This applies equally to TLS and non-TLS
@@ -160,6 +440,17 @@ func setLameDuck(status float64) {
 	lameDuck.Set(status)
 }
 
+// Handle requests to the /ready endpoint.
+// Writes out a 200 status code only if the server is neither in lame duck mode,
+// draining tests to shut down, nor running as many flows as it can.
+func handleReady(rw http.ResponseWriter, req *http.Request) {
+	if isLameDuck || activeTests.Draining() || flows.Saturated() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
 // Handle requests to the /health endpoint.
 // Writes out a 200 status code only if the server is not in lame duck mode.
 func handleHealth(rw http.ResponseWriter, req *http.Request) {
@@ -170,16 +461,581 @@ func handleHealth(rw http.ResponseWriter, req *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 }
 
+// Handle requests to the /healthz endpoint.
+// Writes out a 200 status code as long as the process serves requests.
+func handleHealthz(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
+
+// Handle requests to the /readyz endpoint.
+// Writes out a 200 status code only if the server accepts new tests, is not
+// running as many flows as it can, and can write results to the data
+// directory. Otherwise, the body lists the reasons why it is not ready.
+func handleReadyz(rw http.ResponseWriter, req *http.Request) {
+	reasons := []string{}
+	if isLameDuck || activeTests.Draining() {
+		reasons = append(reasons, "not accepting new tests")
+	}
+	if flows.Saturated() {
+		reasons = append(reasons, "running as many flows as it can")
+	}
+	if err := checkWritable(*dataDir); err != nil {
+		reasons = append(reasons, "data directory is not writable: "+err.Error())
+	}
+	if len(reasons) > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rw, strings.Join(reasons, "\n"))
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// checkWritable returns an error unless a file can be created in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Handle requests to the /version endpoint.
+// Writes out the version, commit, build time, and Go version of the server as
+// JSON.
+func handleVersion(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(version.Get())
+}
+
+// newResultWriter returns a results.Writer for all of the writers named by the
+// -results.writers flag, whose background work stops when ctx is done.
+func newResultWriter(ctx context.Context) (results.Writer, error) {
+	writers := []results.Writer{}
+	fail := func(err error, format string, args ...interface{}) (results.Writer, error) {
+		results.NewMultiWriter(writers...).Close()
+		return nil, fmt.Errorf(format+": %w", append(args, err)...)
+	}
+	for _, name := range strings.Split(*resultWriters, ",") {
+		switch name {
+		case "":
+			continue
+		case "file":
+			rotation, err := results.ParseRotation(*archiveRotation)
+			if err != nil {
+				return fail(err, "invalid -results.rotation")
+			}
+			archive, err := results.NewArchive(*dataDir, rotation, *compress)
+			if err != nil {
+				return fail(err, "could not create results archive")
+			}
+			go archive.Run(ctx)
+			writers = append(writers, archive)
+		case "parquet":
+			rotation, err := results.ParseRotation(*archiveRotation)
+			if err != nil {
+				return fail(err, "invalid -results.rotation")
+			}
+			archive, err := parquet.New(*dataDir, rotation, *compress)
+			if err != nil {
+				return fail(err, "could not create Parquet results archive")
+			}
+			go archive.Run(ctx)
+			writers = append(writers, archive)
+		case "stdout":
+			writers = append(writers, results.NewJSONWriter(os.Stdout))
+		case "kafka":
+			var brokers []string
+			if *kafkaBrokers != "" {
+				brokers = strings.Split(*kafkaBrokers, ",")
+			}
+			publisher, err := kafka.New(brokers, *kafkaTopic)
+			if err != nil {
+				return fail(err, "invalid -results.kafka.brokers or -results.kafka.topic")
+			}
+			go publisher.Run(ctx)
+			writers = append(writers, publisher)
+		case "statsd":
+			w, err := push.New(push.StatsD, *statsdAddr)
+			if err != nil {
+				return fail(err, "invalid -results.statsd.addr")
+			}
+			writers = append(writers, w)
+		case "influx":
+			w, err := push.New(push.Influx, *influxAddr)
+			if err != nil {
+				return fail(err, "invalid -results.influx.addr")
+			}
+			writers = append(writers, w)
+		case "bigquery":
+			inserter, err := bigquery.New(*bigqueryProject, *bigqueryDataset)
+			if err != nil {
+				return fail(err, "invalid -results.bigquery.project or -results.bigquery.dataset")
+			}
+			go inserter.Run(ctx)
+			writers = append(writers, inserter)
+		case "webhook":
+			sender, err := newWebhookSender()
+			if err != nil {
+				return fail(err, "invalid -results.webhook flags")
+			}
+			go sender.Run(ctx)
+			writers = append(writers, sender)
+		default:
+			return fail(errors.New("unknown writer"), "invalid %q in -results.writers", name)
+		}
+	}
+	return results.NewMultiWriter(writers...), nil
+}
+
+// newWebhookSender returns a Sender for the -results.webhook flags.
+func newWebhookSender() (*webhook.Sender, error) {
+	if *webhookSecret == "" {
+		return nil, errors.New("the webhook result writer requires -results.webhook.secret-file")
+	}
+	secret, err := os.ReadFile(*webhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	deadLetter := *webhookDeadLetter
+	if deadLetter == "" {
+		deadLetter = filepath.Join(*dataDir, "webhook-dead-letters.jsonl")
+	}
+	var urls []string
+	if *webhookURLs != "" {
+		urls = strings.Split(*webhookURLs, ",")
+	}
+	return webhook.New(urls, bytes.TrimSpace(secret), deadLetter)
+}
+
+// newUploader returns an Uploader for the object store named by the
+// -results.backend flag, or nil if uploads are disabled.
+func newUploader() *results.Uploader {
+	if *uploadBackend == "" {
+		return nil
+	}
+	if !strings.Contains(","+*resultWriters+",", ",file,") {
+		golog.Fatal("-results.backend requires the file writer in -results.writers")
+	}
+	if *uploadBucket == "" {
+		golog.Fatal("-results.backend requires -results.bucket")
+	}
+	var bucket results.Bucket
+	switch *uploadBackend {
+	case "gcs":
+		bucket = gcs.New(*uploadBucket)
+	case "s3":
+		creds, err := s3.CredentialsFromEnv()
+		rtx.Must(err, "Could not read S3 credentials")
+		bucket, err = s3.New(*s3Endpoint, *s3Region, *uploadBucket, creds)
+		rtx.Must(err, "Could not create S3 bucket")
+	default:
+		golog.Fatalf("Unknown -results.backend %q", *uploadBackend)
+	}
+	rotation, err := results.ParseRotation(*archiveRotation)
+	rtx.Must(err, "Invalid -results.rotation")
+	node := tokenMachine
+	if node == "" {
+		node, err = os.Hostname()
+		rtx.Must(err, "Could not get hostname")
+	}
+	return &results.Uploader{
+		Bucket:   bucket,
+		DataDir:  *dataDir,
+		Rotation: rotation,
+		Prefix:   *uploadPrefix,
+		Node:     node,
+		Interval: *uploadInterval,
+		Attempts: 5,
+		Backoff:  time.Second,
+	}
+}
+
+// newCleaner returns a Cleaner for the -retention policies, or nil if files are
+// kept forever as they were saved.
+func newCleaner() *retention.Cleaner {
+	if *retentionMaxAge == 0 && *retentionPcap == 0 && *retentionTrace == 0 && *retentionCompress == 0 {
+		return nil
+	}
+	policy := retention.Policy{MaxAge: *retentionMaxAge, CompressAfter: *retentionCompress}
+	kinds := map[string]retention.Policy{}
+	if *retentionPcap != 0 {
+		kinds["pcap"] = retention.Policy{MaxAge: *retentionPcap, CompressAfter: *retentionCompress}
+	}
+	if *retentionTrace != 0 {
+		kinds["traceroute"] = retention.Policy{MaxAge: *retentionTrace, CompressAfter: *retentionCompress}
+	}
+	return &retention.Cleaner{
+		DataDir:  *dataDir,
+		Default:  policy,
+		Kinds:    kinds,
+		Interval: *retentionInterval,
+	}
+}
+
+// newLocator returns a Locator for the -geoip.db and -geoip.asn-db databases,
+// which are reloaded whenever they change until ctx is done, with the country
+// policy, or nil if results are not annotated.
+func newLocator(ctx context.Context, policy *geoip.Policy) *geoip.Locator {
+	if *geoipDB == "" && *geoipASNDB == "" {
+		return nil
+	}
+	open := func(path, name string) *mmdb.DB {
+		if path == "" {
+			return nil
+		}
+		db, err := mmdb.Open(path)
+		rtx.Must(err, "Could not open -%s", name)
+		go db.Watch(ctx, *geoipReload)
+		return db
+	}
+	return geoip.New(open(*geoipDB, "geoip.db"), open(*geoipASNDB, "geoip.asn-db"), *geoipPrecision).
+		WithPolicy(policy)
+}
+
+// newCountryPolicy returns the Policy of the -geoip country flags, or nil if
+// clients of every country are admitted. With a -config file, the flags may be
+// reloaded, so there is a Policy whenever there is a -geoip.db.
+func newCountryPolicy() *geoip.Policy {
+	if *countriesAllow == "" && *countriesDeny == "" && *countriesLow == "" && (*configFile == "" || *geoipDB == "") {
+		return nil
+	}
+	if *geoipDB == "" {
+		golog.Fatal("The -geoip country policy flags require -geoip.db")
+	}
+	// The limiter is created later, so it is looked up when needed.
+	busy := func() bool { return flows.Saturated() }
+	return geoip.NewPolicy(commaList(*countriesAllow), commaList(*countriesDeny), commaList(*countriesLow), busy)
+}
+
+// commaList returns the items of the comma-separated list s.
+func commaList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// readAdminToken returns the secret in the -admin.token-file.
+func readAdminToken() string {
+	if *adminTokenFile == "" {
+		golog.Fatal("-admin.addr requires -admin.token-file")
+	}
+	b, err := os.ReadFile(*adminTokenFile)
+	rtx.Must(err, "Could not read -admin.token-file")
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		golog.Fatalf("%s is empty", *adminTokenFile)
+	}
+	return token
+}
+
+// readMetricsUsers returns the passwords of the users in the
+// -metrics.basic-auth-file, or nil if there is none.
+func readMetricsUsers() map[string]string {
+	if *metricsAuthFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*metricsAuthFile)
+	rtx.Must(err, "Could not read -metrics.basic-auth-file")
+	users := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			golog.Fatalf("%s: want user:password, got %q", *metricsAuthFile, line)
+		}
+		users[user] = password
+	}
+	if len(users) == 0 {
+		golog.Fatalf("%s is empty", *metricsAuthFile)
+	}
+	return users
+}
+
+// basicAuth wraps next so that requests without the password of one of the
+// users are answered with 401 Unauthorized.
+func basicAuth(next http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		want, known := users[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mustServeMetrics starts the Prometheus metrics server on
+// -prometheusx.listen-address. With -metrics.cert or -metrics.basic-auth-file,
+// it serves only /metrics, over HTTPS with a certificate that is reloaded until
+// ctx is done, and to authenticated users.
+func mustServeMetrics(ctx context.Context) *http.Server {
+	if *metricsCert == "" && *metricsKey == "" && *metricsAuthFile == "" {
+		return prometheusx.MustServeMetrics()
+	}
+	var handler http.Handler = promhttp.Handler()
+	if users := readMetricsUsers(); users != nil {
+		handler = basicAuth(handler, users)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	srv := httpServer(*prometheusx.ListenAddress, mux)
+	if *metricsCert == "" && *metricsKey == "" {
+		rtx.Must(listener.ListenAndServeAsync(srv), "Could not start metrics server")
+		return srv
+	}
+	pair, err := certs.Open(*metricsCert, *metricsKey)
+	rtx.Must(err, "Could not load -metrics.cert and -metrics.key")
+	go pair.Watch(ctx, *certReload)
+	go reloadOnSIGHUP(ctx, "metrics certificate", pair.Load)
+	srv.TLSConfig.GetCertificate = pair.GetCertificate
+	rtx.Must(listener.ListenAndServeTLSAsync(srv, "", ""), "Could not start metrics server")
+	return srv
+}
+
+// newIPList returns the List in the -iplist.file, which is reloaded whenever it
+// changes or the process receives SIGHUP until ctx is done, or nil if every
+// client is allowed.
+func newIPList(ctx context.Context) *iplist.List {
+	if *ipListFile == "" {
+		return nil
+	}
+	l, err := iplist.Open(*ipListFile)
+	rtx.Must(err, "Could not read -iplist.file")
+	go l.Watch(ctx, *ipListReload)
+	go reloadOnSIGHUP(ctx, "IP list", l.Load)
+	return l
+}
+
+// newFlowLimiter returns a Limiter for the -flows flags, or nil if flows are
+// not limited.
+func newFlowLimiter() *flowlimit.Limiter {
+	policy, err := flowlimit.ParsePolicy(*flowsPolicy)
+	rtx.Must(err, "Invalid -flows.policy")
+	max := *flowsMax
+	if max < 0 {
+		iface, err := flowlimit.Interface(*ndt7Addr, "/proc/net/route")
+		if err != nil {
+			logging.Logger.WithError(err).Warn("Could not find the interface to derive -flows.max from, flows are not limited")
+			return nil
+		}
+		speed, err := flowlimit.LinkSpeed("/sys/class/net", iface)
+		if err != nil {
+			logging.Logger.WithError(err).WithField("interface", iface).Warn("Could not derive -flows.max from the interface speed, flows are not limited")
+			return nil
+		}
+		max = int(float64(speed) / *flowsMbps)
+		if max < 1 {
+			max = 1
+		}
+		logging.Logger.WithFields(log.Fields{"interface": iface, "mbps": speed, "flows": max}).Info("Derived -flows.max from the interface speed")
+	}
+	if max == 0 {
+		return nil
+	}
+	return flowlimit.New(max, policy, *flowsTimeout)
+}
+
+// reloadableFlags are the flags of the -config file that are applied again on
+// SIGHUP. The IP list is reloaded from its file whether or not there is a
+// config file.
+var reloadableFlags = []string{
+	"ndt5.ratelimit.tests-per-hour",
+	"ndt5.ratelimit.burst",
+	"ratelimit.subnet.tests-per-hour",
+	"ratelimit.subnet.burst",
+	"ratelimit.subnet.max-concurrent",
+	"geoip.allow-countries",
+	"geoip.deny-countries",
+	"geoip.deprioritize-countries",
+	"ndt5.ws.allowed-origins",
+	"results.writers",
+	"results.kafka.brokers",
+	"results.kafka.topic",
+	"results.statsd.addr",
+	"results.influx.addr",
+	"results.bigquery.project",
+	"results.bigquery.dataset",
+	"results.webhook.urls",
+	"results.webhook.secret-file",
+	"results.webhook.dead-letter",
+}
+
+// runtimePolicy is what the reloadable flags configure while the server runs.
+type runtimePolicy struct {
+	reloader    *config.Reloader
+	ndt5Rate    *ratelimit.Limiter
+	subnetRate  *ratelimit.Limiter
+	subnetTests *ratelimit.Concurrency
+	countries   *geoip.Policy
+	writers     *results.Swappable
+	stopWriters context.CancelFunc
+}
+
+// reload applies the reloadable flags of the -config file again, and logs the
+// flags that changed. Running tests keep the limits they were admitted with,
+// and the results of tests that end during a reload are saved by either the
+// old or the new result writers. If the new flags are invalid, the old ones
+// are kept.
+func (p *runtimePolicy) reload() error {
+	changes, restart, err := p.reloader.Reload()
+	if err != nil {
+		return err
+	}
+	for _, name := range restart {
+		logging.Logger.WithField("flag", name).Warn("Ignored the change of a -config flag that requires a restart")
+	}
+	if err := validateFlags(); err != nil {
+		p.reloader.Revert(changes)
+		return err
+	}
+	rewrite := false
+	for _, c := range changes {
+		logging.Logger.WithFields(log.Fields{"flag": c.Name, "old": c.Old, "new": c.New}).Info("Reloaded flag")
+		rewrite = rewrite || strings.HasPrefix(c.Name, "results.")
+	}
+	if rewrite {
+		writersCtx, stop := context.WithCancel(ctx)
+		w, err := newResultWriter(writersCtx)
+		if err != nil {
+			stop()
+			p.reloader.Revert(changes)
+			return err
+		}
+		if err := p.writers.Swap(w).Close(); err != nil {
+			logging.Logger.WithError(err).Warn("Could not close the old result writers")
+		}
+		p.stopWriters()
+		p.stopWriters = stop
+	}
+	p.ndt5Rate.SetLimits(*rateLimit, *rateLimitBurst)
+	p.subnetRate.SetLimits(*subnetRateLimit, *subnetBurst)
+	p.subnetTests.SetMax(*subnetConcurrent)
+	p.countries.Set(commaList(*countriesAllow), commaList(*countriesDeny), commaList(*countriesLow))
+	ws.LoadAllowedOrigins()
+	return nil
+}
+
+// validateFlags checks the values of the flags that can be checked before
+// anything is served, and returns every problem it finds.
+func validateFlags() error {
+	var errs []error
+	check := func(err error, name string) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -%s: %w", name, err))
+		}
+	}
+	oneOf := func(name, value string, valid ...string) {
+		for _, v := range valid {
+			if value == v {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("invalid -%s %q, valid values: %s", name, value, strings.Join(valid, ", ")))
+	}
+	readable := func(name, paths string) {
+		for _, p := range strings.Split(paths, ",") {
+			if p == "" {
+				continue
+			}
+			f, err := os.Open(p)
+			check(err, name)
+			if err == nil {
+				f.Close()
+			}
+		}
+	}
+	oneOf("log.format", *logFormat, "json", "text")
+	_, err := log.ParseLevel(*logLevel)
+	check(err, "log.level")
+	oneOf("tls.version", *tlsVersion, "", "1.2", "1.3")
+	_, err = parseCipherSuites(*tlsCipherSuites)
+	check(err, "tls.cipher-suites")
+	_, err = parseCurves(*tlsCurves)
+	check(err, "tls.curves")
+	if *certFile != "" || *keyFile != "" {
+		_, err = certs.OpenSet(strings.Split(*certFile, ","), strings.Split(*keyFile, ","))
+		check(err, "cert or -key")
+	}
+	_, err = flowlimit.ParsePolicy(*flowsPolicy)
+	check(err, "flows.policy")
+	_, err = results.ParseRotation(*archiveRotation)
+	check(err, "results.rotation")
+	if err := latency.CheckFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, name := range strings.Split(*resultWriters, ",") {
+		oneOf("results.writers", name, "", "file", "parquet", "stdout", "kafka", "statsd", "influx", "bigquery", "webhook")
+	}
+	oneOf("results.backend", *uploadBackend, "", "gcs", "s3")
+	if *uploadBackend != "" && *uploadBucket == "" {
+		errs = append(errs, errors.New("-results.backend requires -results.bucket"))
+	}
+	if *adminAddr != "" && *adminTokenFile == "" {
+		errs = append(errs, errors.New("-admin.addr requires -admin.token-file"))
+	}
+	if (*countriesAllow != "" || *countriesDeny != "" || *countriesLow != "") && *geoipDB == "" {
+		errs = append(errs, errors.New("the -geoip country policy flags require -geoip.db"))
+	}
+	readable("admin.token-file", *adminTokenFile)
+	readable("metrics.basic-auth-file", *metricsAuthFile)
+	readable("geoip.db", *geoipDB)
+	readable("geoip.asn-db", *geoipASNDB)
+	readable("iplist.file", *ipListFile)
+	readable("results.webhook.secret-file", *webhookSecret)
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"retention.max-age", *retentionMaxAge},
+		{"retention.pcap.max-age", *retentionPcap},
+		{"retention.traceroute.max-age", *retentionTrace},
+		{"retention.compress-after", *retentionCompress},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("invalid -%s %v, it must not be negative", d.name, d.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func main() {
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env args")
+	rtx.Must(config.FromEnv(flag.CommandLine), "Could not parse "+config.EnvPrefix+" environment variables")
+	if *configFile != "" {
+		rtx.Must(config.Load(flag.CommandLine, *configFile), "Invalid -config file")
+	}
+	if err := validateFlags(); err != nil || *configCheck {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("The configuration is valid")
+		os.Exit(0)
+	}
+	ws.LoadAllowedOrigins()
+	rtx.Must(logging.Configure(*logLevel, *logFormat), "Invalid -log.level or -log.format")
+	privacy.Configure(anonymize.IPAnonymizationFlag)
+	if privacy.Enabled() && (*tracerouteCommand != "" || *pcapInterface != "") {
+		golog.Fatal("-traceroute.command and -pcap.interface save full client IPs, so they can't be used with -anonymize.ip")
+	}
 
 	serverMetadata := parseDeploymentLabels()
 
 	// TODO: Decide if signal handling is the right approach here.
 	go catchSigterm()
+	if *debug {
+		go dumpGoroutinesOnSIGQUIT(ctx)
+	}
 
-	promSrv := prometheusx.MustServeMetrics()
+	promSrv := mustServeMetrics(ctx)
 	defer promSrv.Close()
 
 	platformx.WarnIfNotFullySupported()
@@ -203,7 +1059,8 @@ func main() {
 	go eventSrv.Serve(ctx)
 
 	// Enforce tokens and tx controllers on the same ndt5 resource.
-	// NOTE: raw ndt5 requests cannot honor tokens or differentiate between upload/downloads.
+	// NOTE: raw ndt5 requests cannot differentiate between upload/downloads,
+	// and their tokens are checked by ndt5Tokens during the login instead.
 	ndt5Paths := controller.Paths{
 		"/ndt_protocol": true,
 	}
@@ -220,27 +1077,164 @@ func main() {
 	ac5, tx5 := controller.Setup(ctx, v, tokenRequired5, tokenMachine, ndt5Paths, ndt5Paths)
 	ac7, _ := controller.Setup(ctx, v, tokenRequired7, tokenMachine, ndt7TxPaths, ndt7TokenPaths)
 
+	// Optionally announce every test to sidecar services.
+	var testEvents *events.Server
+	if *eventsSocket != "" {
+		testEvents = events.New(*eventsSocket)
+		rtx.Must(testEvents.Listen(), "Could not listen on", *eventsSocket)
+		go testEvents.Serve(ctx)
+	}
+
+	// Optionally save all results in more places than the per-test files.
+	// The writers are replaced when their flags are reloaded.
+	writersCtx, stopWriters := context.WithCancel(ctx)
+	w, err := newResultWriter(writersCtx)
+	rtx.Must(err, "Could not create the result writers")
+	defer stopWriters()
+	writers := results.NewSwappable(w)
+	var resultWriter results.Writer = writers
+	if testEvents != nil {
+		resultWriter = results.NewMultiWriter(resultWriter, testEvents.Results())
+	}
+	defer resultWriter.Close()
+	if uploader := newUploader(); uploader != nil {
+		go uploader.Run(ctx)
+	}
+	if cleaner := newCleaner(); cleaner != nil {
+		go cleaner.Run(ctx)
+	}
+	if *otlpEndpoint != "" {
+		tp, err := tracing.NewProvider(ctx, *otlpEndpoint, "ndt-server")
+		rtx.Must(err, "Could not create the tracer provider of -tracing.otlp-endpoint")
+		defer func() {
+			// Send the spans of the drained tests that are still batched.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(shutdownCtx); err != nil {
+				logging.Logger.WithError(err).Warn("Could not send the last spans")
+			}
+		}()
+		otel.SetTracerProvider(tp)
+		// Tests join the trace of the traceparent header of ndt5 WebSocket clients.
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	}
+	metrics.MaxASNLabels = *asnLabels
+	countries := newCountryPolicy()
+	locator := newLocator(ctx, countries)
+
 	// The ndt5 protocol serving non-HTTP-based tests - forwards to Ws-based
 	// server if the first three bytes are "GET".
-	ndt5Server := plain.NewServer(*dataDir+"/ndt5", *ndt5WsAddr, serverMetadata)
-	rtx.Must(
-		ndt5Server.ListenAndServe(ctx, *ndt5Addr, tx5),
-		"Could not start raw server")
-
-	// The ndt5 protocol serving Ws-based tests. Most clients are hard-coded to
-	// connect to the raw server, which will forward things along.
-	ndt5WsMux := http.NewServeMux()
-	ndt5WsMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
-	ndt5WsMux.Handle("/ndt_protocol", ndt5handler.NewWS(*dataDir+"/ndt5", serverMetadata))
-	ndt5WsServer := httpServer(
-		*ndt5WsAddr,
-		// NOTE: do not use `ac.Then()` to prevent 'double jeopardy' for
-		// forwarded clients when txcontroller is enabled.
-		logging.MakeAccessLogHandler(ndt5WsMux),
-	)
-	log.Println("About to listen for unencrypted ndt5 NDT tests on " + *ndt5WsAddr)
-	rtx.Must(listener.ListenAndServeAsync(ndt5WsServer), "Could not start unencrypted ndt5 NDT server")
-	defer ndt5WsServer.Close()
+	// All protocols share a single limit on the number of flows.
+	flows = newFlowLimiter()
+	// All protocols share the same IP list.
+	ipList := newIPList(ctx)
+	// All protocols register their running tests for the admin API, the
+	// event socket, the traceroutes, and the packet captures.
+	var running *live.Registry
+	var adminToken string
+	if *adminAddr != "" {
+		adminToken = readAdminToken()
+	}
+	if *adminAddr != "" || testEvents != nil || *tracerouteCommand != "" || *pcapInterface != "" {
+		running = live.NewRegistry()
+	}
+	if testEvents != nil {
+		running.WithObserver(testEvents)
+	}
+	if *tracerouteCommand != "" {
+		tracer := traceroute.New(ctx, *dataDir, strings.Fields(*tracerouteCommand), *tracerouteEvery, *tracerouteTimeout)
+		running.WithObserver(tracer)
+	}
+	if *pcapInterface != "" {
+		capturer := pcap.New(ctx, *dataDir, *pcapTcpdump, *pcapInterface, *pcapSnaplen, *pcapMaxBytes)
+		running.WithObserver(capturer)
+	}
+	// All protocols share the same abuse bans.
+	var bans *abuse.Detector
+	if *abuseThreshold > 0 {
+		bans = abuse.New(*abuseThreshold, *abuseWindow, *abuseCooldown)
+	}
+	// All protocols share the same limits on the tests of each subnet.
+	subnets := ratelimit.Subnets{IPv4: *subnetIPv4Prefix, IPv6: *subnetIPv6Prefix}
+	// With a -config file, the limits may be reloaded, so the limiters exist
+	// even when there are no limits yet.
+	var subnetRate *ratelimit.Limiter
+	if *subnetRateLimit > 0 || *configFile != "" {
+		subnetRate = ratelimit.New(*subnetRateLimit, *subnetBurst).WithSubnets(subnets)
+	}
+	var subnetTests *ratelimit.Concurrency
+	if *subnetConcurrent > 0 || *configFile != "" {
+		subnetTests = ratelimit.NewConcurrency(*subnetConcurrent, subnets)
+	}
+	// All ndt5 servers share a single queue.
+	var ndt5Queue *queue.Queue
+	// The admin API drains ndt5 tests with the queue.
+	if *queueMaxActive > 0 || flows != nil || subnetRate != nil || subnetTests != nil || *adminAddr != "" {
+		maxActive := *queueMaxActive
+		if maxActive == 0 {
+			// Only the server-wide and per-subnet limits, and draining,
+			// apply.
+			maxActive = math.MaxInt
+		}
+		ndt5Queue = queue.New(maxActive, *queueMaxWaiting, *queueTimeout).
+			WithLimiter(flows).
+			WithSubnetLimits(subnetRate, subnetTests)
+	}
+	// All ndt5 servers share a single per-client rate limit.
+	var ndt5Limiter *ratelimit.Limiter
+	if *rateLimit > 0 || *configFile != "" {
+		ndt5Limiter = ratelimit.New(*rateLimit, *rateLimitBurst)
+	}
+	// With a -config file, SIGHUP applies its limits, country and origin
+	// policies, and result writers again.
+	if *configFile != "" {
+		reloader, err := config.NewReloader(flag.CommandLine, *configFile, reloadableFlags...)
+		rtx.Must(err, "Could not read -config")
+		policy := &runtimePolicy{
+			reloader:    reloader,
+			ndt5Rate:    ndt5Limiter,
+			subnetRate:  subnetRate,
+			subnetTests: subnetTests,
+			countries:   countries,
+			writers:     writers,
+			stopWriters: stopWriters,
+		}
+		go reloadOnSIGHUP(ctx, "runtime policy", policy.reload)
+	}
+	// All ndt5 servers check access tokens, including the client IP they
+	// were issued to, when tokens are required.
+	var ndt5Tokens *admission.Checker
+	if tokenRequired5 {
+		ndt5Tokens = admission.New(v, tokenMachine)
+	}
+	ndt5Opts := []legacy.Option{
+		legacy.WithDataDir(*dataDir + "/ndt5"),
+		legacy.WithHTMLDir(*htmlDir),
+		legacy.WithMetadata(serverMetadata),
+		legacy.WithRawAddr(*ndt5Addr),
+		legacy.WithWSAddr(*ndt5WsAddr),
+		legacy.WithWSSAddr(*ndt5WssAddr),
+		legacy.WithRawTLSAddr(*ndt5TLSAddr),
+		legacy.WithLatencyAddr(*ndt5UDPAddr),
+		legacy.WithResultWriter(resultWriter),
+		legacy.WithLocator(locator),
+		legacy.WithQueue(ndt5Queue),
+		legacy.WithRateLimiter(ndt5Limiter),
+		legacy.WithIPList(ipList),
+		legacy.WithAbuseDetector(bans),
+		legacy.WithRegistry(running),
+		legacy.WithTokens(ndt5Tokens),
+		legacy.WithAccessControl(tx5, ac5.Then),
+		legacy.WithTrustedProxies(trustedProxies),
+	}
+	certManager := newAutocert()
+	serverTLS := serverTLSConfig(ctx, certManager)
+	if serverTLS != nil {
+		ndt5Opts = append(ndt5Opts, legacy.WithTLSConfig(serverTLS))
+	}
+	ndt5Server := legacy.NewServer(ndt5Opts...)
+	rtx.Must(singleserving.EnableECN(), "Could not enable ECN for -ndt5.socket.ecn")
+	rtx.Must(ndt5Server.ListenAndServe(ctx), "Could not start ndt5 servers")
 
 	// The ndt7 listener serving up NDT7 tests, likely on standard ports.
 	ndt7Mux := http.NewServeMux()
@@ -252,46 +1246,48 @@ func main() {
 		ServerMetadata:  serverMetadata,
 		CompressResults: *compress,
 		Events:          eventSrv,
+		Results:         resultWriter,
+		Locator:         locator,
+		Running:         running,
 	}
-	ndt7Mux.Handle(spec.DownloadURLPath, http.HandlerFunc(ndt7Handler.Download))
-	ndt7Mux.Handle(spec.UploadURLPath, http.HandlerFunc(ndt7Handler.Upload))
-	ndt7ServerCleartext := httpServer(
-		*ndt7AddrCleartext,
-		ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
-	)
-	log.Println("About to listen for ndt7 cleartext tests on " + *ndt7AddrCleartext)
+	limit7 := func(h http.HandlerFunc) http.Handler {
+		return activeTests.Then(ipList.Then(bans.Then(subnetRate.Then(subnetTests.Then(flows.Then(h, "ndt7"), "ndt7", nil), "ndt7", nil), "ndt7", nil), "ndt7", nil))
+	}
+	ndt7Mux.Handle(spec.DownloadURLPath, limit7(ndt7Handler.Download))
+	ndt7Mux.Handle(spec.UploadURLPath, limit7(ndt7Handler.Upload))
+	var ndt7CleartextHandler http.Handler = trustedProxies.Then(ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)))
+	if certManager != nil {
+		// Answer HTTP-01 challenges, and serve everything else as before.
+		ndt7CleartextHandler = certManager.HTTPHandler(ndt7CleartextHandler)
+	}
+	ndt7ServerCleartext := httpServer(*ndt7AddrCleartext, ndt7CleartextHandler)
+	logging.Logger.WithField("addr", *ndt7AddrCleartext).Info("About to listen for ndt7 cleartext tests")
 	rtx.Must(listener.ListenAndServeAsync(ndt7ServerCleartext), "Could not start ndt7 cleartext server")
 	defer ndt7ServerCleartext.Close()
 
 	// Only start TLS-based services if certs and keys are provided
-	if *certFile != "" && *keyFile != "" {
-		// The ndt5 protocol serving WsS-based tests.
-		ndt5WssMux := http.NewServeMux()
-		ndt5WssMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
-		ndt5WssMux.Handle("/ndt_protocol", ndt5handler.NewWSS(*dataDir+"/ndt5", *certFile, *keyFile, serverMetadata))
-		ndt5WssServer := httpServer(
-			*ndt5WssAddr,
-			ac5.Then(logging.MakeAccessLogHandler(ndt5WssMux)),
-		)
-		log.Println("About to listen for ndt5 WsS tests on " + *ndt5WssAddr)
-		rtx.Must(listener.ListenAndServeTLSAsync(ndt5WssServer, *certFile, *keyFile), "Could not start ndt5 WsS server")
-		defer ndt5WssServer.Close()
-
+	if serverTLS != nil {
 		// The ndt7 listener serving up WSS based tests
 		ndt7Server := httpServer(
 			*ndt7Addr,
-			ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
+			trustedProxies.Then(ac7.Then(logging.MakeAccessLogHandler(ndt7Mux))),
 		)
-		log.Println("About to listen for ndt7 tests on " + *ndt7Addr)
-		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, *certFile, *keyFile), "Could not start ndt7 server")
+		ndt7Server.TLSConfig = serverTLS
+		logging.Logger.WithField("addr", *ndt7Addr).Info("About to listen for ndt7 tests")
+		// The certificates are in the TLS config.
+		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, "", ""), "Could not start ndt7 server")
 		defer ndt7Server.Close()
 	} else {
-		log.Printf("Cert=%q and Key=%q means no TLS services will be started.\n", *certFile, *keyFile)
+		logging.Logger.WithFields(log.Fields{"cert": *certFile, "key": *keyFile}).Info("No TLS services will be started")
 	}
 
-	// Set up handler for /health endpoint.
+	// Set up handlers for the health, readiness, and version endpoints.
 	healthMux := http.NewServeMux()
 	healthMux.Handle("/health", http.HandlerFunc(handleHealth))
+	healthMux.Handle("/ready", http.HandlerFunc(handleReady))
+	healthMux.Handle("/healthz", http.HandlerFunc(handleHealthz))
+	healthMux.Handle("/readyz", http.HandlerFunc(handleReadyz))
+	healthMux.Handle("/version", http.HandlerFunc(handleVersion))
 	healthServer := httpServer(
 		*healthAddr,
 		healthMux,
@@ -299,6 +1295,35 @@ func main() {
 	rtx.Must(listener.ListenAndServeAsync(healthServer), "Could not start health server")
 	defer healthServer.Close()
 
+	if *adminAddr != "" {
+		api := &admin.API{
+			Tests:    running,
+			Queue:    ndt5Queue,
+			Flows:    flows,
+			Bans:     bans,
+			Drainers: []admin.Drainer{activeTests, ndt5Queue},
+			Debug:    *debug,
+		}
+		adminServer := httpServer(*adminAddr, api.Handler(adminToken))
+		logging.Logger.WithField("addr", *adminAddr).Info("About to listen for admin requests")
+		rtx.Must(listener.ListenAndServeAsync(adminServer), "Could not start admin server")
+		defer adminServer.Close()
+	}
+
 	// Serve until the context is canceled.
 	<-ctx.Done()
+
+	// Stop accepting new tests and give running tests a chance to finish.
+	// Connections that are still open when main returns are closed.
+	logging.Logger.WithField("grace_period", gracePeriod.String()).Info("Draining running tests")
+	metrics.Draining.Set(1)
+	activeTests.Drain()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), *gracePeriod)
+	defer drainCancel()
+	if err := ndt5Server.Shutdown(drainCtx); err != nil {
+		logging.Logger.WithError(err).Warn("Could not drain ndt5 tests")
+	}
+	if err := activeTests.Wait(drainCtx); err != nil {
+		logging.Logger.WithError(err).WithField("active", activeTests.Active()).Warn("Could not drain tests")
+	}
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +13,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,7 +22,11 @@ import (
 	"github.com/m-lab/go/osx"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/config"
 	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ratelimit"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/version"
 	"go.uber.org/goleak"
 	"gopkg.in/m-lab/pipe.v3"
 )
@@ -409,3 +417,143 @@ func Test_handleHealth(t *testing.T) {
 		})
 	}
 }
+
+func Test_handleReadyz(t *testing.T) {
+	defer func(d string) { *dataDir = d }(*dataDir)
+	*dataDir = t.TempDir()
+	isLameDuck = false
+	writer := httptest.NewRecorder()
+	handleReadyz(writer, nil)
+	if writer.Code != http.StatusOK {
+		t.Errorf("handleReadyz() got = %d, want 200: %s", writer.Code, writer.Body)
+	}
+	*dataDir = filepath.Join(*dataDir, "missing")
+	writer = httptest.NewRecorder()
+	handleReadyz(writer, nil)
+	if writer.Code != http.StatusServiceUnavailable || !strings.Contains(writer.Body.String(), "data directory") {
+		t.Errorf("handleReadyz() got = %d, %q, want 503 for the data directory", writer.Code, writer.Body)
+	}
+}
+
+func Test_handleVersion(t *testing.T) {
+	writer := httptest.NewRecorder()
+	handleVersion(writer, nil)
+	var info version.Info
+	if err := json.Unmarshal(writer.Body.Bytes(), &info); err != nil || info.GoVersion == "" {
+		t.Errorf("handleVersion() = %q, %v", writer.Body, err)
+	}
+}
+
+func Test_parseTLSFlags(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if err != nil || !reflect.DeepEqual(suites, want) {
+		t.Errorf("parseCipherSuites() = %v, %v, want %v", suites, err, want)
+	}
+	if _, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Error("parseCipherSuites() accepted an insecure suite")
+	}
+	curves, err := parseCurves("X25519,CurveP256")
+	if err != nil || !reflect.DeepEqual(curves, []tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("parseCurves() = %v, %v", curves, err)
+	}
+	if _, err := parseCurves("P-256"); err == nil {
+		t.Error("parseCurves() accepted an unknown curve")
+	}
+	if suites, err := parseCipherSuites(""); suites != nil || err != nil {
+		t.Errorf("parseCipherSuites(\"\") = %v, %v, want nil, nil", suites, err)
+	}
+}
+
+func Test_validateFlags(t *testing.T) {
+	if err := validateFlags(); err != nil {
+		t.Fatalf("validateFlags() = %v with the default flags", err)
+	}
+	defer func(w, b, db string) { *resultWriters, *uploadBackend, *geoipDB = w, b, db }(*resultWriters, *uploadBackend, *geoipDB)
+	*resultWriters = "file,sqlite"
+	*uploadBackend = "gcs"
+	*geoipDB = filepath.Join(t.TempDir(), "missing.mmdb")
+	defer flag.Set("ndt5.latency.probes", flag.Lookup("ndt5.latency.probes").Value.String())
+	flag.Set("ndt5.latency.probes", "-1")
+	err := validateFlags()
+	if err == nil {
+		t.Fatal("validateFlags() accepted invalid flags")
+	}
+	for _, want := range []string{"-results.writers \"sqlite\"", "-results.bucket", "-geoip.db", "-ndt5.latency.probes"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validateFlags() = %v, want it to report %s", err, want)
+		}
+	}
+}
+
+func Test_runtimePolicy_reload(t *testing.T) {
+	defer func(w string, max int) { *resultWriters, *subnetConcurrent = w, max }(*resultWriters, *subnetConcurrent)
+	path := filepath.Join(t.TempDir(), "ndt-server.yaml")
+	rtx.Must(os.WriteFile(path, []byte("ratelimit.subnet.max-concurrent: 0\n"), 0644), "Could not write config")
+	rtx.Must(config.Load(flag.CommandLine, path), "Could not load config")
+	reloader, err := config.NewReloader(flag.CommandLine, path, reloadableFlags...)
+	rtx.Must(err, "Could not create reloader")
+	p := &runtimePolicy{
+		reloader:    reloader,
+		subnetTests: ratelimit.NewConcurrency(0, ratelimit.Subnets{IPv4: 24, IPv6: 64}),
+		writers:     results.NewSwappable(results.NullWriter()),
+		stopWriters: func() {},
+	}
+
+	updated := "ratelimit:\n  subnet:\n    max-concurrent: 1\nresults.writers: stdout\n"
+	rtx.Must(os.WriteFile(path, []byte(updated), 0644), "Could not write config")
+	if err := p.reload(); err != nil {
+		t.Fatalf("reload() = %v", err)
+	}
+	if !p.subnetTests.Acquire("1.2.3.4") || p.subnetTests.Acquire("1.2.3.5") {
+		t.Error("the reloaded subnet limit was not applied")
+	}
+	if p.writers.Swap(results.NullWriter()) == results.NullWriter() {
+		t.Error("the result writers were not replaced")
+	}
+
+	rtx.Must(os.WriteFile(path, []byte("results.writers: sqlite\n"), 0644), "Could not write config")
+	if err := p.reload(); err == nil {
+		t.Error("reload() accepted an invalid writer")
+	}
+	if *resultWriters != "stdout" || *subnetConcurrent != 1 {
+		t.Errorf("a failed reload() changed flags to %q and %d", *resultWriters, *subnetConcurrent)
+	}
+}
+
+func Test_basicAuth(t *testing.T) {
+	h := basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), map[string]string{"prometheus": "secret"})
+	tests := []struct {
+		name           string
+		user, password string
+		want           int
+	}{
+		{name: "valid", user: "prometheus", password: "secret", want: http.StatusOK},
+		{name: "wrong-password", user: "prometheus", password: "guess", want: http.StatusUnauthorized},
+		{name: "unknown-user", user: "root", password: "secret", want: http.StatusUnauthorized},
+		{name: "missing", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			writer := httptest.NewRecorder()
+			h.ServeHTTP(writer, req)
+			if writer.Code != tt.want {
+				t.Errorf("basicAuth() got = %d, want %d", writer.Code, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readMetricsUsers(t *testing.T) {
+	defer func(f string) { *metricsAuthFile = f }(*metricsAuthFile)
+	*metricsAuthFile = filepath.Join(t.TempDir(), "users")
+	rtx.Must(os.WriteFile(*metricsAuthFile, []byte("# Scrapers\nprometheus:secret\n\nbackup:pa:ss\n"), 0600), "Could not write users")
+	want := map[string]string{"prometheus": "secret", "backup": "pa:ss"}
+	if got := readMetricsUsers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("readMetricsUsers() = %v, want %v", got, want)
+	}
+}
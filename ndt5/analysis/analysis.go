@@ -0,0 +1,111 @@
+// Package analysis diagnoses the client's path from the measurements of the
+// ndt5 tests, in the spirit of the heuristics of the original C NDT server:
+// duplex mismatch, faulty hardware, and congestion.
+//
+// The C server used web100 variables, and these heuristics use the TCP_INFO
+// equivalents of the s2c test. They are hints for users, not proofs.
+package analysis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+)
+
+// Thresholds of the heuristics.
+const (
+	// cwndLimitedMismatch is the fraction of the time limited by the
+	// congestion window above which a lossy, asymmetric path suggests a
+	// duplex mismatch.
+	cwndLimitedMismatch = 0.9
+	// retransPerSecondMismatch is the retransmission rate above which a path
+	// may have a duplex mismatch.
+	retransPerSecondMismatch = 2
+	// asymmetryMismatch is how many times faster the upload must be than the
+	// download for a duplex mismatch. Half-duplex links lose the data that
+	// collides with the ACKs of the download, but barely hurt the upload.
+	asymmetryMismatch = 2
+	// lossFaulty is the fraction of lost segments above which a path whose
+	// RTT does not grow is considered faulty: the losses are not caused by
+	// queues filling up.
+	lossFaulty = 0.01
+	// rttGrowthQueueing is how many times the minimum RTT the maximum RTT must
+	// reach for the losses to be explained by queueing.
+	rttGrowthQueueing = 2
+	// cwndLimitedCongestion is the fraction of the time limited by the
+	// congestion window above which the path is considered congested, as in
+	// the C server.
+	cwndLimitedCongestion = 0.02
+)
+
+// Verdicts are the findings of Analyze.
+type Verdicts struct {
+	// DuplexMismatch is true if a link of the path seems to run in half
+	// duplex mode on one side and full duplex mode on the other.
+	DuplexMismatch bool
+	// FaultyLink is true if segments are lost without queueing, e.g. because
+	// of a bad cable or a noisy wireless link.
+	FaultyLink bool
+	// Congestion is true if the download was limited by the congestion window
+	// for other reasons than a duplex mismatch or a faulty link, i.e. other
+	// traffic competed for the bottleneck.
+	Congestion bool
+	// LimitedBy is what limited the download most of the time: "cwnd" for the
+	// network, "rwnd" for the client's receive window, or "sndbuf" for the
+	// server's send buffer.
+	LimitedBy string
+	// CwndLimitedFraction is the fraction of the download during which the
+	// congestion window limited the sender.
+	CwndLimitedFraction float64
+	// LossFraction is the fraction of the data segments of the download that
+	// were retransmitted.
+	LossFraction float64
+}
+
+// Analyze returns the verdicts for the s2c test record and the c2s rate, or
+// nil if the s2c test did not complete.
+func Analyze(record *s2c.ArchivalData, c2sMbps float64) *Verdicts {
+	if record == nil || record.TCPInfo == nil || record.Error != "" {
+		return nil
+	}
+	info := record.TCPInfo
+	v := &Verdicts{}
+	busy := float64(info.BusyTime)
+	rwnd, sndbuf := float64(info.RWndLimited), float64(info.SndBufLimited)
+	if busy > 0 {
+		v.CwndLimitedFraction = (busy - rwnd - sndbuf) / busy
+	}
+	switch {
+	case rwnd > busy/2:
+		v.LimitedBy = "rwnd"
+	case sndbuf > busy/2:
+		v.LimitedBy = "sndbuf"
+	default:
+		v.LimitedBy = "cwnd"
+	}
+	if info.DataSegsOut > 0 {
+		v.LossFraction = float64(info.TotalRetrans) / float64(info.DataSegsOut)
+	}
+	seconds := record.EndTime.Sub(record.StartTime).Seconds()
+	var retransPerSecond float64
+	if seconds > 0 {
+		retransPerSecond = float64(info.TotalRetrans) / seconds
+	}
+
+	v.DuplexMismatch = v.CwndLimitedFraction > cwndLimitedMismatch &&
+		retransPerSecond > retransPerSecondMismatch &&
+		c2sMbps > asymmetryMismatch*record.MeanThroughputMbps
+	queueing := record.MinRTT > 0 && record.MaxRTT >= time.Duration(rttGrowthQueueing)*record.MinRTT
+	v.FaultyLink = !v.DuplexMismatch && v.LossFraction > lossFaulty && !queueing
+	v.Congestion = !v.DuplexMismatch && !v.FaultyLink && v.CwndLimitedFraction > cwndLimitedCongestion
+	return v
+}
+
+// ResultsMessage returns the verdicts in the "name: value" form of the other
+// results sent to the client at the end of the tests.
+func (v *Verdicts) ResultsMessage() string {
+	return fmt.Sprintf(
+		"Analysis.DuplexMismatch: %t\nAnalysis.FaultyLink: %t\nAnalysis.Congestion: %t\nAnalysis.LimitedBy: %s\n",
+		v.DuplexMismatch, v.FaultyLink, v.Congestion, v.LimitedBy)
+}
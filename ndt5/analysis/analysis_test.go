@@ -0,0 +1,65 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestAnalyze(t *testing.T) {
+	start := time.Now()
+	record := func(mbps float64, minRTT, maxRTT time.Duration, info tcp.LinuxTCPInfo) *s2c.ArchivalData {
+		return &s2c.ArchivalData{
+			StartTime:          start,
+			EndTime:            start.Add(10 * time.Second),
+			MeanThroughputMbps: mbps,
+			MinRTT:             minRTT,
+			MaxRTT:             maxRTT,
+			TCPInfo:            &info,
+		}
+	}
+	tests := []struct {
+		name   string
+		record *s2c.ArchivalData
+		c2s    float64
+		want   Verdicts
+	}{
+		{
+			name:   "clean",
+			record: record(100, 10*time.Millisecond, 12*time.Millisecond, tcp.LinuxTCPInfo{BusyTime: 1e7, RWndLimited: 1e7, DataSegsOut: 1000}),
+			c2s:    100,
+			want:   Verdicts{LimitedBy: "rwnd"},
+		},
+		{
+			name:   "duplex-mismatch",
+			record: record(1, 10*time.Millisecond, 15*time.Millisecond, tcp.LinuxTCPInfo{BusyTime: 1e7, DataSegsOut: 1000, TotalRetrans: 100}),
+			c2s:    50,
+			want:   Verdicts{DuplexMismatch: true, LimitedBy: "cwnd", CwndLimitedFraction: 1, LossFraction: 0.1},
+		},
+		{
+			name:   "faulty-link",
+			record: record(20, 10*time.Millisecond, 12*time.Millisecond, tcp.LinuxTCPInfo{BusyTime: 1e7, DataSegsOut: 1000, TotalRetrans: 50}),
+			c2s:    20,
+			want:   Verdicts{FaultyLink: true, LimitedBy: "cwnd", CwndLimitedFraction: 1, LossFraction: 0.05},
+		},
+		{
+			name:   "congestion",
+			record: record(20, 10*time.Millisecond, 80*time.Millisecond, tcp.LinuxTCPInfo{BusyTime: 1e7, DataSegsOut: 1000, TotalRetrans: 50}),
+			c2s:    20,
+			want:   Verdicts{Congestion: true, LimitedBy: "cwnd", CwndLimitedFraction: 1, LossFraction: 0.05},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Analyze(tt.record, tt.c2s)
+			if got == nil || *got != tt.want {
+				t.Errorf("Analyze() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if got := Analyze(&s2c.ArchivalData{Error: "failed"}, 0); got != nil {
+		t.Errorf("Analyze() of a failed test = %+v, want nil", got)
+	}
+}
@@ -2,17 +2,40 @@ package c2s
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
+	"github.com/m-lab/ndt-server/ndt5/singleserving"
 	"github.com/m-lab/ndt-server/ndt5/web100"
+	"github.com/m-lab/ndt-server/tracing"
+	"github.com/m-lab/tcp-info/tcp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// tracer traces the steps of the tests.
+var tracer = otel.Tracer("github.com/m-lab/ndt-server/ndt5/c2s")
+
+// clk is the clock of the measurement window and of the drain grace period.
+var clk = clock.Real
+
+// errDrainPanic is the error of a drain that ended with a panic.
+var errDrainPanic = errors.New("the drain panicked")
+
+var drainGrace = flag.Duration("ndt5.c2s.drain-grace", 3*time.Second, "How long the server keeps reading the data of ndt5 c2s clients after the test before closing the test connection, so that clients that are still sending do not get a reset")
+
 // ArchivalData is the data saved by the C2S test. If a researcher wants deeper
 // data, then they should use the UUID to get deeper data from tcp-info.
 type ArchivalData struct {
@@ -31,14 +54,39 @@ type ArchivalData struct {
 	StartTime          time.Time
 	EndTime            time.Time
 	MeanThroughputMbps float64
+	// BytesReceived is the kernel's count of the bytes received by the end of
+	// the measurement, which MeanThroughputMbps is computed from. BytesRead is
+	// how many of them the server had read, and ApplicationThroughputMbps the
+	// rate computed from it. The bytes not yet read were still buffered, and
+	// for WS clients BytesRead excludes the WebSocket framing. ndt5 clients do
+	// not report the rate they measured.
+	BytesReceived             int64
+	BytesRead                 int64
+	ApplicationThroughputMbps float64
+	// DSCP is the DSCP that the server marked the packets of the test with, if
+	// any.
+	DSCP int `json:",omitempty"`
 	// TODO: Add TCPEngine (bbr, cubic, reno, etc.)
 
+	// TCPInfo is the last TCP_INFO snapshot of the measurement connection. Its
+	// BytesReceived is the number of bytes the client transferred.
+	TCPInfo *tcp.LinuxTCPInfo `json:",omitempty"`
+	// Retransmissions are the loss counters of TCPInfo.
+	Retransmissions *web100.Retransmissions `json:",omitempty"`
+	// RTT is the kernel's RTT estimate in TCPInfo.
+	RTT *web100.RTT `json:",omitempty"`
+	// ECN is whether the test connection used ECN, per TCPInfo.
+	ECN *web100.ECN `json:",omitempty"`
+
 	Error string `json:",omitempty"`
+	// ErrorType classifies Error by the step of the test that failed, using the
+	// same values as the ndt5_client_test_errors_total metric.
+	ErrorType string `json:",omitempty"`
 }
 
 // ManageTest manages the c2s test lifecycle.
 func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server) (record *ArchivalData, err error) {
-	localContext, localCancel := context.WithTimeout(ctx, 30*time.Second)
+	localContext, localCancel := context.WithTimeout(ctx, *protocol.TestDuration+20*time.Second)
 	defer localCancel()
 	defer func() {
 		if err != nil && record != nil {
@@ -46,131 +94,223 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		}
 	}()
 	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("test", "c2s")
+	// step is the span of the step of the test that is running, so that the
+	// step that fails is the one marked with the error.
+	_, step := tracer.Start(ctx, "ndt5.c2s.prepare")
+	defer func() {
+		tracing.SetError(step, err)
+		step.End()
+	}()
 
 	m := controlConn.Messager()
 	connType := s.ConnectionType().Label()
+	fail := func(errType string) {
+		record.ErrorType = errType
+		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", errType).Inc()
+	}
 
 	srv, err := s.SingleServingServer("c2s")
 	if err != nil {
-		log.Println("Could not start SingleServingServer", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "StartSingleServingServer").Inc()
+		logger.WithError(err).Warn("Could not start SingleServingServer")
+		fail("StartSingleServingServer")
 		return record, err
 	}
 
-	err = m.SendMessage(protocol.TestPrepare, []byte(strconv.Itoa(srv.Port())))
+	err = m.Send(ndt.PrepareMessage(srv))
 	if err != nil {
-		log.Println("Could not send TestPrepare", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestPrepare").Inc()
+		logger.WithError(err).Warn("Could not send TestPrepare")
+		fail("TestPrepare")
 		return record, err
 	}
 
 	testConn, err := srv.ServeOnce(localContext)
 	if err != nil {
-		log.Println("Could not successfully ServeOnce", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "ServeOnce").Inc()
+		logger.WithError(err).Warn("Could not successfully ServeOnce")
+		fail("ServeOnce")
 		return record, err
 	}
 
 	// When ManageTest exits, close the test connection.
+	var dr *drainer
 	defer func() {
 		// Allow the connection-draining goroutine to empty all buffers in support of
 		// poorly-written clients before we close the connection, but do not block the
 		// exit of ManageTest on waiting for the test connection to close.
 		go func() {
-			time.Sleep(3 * time.Second)
+			if dr != nil && dr.stillSending(*drainGrace) {
+				logger.Info("C2S client still sending after the drain grace period")
+				metrics.C2SDrainTimeouts.Inc()
+			}
 			warnonerror.Close(testConn, "Could not close test connection")
 		}()
 	}()
 
 	record.UUID = testConn.UUID()
+	logger = logger.WithField("test_uuid", record.UUID)
 	record.ServerIP, record.ServerPort = testConn.ServerIPAndPort()
 	record.ClientIP, record.ClientPort = testConn.ClientIPAndPort()
+	record.DSCP = singleserving.DSCP()
 
-	err = m.SendMessage(protocol.TestStart, []byte{})
+	step.End()
+	_, step = tracer.Start(ctx, "ndt5.c2s.transfer")
+	step.SetAttributes(attribute.String("test_uuid", record.UUID))
+	err = m.Send(&protocol.Start{})
 	if err != nil {
-		log.Println("Could not send TestStart", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestStart").Inc()
+		logger.WithError(err).Warn("Could not send TestStart")
+		fail("TestStart")
 		return record, err
 	}
 
-	record.StartTime = time.Now()
-	web100Metrics, err := drainForeverButMeasureFor(ctx, testConn, 10*time.Second)
-	record.EndTime = time.Now()
-	seconds := record.EndTime.Sub(record.StartTime).Seconds()
-	log.Println("Ended C2S test on", testConn, record.UUID)
+	record.StartTime = clk.Now()
+	web100Metrics, dr, err := drainForeverButMeasureFor(ctx, testConn, *protocol.TestDuration)
+	bytesRead := dr.measured
+	var elapsed time.Duration
+	record.EndTime, elapsed = protocol.EndTime(clk, record.StartTime)
+	seconds := elapsed.Seconds()
+	logger.WithField("conn", testConn.String()).Info("Ended C2S test")
+	record.BytesRead = bytesRead
+	if web100Metrics != nil {
+		// The kernel's counters are those of the last snapshot, so the rate
+		// is computed over the time until it was taken.
+		if n := len(web100Metrics.Snapshots); n > 0 && web100Metrics.Snapshots[n-1].Time.After(record.StartTime) {
+			seconds = web100Metrics.Snapshots[n-1].Time.Sub(record.StartTime).Seconds()
+		}
+		record.TCPInfo = &web100Metrics.TCPInfo
+		record.BytesReceived = web100Metrics.TCPInfo.BytesReceived
+		record.Retransmissions = web100.NewRetransmissions(record.TCPInfo)
+		record.RTT = web100.NewRTT(record.TCPInfo)
+		record.ECN = web100.NewECN(record.TCPInfo)
+	}
 	if err != nil {
-		if web100Metrics.TCPInfo.BytesReceived == 0 {
-			log.Println("Could not drain the test connection", err, record.UUID)
-			metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "Drain").Inc()
+		if web100Metrics == nil || web100Metrics.TCPInfo.BytesReceived == 0 {
+			logger.WithError(err).Warn("Could not drain the test connection")
+			fail("Drain")
 			return record, err
 		}
-		// It is possible for the client to reach 10 seconds slightly before the server does.
-		if seconds < 9 {
-			log.Printf("C2S test client only uploaded for %f seconds  %s\n", seconds, record.UUID)
-			metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "EarlyExit").Inc()
+		// It is possible for the client to reach the end of the test slightly
+		// before the server does.
+		if seconds < 0.9*protocol.TestDuration.Seconds() {
+			logger.WithField("seconds", seconds).Warn("C2S test client only uploaded for part of the test")
+			fail("EarlyExit")
 			return record, err
 		}
-		// More than 9 seconds is fine.
-		log.Printf("C2S test had an error (%v) after %f seconds. We will continue with the test.\n", err, seconds)
+		// More than 90% of the test duration is fine.
+		logger.WithError(err).WithField("seconds", seconds).Info("C2S test had an error near its end. We will continue with the test")
 	}
 
 	throughputValue := 8 * float64(web100Metrics.TCPInfo.BytesReceived) / 1000 / seconds
 	record.MeanThroughputMbps = throughputValue / 1000 // Convert Kbps to Mbps
+	record.ApplicationThroughputMbps = 8 * float64(bytesRead) / 1e6 / seconds
 
-	log.Println(controlConn, "sent us", throughputValue, "Kbps")
-	err = m.SendMessage(protocol.TestMsg, []byte(strconv.FormatInt(int64(throughputValue), 10)))
+	logger.WithFields(log.Fields{
+		"kbps":             throughputValue,
+		"application_kbps": record.ApplicationThroughputMbps * 1000,
+	}).Info("Client upload rate")
+	step.End()
+	_, step = tracer.Start(ctx, "ndt5.c2s.results")
+	err = m.Send(&protocol.TestMessage{Text: strconv.FormatInt(int64(throughputValue), 10)})
 	if err != nil {
-		log.Println("Could not send TestMsg with C2S results", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestMsg").Inc()
+		logger.WithError(err).Warn("Could not send TestMsg with C2S results")
+		fail("TestMsg")
 		return record, err
 	}
 
-	err = m.SendMessage(protocol.TestFinalize, []byte{})
+	err = m.Send(&protocol.Finalize{})
 	if err != nil {
-		log.Println("Could not send TestFinalize", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestFinalize").Inc()
+		logger.WithError(err).Warn("Could not send TestFinalize")
+		fail("TestFinalize")
 		return record, err
 	}
 
 	return record, nil
 }
 
-// drainForeverButMeasureFor is a generic method for draining a connection while
-// measuring the connection for the first part of the drain. This method does
-// not close the passed-in Connection, and starts a goroutine which runs until
-// that Connection is closed.
-func drainForeverButMeasureFor(ctx context.Context, conn protocol.MeasuredConnection, d time.Duration) (*web100.Metrics, error) {
-	derivedCtx, derivedCancel := context.WithTimeout(ctx, d)
-	defer derivedCancel()
-
-	conn.StartMeasuring(derivedCtx)
+// drainer reads and discards the data of a connection until reading fails.
+type drainer struct {
+	read atomic.Int64
+	// measured is the value of read when the measurement ended.
+	measured int64
+	// err is the error that ended the drain. It is set when done is closed.
+	err  error
+	done chan struct{}
+}
 
-	errs := make(chan error, 1)
-	// This is the "drain forever" part of this function. Read the passed-in
-	// connection until the passed-in connection is closed.
+func drain(conn protocol.MeasuredConnection, logger log.Interface) *drainer {
+	dr := &drainer{done: make(chan struct{})}
 	go func() {
+		defer close(dr.done)
+		defer recovery.Recover(logger, "c2s.drain", conn)
+		// Set again once the drain ends, unless it panics.
+		dr.err = errDrainPanic
 		var connErr error
 		// Read the connections until the connection is closed. Reading on a closed
 		// connection returns an error, which terminates the loop and the goroutine.
 		for connErr == nil {
-			_, connErr = conn.ReadBytes()
+			var n int64
+			n, connErr = conn.ReadBytes()
+			dr.read.Add(n)
 		}
-		errs <- connErr
+		dr.err = connErr
 	}()
+	return dr
+}
+
+// wait waits up to grace for the drain to end, e.g. because the client closed
+// its connection, and reports whether it did.
+func (dr *drainer) wait(grace time.Duration) bool {
+	t := clk.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-dr.done:
+		return true
+	case <-t.C():
+		return false
+	}
+}
+
+// stillSending waits up to grace for the drain to end, and reports whether
+// it did not because the client kept sending. Clients that neither send nor
+// close their connection during the grace period are not sending.
+func (dr *drainer) stillSending(grace time.Duration) bool {
+	before := dr.read.Load()
+	return !dr.wait(grace) && dr.read.Load() > before
+}
+
+// drainForeverButMeasureFor is a generic method for draining a connection while
+// measuring the connection for the first part of the drain. This method does
+// not close the passed-in Connection, and the drainer that it returns runs
+// until that Connection is closed.
+func drainForeverButMeasureFor(ctx context.Context, conn protocol.MeasuredConnection, d time.Duration) (*web100.Metrics, *drainer, error) {
+	timer := clk.NewTimer(d)
+	defer timer.Stop()
+
+	conn.StartMeasuring(ctx)
+	live.FromContext(ctx).Measure("c2s", func() int64 {
+		if sample := conn.LatestSnapshot(); sample != nil {
+			return sample.TCPInfo.BytesReceived
+		}
+		return 0
+	})
+
+	// This is the "drain forever" part of this function.
+	dr := drain(conn, logging.FromContext(ctx))
 
 	var socketStats *web100.Metrics
 	var err error
 	select {
-	case <-derivedCtx.Done(): // Wait for timeout
-		log.Println("Timed out")
+	case <-timer.C(): // Wait for timeout
+		logging.FromContext(ctx).Debug("C2S measurement timed out")
+		socketStats, err = conn.StopMeasuring()
+	case <-ctx.Done():
+		logging.FromContext(ctx).Debug("C2S measurement canceled")
 		socketStats, err = conn.StopMeasuring()
-	case err = <-errs: // Error in c2s transfer
-		log.Println("C2S error:", err)
+	case <-dr.done: // Error in c2s transfer
+		err = dr.err
+		logging.FromContext(ctx).WithError(err).Info("C2S transfer ended early")
 		socketStats, _ = conn.StopMeasuring()
 	}
-	if socketStats == nil {
-		return nil, err
-	}
-	// socketStats is guaranteed to be non-nil and the TCPInfo element is a value not a pointer.
-	return socketStats, err
+	dr.measured = dr.read.Load()
+	// socketStats may be nil, but its TCPInfo element is a value not a pointer.
+	return socketStats, dr, err
 }
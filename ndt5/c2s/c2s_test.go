@@ -1,6 +1,7 @@
 package c2s
 
 import (
+	"bufio"
 	"context"
 	"net"
 	"net/http"
@@ -11,8 +12,13 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/protocol/protocoltest"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
+	"github.com/m-lab/ndt-server/ndt5/web100"
 	"github.com/m-lab/ndt-server/netx"
 )
 
@@ -47,13 +53,80 @@ func Test_DrainForeverButMeasureFor_NormalOperation(t *testing.T) {
 		}
 		cConn.Close()
 	}()
-	metrics, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(500*time.Millisecond))
+	metrics, dr, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(500*time.Millisecond))
 	if err != nil {
 		t.Fatal("Should not have gotten error:", err)
 	}
 	if metrics.TCPInfo.BytesReceived <= 0 {
 		t.Errorf("Expected positive byte count but got %d", metrics.TCPInfo.BytesReceived)
 	}
+	if dr.measured <= 0 {
+		t.Errorf("Expected positive read count but got %d", dr.measured)
+	}
+	// The client keeps sending for longer than the grace period.
+	if dr.wait(100 * time.Millisecond) {
+		t.Error("The drain ended while the client was sending")
+	}
+}
+
+func Test_drainer_stillSending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sConn, cConn := MustMakeNetConnection(ctx)
+	defer sConn.Close()
+	defer cConn.Close()
+	dr := drain(sConn, &logging.Logger)
+	// A client that neither sends nor closes is idle, not sending.
+	if dr.stillSending(50 * time.Millisecond) {
+		t.Error("stillSending() = true for an idle client")
+	}
+	go func() {
+		for ctx.Err() == nil {
+			cConn.Write([]byte("hello"))
+		}
+	}()
+	if !dr.stillSending(50 * time.Millisecond) {
+		t.Error("stillSending() = false for a sending client")
+	}
+}
+
+func Test_DrainForeverButMeasureFor_FakeClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	clk = fake
+	defer func() { clk = clock.Real }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sConn, cConn := MustMakeNetConnection(ctx)
+	defer sConn.Close()
+	defer cConn.Close()
+	go func() {
+		for ctx.Err() == nil {
+			cConn.Write([]byte("hello"))
+		}
+	}()
+	type result struct {
+		metrics *web100.Metrics
+		err     error
+	}
+	results := make(chan result)
+	go func() {
+		metrics, _, err := drainForeverButMeasureFor(ctx, sConn, 10*time.Second)
+		results <- result{metrics, err}
+	}()
+	// The 10 second window ends without waiting 10 seconds, once there is a
+	// measurement of received bytes.
+	fake.BlockUntil(1)
+	for s := sConn.LatestSnapshot(); s == nil || s.TCPInfo.BytesReceived == 0; s = sConn.LatestSnapshot() {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(10 * time.Second)
+	r := <-results
+	if r.err != nil {
+		t.Fatal("Should not have gotten error:", r.err)
+	}
+	if r.metrics.TCPInfo.BytesReceived <= 0 {
+		t.Errorf("Expected positive byte count but got %d", r.metrics.TCPInfo.BytesReceived)
+	}
 }
 
 func Test_DrainForeverButMeasureFor_EarlyClientQuit(t *testing.T) {
@@ -70,10 +143,13 @@ func Test_DrainForeverButMeasureFor_EarlyClientQuit(t *testing.T) {
 		time.Sleep(150 * time.Millisecond) // Give the drainForever process time to get going
 		cConn.Close()
 	}()
-	metrics, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(4*time.Second))
+	metrics, dr, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(4*time.Second))
 	if err == nil {
 		t.Fatal("Should have gotten an error")
 	}
+	if !dr.wait(time.Second) {
+		t.Error("The drain did not end after the client closed")
+	}
 	if metrics.TCPInfo.BytesReceived <= 0 {
 		t.Errorf("Expected positive byte count but got %d", metrics.TCPInfo.BytesReceived)
 	}
@@ -113,7 +189,7 @@ func Test_DrainForeverButMeasureFor_CountsAllBytesNotJustWsGoodput(t *testing.T)
 		<-ctx2.Done()
 		cConn.Close()
 	}()
-	metrics, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(100*time.Millisecond))
+	metrics, _, err := drainForeverButMeasureFor(ctx, sConn, time.Duration(100*time.Millisecond))
 	if err != nil {
 		t.Fatal("Should not have gotten error:", err)
 	}
@@ -121,3 +197,62 @@ func Test_DrainForeverButMeasureFor_CountsAllBytesNotJustWsGoodput(t *testing.T)
 		t.Errorf("Expected positive byte count but got %d", metrics.TCPInfo.BytesReceived)
 	}
 }
+
+// pipeServer is an ndt.Server whose single-serving server serves conn.
+type pipeServer struct {
+	ndt.Server
+	conn *protocoltest.Conn
+}
+
+func (s *pipeServer) ConnectionType() ndt.ConnectionType { return ndt.Plain }
+func (s *pipeServer) SingleServingServer(string) (ndt.SingleMeasurementServer, error) {
+	return s, nil
+}
+func (s *pipeServer) Port() int { return 3002 }
+func (s *pipeServer) ServeOnce(context.Context) (protocol.MeasuredConnection, error) {
+	return s.conn, nil
+}
+func (s *pipeServer) Close() {}
+
+func TestManageTest(t *testing.T) {
+	defer func(d time.Duration) { *protocol.TestDuration = d }(*protocol.TestDuration)
+	*protocol.TestDuration = 200 * time.Millisecond
+	control, controlClient := protocoltest.Pipe()
+	defer controlClient.Close()
+	test, testClient := protocoltest.Pipe()
+	defer testClient.Close()
+
+	// The client uploads until the server closes the test connection.
+	rates := make(chan string, 1)
+	go func() {
+		cc := protocol.AdaptNetConn(controlClient, bufio.NewReader(controlClient))
+		cc.SetEncoding(protocol.TLV)
+		m := cc.Messager()
+		if _, err := m.ReceiveMessage(protocol.TestPrepare); err != nil {
+			rates <- ""
+			return
+		}
+		go func() {
+			for {
+				if _, err := testClient.Write(make([]byte, 8192)); err != nil {
+					return
+				}
+			}
+		}()
+		m.ReceiveMessage(protocol.TestStart)
+		rate, _ := m.ReceiveMessage(protocol.TestMsg)
+		m.ReceiveMessage(protocol.TestFinalize)
+		rates <- string(rate)
+	}()
+
+	record, err := ManageTest(context.Background(), control, &pipeServer{conn: test})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.UUID != test.ID || record.BytesReceived <= 0 || record.MeanThroughputMbps <= 0 {
+		t.Errorf("ManageTest() = %+v", record)
+	}
+	if rate := <-rates; rate == "" || rate == "0" {
+		t.Errorf("The client received the rate %q", rate)
+	}
+}
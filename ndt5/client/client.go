@@ -0,0 +1,444 @@
+// Package client implements the client side of the ndt5 protocol over raw
+// TCP, WS, and WSS connections. It runs the c2s, s2c, and META tests against
+// an ndt5 server, such as this one or the legacy C server, and returns what
+// both sides measured.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// Protocol is the protocol of the connections of a Client.
+type Protocol string
+
+// The protocols of ndt5 clients.
+const (
+	Raw = Protocol("raw")
+	WS  = Protocol("ws")
+	WSS = Protocol("wss")
+)
+
+// The bits of the tests that a client requests in its login. Clients always
+// request TestStatus.
+const (
+	TestMID    = 1
+	TestC2S    = 2
+	TestS2C    = 4
+	TestSFW    = 8
+	TestStatus = 16
+	TestMETA   = 32
+)
+
+// supportedTests are the tests that a Client can run.
+const supportedTests = TestC2S | TestS2C | TestMETA
+
+// Special values of SrvQueue messages.
+const (
+	queueBusy      = 9988
+	queueHeartbeat = 9990
+)
+
+const (
+	// DefaultVersion is the version that clients send in their login, which
+	// tells the server that they accept all of its results.
+	DefaultVersion = "v3.7.0"
+	// DefaultDuration is how long the c2s test uploads by default.
+	DefaultDuration = 10 * time.Second
+
+	dialTimeout = 10 * time.Second
+)
+
+// ErrServerBusy is returned when the server's queue is full, or when the
+// client waited too long in it.
+var ErrServerBusy = errors.New("client: the server is busy")
+
+// ServerError is the explanation that the server sent in a MsgError.
+type ServerError struct {
+	Text string
+}
+
+func (e *ServerError) Error() string {
+	return "client: the server sent an error: " + e.Text
+}
+
+// Client runs ndt5 tests. Server must be set, and the other fields may be
+// left at their zero values.
+type Client struct {
+	// Protocol is the protocol of the control and test connections. The
+	// empty Protocol is Raw.
+	Protocol Protocol
+	// Server is the host and port of the server's raw, WS, or WSS port, e.g.
+	// ndt.example.org:3001.
+	Server string
+	// TLSConfig configures WSS connections. Nil uses the default
+	// configuration.
+	TLSConfig *tls.Config
+	// AccessToken is sent to servers that require one.
+	AccessToken string
+	// Version is sent in the login. Empty means DefaultVersion.
+	Version string
+	// Duration is how long the c2s test uploads. Zero means DefaultDuration.
+	Duration time.Duration
+	// Metadata is sent to the server in the META test, if it is requested.
+	Metadata map[string]string
+}
+
+// Measurement is the result of a c2s or s2c test.
+type Measurement struct {
+	// ServerKbps is the rate measured by the server, and ClientKbps the rate
+	// measured by the client.
+	ServerKbps float64
+	ClientKbps float64
+	// Bytes were sent or received by the client in Elapsed.
+	Bytes   int64
+	Elapsed time.Duration
+	// Variables are the "name: value" measurements that the server sent
+	// during the test.
+	Variables map[string]string
+}
+
+// Result is the result of a Run.
+type Result struct {
+	// ServerVersion is the version that the server sent in its login.
+	ServerVersion string
+	// Tests are the bits of the tests that the server ran, in order.
+	Tests []int
+	C2S   *Measurement
+	S2C   *Measurement
+	// Results are the "name: value" results that the server sent once the
+	// tests were over.
+	Results map[string]string
+	// Summary is the JSON summary of the results that this server sends
+	// last, or nil.
+	Summary json.RawMessage
+}
+
+// UUID returns the UUID of the test, as reported by the server, or "".
+func (r *Result) UUID() string {
+	return r.Results["UUID"]
+}
+
+// run holds the state of a Run.
+type run struct {
+	c      *Client
+	ctrl   controlConn
+	result *Result
+}
+
+// Run runs the tests whose bits are set in tests, which may only be TestC2S,
+// TestS2C, and TestMETA. Canceling ctx stops the tests.
+func (c *Client) Run(ctx context.Context, tests int) (*Result, error) {
+	if tests&^(supportedTests|TestStatus) != 0 {
+		return nil, fmt.Errorf("client: unsupported tests %d", tests&^(supportedTests|TestStatus))
+	}
+	ctrl, err := c.dialControl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+	defer closeOnDone(ctx, ctrl)()
+
+	r := &run{c: c, ctrl: ctrl, result: &Result{Results: map[string]string{}}}
+	err = r.login(tests | TestStatus)
+	for i := 0; err == nil && i < len(r.result.Tests); i++ {
+		switch t := r.result.Tests[i]; t {
+		case TestC2S:
+			r.result.C2S, err = r.c2s(ctx)
+		case TestS2C:
+			r.result.S2C, err = r.s2c(ctx)
+		case TestMETA:
+			err = r.meta()
+		default:
+			err = fmt.Errorf("client: the server runs test %d, which was not requested", t)
+		}
+	}
+	if err == nil {
+		err = r.results()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return r.result, err
+}
+
+// closeOnDone closes c if ctx is done before the returned function is called,
+// which interrupts a blocked read or write.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func (c *Client) protocol() Protocol {
+	if c.Protocol == "" {
+		return Raw
+	}
+	return c.Protocol
+}
+
+func (c *Client) version() string {
+	if c.Version == "" {
+		return DefaultVersion
+	}
+	return c.Version
+}
+
+func (c *Client) duration() time.Duration {
+	if c.Duration == 0 {
+		return DefaultDuration
+	}
+	return c.Duration
+}
+
+// send sends msg to the server.
+func (r *run) send(msg protocol.Message) error {
+	body, err := protocol.Encode(protocol.JSON, msg)
+	if err != nil {
+		return err
+	}
+	return r.ctrl.send(msg.Type(), body)
+}
+
+// receive receives the next message from the server, which must be of msg's
+// type, into msg. A MsgError is returned as a *ServerError.
+func (r *run) receive(msg protocol.Message) error {
+	t, body, err := r.ctrl.receive()
+	if err != nil {
+		return err
+	}
+	if t == protocol.MsgError {
+		e := &protocol.Error{}
+		if err := protocol.Decode(protocol.JSON, body, e); err != nil {
+			e.Text = string(body)
+		}
+		return &ServerError{Text: e.Text}
+	}
+	if t != msg.Type() {
+		return fmt.Errorf("client: received %s, want %s", t, msg.Type())
+	}
+	return protocol.Decode(protocol.JSON, body, msg)
+}
+
+// login logs in, waits in the server's queue, and reads the server's version
+// and the tests it will run.
+func (r *run) login(tests int) error {
+	err := r.send(&protocol.ExtendedLogin{Version: r.c.version(), Tests: tests, AccessToken: r.c.AccessToken})
+	if err != nil {
+		return err
+	}
+	for {
+		q := &protocol.Queue{}
+		if err := r.receive(q); err != nil {
+			return err
+		}
+		if q.Wait == 0 {
+			break
+		}
+		if q.Wait == queueBusy {
+			return ErrServerBusy
+		}
+		if q.Wait == queueHeartbeat {
+			if err := r.send(&protocol.Waiting{}); err != nil {
+				return err
+			}
+		}
+		// Any other value is the client's position in the queue.
+	}
+	v := &protocol.LoginVersion{}
+	if err := r.receive(v); err != nil {
+		return err
+	}
+	r.result.ServerVersion = v.Version
+	lt := &protocol.LoginTests{}
+	if err := r.receive(lt); err != nil {
+		return err
+	}
+	r.result.Tests = lt.Tests
+	return nil
+}
+
+// prepare receives the TestPrepare of a test, opens its connection, and
+// receives its TestStart.
+func (r *run) prepare(ctx context.Context, subprotocol string) (testConn, error) {
+	p := &protocol.Prepare{}
+	if err := r.receive(p); err != nil {
+		return nil, err
+	}
+	conn, err := r.c.dialTest(ctx, p, subprotocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.receive(&protocol.Start{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// c2s uploads for the client's duration, and receives the rate measured by
+// the server.
+func (r *run) c2s(ctx context.Context) (*Measurement, error) {
+	conn, err := r.prepare(ctx, "c2s")
+	if err != nil {
+		return nil, err
+	}
+	defer closeOnDone(ctx, conn)()
+	b := make([]byte, bufferSize)
+	for i := range b {
+		b[i] = byte('a' + i%26)
+	}
+	m := &Measurement{}
+	start := time.Now()
+	for time.Since(start) < r.c.duration() {
+		if err := conn.write(b); err != nil {
+			break
+		}
+		m.Bytes += int64(len(b))
+	}
+	m.Elapsed = time.Since(start)
+	conn.Close()
+	m.ClientKbps = kbps(m.Bytes, m.Elapsed)
+
+	rate := &protocol.TestMessage{}
+	if err := r.receive(rate); err != nil {
+		return m, err
+	}
+	m.ServerKbps, err = strconv.ParseFloat(rate.Text, 64)
+	if err != nil {
+		return m, fmt.Errorf("client: bad c2s rate %q", rate.Text)
+	}
+	return m, r.receive(&protocol.Finalize{})
+}
+
+// s2c downloads until the server closes the test connection, and exchanges
+// the rates measured by both sides.
+func (r *run) s2c(ctx context.Context) (*Measurement, error) {
+	conn, err := r.prepare(ctx, "s2c")
+	if err != nil {
+		return nil, err
+	}
+	defer closeOnDone(ctx, conn)()
+	m := &Measurement{Variables: map[string]string{}}
+	start := time.Now()
+	for {
+		n, err := conn.read()
+		m.Bytes += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	m.Elapsed = time.Since(start)
+	conn.Close()
+	m.ClientKbps = kbps(m.Bytes, m.Elapsed)
+
+	results := &protocol.S2CResults{}
+	if err := r.receive(results); err != nil {
+		return m, err
+	}
+	m.ServerKbps = float64(results.ThroughputKbps)
+	rate := &protocol.TestMessage{Text: strconv.FormatFloat(m.ClientKbps, 'f', 4, 64)}
+	if err := r.send(rate); err != nil {
+		return m, err
+	}
+	// The server's measurements, then TestFinalize.
+	for {
+		t, body, err := r.ctrl.receive()
+		if err != nil {
+			return m, err
+		}
+		switch t {
+		case protocol.TestFinalize:
+			return m, nil
+		case protocol.TestMsg:
+			msg := &protocol.TestMessage{}
+			if err := protocol.Decode(protocol.JSON, body, msg); err != nil {
+				return m, err
+			}
+			parseVariables(msg.Text, m.Variables)
+		default:
+			return m, fmt.Errorf("client: received %s during the s2c test", t)
+		}
+	}
+}
+
+// meta sends the client's metadata.
+func (r *run) meta() error {
+	if err := r.receive(&protocol.Prepare{}); err != nil {
+		return err
+	}
+	if err := r.receive(&protocol.Start{}); err != nil {
+		return err
+	}
+	for name, value := range r.c.Metadata {
+		if err := r.send(&protocol.TestMessage{Text: name + ":" + value}); err != nil {
+			return err
+		}
+	}
+	// An empty message ends the metadata.
+	if err := r.send(&protocol.TestMessage{}); err != nil {
+		return err
+	}
+	return r.receive(&protocol.Finalize{})
+}
+
+// results receives the results until the server's MsgLogout.
+func (r *run) results() error {
+	for {
+		t, body, err := r.ctrl.receive()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case protocol.MsgLogout:
+			return nil
+		case protocol.MsgResults:
+			msg := &protocol.Results{}
+			if err := protocol.Decode(protocol.JSON, body, msg); err != nil {
+				return err
+			}
+			if strings.HasPrefix(msg.Text, "{") && json.Valid([]byte(msg.Text)) {
+				r.result.Summary = json.RawMessage(msg.Text)
+				continue
+			}
+			parseVariables(msg.Text, r.result.Results)
+		default:
+			return fmt.Errorf("client: received %s instead of the results", t)
+		}
+	}
+}
+
+// parseVariables adds the "name: value" lines of text to vars. Other lines
+// are ignored.
+func parseVariables(text string, vars map[string]string) {
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" || strings.Contains(name, " ") {
+			continue
+		}
+		vars[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+}
+
+// kbps returns the rate of n bytes in d, in kbit/s.
+func kbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return 8 * float64(n) / 1000 / d.Seconds()
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/singleserving"
+)
+
+// fakeServer runs the server side of the raw protocol on one connection.
+type fakeServer struct {
+	t    *testing.T
+	ctrl *rawControl
+	// tests are sent in the login, and run in order.
+	tests []int
+	// reject, if not empty, is sent in a MsgError instead of the login.
+	reject string
+	// meta receives the metadata of the META test.
+	meta chan map[string]string
+}
+
+func (s *fakeServer) send(msg protocol.Message) {
+	body, err := protocol.Encode(protocol.JSON, msg)
+	if err == nil {
+		err = s.ctrl.send(msg.Type(), body)
+	}
+	if err != nil {
+		s.t.Errorf("send(%T) = %v", msg, err)
+	}
+}
+
+func (s *fakeServer) receive(msg protocol.Message) {
+	t, body, err := s.ctrl.receive()
+	if err == nil && t != msg.Type() {
+		err = errors.New("received " + t.String())
+	}
+	if err == nil {
+		err = protocol.Decode(protocol.JSON, body, msg)
+	}
+	if err != nil {
+		s.t.Errorf("receive(%T) = %v", msg, err)
+	}
+}
+
+// accept sends a TestPrepare for a new port, and accepts the test connection
+// on it.
+func (s *fakeServer) accept() net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	defer l.Close()
+	s.send(&protocol.Prepare{Port: l.Addr().(*net.TCPAddr).Port})
+	conn, err := l.Accept()
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	return conn
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	// Like the server, the fake only kicks off once the client logged in.
+	s.ctrl = &rawControl{conn: conn, r: bufio.NewReader(conn), kickedOff: true}
+	login := &protocol.ExtendedLogin{}
+	s.receive(login)
+	conn.Write([]byte(kickoff))
+	if login.Tests&TestStatus == 0 || login.Version != DefaultVersion {
+		s.t.Errorf("login = %+v", login)
+	}
+	if s.reject != "" {
+		s.send(&protocol.Error{Text: s.reject})
+		s.send(&protocol.Logout{})
+		return
+	}
+	// The client waits in the queue, and answers heartbeats.
+	s.send(&protocol.Queue{Wait: 1})
+	s.send(&protocol.Queue{Wait: queueHeartbeat})
+	s.receive(&protocol.Waiting{})
+	s.send(&protocol.Queue{Wait: 0})
+	s.send(&protocol.LoginVersion{Version: "v5.0-fake"})
+	lt := &protocol.LoginTests{Tests: s.tests}
+	s.send(lt)
+	for _, t := range lt.Tests {
+		switch t {
+		case TestC2S:
+			tc := s.accept()
+			if tc == nil {
+				return
+			}
+			s.send(&protocol.Start{})
+			n, _ := io.Copy(io.Discard, tc)
+			tc.Close()
+			s.send(&protocol.TestMessage{Text: strconv.FormatInt(n, 10)})
+			s.send(&protocol.Finalize{})
+		case TestS2C:
+			tc := s.accept()
+			if tc == nil {
+				return
+			}
+			s.send(&protocol.Start{})
+			tc.Write(make([]byte, 100000))
+			tc.Close()
+			s.send(&protocol.S2CResults{ThroughputKbps: 800, TotalSentBytes: 100000})
+			s.receive(&protocol.TestMessage{})
+			s.send(&protocol.TestMessage{Text: "CurMSS: 1448\n"})
+			s.send(&protocol.Finalize{})
+		case TestMETA:
+			s.send(&protocol.Prepare{})
+			s.send(&protocol.Start{})
+			meta := map[string]string{}
+			for {
+				m := &protocol.TestMessage{}
+				s.receive(m)
+				if m.Text == "" {
+					break
+				}
+				parseVariables(m.Text, meta)
+			}
+			s.meta <- meta
+			s.send(&protocol.Finalize{})
+		}
+	}
+	s.send(&protocol.Results{Text: "You uploaded at 1.0000 and downloaded at 800.0000"})
+	s.send(&protocol.Results{Text: "UUID: fake-uuid\n"})
+	s.send(&protocol.Results{Text: `{"UUID":"fake-uuid"}`})
+	s.send(&protocol.Logout{})
+}
+
+// start serves s on a new raw port and returns its address.
+func (s *fakeServer) start() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err == nil {
+			s.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_Run(t *testing.T) {
+	s := &fakeServer{t: t, tests: []int{TestC2S, TestS2C, TestMETA}, meta: make(chan map[string]string, 1)}
+	c := &Client{
+		Server:   s.start(),
+		Duration: 100 * time.Millisecond,
+		Metadata: map[string]string{"client.name": "test"},
+	}
+	r, err := c.Run(context.Background(), TestC2S|TestS2C|TestMETA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ServerVersion != "v5.0-fake" || len(r.Tests) != 3 {
+		t.Errorf("Run() version, tests = %q, %v", r.ServerVersion, r.Tests)
+	}
+	if r.C2S == nil || r.C2S.Bytes == 0 || r.C2S.ServerKbps != float64(r.C2S.Bytes) {
+		t.Errorf("Run() C2S = %+v", r.C2S)
+	}
+	if r.S2C == nil || r.S2C.Bytes != 100000 || r.S2C.ServerKbps != 800 || r.S2C.Variables["CurMSS"] != "1448" {
+		t.Errorf("Run() S2C = %+v", r.S2C)
+	}
+	if meta := <-s.meta; meta["client.name"] != "test" {
+		t.Errorf("server received metadata %v", meta)
+	}
+	if r.UUID() != "fake-uuid" || string(r.Summary) != `{"UUID":"fake-uuid"}` {
+		t.Errorf("Run() UUID, Summary = %q, %q", r.UUID(), r.Summary)
+	}
+}
+
+func TestClient_RunRejected(t *testing.T) {
+	s := &fakeServer{t: t, reject: "no"}
+	c := &Client{Server: s.start()}
+	_, err := c.Run(context.Background(), TestS2C)
+	var se *ServerError
+	if !errors.As(err, &se) || se.Text != "no" {
+		t.Errorf("Run() = %v, want a ServerError", err)
+	}
+	if _, err := c.Run(context.Background(), TestMID); err == nil {
+		t.Error("Run() of an unsupported test did not fail")
+	}
+}
+
+func Test_tokenPrefix(t *testing.T) {
+	if tokenPrefix != singleserving.TokenPrefix {
+		t.Errorf("tokenPrefix = %q, want %q", tokenPrefix, singleserving.TokenPrefix)
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// kickoff is sent by the server on raw control connections once it received
+// the first bytes of the login, before anything else.
+const kickoff = "123456 654321"
+
+// tokenPrefix starts the raw test connections made to a server that runs its
+// tests on the control port. It is singleserving.TokenPrefix.
+const tokenPrefix = "TEST "
+
+// bufferSize is the size of the messages sent in the c2s test, and of the
+// reads of the s2c test.
+const bufferSize = 8192
+
+// controlConn sends and receives the control messages of a test, framed with
+// their type and length.
+type controlConn interface {
+	send(t protocol.MessageType, body []byte) error
+	receive() (protocol.MessageType, []byte, error)
+	Close() error
+}
+
+func frame(t protocol.MessageType, body []byte) []byte {
+	return append([]byte{byte(t), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// rawControl is the control connection of a raw client.
+type rawControl struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// kickedOff is whether the kickoff message was read.
+	kickedOff bool
+}
+
+func (c *rawControl) send(t protocol.MessageType, body []byte) error {
+	_, err := c.conn.Write(frame(t, body))
+	return err
+}
+
+func (c *rawControl) receive() (protocol.MessageType, []byte, error) {
+	if !c.kickedOff {
+		b := make([]byte, len(kickoff))
+		if _, err := io.ReadFull(c.r, b); err != nil || string(b) != kickoff {
+			return protocol.MsgUnknown, nil, fmt.Errorf("client: could not read the kickoff message: %q, %v", b, err)
+		}
+		c.kickedOff = true
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return protocol.MsgUnknown, nil, err
+	}
+	body := make([]byte, int(header[1])<<8+int(header[2]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return protocol.MsgUnknown, nil, err
+	}
+	return protocol.MessageType(header[0]), body, nil
+}
+
+func (c *rawControl) Close() error {
+	return c.conn.Close()
+}
+
+// wsControl is the control connection of a WS or WSS client, whose WebSocket
+// messages each hold a control message.
+type wsControl struct {
+	conn *websocket.Conn
+}
+
+func (c *wsControl) send(t protocol.MessageType, body []byte) error {
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame(t, body))
+}
+
+func (c *wsControl) receive() (protocol.MessageType, []byte, error) {
+	_, b, err := c.conn.ReadMessage()
+	if err != nil {
+		return protocol.MsgUnknown, nil, err
+	}
+	if len(b) < 3 || int(b[1])<<8+int(b[2]) != len(b)-3 {
+		return protocol.MsgUnknown, nil, errors.New("client: malformed control message")
+	}
+	return protocol.MessageType(b[0]), b[3:], nil
+}
+
+func (c *wsControl) Close() error {
+	return c.conn.Close()
+}
+
+// testConn is the connection of a c2s or s2c test.
+type testConn interface {
+	// write sends b.
+	write(b []byte) error
+	// read reads and discards some data, and returns its size.
+	read() (int, error)
+	Close() error
+}
+
+type rawTest struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (c *rawTest) write(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *rawTest) read() (int, error) {
+	return c.conn.Read(c.buf)
+}
+
+func (c *rawTest) Close() error {
+	return c.conn.Close()
+}
+
+type wsTest struct {
+	conn *websocket.Conn
+}
+
+func (c *wsTest) write(b []byte) error {
+	return c.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (c *wsTest) read() (int, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, r)
+	return int(n), err
+}
+
+func (c *wsTest) Close() error {
+	return c.conn.Close()
+}
+
+// dialWS opens a WebSocket connection with the given subprotocol to the
+// /ndt_protocol path of host:port.
+func (c *Client) dialWS(ctx context.Context, hostport, subprotocol string, query url.Values) (*websocket.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: hostport, Path: "/ndt_protocol", RawQuery: query.Encode()}
+	if c.protocol() == WSS {
+		u.Scheme = "wss"
+	}
+	d := &websocket.Dialer{
+		TLSClientConfig:  c.TLSConfig,
+		Subprotocols:     []string{subprotocol},
+		HandshakeTimeout: dialTimeout,
+		ReadBufferSize:   bufferSize,
+		WriteBufferSize:  bufferSize,
+	}
+	conn, _, err := d.DialContext(ctx, u.String(), nil)
+	return conn, err
+}
+
+// dialControl opens the control connection to the server. The kickoff message
+// of raw connections is read with the first message that they receive, since
+// the server only sends it once the client started to log in.
+func (c *Client) dialControl(ctx context.Context) (controlConn, error) {
+	switch c.protocol() {
+	case Raw:
+		d := &net.Dialer{Timeout: dialTimeout}
+		conn, err := d.DialContext(ctx, "tcp", c.Server)
+		if err != nil {
+			return nil, err
+		}
+		return &rawControl{conn: conn, r: bufio.NewReader(conn)}, nil
+	case WS, WSS:
+		query := url.Values{}
+		if c.AccessToken != "" {
+			query.Set("access_token", c.AccessToken)
+		}
+		conn, err := c.dialWS(ctx, c.Server, "ndt", query)
+		if err != nil {
+			return nil, err
+		}
+		return &wsControl{conn: conn}, nil
+	}
+	return nil, fmt.Errorf("client: unknown protocol %q", c.protocol())
+}
+
+// dialTest opens the connection of the test that p prepares, with the given
+// subprotocol for WS and WSS.
+func (c *Client) dialTest(ctx context.Context, p *protocol.Prepare, subprotocol string) (testConn, error) {
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return nil, err
+	}
+	hostport := net.JoinHostPort(host, strconv.Itoa(p.Port))
+	if c.protocol() != Raw {
+		conn, err := c.dialWS(ctx, hostport, subprotocol, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsTest{conn: conn}, nil
+	}
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	// Servers that run their tests on the control port identify the test by
+	// its token.
+	if len(p.Args) > 0 {
+		if _, err := conn.Write([]byte(tokenPrefix + p.Args[0])); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &rawTest{conn: conn, buf: make([]byte, bufferSize)}, nil
+}
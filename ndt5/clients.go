@@ -0,0 +1,60 @@
+package ndt5
+
+import "strings"
+
+// classicTests are the tests of the legacy C server, which is all that the
+// clients written for it can request.
+const classicTests = cTestMID | cTestC2S | cTestS2C | cTestSFW | cTestStatus | cTestMETA
+
+// clientVersion is what is known of the clients that send a version in their
+// login, and how the server adapts to them.
+type clientVersion struct {
+	// prefix matches the versions of the clients.
+	prefix string
+	// label names the clients in metrics. There are few labels, whatever the
+	// versions that clients send.
+	label string
+	// tests is the mask of the test bits that the clients may request. Other
+	// bits are ignored.
+	tests int
+	// extendedResults is whether the clients accept the results messages that
+	// the legacy C server did not send: the TCP, latency, and analysis
+	// results, the UUID, and the summary. Clients that don't are only sent the
+	// speeds and the MID results.
+	extendedResults bool
+}
+
+var (
+	// noVersion is for clients that log in with MsgLogin, which has no
+	// version.
+	noVersion = clientVersion{label: "none", tests: classicTests}
+	// otherVersion is for the clients whose version is not in knownVersions.
+	// They are assumed to be recent.
+	otherVersion = clientVersion{label: "other", tests: -1, extendedResults: true}
+
+	// knownVersions lists the versions sent by the clients of the legacy C
+	// server, such as web100clt, and by the clients of this server. The first
+	// match is used.
+	knownVersions = []clientVersion{
+		// Clients from before JSON support, which parse the results strictly.
+		{prefix: "v3.5.", label: "v3.5", tests: classicTests},
+		{prefix: "v3.6.", label: "v3.6", tests: classicTests},
+		// The JSON clients, and the many clients that claim to be them.
+		{prefix: "v3.7.", label: "v3.7", tests: -1, extendedResults: true},
+		{prefix: "v5.", label: "v5", tests: -1, extendedResults: true},
+	}
+)
+
+// lookupClient returns what is known of the clients with the given version,
+// which is empty for clients that logged in with MsgLogin.
+func lookupClient(version string) clientVersion {
+	if version == "" {
+		return noVersion
+	}
+	for _, v := range knownVersions {
+		if strings.HasPrefix(version, v.prefix) {
+			return v
+		}
+	}
+	return otherVersion
+}
@@ -0,0 +1,30 @@
+package ndt5
+
+import "testing"
+
+func Test_lookupClient(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		label   string
+		tests   int
+	}{
+		{"", "none", classicTests},
+		{"v3.6.4", "v3.6", classicTests},
+		{"v3.7.0.2", "v3.7", cTestStatus | cTestS2C | cTestLatency},
+		{"v5.0-NDTinGO", "v5", cTestStatus | cTestS2C | cTestLatency},
+		{"my-client/1.0", "other", cTestStatus | cTestS2C | cTestLatency},
+	} {
+		c := lookupClient(tt.version)
+		if c.label != tt.label {
+			t.Errorf("lookupClient(%q).label = %q, want %q", tt.version, c.label, tt.label)
+		}
+		// Clients may request any test of the client's mask.
+		requested := cTestStatus | cTestS2C | cTestLatency
+		if got := requested & c.tests; got != tt.tests&requested {
+			t.Errorf("lookupClient(%q) allows tests %d, want %d", tt.version, got, tt.tests&requested)
+		}
+	}
+	if lookupClient("v3.5.5").extendedResults || !lookupClient("v3.7.0").extendedResults {
+		t.Error("lookupClient() extendedResults are wrong")
+	}
+}
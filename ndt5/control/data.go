@@ -11,6 +11,7 @@ type ArchivalData struct {
 	UUID            string
 	Protocol        ndt.ConnectionType
 	MessageProtocol string
+	ClientVersion   string               `json:",omitempty"`
 	ClientMetadata  []metadata.NameValue `json:",omitempty"`
 	ServerMetadata  []metadata.NameValue `json:",omitempty"`
 }
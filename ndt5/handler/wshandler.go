@@ -1,19 +1,31 @@
 package handler
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"strconv"
 
+	"github.com/apex/log"
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/admission"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
 	"github.com/m-lab/ndt-server/ndt5/ws"
+	"github.com/m-lab/ndt-server/netx/forwarded"
+	"github.com/m-lab/ndt-server/privacy"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/tracing"
 )
 
 // WSHandler is both an ndt.Server and an http.Handler to allow websocket-based
@@ -36,19 +48,30 @@ type httpHandler struct {
 	connectionType ndt.ConnectionType
 	datadir        string
 	metadata       []metadata.NameValue
+	writer         results.Writer
+	queue          *queue.Queue
+	locator        *geoip.Locator
+	tokens         *admission.Checker
+	cb             *ndt.Callbacks
+	running        *live.Registry
 }
 
 func (s *httpHandler) DataDir() string                    { return s.datadir }
 func (s *httpHandler) ConnectionType() ndt.ConnectionType { return s.connectionType }
 func (s *httpHandler) Metadata() []metadata.NameValue     { return s.metadata }
+func (s *httpHandler) ResultWriter() results.Writer       { return s.writer }
+func (s *httpHandler) Queue() *queue.Queue                { return s.queue }
+func (s *httpHandler) Locator() *geoip.Locator            { return s.locator }
+func (s *httpHandler) Callbacks() *ndt.Callbacks          { return s.cb }
+func (s *httpHandler) Running() *live.Registry            { return s.running }
 
-func (s *httpHandler) LoginCeremony(conn protocol.Connection) (int, error) {
+func (s *httpHandler) LoginCeremony(conn protocol.Connection) (*protocol.ExtendedLogin, error) {
 	// WS and WSS both only support JSON clients and not TLV clients.
-	msg, err := protocol.ReceiveJSONMessage(conn, protocol.MsgExtendedLogin)
-	if err != nil {
-		return 0, err
+	login := &protocol.ExtendedLogin{}
+	if err := protocol.Receive(conn, protocol.JSON, login); err != nil {
+		return nil, err
 	}
-	return strconv.Atoi(msg.Tests)
+	return login, nil
 }
 
 func (s *httpHandler) SingleServingServer(dir string) (ndt.SingleMeasurementServer, error) {
@@ -61,46 +84,96 @@ func (s *httpHandler) SingleServingServer(dir string) (ndt.SingleMeasurementServ
 // an unrecoverable error. It is called ServeHTTP to make sure that the Server
 // implements the http.Handler interface.
 func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// RemoteAddr is the client's address, even behind a trusted proxy.
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	// The WebSocket connection, once upgraded, is closed by its own defer.
+	defer recovery.Recover(logging.Logger.WithField("client_ip", privacy.IP(clientIP)), s.connectionType.Label(), nil)
+	if !ws.CheckOrigin(r) {
+		logging.Logger.WithFields(log.Fields{"client_ip": privacy.IP(clientIP), "origin": r.Header.Get("Origin")}).Warn("Rejected origin")
+		ndt5metrics.ClientOriginRejected.WithLabelValues(s.connectionType.Label()).Inc()
+		s.cb.ClientRejected(clientIP, "Origin")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := s.tokens.Check(r.URL.Query().Get("access_token"), clientIP); err != nil {
+		logging.Logger.WithError(err).WithField("client_ip", privacy.IP(clientIP)).Warn("Rejected")
+		ndt5metrics.ClientTestErrors.WithLabelValues(s.connectionType.Label(), "control", "Admission").Inc()
+		s.cb.ClientRejected(clientIP, "Admission")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	upgrader := ws.Upgrader("ndt")
 	wsc, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("ERROR SERVER:", err)
+		logging.Logger.WithError(err).WithField("client_ip", privacy.IP(clientIP)).Warn("Could not upgrade to WebSockets")
 		return
 	}
-	ws := protocol.AdaptWsConn(wsc)
+	// Control messages are small. Larger ones fail to read and close the
+	// connection with a "message too big" close frame.
+	wsc.SetReadLimit(protocol.ControlReadLimit())
+	// The client address is nil unless the upgrade came through a trusted proxy.
+	ws := protocol.AdaptProxiedWsConn(wsc, forwarded.FromContext(r.Context()))
 	defer warnonerror.Close(ws, "Could not close connection")
 	isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(r.Context())))
-	ndt5.HandleControlChannel(ws, s, isMon)
+	// The spans of the test join the trace of the client, if it sent one.
+	ndt5.HandleControlChannel(tracing.FromRequest(r), ws, s, isMon)
 }
 
-// NewWS returns a handler suitable for http-based connections.
-func NewWS(datadir string, metadata []metadata.NameValue) WSHandler {
+// NewWS returns a handler suitable for http-based connections. Every result is
+// also saved with writer, which may be nil. Tests wait their turn in q, which
+// may be nil to run every test immediately. Results are annotated with the
+// client's location by loc, which may be nil. Clients must present an access
+// token that tokens accepts in the access_token query parameter, unless tokens
+// is nil. The functions in cb, which may be nil, are called as tests run.
+// Running tests are registered with running, which may be nil.
+func NewWS(datadir string, metadata []metadata.NameValue, writer results.Writer, q *queue.Queue, loc *geoip.Locator, tokens *admission.Checker, cb *ndt.Callbacks, running *live.Registry) WSHandler {
+	if writer == nil {
+		writer = results.NullWriter()
+	}
 	return &httpHandler{
 		serverFactory:  &httpFactory{},
 		connectionType: ndt.WS,
 		datadir:        datadir,
 		metadata:       metadata,
+		writer:         writer,
+		queue:          q,
+		locator:        loc,
+		tokens:         tokens,
+		cb:             cb,
+		running:        running,
 	}
 }
 
 type httpsFactory struct {
-	certFile string
-	keyFile  string
+	config *tls.Config
 }
 
 func (hf *httpsFactory) SingleServingServer(dir string) (ndt.SingleMeasurementServer, error) {
-	return singleserving.ListenWSS(dir, hf.certFile, hf.keyFile)
+	return singleserving.ListenWSS(dir, hf.config)
 }
 
-// NewWSS returns a handler suitable for https-based connections.
-func NewWSS(datadir, certFile, keyFile string, metadata []metadata.NameValue) WSHandler {
+// NewWSS returns a handler suitable for https-based connections, whose test
+// servers use the certificates of config. Every result is also saved with
+// writer, which may be nil. Tests wait their turn in q, which may be nil to run
+// every test immediately. Results are annotated with the client's location by
+// loc, which may be nil. Clients must present an access token that tokens
+// accepts in the access_token query parameter, unless tokens is nil. The
+// functions in cb, which may be nil, are called as tests run. Running tests are
+// registered with running, which may be nil.
+func NewWSS(datadir string, config *tls.Config, metadata []metadata.NameValue, writer results.Writer, q *queue.Queue, loc *geoip.Locator, tokens *admission.Checker, cb *ndt.Callbacks, running *live.Registry) WSHandler {
+	if writer == nil {
+		writer = results.NullWriter()
+	}
 	return &httpHandler{
-		serverFactory: &httpsFactory{
-			certFile: certFile,
-			keyFile:  keyFile,
-		},
+		serverFactory:  &httpsFactory{config: config},
 		connectionType: ndt.WSS,
 		datadir:        datadir,
 		metadata:       metadata,
+		writer:         writer,
+		queue:          q,
+		locator:        loc,
+		tokens:         tokens,
+		cb:             cb,
+		running:        running,
 	}
 }
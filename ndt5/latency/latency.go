@@ -0,0 +1,415 @@
+// Package latency implements a UDP test of the round-trip time, jitter, and
+// packet loss of the path to the client. The tests of all clients share one
+// UDP port. The client first sends a hello datagram with the token of its
+// test, so that the server learns its address, and then echoes the probes
+// that the server sends to that address. The server times the echoes.
+package latency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+var (
+	probes   = flag.Int("ndt5.latency.probes", 100, "How many UDP probes the ndt5 latency test sends")
+	interval = flag.Duration("ndt5.latency.interval", 50*time.Millisecond, "How long the ndt5 latency test waits between UDP probes")
+)
+
+// CheckFlags returns an error if the flags of the latency test are out of
+// range.
+func CheckFlags() error {
+	if *probes < 1 {
+		return fmt.Errorf("-ndt5.latency.probes is %d, but the test needs at least one probe", *probes)
+	}
+	return nil
+}
+
+const (
+	tokenSize = 8
+	// packetSize is the size of every datagram: the token, the kind, the
+	// sequence number, and the timestamp.
+	packetSize = tokenSize + 1 + 4 + 8
+	// helloTimeout is how long the client may take to send its hello.
+	helloTimeout = 10 * time.Second
+	// echoTimeout is how long the server waits for echoes after the last
+	// probe. Later echoes count as lost.
+	echoTimeout = time.Second
+)
+
+// The kinds of datagrams.
+const (
+	kindHello = byte(0) // From the client, to reveal its address.
+	kindProbe = byte(1) // From the server.
+	kindEcho  = byte(2) // From the client, a copy of a probe.
+)
+
+// packet is a datagram of the test. All integers are big endian.
+type packet struct {
+	token [tokenSize]byte
+	kind  byte
+	seq   uint32
+	// nanos is when the server sent the probe, in nanoseconds since the first
+	// probe. The client may use it to compute one-way jitter.
+	nanos int64
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, packetSize)
+	copy(b, p.token[:])
+	b[tokenSize] = p.kind
+	binary.BigEndian.PutUint32(b[tokenSize+1:], p.seq)
+	binary.BigEndian.PutUint64(b[tokenSize+5:], uint64(p.nanos))
+	return b
+}
+
+var errBadPacket = errors.New("bad latency packet")
+
+func parse(b []byte) (*packet, error) {
+	if len(b) != packetSize {
+		return nil, errBadPacket
+	}
+	p := &packet{
+		kind:  b[tokenSize],
+		seq:   binary.BigEndian.Uint32(b[tokenSize+1:]),
+		nanos: int64(binary.BigEndian.Uint64(b[tokenSize+5:])),
+	}
+	copy(p.token[:], b)
+	return p, nil
+}
+
+// datagram is a packet received from addr at received.
+type datagram struct {
+	*packet
+	addr     *net.UDPAddr
+	received time.Time
+}
+
+// Server is the UDP server of the latency tests.
+type Server struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	sessions map[[tokenSize]byte]chan datagram
+}
+
+// current is the running Server, if any.
+var current atomic.Pointer[Server]
+
+// ListenAndServe serves latency tests on the UDP address addr until ctx is
+// canceled, and makes the server Current. It returns once the server is
+// listening. An empty addr does nothing.
+func ListenAndServe(ctx context.Context, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	s := &Server{conn: conn, sessions: make(map[[tokenSize]byte]chan datagram)}
+	current.Store(s)
+	go func() {
+		<-ctx.Done()
+		current.CompareAndSwap(s, nil)
+		conn.Close()
+	}()
+	go s.serve()
+	return nil
+}
+
+// Current returns the running Server, or nil if there is none.
+func Current() *Server {
+	return current.Load()
+}
+
+// Addr returns the address of the server.
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// serve hands the datagrams it receives to the sessions of their tokens until
+// the connection is closed. Datagrams of unknown sessions, and those that
+// their session has no room for, are dropped.
+func (s *Server) serve() {
+	b := make([]byte, 2*packetSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		received := time.Now()
+		if err != nil {
+			continue
+		}
+		p, err := parse(b[:n])
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		c := s.sessions[p.token]
+		s.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		select {
+		case c <- datagram{packet: p, addr: addr, received: received}:
+		default:
+		}
+	}
+}
+
+// open starts a session, and returns its token, the channel of its datagrams,
+// and a function that ends it.
+func (s *Server) open() ([tokenSize]byte, <-chan datagram, func(), error) {
+	var token [tokenSize]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return token, nil, nil, err
+	}
+	c := make(chan datagram, 256)
+	s.mu.Lock()
+	s.sessions[token] = c
+	s.mu.Unlock()
+	return token, c, func() {
+		s.mu.Lock()
+		delete(s.sessions, token)
+		s.mu.Unlock()
+	}, nil
+}
+
+// ArchivalData is the data saved by the latency test.
+type ArchivalData struct {
+	ServerPort int
+	ClientIP   string
+	ClientPort int
+
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Sent is the number of probes sent, and Received the number of their
+	// echoes received in time.
+	Sent     int
+	Received int
+
+	MinRTT    time.Duration
+	MedianRTT time.Duration
+	P99RTT    time.Duration
+	// Jitter is the mean difference between the round-trip times of
+	// consecutive echoes, as in RFC 3550.
+	Jitter       time.Duration
+	LossFraction float64
+
+	Error string `json:",omitempty"`
+	// ErrorType classifies Error by the step of the test that failed, using the
+	// same values as the ndt5_client_test_errors_total metric.
+	ErrorType string `json:",omitempty"`
+}
+
+// ResultsMessage returns the results in the "name: value" form of the other
+// results sent to the client at the end of the tests. Times are in
+// milliseconds.
+func (r *ArchivalData) ResultsMessage() string {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return fmt.Sprintf(
+		"Latency.MinRTT: %.3f\nLatency.MedianRTT: %.3f\nLatency.P99RTT: %.3f\nLatency.Jitter: %.3f\nLatency.LossFraction: %.4f\n",
+		ms(r.MinRTT), ms(r.MedianRTT), ms(r.P99RTT), ms(r.Jitter), r.LossFraction)
+}
+
+// summarize computes the statistics of the round-trip times rtts of the echoes
+// of sent probes. rtts are in the order of the probes.
+func (r *ArchivalData) summarize(sent int, rtts []time.Duration) {
+	r.Sent = sent
+	r.Received = len(rtts)
+	if sent > 0 {
+		r.LossFraction = float64(sent-len(rtts)) / float64(sent)
+	}
+	if len(rtts) == 0 {
+		return
+	}
+	var diffs time.Duration
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		diffs += d
+	}
+	if len(rtts) > 1 {
+		r.Jitter = diffs / time.Duration(len(rtts)-1)
+	}
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	r.MinRTT = sorted[0]
+	r.MedianRTT = percentile(sorted, 50)
+	r.P99RTT = percentile(sorted, 99)
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ManageTest manages the latency test lifecycle.
+func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server, srv *Server) (record *ArchivalData, err error) {
+	localCtx, localCancel := context.WithTimeout(ctx, helloTimeout+time.Duration(*probes)*(*interval)+echoTimeout+20*time.Second)
+	defer localCancel()
+	defer func() {
+		if err != nil && record != nil {
+			record.Error = err.Error()
+		}
+	}()
+	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("test", "latency")
+
+	m := controlConn.Messager()
+	connType := s.ConnectionType().Label()
+	fail := func(errType string) {
+		record.ErrorType = errType
+		metrics.ClientTestErrors.WithLabelValues(connType, "latency", errType).Inc()
+	}
+
+	token, datagrams, closeSession, err := srv.open()
+	if err != nil {
+		logger.WithError(err).Warn("Could not open latency session")
+		fail("OpenSession")
+		return record, err
+	}
+	defer closeSession()
+	record.ServerPort = srv.Addr().Port
+	record.ClientIP, _ = controlConn.ClientIPAndPort()
+
+	err = m.Send(&protocol.Prepare{Port: record.ServerPort, Args: []string{hex.EncodeToString(token[:])}})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestPrepare")
+		fail("TestPrepare")
+		return record, err
+	}
+
+	// Only probe the address that the control connection comes from, so that
+	// the server cannot be used to send probes to third parties.
+	clientIP := net.ParseIP(record.ClientIP)
+	helloCtx, helloCancel := context.WithTimeout(localCtx, helloTimeout)
+	defer helloCancel()
+	var client *net.UDPAddr
+	for client == nil {
+		select {
+		case d := <-datagrams:
+			if d.kind == kindHello && d.addr.IP.Equal(clientIP) {
+				client = d.addr
+			}
+		case <-helloCtx.Done():
+			logger.Warn("Did not receive the client's hello")
+			fail("Hello")
+			return record, errors.New("no hello from the client")
+		}
+	}
+	record.ClientPort = client.Port
+
+	err = m.Send(&protocol.Start{})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestStart")
+		fail("TestStart")
+		return record, err
+	}
+
+	record.StartTime = time.Now()
+	rtts, err := srv.probe(localCtx, token, client, datagrams, *probes, *interval)
+	record.EndTime = time.Now()
+	if err != nil {
+		logger.WithError(err).Warn("Could not send probes")
+		fail("Probe")
+		return record, err
+	}
+	record.summarize(*probes, rtts)
+	logger.WithFields(log.Fields{
+		"median_rtt":    record.MedianRTT,
+		"jitter":        record.Jitter,
+		"loss_fraction": record.LossFraction,
+	}).Info("Latency test done")
+
+	err = m.Send(&protocol.TestMessage{Text: record.ResultsMessage()})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestMsg with latency results")
+		fail("TestMsgSend")
+		return record, err
+	}
+	err = m.Send(&protocol.Finalize{})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestFinalize")
+		fail("TestFinalize")
+		return record, err
+	}
+	return record, nil
+}
+
+// probe sends n probes to client, one every gap, and returns the round-trip
+// times of the echoes received from client in datagrams, in the order of the
+// probes. Duplicate echoes are ignored.
+func (s *Server) probe(ctx context.Context, token [tokenSize]byte, client *net.UDPAddr, datagrams <-chan datagram, n int, gap time.Duration) ([]time.Duration, error) {
+	sent := make([]time.Time, n)
+	rtt := make([]time.Duration, n)
+	start := time.Now()
+	ticker := time.NewTicker(gap)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	for seq := 0; seq < n || deadline != nil; {
+		select {
+		case <-ticker.C:
+		case d := <-datagrams:
+			if d.kind == kindEcho && d.addr.IP.Equal(client.IP) && d.addr.Port == client.Port &&
+				int(d.seq) < seq && rtt[d.seq] == 0 {
+				rtt[d.seq] = d.received.Sub(sent[d.seq])
+			}
+			continue
+		case <-deadline:
+			deadline = nil
+			continue
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if seq == n {
+			continue
+		}
+		sent[seq] = time.Now()
+		p := &packet{token: token, kind: kindProbe, seq: uint32(seq), nanos: int64(sent[seq].Sub(start))}
+		if _, err := s.conn.WriteToUDP(p.marshal(), client); err != nil {
+			return nil, err
+		}
+		seq++
+		if seq == n {
+			ticker.Stop()
+			deadline = time.After(echoTimeout)
+		}
+	}
+	rtts := []time.Duration{}
+	for _, d := range rtt {
+		if d > 0 {
+			rtts = append(rtts, d)
+		}
+	}
+	return rtts, nil
+}
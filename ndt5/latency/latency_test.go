@@ -0,0 +1,96 @@
+package latency
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestArchivalData_summarize(t *testing.T) {
+	ms := time.Millisecond
+	r := &ArchivalData{}
+	r.summarize(5, []time.Duration{10 * ms, 14 * ms, 12 * ms, 40 * ms})
+	if r.Sent != 5 || r.Received != 4 || r.LossFraction != 0.2 {
+		t.Errorf("Sent, Received, LossFraction = %d, %d, %v, want 5, 4, 0.2", r.Sent, r.Received, r.LossFraction)
+	}
+	if r.MinRTT != 10*ms || r.MedianRTT != 12*ms || r.P99RTT != 40*ms {
+		t.Errorf("MinRTT, MedianRTT, P99RTT = %v, %v, %v, want 10ms, 12ms, 40ms", r.MinRTT, r.MedianRTT, r.P99RTT)
+	}
+	// (4 + 2 + 28) / 3
+	if want := 34 * ms / 3; r.Jitter != want {
+		t.Errorf("Jitter = %v, want %v", r.Jitter, want)
+	}
+	want := "Latency.MinRTT: 10.000\nLatency.MedianRTT: 12.000\nLatency.P99RTT: 40.000\nLatency.Jitter: 11.333\nLatency.LossFraction: 0.2000\n"
+	if got := r.ResultsMessage(); got != want {
+		t.Errorf("ResultsMessage() = %q, want %q", got, want)
+	}
+
+	r = &ArchivalData{}
+	r.summarize(3, nil)
+	if r.LossFraction != 1 || r.MedianRTT != 0 {
+		t.Errorf("summarize() without echoes = %+v", r)
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	defer func(n int) { *probes = n }(*probes)
+	for n, ok := range map[int]bool{-1: false, 0: false, 1: true, 100: true} {
+		*probes = n
+		if err := CheckFlags(); (err == nil) != ok {
+			t.Errorf("CheckFlags() with %d probes = %v", n, err)
+		}
+	}
+}
+
+func TestServer_probe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ListenAndServe(ctx, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	srv := Current()
+	token, datagrams, closeSession, err := srv.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSession()
+
+	// The client echoes every probe but the second.
+	client, err := net.DialUDP("udp", nil, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go func() {
+		b := make([]byte, packetSize)
+		for {
+			n, err := client.Read(b)
+			if err != nil {
+				return
+			}
+			p, err := parse(b[:n])
+			if err != nil || p.kind != kindProbe || p.seq == 1 {
+				continue
+			}
+			p.kind = kindEcho
+			client.Write(p.marshal())
+		}
+	}()
+	hello := &packet{token: token, kind: kindHello}
+	if _, err := client.Write(hello.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	d := <-datagrams
+	if d.kind != kindHello {
+		t.Fatalf("received kind %d, want a hello", d.kind)
+	}
+
+	rtts, err := srv.probe(ctx, token, d.addr, datagrams, 5, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtts) != 4 {
+		t.Errorf("probe() returned %d RTTs, want 4", len(rtts))
+	}
+}
@@ -0,0 +1,499 @@
+// Package legacy runs the servers of the legacy ndt5 protocol: the raw server
+// that also forwards WebSocket clients, the WS server, and the WSS server. It
+// lets other Go programs embed an ndt5 endpoint without copying the wiring of
+// the ndt-server binary.
+package legacy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/m-lab/ndt-server/abuse"
+	"github.com/m-lab/ndt-server/admission"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/drain"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/iplist"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/metadata"
+	ndt5handler "github.com/m-lab/ndt-server/ndt5/handler"
+	"github.com/m-lab/ndt-server/ndt5/latency"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/plain"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/ndt7/listener"
+	"github.com/m-lab/ndt-server/netx/forwarded"
+	"github.com/m-lab/ndt-server/ratelimit"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// forwardHeaderTimeout is how long the WS server waits for the PROXY protocol
+// header of the connections that the raw server forwards to it.
+const forwardHeaderTimeout = 5 * time.Second
+
+// Server runs the ndt5 servers. Create it with NewServer.
+type Server struct {
+	datadir  string
+	htmlDir  string
+	metadata []metadata.NameValue
+
+	rawAddr    string
+	rawTLSAddr string
+	udpAddr    string
+	wsAddr     string
+	wssAddr    string
+
+	certFile  string
+	keyFile   string
+	tlsConfig *tls.Config
+
+	writer  results.Writer
+	locator *geoip.Locator
+
+	queue    *queue.Queue
+	limiter  *ratelimit.Limiter
+	ipList   *iplist.List
+	abuse    *abuse.Detector
+	tokens   *admission.Checker
+	accepter plain.Accepter
+	control  func(http.Handler) http.Handler
+	trusted  forwarded.Trusted
+
+	registerer prometheus.Registerer
+	logger     *log.Logger
+	callbacks  *ndt.Callbacks
+	running    *live.Registry
+
+	// started holds the UUIDs of the tests that were admitted and have not
+	// completed yet.
+	started sync.Map
+
+	tests drain.Tracker
+	raw   plain.Server
+	ws    *http.Server
+	wss   *http.Server
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithDataDir sets the directory that the per-test result files are saved in.
+// The default is /var/spool/ndt/ndt5.
+func WithDataDir(dir string) Option {
+	return func(s *Server) { s.datadir = dir }
+}
+
+// WithHTMLDir serves the static web content in dir from the WS and WSS
+// servers. By default no content is served.
+func WithHTMLDir(dir string) Option {
+	return func(s *Server) { s.htmlDir = dir }
+}
+
+// WithMetadata adds md to every result.
+func WithMetadata(md []metadata.NameValue) Option {
+	return func(s *Server) { s.metadata = md }
+}
+
+// WithRawAddr sets the address of the raw server. The default is :3001. An
+// empty address disables the raw server.
+func WithRawAddr(addr string) Option {
+	return func(s *Server) { s.rawAddr = addr }
+}
+
+// WithRawTLSAddr serves raw NDT clients over TLS on addr, with the
+// certificate of WithTLS. By default, and without a certificate, no such
+// server is started. It requires the raw server.
+func WithRawTLSAddr(addr string) Option {
+	return func(s *Server) { s.rawTLSAddr = addr }
+}
+
+// WithLatencyAddr serves the UDP latency test on the UDP address addr. By
+// default the test is not offered.
+func WithLatencyAddr(addr string) Option {
+	return func(s *Server) { s.udpAddr = addr }
+}
+
+// WithWSAddr sets the address of the WS server, which the raw server forwards
+// WebSocket clients to. The default is 127.0.0.1:3002.
+func WithWSAddr(addr string) Option {
+	return func(s *Server) { s.wsAddr = addr }
+}
+
+// WithWSSAddr sets the address of the WSS server. The default is :3010.
+func WithWSSAddr(addr string) Option {
+	return func(s *Server) { s.wssAddr = addr }
+}
+
+// WithTLS enables the WSS server with the certificate and key in certFile and
+// keyFile. The config, which may be nil, sets the other TLS parameters.
+func WithTLS(certFile, keyFile string, config *tls.Config) Option {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+		s.tlsConfig = config
+	}
+}
+
+// WithTLSConfig enables the WSS server with the certificates of config, e.g.
+// a config that obtains them with ACME, instead of certificate files.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.certFile = ""
+		s.keyFile = ""
+		s.tlsConfig = config
+	}
+}
+
+// WithResultWriter saves every result with w, in addition to the per-test
+// files in the data directory.
+func WithResultWriter(w results.Writer) Option {
+	return func(s *Server) { s.writer = w }
+}
+
+// WithLocator annotates results with the client's location by loc.
+func WithLocator(loc *geoip.Locator) Option {
+	return func(s *Server) { s.locator = loc }
+}
+
+// WithQueue makes tests wait their turn in q.
+func WithQueue(q *queue.Queue) Option {
+	return func(s *Server) { s.queue = q }
+}
+
+// WithRateLimiter limits how often each client may start a test, whichever
+// server it connects to. Clients over the limit are told that the server is
+// busy once they have logged in, when their address is known even behind a
+// proxy. The limit is enforced by the queue of the tests.
+func WithRateLimiter(l *ratelimit.Limiter) Option {
+	return func(s *Server) { s.limiter = l }
+}
+
+// WithIPList closes the connections of the raw server, and rejects the
+// requests of the WSS server, from clients that l blocks. Clients of the WS
+// server are checked by the raw server that forwards them.
+func WithIPList(l *iplist.List) Option {
+	return func(s *Server) { s.ipList = l }
+}
+
+// WithAbuseDetector reports the outcome of every test to d, and rejects the
+// clients that d bans like WithIPList rejects blocked clients.
+func WithAbuseDetector(d *abuse.Detector) Option {
+	return func(s *Server) { s.abuse = d }
+}
+
+// WithTokens requires clients to present an access token that c accepts.
+func WithTokens(c *admission.Checker) Option {
+	return func(s *Server) { s.tokens = c }
+}
+
+// WithAccessControl makes the raw server accept connections with tx, and wraps
+// the WSS server's handler with wrap. Either may be nil.
+func WithAccessControl(tx plain.Accepter, wrap func(http.Handler) http.Handler) Option {
+	return func(s *Server) {
+		s.accepter = tx
+		s.control = wrap
+	}
+}
+
+// WithTrustedProxies lets the reverse proxies in t report the client address
+// of WS and WSS tests.
+func WithTrustedProxies(t forwarded.Trusted) Option {
+	return func(s *Server) { s.trusted = t }
+}
+
+// WithRegisterer also registers the ndt5 metrics with reg.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(s *Server) { s.registerer = reg }
+}
+
+// WithLogger logs the server's messages and the WS and WSS access logs with l.
+// The messages of running tests are always logged with the standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithCallbacks calls the functions in c as tests run, so that the embedding
+// program can react to tests and their results.
+func WithCallbacks(c ndt.Callbacks) Option {
+	return func(s *Server) { s.callbacks = &c }
+}
+
+// WithRegistry registers the running tests with r, so that they can be listed
+// and canceled.
+func WithRegistry(r *live.Registry) Option {
+	return func(s *Server) { s.running = r }
+}
+
+// NewServer creates a Server configured by opts.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		datadir: "/var/spool/ndt/ndt5",
+		rawAddr: ":3001",
+		wsAddr:  "127.0.0.1:3002",
+		wssAddr: ":3010",
+		writer:  results.NullWriter(),
+		logger:  log.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.limiter != nil {
+		if s.queue == nil {
+			// Without a queue, every test is admitted immediately.
+			s.queue = queue.New(math.MaxInt, 0, 0)
+		}
+		s.queue.WithClientLimit(s.limiter)
+	}
+	if s.abuse != nil {
+		s.observeTests()
+	}
+	return s
+}
+
+// observeTests wraps the callbacks of s so that the outcome of every test is
+// reported to the abuse detector. Tests count as complete if any of their
+// measurements succeeded. Clients that were admitted, or that never finished
+// logging in, and that completed nothing count as abusive. Clients that the
+// server turned away after logging in, e.g. because it was busy, do not.
+func (s *Server) observeTests() {
+	c := ndt.Callbacks{}
+	if s.callbacks != nil {
+		c = *s.callbacks
+	}
+	onStart, onComplete := c.OnTestStart, c.OnTestComplete
+	c.OnTestStart = func(uuid, clientIP string) {
+		s.started.Store(uuid, true)
+		if onStart != nil {
+			onStart(uuid, clientIP)
+		}
+	}
+	c.OnTestComplete = func(r *results.Result) {
+		_, started := s.started.LoadAndDelete(r.UUID)
+		if record, ok := r.Data.(*data.NDT5Result); ok {
+			switch {
+			case completed(record):
+				s.abuse.Observe(record.ClientIP, true)
+			case started || record.Control == nil || record.Control.MessageProtocol == "":
+				s.abuse.Observe(record.ClientIP, false)
+			}
+		}
+		if onComplete != nil {
+			onComplete(r)
+		}
+	}
+	s.callbacks = &c
+}
+
+// completed reports whether any measurement of record succeeded.
+func completed(record *data.NDT5Result) bool {
+	return (record.C2S != nil && record.C2S.Error == "") ||
+		(record.S2C != nil && record.S2C.Error == "")
+}
+
+// blocked reports the rejection of a client blocked by the IP list.
+func (s *Server) blocked(ip string) {
+	s.callbacks.ClientRejected(ip, "Blocked")
+}
+
+// banned reports the rejection of a client banned by the abuse detector.
+func (s *Server) banned(ip string) {
+	s.callbacks.ClientRejected(ip, "Banned")
+}
+
+// limit wraps tx so that blocked clients, and then banned clients, are
+// rejected. The label names the server in metrics.
+func (s *Server) limit(tx plain.Accepter, label string) plain.Accepter {
+	return s.abuse.Accepter(s.ipList.Accepter(tx, label, s.blocked), label, s.banned)
+}
+
+// acceptAll accepts every connection.
+type acceptAll struct{}
+
+func (acceptAll) Accept(l net.Listener) (net.Conn, error) {
+	return l.Accept()
+}
+
+// httpServer creates an *http.Server with explicit read and write timeouts.
+// Requests are checked by control, if it is not nil, before they are logged.
+func (s *Server) httpServer(addr string, handler http.Handler, control func(http.Handler) http.Handler) *http.Server {
+	handler = handlers.LoggingHandler(s.logger.Writer(), handler)
+	if control != nil {
+		handler = control(handler)
+	}
+	return &http.Server{
+		Addr:    addr,
+		Handler: s.trusted.Then(handler),
+		// NOTE: set absolute read and write timeouts for server connections.
+		// This prevents clients, or middleboxes, from opening a connection and
+		// holding it open indefinitely. This applies equally to TLS and non-TLS
+		// servers.
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+}
+
+// mux returns a ServeMux that serves tests with h, and the static web content
+// if there is any.
+func (s *Server) mux(h http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	if s.htmlDir != "" {
+		mux.Handle("/", http.FileServer(http.Dir(s.htmlDir)))
+	}
+	mux.Handle("/ndt_protocol", s.tests.Then(h))
+	return mux
+}
+
+// ListenAndServe starts the servers, which serve until ctx is canceled or
+// Shutdown is called. It returns once they are listening.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if s.registerer != nil {
+		if err := ndt5metrics.Register(s.registerer); err != nil {
+			return err
+		}
+	}
+
+	config, err := s.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	if s.udpAddr != "" {
+		s.logger.Println("About to listen for ndt5 UDP latency tests on " + s.udpAddr)
+		if err := latency.ListenAndServe(ctx, s.udpAddr); err != nil {
+			return err
+		}
+	}
+
+	// The WS server is started first, so that the raw server knows where to
+	// forward WebSocket clients even if the WS port is chosen by the kernel.
+	// The raw server reports the address of the clients it forwards in a
+	// PROXY protocol header.
+	// NOTE: the IP list and access control are not applied to the WS server to
+	// prevent 'double jeopardy' for forwarded clients.
+	s.ws = s.httpServer(s.wsAddr, s.mux(
+		ndt5handler.NewWS(s.datadir, s.metadata, s.writer, s.queue, s.locator, s.tokens, s.callbacks, s.running)), nil)
+	s.logger.Println("About to listen for unencrypted ndt5 NDT tests on " + s.wsAddr)
+	if err := listener.ListenAndServeLocalProxyAsync(s.ws, forwardHeaderTimeout); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.ws.Close()
+	}()
+
+	tx := s.accepter
+	if tx == nil {
+		tx = acceptAll{}
+	}
+	if s.rawAddr != "" {
+		s.raw = plain.NewServer(s.datadir, s.ws.Addr, s.metadata, s.writer, s.queue, s.locator, s.tokens, s.callbacks, s.running)
+		if config != nil {
+			// Connections on the raw port are already checked against the IP
+			// list and access controlled, so neither applies to its WSS
+			// clients.
+			s.raw.EnableTLS(config, s.mux(
+				ndt5handler.NewWSS(s.datadir, config, s.metadata, s.writer, s.queue, s.locator, s.tokens, s.callbacks, s.running)))
+		}
+		if err := s.raw.ListenAndServe(ctx, s.rawAddr, s.limit(tx, "ndt5+plain")); err != nil {
+			return err
+		}
+		if s.rawTLSAddr != "" && config != nil {
+			s.logger.Println("About to listen for ndt5 raw TLS tests on " + s.rawTLSAddr)
+			if err := s.raw.ListenAndServeTLS(ctx, s.rawTLSAddr, config, s.limit(tx, "ndt5+tls")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if config == nil {
+		s.logger.Printf("Cert=%q and Key=%q means no ndt5 WsS server will be started.\n", s.certFile, s.keyFile)
+		return nil
+	}
+	s.wss = s.httpServer(s.wssAddr, s.mux(s.ipList.Then(s.abuse.Then(
+		ndt5handler.NewWSS(s.datadir, config, s.metadata, s.writer, s.queue, s.locator, s.tokens, s.callbacks, s.running),
+		"ndt5+wss", s.banned), "ndt5+wss", s.blocked)), s.control)
+	s.wss.TLSConfig = config
+	if s.raw != nil {
+		// Clients that negotiate raw NDT over TLS with ALPN run raw tests on
+		// the WSS port. The HTTP middleware of the WSS server doesn't see
+		// them, so they are checked like the clients of the raw TLS port.
+		alpnTx := s.limit(tx, "ndt5+tls")
+		s.wss.TLSConfig = plain.WithALPN(s.wss.TLSConfig)
+		s.wss.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+			plain.ALPNProtocol: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+				s.raw.ServeTLSConn(conn, alpnTx)
+			},
+		}
+	}
+	s.logger.Println("About to listen for ndt5 WsS tests on " + s.wssAddr)
+	// The certificates are in the TLS config.
+	if err := listener.ListenAndServeTLSAsync(s.wss, "", ""); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.wss.Close()
+	}()
+	return nil
+}
+
+// serverTLSConfig returns the TLS configuration of the TLS servers, which
+// serves the certificate in certFile and keyFile, or the certificates of the
+// config of WithTLSConfig. It returns nil if TLS is not configured.
+func (s *Server) serverTLSConfig() (*tls.Config, error) {
+	if s.certFile == "" || s.keyFile == "" {
+		if s.tlsConfig != nil && (len(s.tlsConfig.Certificates) > 0 || s.tlsConfig.GetCertificate != nil) {
+			return s.tlsConfig, nil
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// RawAddr returns the address of the raw server, or nil if it is not running.
+func (s *Server) RawAddr() net.Addr {
+	if s.raw == nil {
+		return nil
+	}
+	return s.raw.Addr()
+}
+
+// RawTLSAddr returns the address of the raw TLS server, or nil if it is not
+// running.
+func (s *Server) RawTLSAddr() net.Addr {
+	if s.raw == nil {
+		return nil
+	}
+	return s.raw.TLSAddr()
+}
+
+// Shutdown stops accepting new tests and waits for the tests that are already
+// running to finish, or for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.tests.Drain()
+	var errs []error
+	if s.raw != nil {
+		errs = append(errs, s.raw.Shutdown(ctx))
+	}
+	errs = append(errs, s.tests.Wait(ctx))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,311 @@
+package legacy
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt-server/abuse"
+	"github.com/m-lab/ndt-server/admission"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/client"
+	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ratelimit"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	completed := make(chan *results.Result, 1)
+	reg := prometheus.NewRegistry()
+	s := NewServer(
+		WithDataDir(t.TempDir()),
+		WithRawAddr(":0"),
+		WithWSAddr("127.0.0.1:0"),
+		WithRegisterer(reg),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithCallbacks(ndt.Callbacks{
+			OnTestComplete: func(r *results.Result) { completed <- r },
+		}),
+	)
+	if err := s.ListenAndServe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.RawAddr() == nil {
+		t.Fatal("RawAddr() = nil")
+	}
+	// The raw server sends its kickoff message to clients that are not HTTP.
+	conn, err := net.Dial("tcp", s.RawAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{2, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	kickoff := make([]byte, len("123456 654321"))
+	if _, err := conn.Read(kickoff); err != nil || string(kickoff) != "123456 654321" {
+		t.Errorf("Read() = %q, %v, want the kickoff message", kickoff, err)
+	}
+	conn.Close()
+
+	// Even the result of the abandoned test is reported.
+	select {
+	case r := <-completed:
+		if r.Datatype != "ndt5" {
+			t.Errorf("OnTestComplete() got a %q result", r.Datatype)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnTestComplete() was not called")
+	}
+
+	// The metrics are also registered with the given registry.
+	if _, err := reg.Gather(); err != nil {
+		t.Error(err)
+	}
+	if err := reg.Register(prometheus.NewCounter(prometheus.CounterOpts{Name: "ndt5_client_test_errors_total"})); err == nil {
+		t.Error("the ndt5 metrics were not registered")
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	defer func(d time.Duration) { *protocol.TestDuration = d }(*protocol.TestDuration)
+	*protocol.TestDuration = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan string, 1)
+	s := NewServer(
+		WithDataDir(t.TempDir()),
+		WithRawAddr("127.0.0.1:0"),
+		WithWSAddr("127.0.0.1:0"),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithCallbacks(ndt.Callbacks{
+			OnTestStart: func(uuid, _ string) { started <- uuid },
+		}),
+	)
+	if err := s.ListenAndServe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		r   *client.Result
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c := &client.Client{Server: s.RawAddr().String(), Duration: time.Second}
+		r, err := c.Run(context.Background(), client.TestC2S|client.TestS2C)
+		done <- result{r, err}
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the test did not start")
+	}
+	// The server stops, but the running test may finish within the grace
+	// period.
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Run() = %v, want the test to complete", r.err)
+	}
+	if r.r.C2S == nil || r.r.S2C == nil {
+		t.Errorf("Run() = %+v, want c2s and s2c measurements", r.r)
+	}
+}
+
+// TestServer_rateLimit checks that clients over their rate limit are told that
+// the server is busy, whether they connect with raw NDT or WebSockets.
+func TestServer_rateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rejected := make(chan string, 2)
+	s := NewServer(
+		WithDataDir(t.TempDir()),
+		WithRawAddr("127.0.0.1:0"),
+		WithWSAddr("127.0.0.1:0"),
+		WithRateLimiter(ratelimit.New(1, 1)),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithCallbacks(ndt.Callbacks{
+			OnClientRejected: func(_, reason string) { rejected <- reason },
+		}),
+	)
+	if err := s.ListenAndServe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&client.Client{Server: s.RawAddr().String()}).Run(ctx, 0); err != nil {
+		t.Fatalf("first Run() = %v", err)
+	}
+	for _, p := range []client.Protocol{client.Raw, client.WS} {
+		c := &client.Client{Protocol: p, Server: s.RawAddr().String()}
+		if _, err := c.Run(ctx, 0); err != client.ErrServerBusy {
+			t.Errorf("Run() over the limit with %v = %v, want %v", p, err, client.ErrServerBusy)
+		}
+		if reason := <-rejected; reason != "RateLimit" {
+			t.Errorf("OnClientRejected() reason = %q, want RateLimit", reason)
+		}
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
+
+// TestServer_singlePortRateLimit checks that the test connections made to the
+// control port of a single-port server are not charged to the client's rate
+// limit.
+func TestServer_singlePortRateLimit(t *testing.T) {
+	defer flag.Set("ndt5.single-port", "false")
+	flag.Set("ndt5.single-port", "true")
+	defer func(d time.Duration) { *protocol.TestDuration = d }(*protocol.TestDuration)
+	*protocol.TestDuration = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer(
+		WithDataDir(t.TempDir()),
+		WithRawAddr("127.0.0.1:0"),
+		WithWSAddr("127.0.0.1:0"),
+		WithRateLimiter(ratelimit.New(1, 1)),
+		WithLogger(log.New(io.Discard, "", 0)),
+	)
+	if err := s.ListenAndServe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c := &client.Client{Server: s.RawAddr().String(), Duration: time.Second}
+	r, err := c.Run(ctx, client.TestC2S|client.TestS2C)
+	if err != nil {
+		t.Fatalf("Run() = %v, want the test to complete", err)
+	}
+	if r.C2S == nil || r.S2C == nil {
+		t.Errorf("Run() = %+v, want c2s and s2c measurements", r)
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
+
+type fakeVerifier struct{}
+
+func (fakeVerifier) Verify(token string, exp jwt.Expected) (*jwt.Claims, error) {
+	return &jwt.Claims{Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}, nil
+}
+
+// TestServer_forwardedToken checks that the WebSocket clients forwarded by the
+// raw server are admitted with tokens issued to their own address, which the
+// raw server learns from a proxy in front of it.
+func TestServer_forwardedToken(t *testing.T) {
+	defer flag.Set("ndt5.proxy-protocol", "false")
+	flag.Set("ndt5.proxy-protocol", "true")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer(
+		WithDataDir(t.TempDir()),
+		WithRawAddr("127.0.0.1:0"),
+		WithWSAddr("127.0.0.1:0"),
+		WithTokens(admission.New(fakeVerifier{}, "")),
+		WithLogger(log.New(io.Discard, "", 0)),
+	)
+	if err := s.ListenAndServe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		issuedTo string
+		wantErr  bool
+	}{
+		{name: "client", issuedTo: "192.0.2.1"},
+		{name: "other", issuedTo: "192.0.2.9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"client_ip":"`+tt.issuedTo+`"}`)) + ".c2ln"
+			d := websocket.Dialer{
+				Subprotocols: []string{"ndt"},
+				NetDial: func(network, addr string) (net.Conn, error) {
+					conn, err := net.Dial(network, addr)
+					if err == nil {
+						_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 4321 3001\r\n"))
+					}
+					return conn, err
+				},
+			}
+			ws, resp, err := d.Dial("ws://"+s.RawAddr().String()+"/ndt_protocol?access_token="+token, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() = %v, %v, wantErr %t", resp, err, tt.wantErr)
+			}
+			if ws != nil {
+				ws.Close()
+			}
+		})
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
+
+func TestServer_observeTests(t *testing.T) {
+	bans := abuse.New(1, time.Minute, time.Hour)
+	completed := 0
+	s := NewServer(
+		WithAbuseDetector(bans),
+		WithCallbacks(ndt.Callbacks{
+			OnTestComplete: func(r *results.Result) { completed++ },
+		}),
+	)
+	result := func(uuid, ip, encoding string, c2sRecord *c2s.ArchivalData) *results.Result {
+		record := &data.NDT5Result{
+			ClientIP: ip,
+			Control:  &control.ArchivalData{UUID: uuid, MessageProtocol: encoding},
+			C2S:      c2sRecord,
+		}
+		return &results.Result{Datatype: "ndt5", UUID: uuid, Data: record}
+	}
+	// A client turned away by the server after logging in is not abusive.
+	s.callbacks.TestComplete(result("a", "192.0.2.1", "JSON", nil))
+	// Neither is a client that completed a test.
+	s.callbacks.TestStart("b", "192.0.2.2")
+	s.callbacks.TestComplete(result("b", "192.0.2.2", "JSON", &c2s.ArchivalData{}))
+	if len(bans.Bans()) != 0 {
+		t.Errorf("clients were banned: %v", bans.Bans())
+	}
+	// A client that never logged in is.
+	s.callbacks.TestComplete(result("c", "192.0.2.3", "", nil))
+	// And so is a client admitted to tests that all failed.
+	s.callbacks.TestStart("d", "192.0.2.4")
+	s.callbacks.TestComplete(result("d", "192.0.2.4", "JSON", &c2s.ArchivalData{Error: "timeout"}))
+	if !bans.Banned("192.0.2.3") || !bans.Banned("192.0.2.4") {
+		t.Errorf("Bans() = %v, want 192.0.2.3 and 192.0.2.4", bans.Bans())
+	}
+	if completed != 4 {
+		t.Errorf("OnTestComplete was called %d times, want 4", completed)
+	}
+}
@@ -2,10 +2,11 @@ package meta
 
 import (
 	"context"
-	"log"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
@@ -15,6 +16,24 @@ import (
 // maxClientMessages is the maximum allowed messages we will accept from a client.
 var maxClientMessages = 20
 
+const (
+	// maxNameLength is the maximum length of a metadata name, in bytes.
+	maxNameLength = 63
+	// maxValueLength is the maximum length of a metadata value, in bytes.
+	maxValueLength = 255
+)
+
+// truncate shortens s to at most n bytes without splitting a multi-byte rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
 // ManageTest runs the meta tests. If the given ctx is canceled or the meta test
 // takes longer than 15sec, then ManageTest will return after the next ReceiveMessage.
 // The given protocolMessager should have its own connection timeout to prevent
@@ -27,16 +46,17 @@ func ManageTest(ctx context.Context, m protocol.Messager, s ndt.Server) ([]metad
 	var message []byte
 	results := []metadata.NameValue{}
 	connType := s.ConnectionType().Label()
+	logger := logging.FromContext(ctx).WithField("test", "meta")
 
-	err = m.SendMessage(protocol.TestPrepare, []byte{})
+	err = m.Send(&protocol.Prepare{})
 	if err != nil {
-		log.Println("META TestPrepare:", err)
+		logger.WithError(err).Warn("META TestPrepare")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestPrepare").Inc()
 		return nil, err
 	}
-	err = m.SendMessage(protocol.TestStart, []byte{})
+	err = m.Send(&protocol.Start{})
 	if err != nil {
-		log.Println("META TestStart:", err)
+		logger.WithError(err).Warn("META TestStart")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestStart").Inc()
 		return nil, err
 	}
@@ -52,31 +72,29 @@ func ManageTest(ctx context.Context, m protocol.Messager, s ndt.Server) ([]metad
 		if len(s) != 2 {
 			continue
 		}
-		name := strings.TrimSpace(s[0])
-		if len(name) > 63 {
-			name = name[:63]
-		}
-		value := strings.TrimSpace(s[1])
-		if len(value) > 255 {
-			value = value[:255]
+		name := truncate(strings.TrimSpace(s[0]), maxNameLength)
+		if name == "" {
+			// A value without a name can't be matched with anything later.
+			continue
 		}
+		value := truncate(strings.TrimSpace(s[1]), maxValueLength)
 		results = append(results, metadata.NameValue{Name: name, Value: value})
 	}
 	if localCtx.Err() != nil {
-		log.Println("META context error:", localCtx.Err())
+		logger.WithError(localCtx.Err()).Warn("META context error")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "context").Inc()
 		return nil, localCtx.Err()
 	}
 	if err != nil {
-		log.Println("Error reading JSON message:", err)
+		logger.WithError(err).Warn("Error reading JSON message")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "ReceiveMessage").Inc()
 		return nil, err
 	}
 	// Count the number meta values sent by the client (when there are no errors).
 	metrics.SubmittedMetaValues.Observe(float64(count))
-	err = m.SendMessage(protocol.TestFinalize, []byte{})
+	err = m.Send(&protocol.Finalize{})
 	if err != nil {
-		log.Println("META TestFinalize:", err)
+		logger.WithError(err).Warn("META TestFinalize")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestFinalize").Inc()
 		return nil, err
 	}
@@ -6,9 +6,13 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/results"
 )
 
 type sendMessage struct {
@@ -38,12 +42,31 @@ func (s *fakeServer) DataDir() string {
 func (s *fakeServer) Metadata() []metadata.NameValue {
 	return []metadata.NameValue{}
 }
-func (s *fakeServer) LoginCeremony(protocol.Connection) (int, error) {
-	return 0, nil
+func (s *fakeServer) LoginCeremony(protocol.Connection) (*protocol.ExtendedLogin, error) {
+	return &protocol.ExtendedLogin{}, nil
+}
+func (s *fakeServer) ResultWriter() results.Writer {
+	return results.NullWriter()
+}
+func (s *fakeServer) Queue() *queue.Queue {
+	return nil
+}
+func (s *fakeServer) Locator() *geoip.Locator {
+	return nil
+}
+func (s *fakeServer) Callbacks() *ndt.Callbacks {
+	return nil
+}
+func (s *fakeServer) Running() *live.Registry {
+	return nil
 }
 
-func (m *fakeMessager) SendMessage(t protocol.MessageType, msg []byte) error {
-	m.sent = append(m.sent, sendMessage{t: t, msg: msg})
+func (m *fakeMessager) Send(msg protocol.Message) error {
+	body, err := protocol.Encode(protocol.TLV, msg)
+	if err != nil {
+		return err
+	}
+	m.sent = append(m.sent, sendMessage{t: msg.Type(), msg: body})
 	return nil
 }
 func (m *fakeMessager) ReceiveMessage(t protocol.MessageType) ([]byte, error) {
@@ -57,10 +80,6 @@ func (m *fakeMessager) ReceiveMessage(t protocol.MessageType) ([]byte, error) {
 	}
 	return msg, nil
 }
-func (m *fakeMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	// Unused.
-	return nil
-}
 func (m *fakeMessager) Encoding() protocol.Encoding {
 	// Unused.
 	return protocol.JSON
@@ -109,6 +128,27 @@ func TestManageTest(t *testing.T) {
 			},
 			want: []metadata.NameValue{{Name: "a", Value: string(len256[:255])}},
 		},
+		{
+			name: "truncate-value-on-rune-boundary",
+			ctx:  context.Background(),
+			m: &fakeMessager{
+				recv: []recvMessage{
+					{msg: append(append([]byte("a:"), len256[:254]...), []byte("é")...)},
+				},
+			},
+			want: []metadata.NameValue{{Name: "a", Value: string(len256[:254])}},
+		},
+		{
+			name: "skip-empty-name",
+			ctx:  context.Background(),
+			m: &fakeMessager{
+				recv: []recvMessage{
+					{msg: []byte(" :b")},
+					{msg: []byte("c:d")},
+				},
+			},
+			want: []metadata.NameValue{{Name: "c", Value: "d"}},
+		},
 		{
 			name: "receive-error",
 			ctx:  context.Background(),
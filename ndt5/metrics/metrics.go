@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"errors"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -28,6 +30,13 @@ var (
 		},
 		[]string{"protocol", "error"},
 	)
+	HandlerPanicCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_handler_panic_total",
+			Help: "The number of recovered panics in the goroutines that handle connections and run tests, by handler.",
+		},
+		[]string{"handler"},
+	)
 	ControlCount = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ndt5_control_total",
@@ -82,6 +91,33 @@ var (
 			Help: "The number of times forwarded client connections have timed out on the server instead of being closed by the client",
 		},
 	)
+	ClientForwardingRejected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ndt5_forwarding_rejected_total",
+			Help: "The number of websocket connections on the plain ndt5 channel that were closed because too many were already forwarded",
+		},
+	)
+	ClientOriginRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_client_origin_rejected_total",
+			Help: "The number of WS and WSS clients rejected because the web page that started the test is not an allowed origin.",
+		},
+		[]string{"protocol"},
+	)
+	ClientRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_client_rejections_total",
+			Help: "The number of ndt5 clients sent a MsgError after their login, by reason: Admission, BadLogin, or TestStatus.",
+		},
+		[]string{"protocol", "reason"},
+	)
+	ClientVersions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_client_versions_total",
+			Help: "The number of ndt5 clients by the version in their login: a known major and minor version, none for MsgLogin clients, or other.",
+		},
+		[]string{"protocol", "version"},
+	)
 	ClientTestResults = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ndt5_client_test_results_total",
@@ -96,6 +132,26 @@ var (
 		},
 		[]string{"protocol", "direction", "error"},
 	)
+	C2SDrainTimeouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ndt5_c2s_drain_timeouts_total",
+			Help: "The number of c2s test connections closed while the client was still sending, after the drain grace period.",
+		},
+	)
+	QueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt5_queue_depth",
+			Help: "The number of ndt5 clients running tests (active) or waiting to run them (waiting).",
+		},
+		[]string{"state"},
+	)
+	AcceptErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_accept_errors_total",
+			Help: "The number of failed accepts on the plain ndt5 port, by type: temporary, fatal, or rejected by the accepter.",
+		},
+		[]string{"type"},
+	)
 	SubmittedMetaValues = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name: "ndt5_submitted_meta_values",
@@ -105,4 +161,49 @@ var (
 				11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 		},
 	)
+	CongestionControl = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_congestion_control_total",
+			Help: "The number of tests that chose a congestion control algorithm, by test, algorithm, and whether it could be set.",
+		},
+		[]string{"test", "algorithm", "result"},
+	)
 )
+
+// Register registers the ndt5 metrics with reg, in addition to the default
+// registry that they are always registered with. Metrics that reg already
+// has are skipped.
+func Register(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		ControlChannelDuration,
+		ControlPanicCount,
+		HandlerPanicCount,
+		ControlCount,
+		MeasurementServerStart,
+		MeasurementServerAccept,
+		MeasurementServerStop,
+		SniffedReverseProxyCount,
+		ClientRequestedTestSuites,
+		ClientRequestedTests,
+		ClientForwardingTimeouts,
+		ClientForwardingRejected,
+		ClientOriginRejected,
+		ClientRejections,
+		ClientVersions,
+		ClientTestResults,
+		ClientTestErrors,
+		C2SDrainTimeouts,
+		QueueDepth,
+		AcceptErrors,
+		SubmittedMetaValues,
+		CongestionControl,
+	}
+	for _, c := range collectors {
+		err := reg.Register(c)
+		var already prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &already) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Package mid implements the legacy NDT middlebox (MID) test. The server sends
+// data for a few seconds over a connection on which it requested a small
+// maximum segment size, then reports the segment size and addresses that it
+// observed, so that middleboxes that rewrite the MSS or translate addresses
+// can be detected.
+package mid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// MSS is the maximum segment size that the server requests for the test
+// connection. Clients that observe a different MSS are behind a middlebox that
+// rewrites it.
+const MSS = 1456
+
+// tcpiOptTimestamps is the bit of tcpi_options set on connections that use the
+// TCP timestamps option.
+const tcpiOptTimestamps = 0x1
+
+// timestampsSize is the size of the padded timestamps option, which the kernel
+// deducts from the MSS of connections that use it.
+const timestampsSize = 12
+
+// testDuration is how long the server sends data for.
+const testDuration = 5 * time.Second
+
+// dataToSend is the data that every test sends over and over.
+var dataToSend = func() *protocol.Payload {
+	b := make([]byte, 8192)
+	for i := range b {
+		b[i] = byte(((i * 101) % (122 - 33)) + 33)
+	}
+	return protocol.NewPayload(b)
+}()
+
+// ArchivalData is the data saved by the MID test.
+type ArchivalData struct {
+	// The addresses of the test connection as seen by the server. Clients
+	// compare them with their own view of the connection to detect NAT, as
+	// only they know which addresses they used.
+	ServerIP   string
+	ServerPort int
+	ClientIP   string
+	ClientPort int
+
+	UUID string
+
+	StartTime time.Time
+	EndTime   time.Time
+
+	// RequestedMSS is the MSS the server asked for, and CurMSS the MSS of the
+	// connection, which leaves room for the TCP options in use. ExpectedMSS
+	// is what CurMSS should be given those options; they differ, and
+	// MSSModified is set, when a middlebox rewrote the MSS option.
+	RequestedMSS int
+	CurMSS       uint32
+	ExpectedMSS  uint32
+	MSSModified  bool
+	// WinScaleSent and WinScaleRcvd are the window scale options sent and
+	// received in the handshake.
+	WinScaleSent int
+	WinScaleRcvd int
+
+	MeanThroughputMbps float64
+	ClientReportedMbps float64 `json:",omitempty"`
+
+	TCPInfo *tcp.LinuxTCPInfo `json:",omitempty"`
+
+	Error string `json:",omitempty"`
+	// ErrorType classifies Error by the step of the test that failed, using the
+	// same values as the ndt5_client_test_errors_total metric.
+	ErrorType string `json:",omitempty"`
+}
+
+// ResultsMessage returns the MID findings in the "name: value" form of the
+// other results sent to the client at the end of the tests.
+func (r *ArchivalData) ResultsMessage() string {
+	return fmt.Sprintf(
+		"MID.CurMSS: %d\nMID.MSSModified: %t\nMID.ServerIP: %s\nMID.ClientIP: %s\n",
+		r.CurMSS, r.MSSModified, r.ServerIP, r.ClientIP)
+}
+
+// ManageTest manages the MID test lifecycle. The test connection must be
+// served with an MSS of MSS.
+func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server) (record *ArchivalData, err error) {
+	localCtx, localCancel := context.WithTimeout(ctx, testDuration+20*time.Second)
+	defer localCancel()
+	defer func() {
+		if err != nil && record != nil {
+			record.Error = err.Error()
+		}
+	}()
+	record = &ArchivalData{RequestedMSS: MSS}
+	logger := logging.FromContext(ctx).WithField("test", "mid")
+
+	m := controlConn.Messager()
+	connType := s.ConnectionType().Label()
+	fail := func(errType string) {
+		record.ErrorType = errType
+		metrics.ClientTestErrors.WithLabelValues(connType, "mid", errType).Inc()
+	}
+
+	srv, err := s.SingleServingServer("mid")
+	if err != nil {
+		logger.WithError(err).Warn("Could not start SingleServingServer")
+		fail("StartSingleServingServer")
+		return record, err
+	}
+
+	err = m.Send(&protocol.Prepare{Port: srv.Port()})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestPrepare")
+		fail("TestPrepare")
+		return record, err
+	}
+
+	testConn, err := srv.ServeOnce(localCtx)
+	if err != nil || testConn == nil {
+		logger.WithError(err).Warn("Could not successfully ServeOnce")
+		fail("ServeOnce")
+		if err == nil {
+			err = errors.New("nil testConn, but also a nil error")
+		}
+		return record, err
+	}
+	defer warnonerror.Close(testConn, "Could not close test connection")
+	// A client that stops reading can block FillUntil forever.
+	go func() {
+		<-localCtx.Done()
+		testConn.Close()
+	}()
+	record.UUID = testConn.UUID()
+	logger = logger.WithField("test_uuid", record.UUID)
+	record.ServerIP, record.ServerPort = testConn.ServerIPAndPort()
+	record.ClientIP, record.ClientPort = testConn.ClientIPAndPort()
+
+	testConn.StartMeasuring(localCtx)
+	record.StartTime = clock.Real.Now()
+	testConn.FillUntil(time.Now().Add(testDuration), dataToSend)
+	var elapsed time.Duration
+	record.EndTime, elapsed = protocol.EndTime(clock.Real, record.StartTime)
+	web100metrics, err := testConn.StopMeasuring()
+	if err != nil {
+		logger.WithError(err).Warn("Could not read metrics")
+		fail("web100Metrics")
+		return record, err
+	}
+	record.CurMSS = web100metrics.CurMSS
+	record.ExpectedMSS = expectedMSS(web100metrics.TCPInfo.Options)
+	record.MSSModified = record.CurMSS != record.ExpectedMSS
+	record.WinScaleSent = web100metrics.RcvWinScale
+	record.WinScaleRcvd = web100metrics.SndWinScale
+	record.TCPInfo = &web100metrics.TCPInfo
+	seconds := elapsed.Seconds()
+	record.MeanThroughputMbps = 8 * float64(web100metrics.TCPInfo.BytesAcked) / seconds / 1e6
+
+	// The legacy results message: CurMSS;WinScaleSent;WinScaleRcvd;ServerIP;ClientIP;
+	results := strings.Join([]string{
+		strconv.FormatUint(uint64(record.CurMSS), 10),
+		strconv.Itoa(record.WinScaleSent),
+		strconv.Itoa(record.WinScaleRcvd),
+		record.ServerIP,
+		record.ClientIP,
+	}, ";") + ";"
+	err = m.Send(&protocol.TestMessage{Text: results})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestMsg with MID results")
+		fail("TestMsgSend")
+		return record, err
+	}
+
+	clientRateMsg, err := m.ReceiveMessage(protocol.TestMsg)
+	if err != nil && clientRateMsg == nil {
+		logger.WithError(err).Warn("Could not receive a TestMsg")
+		fail("TestMsgRcv")
+		return record, err
+	}
+	if clientRateKbps, err := strconv.ParseFloat(strings.TrimSpace(string(clientRateMsg)), 64); err == nil {
+		record.ClientReportedMbps = clientRateKbps / 1000
+	}
+
+	err = m.Send(&protocol.Finalize{})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestFinalize")
+		fail("TestFinalize")
+		return record, err
+	}
+	return record, nil
+}
+
+// expectedMSS returns the MSS of a test connection with the given tcpi_options
+// when no middlebox rewrote the MSS option.
+func expectedMSS(options uint8) uint32 {
+	if options&tcpiOptTimestamps != 0 {
+		return MSS - timestampsSize
+	}
+	return MSS
+}
@@ -0,0 +1,38 @@
+package mid
+
+import "testing"
+
+func TestArchivalData_ResultsMessage(t *testing.T) {
+	r := &ArchivalData{
+		ServerIP:    "192.0.2.1",
+		ClientIP:    "198.51.100.7",
+		CurMSS:      1400,
+		MSSModified: true,
+	}
+	want := "MID.CurMSS: 1400\nMID.MSSModified: true\nMID.ServerIP: 192.0.2.1\nMID.ClientIP: 198.51.100.7\n"
+	if got := r.ResultsMessage(); got != want {
+		t.Errorf("ResultsMessage() = %q, want %q", got, want)
+	}
+}
+
+func Test_expectedMSS(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  uint8
+		curMSS   uint32
+		modified bool
+	}{
+		{name: "no-options", options: 0, curMSS: MSS, modified: false},
+		{name: "timestamps", options: tcpiOptTimestamps, curMSS: 1444, modified: false},
+		{name: "timestamps-sack-wscale", options: 0x7, curMSS: 1444, modified: false},
+		{name: "timestamps-rewritten", options: tcpiOptTimestamps, curMSS: 1348, modified: true},
+		{name: "rewritten", options: 0, curMSS: 1360, modified: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.curMSS != expectedMSS(tt.options); got != tt.modified {
+				t.Errorf("CurMSS %d with options %#x: modified = %t, want %t", tt.curMSS, tt.options, got, tt.modified)
+			}
+		})
+	}
+}
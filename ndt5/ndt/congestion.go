@@ -0,0 +1,50 @@
+package ndt
+
+import (
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/netx"
+)
+
+// CongestionControl is the congestion control algorithm of a test, one of
+// netx.CongestionControls, or empty for the kernel's default. It implements
+// flag.Value, so that invalid algorithms are rejected when the flags are set.
+type CongestionControl string
+
+// Set sets c to s, if it is a valid algorithm.
+func (c *CongestionControl) Set(s string) error {
+	if s != "" {
+		if err := netx.ValidCongestionControl(s); err != nil {
+			return err
+		}
+	}
+	*c = CongestionControl(s)
+	return nil
+}
+
+func (c *CongestionControl) String() string {
+	return string(*c)
+}
+
+// SetCongestionControl sets the congestion control algorithm of conn, the
+// measurement connection of test, to requested, the algorithm the client
+// asked for, or else to def, the server's. It returns the algorithm that conn
+// uses, which is empty if neither chose one. If the algorithm could not be set,
+// e.g. because the kernel lacks its module, the test runs with the algorithm
+// that is returned along with the error.
+func SetCongestionControl(conn protocol.Measurable, test, requested string, def CongestionControl) (string, error) {
+	name := requested
+	if name == "" {
+		name = string(def)
+	}
+	if name == "" {
+		return "", nil
+	}
+	cur, err := conn.SetCongestionControl(name)
+	result := "okay"
+	if err != nil {
+		result = "error"
+	}
+	metrics.CongestionControl.WithLabelValues(test, name, result).Inc()
+	return cur, err
+}
@@ -0,0 +1,61 @@
+package ndt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// fakeMeasurable records the algorithm it is set to, and fails with err.
+type fakeMeasurable struct {
+	protocol.Measurable
+	cc  string
+	err error
+}
+
+func (f *fakeMeasurable) SetCongestionControl(name string) (string, error) {
+	if f.err != nil {
+		return f.cc, f.err
+	}
+	f.cc = name
+	return name, nil
+}
+
+func TestCongestionControl_Set(t *testing.T) {
+	var c CongestionControl
+	if err := c.Set("bbr"); err != nil || c.String() != "bbr" {
+		t.Errorf("Set(bbr) = %v, value %q", err, c)
+	}
+	if err := c.Set("vegas"); err == nil || c.String() != "bbr" {
+		t.Errorf("Set(vegas) = %v, value %q", err, c)
+	}
+	if err := c.Set(""); err != nil || c.String() != "" {
+		t.Errorf("Set() = %v, value %q", err, c)
+	}
+}
+
+func TestSetCongestionControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		def       CongestionControl
+		err       error
+		want      string
+		wantErr   bool
+	}{
+		{name: "none"},
+		{name: "server", def: "bbr", want: "bbr"},
+		{name: "client", requested: "reno", def: "bbr", want: "reno"},
+		{name: "error", requested: "bbr", err: errors.New("no bbr"), want: "cubic", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeMeasurable{cc: "cubic", err: tt.err}
+			got, err := SetCongestionControl(conn, "s2c", tt.requested, tt.def)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("SetCongestionControl() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
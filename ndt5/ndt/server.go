@@ -3,8 +3,12 @@ package ndt
 import (
 	"context"
 
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/results"
 )
 
 // ConnectionType records whether this test is performed over plain TCP,
@@ -44,7 +48,65 @@ type Server interface {
 	ConnectionType() ConnectionType
 	DataDir() string
 	Metadata() []metadata.NameValue
-	LoginCeremony(protocol.Connection) (int, error)
+	// LoginCeremony reads the login of the client. The Version of clients
+	// that log in with MsgLogin is empty.
+	LoginCeremony(protocol.Connection) (*protocol.ExtendedLogin, error)
+	// ResultWriter returns the Writer used to save every completed result in
+	// addition to the per-test files in DataDir.
+	ResultWriter() results.Writer
+	// Queue returns the queue that limits concurrent tests, or nil if tests
+	// are never queued.
+	Queue() *queue.Queue
+	// Locator returns the Locator used to annotate results with the client's
+	// location, or nil if results are not annotated.
+	Locator() *geoip.Locator
+	// Callbacks returns the functions to call as tests run, or nil.
+	Callbacks() *Callbacks
+	// Running returns the registry of running tests, or nil if they are not
+	// tracked.
+	Running() *live.Registry
+}
+
+// Callbacks let a program that embeds the server react to tests as they run.
+// Any of the functions may be nil. They are called from the goroutine of the
+// test, which they should not block for long. A nil *Callbacks calls nothing.
+type Callbacks struct {
+	// OnTestStart is called once a client has been admitted, just before its
+	// tests start.
+	OnTestStart func(uuid, clientIP string)
+	// OnTestComplete is called with every result once it has been saved,
+	// including the results of clients that failed or were rejected. Its Data
+	// is a *data.NDT5Result.
+	OnTestComplete func(*results.Result)
+	// OnClientRejected is called when a client is turned away. The reason is
+	// "Admission" for a missing or invalid access token, "Origin" for a web
+	// page whose origin is not allowed, "Blocked" for a client denied by the
+	// IP list, "Banned" for a client banned for abuse, "Country" for a client
+	// turned away by the country policy, "RateLimit" for a client or subnet
+	// over its limits, or "SrvQueue" when the queue is full or the client
+	// waited too long in it.
+	OnClientRejected func(clientIP, reason string)
+}
+
+// TestStart calls OnTestStart, if there is one.
+func (c *Callbacks) TestStart(uuid, clientIP string) {
+	if c != nil && c.OnTestStart != nil {
+		c.OnTestStart(uuid, clientIP)
+	}
+}
+
+// TestComplete calls OnTestComplete, if there is one.
+func (c *Callbacks) TestComplete(r *results.Result) {
+	if c != nil && c.OnTestComplete != nil {
+		c.OnTestComplete(r)
+	}
+}
+
+// ClientRejected calls OnClientRejected, if there is one.
+func (c *Callbacks) ClientRejected(clientIP, reason string) {
+	if c != nil && c.OnClientRejected != nil {
+		c.OnClientRejected(clientIP, reason)
+	}
 }
 
 // SingleMeasurementServerFactory is the method by which we abstract away what
@@ -62,3 +124,22 @@ type SingleMeasurementServer interface {
 	ServeOnce(context.Context) (protocol.MeasuredConnection, error)
 	Close()
 }
+
+// SharedPortServer is implemented by single-serving servers that receive their
+// connection on the control port. Clients identify the test that they connect
+// for by sending the server's token.
+type SharedPortServer interface {
+	SingleMeasurementServer
+	Token() string
+}
+
+// PrepareMessage returns the TestPrepare message that tells the client where
+// to connect to srv: its port, followed by its token if srv shares the
+// control port.
+func PrepareMessage(srv SingleMeasurementServer) *protocol.Prepare {
+	msg := &protocol.Prepare{Port: srv.Port()}
+	if shared, ok := srv.(SharedPortServer); ok {
+		msg.Args = []string{shared.Token()}
+	}
+	return msg
+}
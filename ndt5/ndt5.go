@@ -3,31 +3,46 @@ package ndt5
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path"
-	"strconv"
+	"runtime/debug"
 	"strings"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/ndt5/analysis"
 	"github.com/m-lab/ndt-server/ndt5/control"
 	"github.com/m-lab/ndt-server/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/warnonerror"
 
+	"github.com/m-lab/ndt-server/admission"
 	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/flowlimit"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metrics"
-	"github.com/m-lab/ndt-server/ndt5/c2s"
-	"github.com/m-lab/ndt-server/ndt5/meta"
 	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/queue"
 	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/privacy"
+	"github.com/m-lab/ndt-server/ratelimit"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/tracing"
 )
 
+// The bits of the tests in the login message. Every client must support the
+// status "test".
 const (
 	cTestMID    = 1
 	cTestC2S    = 2
@@ -35,33 +50,172 @@ const (
 	cTestSFW    = 8
 	cTestStatus = 16
 	cTestMETA   = 32
+	// cTestLatency is only possible in MsgExtendedLogin. The legacy C
+	// server used 64 and 128 for the multi-stream c2s and s2c tests.
+	cTestLatency = 1024
+	// cInterim and cResponsiveness are not tests. Clients set them to receive
+	// interim measurements during the s2c test, and to have the latency of the
+	// control channel measured during the s2c test. Only MsgExtendedLogin has
+	// room for them.
+	cInterim        = 256
+	cResponsiveness = 512
+)
+
+// Special SrvQueue values understood by clients. Any other value is the
+// client's position in the queue, and 0 means the tests may start.
+const (
+	srvQueueBusy      = 9988
+	srvQueueHeartbeat = 9990
+)
+
+// tracer traces the control channel and the steps of the tests.
+var tracer = otel.Tracer("github.com/m-lab/ndt-server/ndt5")
+
+// errQueueTimeout is returned by waitInQueue when the client waited too long.
+var errQueueTimeout = errors.New("timed out waiting in queue")
+
+var (
+	// queueHeartbeatInterval is how often a waiting client must prove that it
+	// is still there.
+	queueHeartbeatInterval = 10 * time.Second
+	// queuePollInterval is how often a waiting client's position is checked.
+	queuePollInterval = time.Second
 )
 
 // SaveData archives the data to disk.
 func SaveData(record *data.NDT5Result, datadir string) {
 	if record == nil {
-		log.Println("nil record won't be saved")
+		logging.Logger.Warn("nil record won't be saved")
 		return
 	}
+	logger := logging.Logger.WithField("uuid", record.Control.UUID)
 	dir := path.Join(datadir, record.StartTime.Format("2006/01/02"))
 	err := os.MkdirAll(dir, 0777)
 	if err != nil {
-		log.Printf("Could not create directory %s: %v\n", dir, err)
+		logger.WithError(err).WithField("dir", dir).Warn("Could not create directory")
 		return
 	}
 	file, err := protocol.UUIDToFile(dir, record.Control.UUID)
 	if err != nil {
-		log.Println("Could not open file:", err)
+		logger.WithError(err).Warn("Could not open file")
 		return
 	}
 	defer file.Close()
 	enc := json.NewEncoder(file)
 	err = enc.Encode(record)
 	if err != nil {
-		log.Println("ERROR: Could not encode", record, "to", file.Name(), "err:", err)
+		logger.WithError(err).WithField("file", file.Name()).Error("Could not encode record")
 		return
 	}
-	log.Println("Wrote", file.Name())
+	logger.WithField("file", file.Name()).Info("Wrote")
+}
+
+// newResult wraps the record in a results.Result.
+func newResult(record *data.NDT5Result) *results.Result {
+	return &results.Result{
+		Datatype:  "ndt5",
+		UUID:      record.Control.UUID,
+		StartTime: record.StartTime,
+		Data:      record,
+	}
+}
+
+// WriteResult saves the record using the given results.Writer.
+func WriteResult(record *data.NDT5Result, w results.Writer) {
+	if record == nil {
+		return
+	}
+	err := w.Write(context.Background(), newResult(record))
+	if err != nil {
+		logging.Logger.WithError(err).WithField("uuid", record.Control.UUID).Warn("Could not write result")
+	}
+}
+
+// waitInQueue waits until q, and then the server-wide flow limiter of q,
+// admit the test of the client at clientIP. While waiting, the client is sent
+// its position in the queue whenever it changes and, if heartbeats is true,
+// regular heartbeats that it must answer with MsgWaiting. Clients are told the
+// server is busy if the queue or the flow limiter is full, if the queue is
+// draining, if their subnet is over its limits, or if they wait for longer
+// than the queue's timeout. The returned Ticket must be released with Done
+// once the tests are over.
+func waitInQueue(m protocol.Messager, q *queue.Queue, clientIP string, heartbeats bool) (*queue.Ticket, error) {
+	t, err := q.JoinFrom(clientIP)
+	if err != nil {
+		m.Send(&protocol.Queue{Wait: srvQueueBusy})
+		return nil, err
+	}
+	// ready is closed once q admits t, and then replaced by the channel that is
+	// closed once the flow limiter does.
+	ready := t.Ready()
+	flow := false
+	joinFlow := func() error {
+		flow = true
+		ready, err = t.JoinFlow()
+		if err != nil {
+			t.Done()
+			m.Send(&protocol.Queue{Wait: srvQueueBusy})
+		}
+		return err
+	}
+	select {
+	case <-ready:
+		if err := joinFlow(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ready:
+			return t, m.Send(&protocol.Queue{Wait: 0})
+		default:
+		}
+	default:
+	}
+	clk := q.Clock()
+	timeout := clk.NewTimer(q.Timeout())
+	defer timeout.Stop()
+	// Receiving from a nil channel blocks forever.
+	var heartbeatC <-chan time.Time
+	if heartbeats {
+		heartbeat := clk.NewTicker(queueHeartbeatInterval)
+		defer heartbeat.Stop()
+		heartbeatC = heartbeat.C()
+	}
+	poll := clk.NewTicker(queuePollInterval)
+	defer poll.Stop()
+	position := 0
+	for {
+		if p := t.Position(); p != 0 && p != position {
+			position = p
+			if err := m.Send(&protocol.Queue{Wait: p}); err != nil {
+				t.Done()
+				return nil, err
+			}
+		}
+		select {
+		case <-ready:
+			if !flow {
+				if err := joinFlow(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return t, m.Send(&protocol.Queue{Wait: 0})
+		case <-heartbeatC:
+			err := m.Send(&protocol.Queue{Wait: srvQueueHeartbeat})
+			if err == nil {
+				_, err = m.ReceiveMessage(protocol.MsgWaiting)
+			}
+			if err != nil {
+				t.Done()
+				return nil, err
+			}
+		case <-timeout.C():
+			t.Done()
+			m.Send(&protocol.Queue{Wait: srvQueueBusy})
+			return nil, errQueueTimeout
+		case <-poll.C():
+		}
+	}
 }
 
 func panicMsgToErrType(msg string) string {
@@ -71,11 +225,8 @@ func panicMsgToErrType(msg string) string {
 		"SrvQueue":        {},
 		"MsgLoginVersion": {},
 		"MsgLoginTests":   {},
-		"C2S":             {},
-		"S2C":             {},
 		"MsgResults":      {},
 		"MsgLogout":       {},
-		"META":            {},
 	}
 	words := strings.SplitN(msg, " ", 2)
 	if len(words) >= 1 {
@@ -83,17 +234,69 @@ func panicMsgToErrType(msg string) string {
 		if _, ok := okayWords[word]; ok {
 			return word
 		}
+		// Failed tests start their messages with their upper-case names.
+		for _, t := range registry {
+			if word == strings.ToUpper(t.Name) {
+				return word
+			}
+		}
 	}
 	return "panic"
 }
 
+// rejectClient counts the rejection of a client for reason, and tells the
+// client why its tests won't run with a MsgError followed by MsgLogout. It
+// must only be called once the encoding of the connection is known, i.e.
+// after the login was read.
+func rejectClient(conn protocol.Connection, connType, reason, explanation string) {
+	ndt5metrics.ClientRejections.WithLabelValues(connType, reason).Inc()
+	m := conn.Messager()
+	if m == nil {
+		return
+	}
+	// The client is disconnected whether or not it receives these.
+	m.Send(&protocol.Error{Text: explanation})
+	m.Send(&protocol.Logout{})
+}
+
+// closeOnDone closes conn if ctx is done before the returned function is
+// called. Closing the connection interrupts any reads or writes that are
+// blocked on a stuck client.
+func closeOnDone(ctx context.Context, conn protocol.Connection) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
 // HandleControlChannel is the "business logic" of an NDT test. It is designed
 // to run every test, and to never need to know whether the underlying
 // connection is just a TCP socket, a WS connection, or a WSS connection. It
 // only needs a connection, and a factory for making single-use servers for
-// connections of that same type.
-func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon string) {
+// connections of that same type. Canceling ctx stops the tests and closes the
+// connection.
+func HandleControlChannel(ctx context.Context, conn protocol.Connection, s ndt.Server, isMon string) {
 	connType := s.ConnectionType().Label()
+	// Every message logged about the test identifies it.
+	cIP, _ := conn.ClientIPAndPort()
+	logger := logging.Logger.WithFields(log.Fields{
+		"uuid":      conn.UUID(),
+		"client_ip": privacy.IP(cIP),
+		"protocol":  connType,
+	})
+	ctx = logging.NewContext(ctx, logger)
+	ctx, span := tracer.Start(ctx, "ndt5.control", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("uuid", conn.UUID()),
+		attribute.String("client_ip", privacy.IP(cIP)),
+		attribute.String("protocol", connType),
+	)
 	metrics.ActiveTests.WithLabelValues(connType).Inc()
 	defer metrics.ActiveTests.WithLabelValues(connType).Dec()
 	defer func(start time.Time) {
@@ -104,25 +307,23 @@ func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		completed := "okay"
 		r := recover()
 		if r != nil {
-			log.Println("Test failed, but we recovered:", r)
+			logger.WithFields(log.Fields{"panic": fmt.Sprint(r), "stack": string(debug.Stack())}).Warn("Test failed, but we recovered")
 			// All of our panic messages begin with an informative first word.  Use that as a label.
 			errType := panicMsgToErrType(fmt.Sprint(r))
 			ndt5metrics.ControlPanicCount.WithLabelValues(connType, errType).Inc()
 			completed = "panic"
+			tracing.SetError(span, fmt.Errorf("%v", r))
 		}
 		ndt5metrics.ControlCount.WithLabelValues(connType, completed).Inc()
 	}()
-	handleControlChannel(conn, s, isMon)
+	handleControlChannel(ctx, conn, s, isMon)
 }
 
-func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string) {
-	// Nothing should take more than 45 seconds, and exiting this method should
-	// cause all resources used by the test to be reclaimed.
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
-	defer cancel()
-
-	log.Println("Handling connection", conn)
+func handleControlChannel(ctx context.Context, conn protocol.Connection, s ndt.Server, isMon string) {
 	defer warnonerror.Close(conn, "Could not close "+conn.String())
+	ctx, cancelLifetime := context.WithTimeout(ctx, *protocol.MaxConnectionLifetime)
+	defer cancelLifetime()
+	defer closeOnDone(ctx, conn)()
 	connType := s.ConnectionType().Label()
 	sIP, sPort := conn.ServerIPAndPort()
 	cIP, cPort := conn.ClientIPAndPort()
@@ -139,101 +340,229 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		ServerPort: sPort,
 		ClientIP:   cIP,
 		ClientPort: cPort,
+		ClientGeo:  s.Locator().Locate(cIP),
+		ClientASN:  s.Locator().ASN(cIP),
 	}
+	logger := logging.FromContext(ctx)
+	logger.WithField("conn", conn.String()).Info("Handling connection")
 	defer func() {
 		record.EndTime = time.Now()
-		SaveData(record, s.DataDir())
+		// The callbacks still need the full client IP.
+		archived := record.Anonymized()
+		SaveData(archived, s.DataDir())
+		WriteResult(archived, s.ResultWriter())
+		s.Callbacks().TestComplete(newResult(record))
 	}()
 
-	tests, err := s.LoginCeremony(conn)
-	if err != nil {
+	_, step := tracer.Start(ctx, "ndt5.login")
+	login, err := s.LoginCeremony(conn)
+	tracing.SetError(step, err)
+	step.End()
+	if errors.Is(err, admission.ErrRejected) {
+		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "Admission").Inc()
+		s.Callbacks().ClientRejected(cIP, "Admission")
+		rejectClient(conn, connType, "Admission", "The server requires a valid access token")
+	} else if errors.Is(err, protocol.ErrBadMessage) {
+		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "LoginCeremony").Inc()
+		rejectClient(conn, connType, "BadLogin", "Invalid login: "+err.Error())
+	} else if err != nil {
+		// The login could not be read, so the client can't be told why.
 		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "LoginCeremony").Inc()
 	}
 	rtx.PanicOnError(err, "Login - error reading JSON message (uuid: %s)", record.Control.UUID)
+	record.Control.ClientVersion = login.Version
+	client := lookupClient(login.Version)
+	ndt5metrics.ClientVersions.WithLabelValues(connType, client.label).Inc()
+	tests := login.Tests & client.tests
 
-	if (tests & cTestStatus) == 0 {
-		log.Println("We don't support clients that don't support TestStatus")
+	m := conn.Messager()
+	// Clients from before TestStatus, which log in with a TLV MsgLogin, get
+	// the legacy handshake: they are not sent the server's version, and they
+	// can't answer the heartbeats of the queue.
+	legacy := (tests&cTestStatus) == 0 && m.Encoding() == protocol.TLV
+	if (tests&cTestStatus) == 0 && !legacy {
+		logger.Warn("We don't support clients that don't support TestStatus")
 		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "TestStatus").Inc()
+		rejectClient(conn, connType, "TestStatus", "The client must support TestStatus (test bit 16)")
 		return
 	}
-	testsToRun := []string{}
-	runC2s := (tests & cTestC2S) != 0
-	runS2c := (tests & cTestS2C) != 0
-	runMeta := (tests & cTestMETA) != 0
-	runSFW := (tests & cTestSFW) != 0
-	runMID := (tests & cTestMID) != 0
-
-	suites := []string{"status"}
-	if runMID {
-		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "mid").Inc()
-		suites = append(suites, "mid")
-	}
-	if runC2s {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestC2S))
-		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "c2s").Inc()
-		suites = append(suites, "c2s")
-	}
-	if runS2c {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestS2C))
-		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "s2c").Inc()
-		suites = append(suites, "s2c")
+	decision, country := s.Locator().Decide(record.ClientGeo)
+	metrics.CountryDecisions.WithLabelValues(connType, country, string(decision)).Inc()
+	if decision != geoip.Admit {
+		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "Country").Inc()
+		s.Callbacks().ClientRejected(cIP, "Country")
+		rejectClient(conn, connType, "Country", decision.Explanation())
+		return
 	}
-	if runSFW {
-		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "sfw").Inc()
-		suites = append(suites, "sfw")
+	testsToRun := []int{}
+	suites := []string{"status"}
+	if legacy {
+		suites[0] = "legacy"
 	}
-	if runMeta {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestMETA))
-		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "meta").Inc()
-		suites = append(suites, "meta")
+	requested := []Test{}
+	for _, t := range registry {
+		if (tests&t.Bit) == 0 || (t.Supported != nil && !t.Supported(s)) {
+			continue
+		}
+		requested = append(requested, t)
+		testsToRun = append(testsToRun, t.Bit)
+		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, t.Name).Inc()
+		suites = append(suites, t.Name)
 	}
 	// Count the combined test suites by name. i.e. "status-s2c-meta"
 	ndt5metrics.ClientRequestedTestSuites.WithLabelValues(connType, strings.Join(suites, "-")).Inc()
 
-	m := conn.Messager()
 	record.Control.MessageProtocol = m.Encoding().String()
+	_, step = tracer.Start(ctx, "ndt5.queue")
+	ticket, err := waitInQueue(m, s.Queue(), cIP, !legacy)
+	tracing.SetError(step, err)
+	step.End()
+	if err != nil {
+		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "SrvQueue").Inc()
+	}
+	switch {
+	case errors.Is(err, queue.ErrClientLimited):
+		metrics.RateLimitedConnections.WithLabelValues(connType).Inc()
+		s.Callbacks().ClientRejected(cIP, "RateLimit")
+	case errors.Is(err, ratelimit.ErrLimited):
+		metrics.SubnetLimitedConnections.WithLabelValues(connType, "rate").Inc()
+		s.Callbacks().ClientRejected(cIP, "RateLimit")
+	case errors.Is(err, ratelimit.ErrBusy):
+		metrics.SubnetLimitedConnections.WithLabelValues(connType, "concurrency").Inc()
+		s.Callbacks().ClientRejected(cIP, "RateLimit")
+	case errors.Is(err, flowlimit.ErrSaturated):
+		metrics.FlowRejections.WithLabelValues(connType).Inc()
+		s.Callbacks().ClientRejected(cIP, "SrvQueue")
+	case errors.Is(err, queue.ErrFull) || errors.Is(err, queue.ErrDraining) || errors.Is(err, errQueueTimeout):
+		s.Callbacks().ClientRejected(cIP, "SrvQueue")
+	}
+	rtx.PanicOnError(err, "SrvQueue - Could not wait in queue (uuid: %s)", record.Control.UUID)
+	defer ticket.Done()
+	s.Callbacks().TestStart(record.Control.UUID, cIP)
+
+	// Once admitted, the tests should take no more than two test durations plus
+	// 25 seconds (45 seconds by default), and exiting this method should cause
+	// all resources used by the tests to be reclaimed.
+	ctx, cancel := context.WithTimeout(ctx, 2*(*protocol.TestDuration)+25*time.Second)
+	defer cancel()
+	defer closeOnDone(ctx, conn)()
+	// Operators may cancel the test, which closes the connection.
+	test := s.Running().Add(record.Control.UUID, cIP, connType, cancel)
+	defer test.Done()
+	ctx = live.NewContext(ctx, test)
+
+	if !legacy {
+		rtx.PanicOnError(
+			m.Send(&protocol.LoginVersion{Version: "v5.0-NDTinGO"}),
+			"MsgLoginVersion - Could not send MsgLogin with version (uuid: %s)", record.Control.UUID)
+	}
 	rtx.PanicOnError(
-		m.SendMessage(protocol.SrvQueue, []byte("0")),
-		"SrvQueue - Could not send SrvQueue (uuid: %s)", record.Control.UUID)
-	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgLogin, []byte("v5.0-NDTinGO")),
-		"MsgLoginVersion - Could not send MsgLogin with version (uuid: %s)", record.Control.UUID)
-	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgLogin, []byte(strings.Join(testsToRun, " "))),
+		m.Send(&protocol.LoginTests{Tests: testsToRun}),
 		"MsgLoginTests - Could not send MsgLogin with the tests (uuid: %s)", record.Control.UUID)
 
+	cfg := &Config{
+		Server: s,
+		Record: record,
+		IsMon:  isMon,
+		S2C: s2c.Options{
+			Interim:           tests&cInterim != 0,
+			Responsiveness:    tests&cResponsiveness != 0,
+			CongestionControl: login.CongestionControl,
+		},
+	}
+	for _, t := range requested {
+		test.Measure(t.Name, nil)
+		testCtx, step := tracer.Start(ctx, "ndt5."+t.Name)
+		err := t.Run(testCtx, conn, cfg)
+		tracing.SetError(step, err)
+		step.End()
+		rtx.PanicOnError(
+			err,
+			"%s - Could not run %s test (uuid: %s)", strings.ToUpper(t.Name), t.Name, record.Control.UUID)
+	}
 	var c2sRate, s2cRate float64
-	if runC2s {
-		record.C2S, err = c2s.ManageTest(ctx, conn, s)
-		if record.C2S != nil && record.C2S.MeanThroughputMbps != 0 {
-			c2sRate = record.C2S.MeanThroughputMbps
-			metrics.TestRate.WithLabelValues(connType, "c2s", isMon).Observe(c2sRate)
-		}
-		r := metrics.GetResultLabel(err, record.C2S.MeanThroughputMbps)
-		ndt5metrics.ClientTestResults.WithLabelValues(connType, "c2s", r).Inc()
-		rtx.PanicOnError(err, "C2S - Could not run c2s test (uuid: %s)", record.Control.UUID)
-	}
-	if runS2c {
-		record.S2C, err = s2c.ManageTest(ctx, conn, s)
-		if record.S2C != nil && record.S2C.MeanThroughputMbps != 0 {
-			s2cRate = record.S2C.MeanThroughputMbps
-			metrics.TestRate.WithLabelValues(connType, "s2c", isMon).Observe(s2cRate)
-		}
-		r := metrics.GetResultLabel(err, record.S2C.MeanThroughputMbps)
-		ndt5metrics.ClientTestResults.WithLabelValues(connType, "s2c", r).Inc()
-		rtx.PanicOnError(err, "S2C - Could not run s2c test (uuid: %s)", record.Control.UUID)
-	}
-	if runMeta {
-		record.Control.ClientMetadata, err = meta.ManageTest(ctx, m, s)
-		rtx.PanicOnError(err, "META - Could not run meta test (uuid: %s)", record.Control.UUID)
+	if record.C2S != nil {
+		c2sRate = record.C2S.MeanThroughputMbps
+	}
+	if record.S2C != nil {
+		s2cRate = record.S2C.MeanThroughputMbps
 	}
 	speedMsg := fmt.Sprintf("You uploaded at %.4f and downloaded at %.4f", c2sRate*1000, s2cRate*1000)
-	log.Println(speedMsg)
+	logger.WithFields(log.Fields{"c2s_kbps": c2sRate * 1000, "s2c_kbps": s2cRate * 1000}).Info("Tests done")
+	_, step = tracer.Start(ctx, "ndt5.results")
+	// Ended before a panic, if any, is recovered and recorded on the control span.
+	defer step.End()
 	// For historical reasons, clients expect results in kbps
 	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgResults, []byte(speedMsg)),
+		m.Send(&protocol.Results{Text: speedMsg}),
 		"MsgResults - Could not send test results message (uuid: %s)", record.Control.UUID)
+	if record.MID != nil {
+		rtx.PanicOnError(
+			m.Send(&protocol.Results{Text: record.MID.ResultsMessage()}),
+			"MsgResults - Could not send MID results message (uuid: %s)", record.Control.UUID)
+	}
+	record.Analysis = analysis.Analyze(record.S2C, c2sRate)
+	// Clients written for the legacy C server may not parse the results it
+	// did not send.
+	if client.extendedResults {
+		if msg := tcpResultsMessage(record); msg != "" {
+			rtx.PanicOnError(
+				m.Send(&protocol.Results{Text: msg}),
+				"MsgResults - Could not send TCP results message (uuid: %s)", record.Control.UUID)
+		}
+		if record.Latency != nil {
+			rtx.PanicOnError(
+				m.Send(&protocol.Results{Text: record.Latency.ResultsMessage()}),
+				"MsgResults - Could not send latency results message (uuid: %s)", record.Control.UUID)
+		}
+		if record.Analysis != nil {
+			rtx.PanicOnError(
+				m.Send(&protocol.Results{Text: record.Analysis.ResultsMessage()}),
+				"MsgResults - Could not send analysis results message (uuid: %s)", record.Control.UUID)
+		}
+		// Send the UUID in the same "name: value" form as the other results so
+		// that clients can correlate their results with the archived record.
+		rtx.PanicOnError(
+			m.Send(&protocol.Results{Text: "UUID: " + record.Control.UUID + "\n"}),
+			"MsgResults - Could not send test UUID message (uuid: %s)", record.Control.UUID)
+		// The summary is last, so that clients that don't parse it can ignore it.
+		rtx.PanicOnError(
+			m.Send(newSummary(record).message()),
+			"MsgResults - Could not send results summary message (uuid: %s)", record.Control.UUID)
+	}
 	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgLogout, []byte{}),
+		m.Send(&protocol.Logout{}),
 		"MsgLogout - Could not send MsgLogout (uuid: %s)", record.Control.UUID)
 }
+
+// tcpResultsMessage returns the RTT, retransmission, and ECN counters of the
+// c2s and s2c tests of record as a results message, or "" if neither test ran.
+func tcpResultsMessage(record *data.NDT5Result) string {
+	msg := ""
+	if r := record.C2S; r != nil {
+		if r.RTT != nil {
+			msg += r.RTT.ResultsMessage("C2S.")
+		}
+		if r.Retransmissions != nil {
+			msg += r.Retransmissions.ResultsMessage("C2S.")
+		}
+		if r.ECN != nil {
+			msg += r.ECN.ResultsMessage("C2S.")
+		}
+	}
+	if r := record.S2C; r != nil {
+		if r.TCPEngine != "" {
+			msg += "S2C.TCPEngine: " + r.TCPEngine + "\n"
+		}
+		if r.RTT != nil {
+			msg += r.RTT.ResultsMessage("S2C.")
+		}
+		if r.Retransmissions != nil {
+			msg += r.Retransmissions.ResultsMessage("S2C.")
+		}
+		if r.ECN != nil {
+			msg += r.ECN.ResultsMessage("S2C.")
+		}
+	}
+	return msg
+}
@@ -0,0 +1,192 @@
+package ndt5
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/flowlimit"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/protocol/protocoltest"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+)
+
+// queueMessager records the waits of the SrvQueue messages sent to a waiting
+// client, which answers every heartbeat.
+type queueMessager struct {
+	sent chan int
+}
+
+func (m *queueMessager) Send(msg protocol.Message) error {
+	m.sent <- msg.(*protocol.Queue).Wait
+	return nil
+}
+
+func (m *queueMessager) ReceiveMessage(protocol.MessageType) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (m *queueMessager) Encoding() protocol.Encoding { return protocol.TLV }
+
+func Test_waitInQueue(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	q := queue.New(1, 1, time.Minute).WithClock(fake)
+	first, err := q.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client waits, answers heartbeats, and gives up after the
+	// queue's timeout.
+	m := &queueMessager{sent: make(chan int, 100)}
+	errs := make(chan error)
+	go func() {
+		_, err := waitInQueue(m, q, "1.2.3.4", true)
+		errs <- err
+	}()
+	if msg := <-m.sent; msg != 1 {
+		t.Errorf("first message = %d, want the position 1", msg)
+	}
+	// The timeout, heartbeat, and poll.
+	fake.BlockUntil(3)
+	fake.Advance(queueHeartbeatInterval)
+	if msg := <-m.sent; msg != srvQueueHeartbeat {
+		t.Errorf("message after %v = %d, want a heartbeat", queueHeartbeatInterval, msg)
+	}
+	fake.Advance(time.Minute)
+	if err := <-errs; err != errQueueTimeout {
+		t.Errorf("waitInQueue() = %v, want %v", err, errQueueTimeout)
+	}
+	msg := 0
+	for len(m.sent) > 0 {
+		msg = <-m.sent
+	}
+	if msg != srvQueueBusy {
+		t.Errorf("last message = %d, want busy", msg)
+	}
+
+	// A waiting client is admitted once the running test is done.
+	go func() {
+		ticket, err := waitInQueue(m, q, "1.2.3.4", true)
+		if err == nil {
+			ticket.Done()
+		}
+		errs <- err
+	}()
+	<-m.sent
+	fake.BlockUntil(3)
+	first.Done()
+	if err := <-errs; err != nil {
+		t.Errorf("waitInQueue() = %v, want nil", err)
+	}
+	if msg := <-m.sent; msg != 0 {
+		t.Errorf("message on admission = %d, want 0", msg)
+	}
+}
+
+func Test_waitInQueue_withoutHeartbeats(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	q := queue.New(1, 1, time.Minute).WithClock(fake)
+	first, err := q.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Legacy clients, which can't answer heartbeats, are only sent their
+	// position until they are admitted.
+	m := &queueMessager{sent: make(chan int, 100)}
+	errs := make(chan error)
+	go func() {
+		ticket, err := waitInQueue(m, q, "1.2.3.4", false)
+		if err == nil {
+			ticket.Done()
+		}
+		errs <- err
+	}()
+	if msg := <-m.sent; msg != 1 {
+		t.Errorf("first message = %d, want the position 1", msg)
+	}
+	// The timeout and poll.
+	fake.BlockUntil(2)
+	fake.Advance(queueHeartbeatInterval)
+	first.Done()
+	if err := <-errs; err != nil {
+		t.Errorf("waitInQueue() = %v, want nil", err)
+	}
+	if msg := <-m.sent; msg != 0 {
+		t.Errorf("message on admission = %d, want 0", msg)
+	}
+}
+
+func Test_waitInQueue_flowLimit(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	flows := flowlimit.New(1, flowlimit.Queue, time.Minute)
+	q := queue.New(2, 1, time.Minute).WithClock(fake).WithLimiter(flows)
+	// Another protocol runs the only flow the server allows.
+	other, err := flows.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is admitted by the queue, but waits for the flow.
+	m := &queueMessager{sent: make(chan int, 100)}
+	errs := make(chan error)
+	go func() {
+		ticket, err := waitInQueue(m, q, "1.2.3.4", true)
+		if err == nil {
+			ticket.Done()
+		}
+		errs <- err
+	}()
+	// The timeout, heartbeat, and poll.
+	fake.BlockUntil(3)
+	if _, waiting := flows.Len(); waiting != 1 {
+		t.Errorf("%d flows waiting, want 1", waiting)
+	}
+	other.Done()
+	if err := <-errs; err != nil {
+		t.Errorf("waitInQueue() = %v, want nil", err)
+	}
+	if msg := <-m.sent; msg != 0 {
+		t.Errorf("message on admission = %d, want 0", msg)
+	}
+	if active, _ := flows.Len(); active != 0 {
+		t.Errorf("%d flows active after Done, want 0", active)
+	}
+
+	// Under the reject policy, the client is told the server is busy.
+	q = queue.New(2, 1, time.Minute).WithClock(fake).WithLimiter(flowlimit.New(0, flowlimit.Reject, time.Minute))
+	if _, err := waitInQueue(m, q, "1.2.3.4", true); err != flowlimit.ErrSaturated {
+		t.Errorf("waitInQueue() = %v, want %v", err, flowlimit.ErrSaturated)
+	}
+	if msg := <-m.sent; msg != srvQueueBusy {
+		t.Errorf("message = %d, want busy", msg)
+	}
+	if active, _ := q.Len(); active != 0 {
+		t.Errorf("%d tests active after rejection, want 0", active)
+	}
+}
+
+func Test_rejectClient(t *testing.T) {
+	conn, client := protocoltest.Pipe()
+	defer client.Close()
+	go rejectClient(conn, "ndt5+plain", "TestStatus", "no TestStatus")
+	for _, want := range []protocoltest.Message{
+		{Type: protocol.MsgError, Body: []byte("no TestStatus")},
+		{Type: protocol.MsgLogout, Body: []byte{}},
+	} {
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, int(header[1])<<8+int(header[2]))
+		if _, err := io.ReadFull(client, body); err != nil {
+			t.Fatal(err)
+		}
+		got := protocoltest.Message{Type: protocol.MessageType(header[0]), Body: body}
+		if got.String() != want.String() {
+			t.Errorf("received %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package plain
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// The types of errors returned by an Accepter, used as metric labels.
+const (
+	// acceptTemporary errors, such as running out of file descriptors, may go
+	// away if the server waits and tries again.
+	acceptTemporary = "temporary"
+	// acceptFatal errors mean that the listener can no longer accept
+	// connections.
+	acceptFatal = "fatal"
+	// acceptRejected errors are connections that the Accepter accepted and
+	// then rejected, e.g. because the client is over its rate limit.
+	acceptRejected = "rejected"
+)
+
+// classifyAcceptError returns the type of an error returned by an Accepter.
+func classifyAcceptError(err error) string {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		// Errors that do not come from the listener are the Accepter's own.
+		return acceptRejected
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+			syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN:
+			return acceptTemporary
+		}
+	}
+	if opErr.Timeout() {
+		return acceptTemporary
+	}
+	return acceptFatal
+}
+
+// The bounds of the wait after a temporary accept error. These are the same
+// as net/http's.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// nextAcceptBackoff returns how long to wait after a temporary accept error,
+// given the previous wait, which is zero after a successful accept. Waits
+// double up to maxAcceptBackoff, so that persistent errors do not spin the
+// accept loop.
+func nextAcceptBackoff(prev time.Duration) time.Duration {
+	if prev == 0 {
+		return minAcceptBackoff
+	}
+	if prev*2 > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return prev * 2
+}
@@ -0,0 +1,49 @@
+package plain
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/iplist"
+	"github.com/m-lab/ndt-server/ratelimit"
+)
+
+func acceptError(err error) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", err)}
+}
+
+func TestClassifyAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{acceptError(syscall.EMFILE), acceptTemporary},
+		{acceptError(syscall.ECONNABORTED), acceptTemporary},
+		{acceptError(syscall.EINVAL), acceptFatal},
+		{ratelimit.ErrLimited, acceptRejected},
+		{iplist.ErrBlocked, acceptRejected},
+		{errors.New("rejected"), acceptRejected},
+	}
+	for _, tt := range tests {
+		if got := classifyAcceptError(tt.err); got != tt.want {
+			t.Errorf("classifyAcceptError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	var d time.Duration
+	want := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}
+	for _, w := range want {
+		if d = nextAcceptBackoff(d); d != w {
+			t.Errorf("nextAcceptBackoff() = %v, want %v", d, w)
+		}
+	}
+	if got := nextAcceptBackoff(800 * time.Millisecond); got != maxAcceptBackoff {
+		t.Errorf("nextAcceptBackoff(800ms) = %v, want %v", got, maxAcceptBackoff)
+	}
+}
@@ -0,0 +1,142 @@
+package plain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/proxyproto"
+)
+
+var (
+	forwardMaxConns    = flag.Int("ndt5.forward.max-conns", 1000, "The maximum number of WebSocket clients forwarded at once from the raw ndt5 port to the WS server. Clients over the limit are disconnected. Zero means no limit")
+	forwardIdleTimeout = flag.Duration("ndt5.forward.idle-timeout", time.Minute, "How long a connection forwarded from the raw ndt5 port to the WS server may go without either side sending or receiving data")
+)
+
+// errForwardLimit is returned by forward when too many connections are
+// already forwarded.
+var errForwardLimit = errors.New("too many forwarded connections")
+
+// idleConn is a net.Conn whose reads and writes fail once they have been
+// blocked for longer than idle, so that a stalled peer cannot hold a
+// forwarded connection open.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(b)
+}
+
+func (c idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(b)
+}
+
+// forward copies the connection of a WebSocket client, whose first bytes were
+// read into input, to and from the WS server until either side closes its
+// connection or stalls, or ctx is done. Forwarding instead of redirecting is
+// needed because deployed clients don't support redirects, e.g.
+//
+//	https://github.com/websockets/ws/issues/812
+//
+// Note that this does NOT introduce overhead for the s2c and c2s tests,
+// because in those tests the HTTP server itself opens the testing port, and
+// that server will not use this TCP proxy.
+//
+// The connection to the WS server starts with a PROXY protocol header, so that
+// the WS server knows the address of the client, e.g. to check that its access
+// token was issued to it. The address is the one reported by proxied, if not
+// nil.
+func (ps *plainServer) forward(ctx context.Context, conn net.Conn, input *bufio.Reader, proxied *proxyproto.Header, logger log.Interface) error {
+	if ps.forwards != nil {
+		select {
+		case ps.forwards <- struct{}{}:
+			defer func() { <-ps.forwards }()
+		default:
+			ndt5metrics.ClientForwardingRejected.Inc()
+			return errForwardLimit
+		}
+	}
+	dialCtx, dialCancel := context.WithTimeout(ctx, ps.dialer.Timeout)
+	fwd, err := ps.dialer.DialContext(dialCtx, "tcp", ps.wsAddr)
+	dialCancel()
+	if err != nil {
+		return err
+	}
+	defer fwd.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	src, dst := netx.ToTCPAddr(conn.RemoteAddr()), netx.ToTCPAddr(conn.LocalAddr())
+	if proxied != nil && proxied.Source != nil {
+		src, dst = proxied.Source, proxied.Destination
+	}
+	// The header and the bytes that were read while sniffing are sent first.
+	lead := &bytes.Buffer{}
+	proxyproto.WriteV1(lead, src, dst)
+	buffered, _ := input.Peek(input.Buffered())
+	lead.Write(buffered)
+	client := idleConn{Conn: conn, idle: ps.idleTimeout}
+	server := idleConn{Conn: fwd, idle: ps.idleTimeout}
+	var stalled atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// pipe copies src to dst. When src is done sending, dst is told that no
+	// more data will come, and the other direction keeps going. Any error ends
+	// both.
+	pipe := func(dst io.Writer, src io.Reader, done func()) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			stalled.Store(true)
+		}
+		if err != nil {
+			cancel()
+			return
+		}
+		done()
+	}
+	go pipe(server, io.MultiReader(lead, client), func() { closeWrite(fwd) })
+	go pipe(client, server, func() { closeWrite(conn) })
+	// When both directions are done, cancel the context.
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+	// When the context is canceled, return, which closes fwd here and conn in
+	// the caller. That unblocks both copies, so that every goroutine above is
+	// either done or running to completion by the time forward returns.
+	// The cancellation could be caused by:
+	//
+	//   1. The context timing out or being explicitly canceled.
+	//   2. Either copy failing, e.g. because a side stalled for longer than the
+	//   idle timeout.
+	//   3. Both sides closing their connections.
+	<-ctx.Done()
+	if ctx.Err() == context.DeadlineExceeded || stalled.Load() {
+		logger.Warn("Forwarded connection timed out")
+		ndt5metrics.ClientForwardingTimeouts.Inc()
+	}
+	return nil
+}
+
+// closeWrite shuts down the writing side of c, if it is a TCP connection.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	}
+}
@@ -0,0 +1,114 @@
+package plain
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/listener"
+	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/proxyproto"
+)
+
+func TestForward(t *testing.T) {
+	// The WS server accepts connections and then never sends anything.
+	ws, err := net.Listen("tcp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer ws.Close()
+	go func() {
+		for {
+			c, err := ws.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	ps := &plainServer{
+		wsAddr:      ws.Addr().String(),
+		dialer:      &net.Dialer{Timeout: time.Second},
+		forwards:    make(chan struct{}, 1),
+		idleTimeout: 100 * time.Millisecond,
+	}
+
+	t.Run("stalled", func(t *testing.T) {
+		client, conn := net.Pipe()
+		defer client.Close()
+		start := time.Now()
+		err := ps.forward(context.Background(), conn, bufio.NewReader(conn), nil, logging.Logger.WithField("test", "stalled"))
+		if err != nil {
+			t.Errorf("forward() = %v, want nil", err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("forward() of a stalled connection took %v", d)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		ps.forwards <- struct{}{}
+		defer func() { <-ps.forwards }()
+		_, conn := net.Pipe()
+		err := ps.forward(context.Background(), conn, bufio.NewReader(conn), nil, logging.Logger.WithField("test", "limit"))
+		if err != errForwardLimit {
+			t.Errorf("forward() = %v, want %v", err, errForwardLimit)
+		}
+	})
+}
+
+func TestForward_clientAddr(t *testing.T) {
+	addrs := make(chan string, 1)
+	ws := &http.Server{
+		Addr: "127.0.0.1:0",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addrs <- r.RemoteAddr
+		}),
+	}
+	rtx.Must(listener.ListenAndServeLocalProxyAsync(ws, time.Second), "Could not start server")
+	defer ws.Close()
+	ps := &plainServer{
+		wsAddr:      ws.Addr,
+		dialer:      &net.Dialer{Timeout: time.Second},
+		idleTimeout: time.Second,
+	}
+	tests := []struct {
+		name    string
+		proxied *proxyproto.Header
+		want    string
+	}{
+		{name: "direct", want: "127.0.0.1"},
+		{
+			name:    "proxied",
+			proxied: &proxyproto.Header{Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321}, Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3001}},
+			want:    "192.0.2.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := netx.Listen("127.0.0.1:0")
+			rtx.Must(err, "Could not listen")
+			defer l.Close()
+			client, err := net.Dial("tcp", l.Addr().String())
+			rtx.Must(err, "Could not dial")
+			defer client.Close()
+			conn, err := netx.NewListener(l).Accept()
+			rtx.Must(err, "Could not accept")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go ps.forward(ctx, conn, bufio.NewReader(conn), tt.proxied, logging.Logger.WithField("test", tt.name))
+			client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			select {
+			case addr := <-addrs:
+				if host, _, _ := net.SplitHostPort(addr); host != tt.want {
+					t.Errorf("the WS server saw %s, want %s", addr, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("the request was not forwarded")
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package plain
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// FuzzSniffThenHandle sends hostile first bytes to the raw port, which are
+// sniffed to tell WS clients, test connections, TLS clients, and raw clients
+// apart, and then handled as such. A panic outside of the control channel's
+// recovery crashes the server.
+func FuzzSniffThenHandle(f *testing.F) {
+	f.Add([]byte("GET /ndt_protocol HTTP/1.1\r\n\r\n"))
+	f.Add([]byte("GE"))
+	f.Add([]byte("TEST abcdef"))
+	f.Add([]byte("\x16\x03\x01\x00"))
+	f.Add([]byte{byte(protocol.MsgLogin), 0, 1})
+	f.Add(append([]byte{byte(protocol.MsgExtendedLogin), 0, 30}, `{"msg":"v3.7.0","tests":"all"}`...))
+	f.Add(append([]byte{byte(protocol.MsgExtendedLogin), 0xFF, 0xFF}, "\x16v3.6.4"...))
+
+	// WS clients are forwarded to a port that is not open.
+	tcpS := NewServer(f.TempDir(), "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtx.Must(tcpS.ListenAndServe(ctx, "127.0.0.1:0", &fakeAccepter{}), "Could not start tcp server")
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn, err := net.Dial("tcp", tcpS.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(input)
+		conn.(*net.TCPConn).CloseWrite()
+		// Valid logins start tests, which don't end before the deadline.
+		io.Copy(io.Discard, conn)
+	})
+}
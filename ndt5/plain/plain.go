@@ -3,37 +3,105 @@ package plain
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
 	"net"
-	"strconv"
-	"sync"
+	"net/http"
 	"time"
 
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/admission"
+	"github.com/m-lab/ndt-server/drain"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5"
 	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/mid"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/queue"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/proxyproto"
+	"github.com/m-lab/ndt-server/privacy"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	proxyProtocol = flag.Bool("ndt5.proxy-protocol", false, "Require a PROXY protocol v1 or v2 header on every raw ndt5 connection and record the client address it reports. Only enable this behind a proxy that always sends the header. Note that rate limits still apply to the proxy's address")
+	acceptors     = flag.Int("ndt5.acceptors", 1, "The number of sockets that listen on the raw ndt5 port, each with its own accept loop. With more than one, the sockets share the port with SO_REUSEPORT and the kernel spreads new connections across them, which helps servers with high connection rates use more cores. Linux only")
+	singlePort    = flag.Bool("ndt5.single-port", false, "Run the raw ndt5 c2s and s2c tests over the control port. The TestPrepare message then holds the port and a token that the client must send, after \""+singleserving.TokenPrefix+"\", as the first bytes of the test connection. Only clients that support this can be served. The MID and SFW tests still use their own ports")
+)
+
+// tracer traces the handling of new connections.
+var tracer = otel.Tracer("github.com/m-lab/ndt-server/ndt5/plain")
+
+// proxyHeaderTimeout is how long to wait for a PROXY protocol header, and
+// tokenTimeout how long to wait for the token of a test connection.
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	tokenTimeout       = 5 * time.Second
 )
 
 // plainServer handles requests that are TCP-based but not HTTP(S) based. If it
 // receives an HTTP test it will forward that test to wsAddr, the address of the
 // websocket-based server..
 type plainServer struct {
-	wsAddr   string
-	dialer   *net.Dialer
-	listener *netx.Listener
-	datadir  string
-	timeout  time.Duration
-	metadata []metadata.NameValue
+	wsAddr string
+	dialer *net.Dialer
+	// forwards has room for the connections that may be forwarded to the WS
+	// server at once, or is nil if there is no limit.
+	forwards    chan struct{}
+	idleTimeout time.Duration
+	// listeners accept the raw clients. There is more than one with
+	// -ndt5.acceptors.
+	listeners []*netx.Listener
+	datadir   string
+	timeout   time.Duration
+	metadata  []metadata.NameValue
+	writer    results.Writer
+	queue     *queue.Queue
+	locator   *geoip.Locator
+	tokens    *admission.Checker
+	cb        *ndt.Callbacks
+	running   *live.Registry
+	tests     drain.Tracker
+	// mux receives the c2s and s2c test connections in single-port mode, and
+	// is nil otherwise.
+	mux *singleserving.Mux
+	// tlsConfig terminates TLS connections on the raw port, which are then
+	// served by wss if they are WebSocket clients. It is nil unless TLS is
+	// enabled.
+	tlsConfig *tls.Config
+	wss       http.Handler
+	wssConns  *connListener
+	// tlsListener accepts raw NDT over TLS clients on a dedicated port, if
+	// ListenAndServeTLS was called.
+	tlsListener net.Listener
+	// conns is the context of the connections, which is only canceled by
+	// Shutdown once its grace period is over, so that the tests that are
+	// running when the server stops accepting can finish.
+	conns     context.Context
+	stopConns context.CancelFunc
 }
 
 func (ps *plainServer) SingleServingServer(direction string) (ndt.SingleMeasurementServer, error) {
+	if direction == "mid" {
+		return singleserving.ListenPlainMSS(direction, mid.MSS)
+	}
+	if ps.mux != nil && (direction == "c2s" || direction == "s2c") {
+		return ps.mux.Listen(direction)
+	}
 	return singleserving.ListenPlain(direction)
 }
 
@@ -47,160 +115,284 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 	// scene" after a successful test. It is an expected case that this might
 	// happen after the connection has already been closed by the other side, and
 	// that the Close will return an error. Therefore, avoid log spam by not using
-	// warnonerror.
-	defer conn.Close()
+	// warnonerror. Test connections handed to a single-serving server are closed
+	// by that server.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			conn.Close()
+		}
+	}()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	logger := logging.Logger.WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String()))
+	ctx, span := tracer.Start(ctx, "ndt5.plain.sniff", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	span.SetAttributes(attribute.String("remote_addr", privacy.Addr(conn.RemoteAddr().String())))
 	// Peek at the first three bytes. If they are "GET", then this is an HTTP
 	// conversation and should be forwarded to the HTTP server.
 	input := bufio.NewReader(conn)
+	var proxied *proxyproto.Header
+	if *proxyProtocol {
+		// The proxy sends its header as soon as the connection opens.
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		h, err := proxyproto.Read(input)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			logger.WithError(err).Warn("Could not read PROXY protocol header")
+			tracing.SetError(span, err)
+			return
+		}
+		proxied = h
+	}
 	lead, err := input.Peek(3)
 	if err != nil {
-		log.Println("Could not handle connection", conn, "due to", err)
+		logger.WithError(err).Warn("Could not handle connection")
+		tracing.SetError(span, err)
 		return
 	}
 	if string(lead) == "GET" {
+		// Forward HTTP-like handshakes to the HTTP server.
+		span.SetAttributes(attribute.String("kind", "forward"))
 		ndt5metrics.SniffedReverseProxyCount.Inc()
-		// Forward HTTP-like handshakes to the HTTP server. Note that this does NOT
-		// introduce overhead for the s2c and c2s tests, because in those tests the
-		// HTTP server itself opens the testing port, and that server will not use
-		// this TCP proxy.
-		//
-		// We must forward instead of doing an HTTP redirect because existing deployed
-		// clients don't support redirects, e.g.
-		//    https://github.com/websockets/ws/issues/812
-		fwd, err := ps.dialer.Dial("tcp", ps.wsAddr)
-		if err != nil {
-			log.Println("Could not forward connection", err)
-			return
+		if err := ps.forward(ctx, conn, input, proxied, logger); err != nil {
+			logger.WithError(err).Warn("Could not forward connection")
+			tracing.SetError(span, err)
 		}
-		wg := sync.WaitGroup{}
-		wg.Add(2)
-		// Copy the input channel.
-		go func() {
-			io.Copy(fwd, input)
-			wg.Done()
-		}()
-		// Copy the ouput channel.
-		go func() {
-			io.Copy(conn, fwd)
-			wg.Done()
-		}()
-		// When the waitgroup is done, cancel the context.
-		go func() {
-			wg.Wait()
-			cancel()
-		}()
-		// When the context is canceled, close `fwd` and return (returning closes
-		// `conn`). Note that this cancellation could be caused by:
-		//
-		//   1. The context times out or is explicitly canceled, which causes fwd to
-		//   close, causing each Copy() to terminate and the waitgroup.Wait() to
-		//   complete.
-		//    OR
-		//   2. The other side of the connection closes `conn` or `fwd`, either of which
-		//   causes the `Copy` operations to terminate, which causes waitgroup.Wait() to
-		//   return, which cancels the context.
-		//
-		// No matter what happens, by the time the return executes all the above
-		// goroutines should be unblocked and be either already done or in the process
-		// of running to completion.
-		<-ctx.Done()
-		if err := ctx.Err(); err == context.DeadlineExceeded {
-			log.Println("Connection", conn, "timed out")
-			ndt5metrics.ClientForwardingTimeouts.Inc()
+		return
+	}
+	if ps.mux != nil && lead[0] == singleserving.TokenPrefix[0] {
+		span.SetAttributes(attribute.String("kind", "test"))
+		handedOff = ps.dispatch(conn, input, proxied)
+		return
+	}
+
+	if ps.tlsConfig != nil && lead[0] == recordTypeHandshake {
+		span.SetAttributes(attribute.String("kind", "tls"))
+		if err := ps.handleTLS(ctx, conn, input, proxied, logger); err != nil {
+			logger.WithError(err).Warn("Could not handle TLS connection")
+			tracing.SetError(span, err)
 		}
-		fwd.Close()
 		return
 	}
 
 	// If there was no error and there was no GET, then this should be treated as a
 	// legitimate attempt to perform a non-ws-based NDT test.
+	span.SetAttributes(attribute.String("kind", "control"))
+	ps.handleControl(ctx, conn, input, proxied, logger)
+}
 
+// handleControl runs the tests of a raw client over conn, whose first bytes
+// were read into input.
+func (ps *plainServer) handleControl(ctx context.Context, conn net.Conn, input *bufio.Reader, proxied *proxyproto.Header, logger log.Interface) {
 	// First, send the kickoff message (which is only sent for non-WS clients),
 	// then transition to the protocol engine where everything should be the same
 	// for plain, WS, and WSS connections.
 	kickoff := "123456 654321"
 	n, err := conn.Write([]byte(kickoff))
 	if n != len(kickoff) || err != nil {
-		log.Printf("Could not write %d byte kickoff string: %d bytes written err: %v\n", len(kickoff), n, err)
+		logger.WithError(err).WithField("written", n).Warn("Could not write kickoff string")
+	}
+	var pconn protocol.MeasuredFlexibleConnection
+	if proxied != nil && proxied.Source != nil {
+		pconn = protocol.AdaptProxiedNetConn(conn, input, proxied.Source, proxied.Destination)
+	} else {
+		pconn = protocol.AdaptNetConn(conn, input)
 	}
-	ndt5.HandleControlChannel(protocol.AdaptNetConn(conn, input), ps, "false")
+	ndt5.HandleControlChannel(ctx, pconn, ps, "false")
+}
+
+// dispatch reads the token of a test connection made to the control port, and
+// hands the connection to the test's single-serving server. It returns whether
+// the connection was handed off.
+func (ps *plainServer) dispatch(conn net.Conn, input *bufio.Reader, proxied *proxyproto.Header) bool {
+	conn.SetReadDeadline(time.Now().Add(tokenTimeout))
+	buf := make([]byte, len(singleserving.TokenPrefix)+singleserving.TokenLength)
+	_, err := io.ReadFull(input, buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || string(buf[:len(singleserving.TokenPrefix)]) != singleserving.TokenPrefix {
+		logging.Logger.WithError(err).WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String())).Warn("Could not read test token")
+		return false
+	}
+	singleserving.Tune(conn)
+	var pconn protocol.MeasuredConnection
+	if proxied != nil && proxied.Source != nil {
+		pconn = protocol.AdaptProxiedNetConn(conn, input, proxied.Source, proxied.Destination)
+	} else {
+		pconn = protocol.AdaptNetConn(conn, input)
+	}
+	token := string(buf[len(singleserving.TokenPrefix):])
+	if !ps.mux.Dispatch(token, pconn) {
+		logging.Logger.WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String())).Warn("No test is waiting for the connection")
+		return false
+	}
+	return true
 }
 
 // ListenAndServe starts up the sniffing server that delegates to the
 // appropriate just-TCP or WS protocol.Connection.
 func (ps *plainServer) ListenAndServe(ctx context.Context, addr string, tx Accepter) error {
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	var lns []*net.TCPListener
+	switch {
+	case *acceptors < 1:
+		return fmt.Errorf("-ndt5.acceptors must be at least 1, not %d", *acceptors)
+	case *acceptors == 1:
+		ln, err := netx.Listen(addr)
+		if err != nil {
+			return err
+		}
+		lns = append(lns, ln)
+	default:
+		var err error
+		if lns, err = netx.ListenReusePort(addr, *acceptors); err != nil {
+			return err
+		}
+	}
+	for _, ln := range lns {
+		ps.listeners = append(ps.listeners, netx.NewListener(ln))
 	}
-	ps.listener = netx.NewListener(ln.(*net.TCPListener))
+	if *singlePort {
+		ps.mux = singleserving.NewMux(lns[0].Addr().(*net.TCPAddr).Port)
+	}
+	if ps.tlsConfig != nil {
+		ps.serveWSS(ctx)
+	}
+	for _, l := range ps.listeners {
+		ps.serve(ctx, l, tx, ps.sniffThenHandle)
+	}
+	return nil
+}
+
+// serve accepts connections from l with tx, and handles each of them with
+// handle in its own goroutine, until ctx is canceled. The connections are
+// handled with the server's own context, so canceling ctx does not stop them.
+func (ps *plainServer) serve(ctx context.Context, l net.Listener, tx Accepter, handle func(context.Context, net.Conn)) {
 	// Close the listener when the context is canceled. We do this in a separate
 	// goroutine to ensure that context cancellation interrupts the Accept() call.
 	go func() {
 		<-ctx.Done()
-		ln.Close()
+		l.Close()
 	}()
 	// Serve requests until the context is canceled.
 	go func() {
+		var backoff time.Duration
 		for ctx.Err() == nil {
-			conn, err := tx.Accept(ps.listener)
+			conn, err := tx.Accept(l)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
-				log.Println("Failed to accept connection:", err)
+				errType := classifyAcceptError(err)
+				ndt5metrics.AcceptErrors.WithLabelValues(errType).Inc()
+				switch errType {
+				case acceptFatal:
+					logging.Logger.WithError(err).Error("Stopped accepting connections")
+					return
+				case acceptTemporary:
+					backoff = nextAcceptBackoff(backoff)
+					logging.Logger.WithError(err).WithField("retry_in", backoff.String()).Warn("Failed to accept connection")
+					select {
+					case <-time.After(backoff):
+					case <-ctx.Done():
+					}
+				default:
+					logging.Logger.WithError(err).Warn("Failed to accept connection")
+				}
+				continue
+			}
+			backoff = 0
+			if !ps.tests.Start() {
+				conn.Close()
 				continue
 			}
 			go func() {
-				connCtx, connCtxCancel := context.WithTimeout(ctx, ps.timeout)
-				defer func() {
-					connCtxCancel()
-					r := recover()
-					if r != nil {
-						// TODO add a metric for this.
-						log.Println("Recovered from panic in RawServer", r)
-					}
-				}()
-				ps.sniffThenHandle(connCtx, conn)
+				defer ps.tests.Done()
+				connCtx, connCtxCancel := context.WithTimeout(ps.conns, ps.timeout)
+				defer connCtxCancel()
+				defer recovery.Recover(connLogger(conn), "plain", conn)
+				handle(connCtx, conn)
 			}()
 		}
 	}()
-	return nil
+}
+
+// connLogger returns a logger that identifies conn by its client address and
+// UUID.
+func connLogger(conn net.Conn) log.Interface {
+	fields := log.Fields{"remote_addr": privacy.Addr(conn.RemoteAddr().String())}
+	if ci := netx.ToConnInfo(conn); ci != nil {
+		if uuid, err := ci.GetUUID(); err == nil {
+			fields["uuid"] = uuid
+		}
+	}
+	return logging.Logger.WithFields(fields)
+}
+
+// Shutdown stops accepting new connections and waits for the tests that are
+// already running to finish, or for ctx to expire, in which case it stops
+// them.
+func (ps *plainServer) Shutdown(ctx context.Context) error {
+	ps.tests.Drain()
+	for _, l := range ps.listeners {
+		l.Close()
+	}
+	if ps.tlsListener != nil {
+		ps.tlsListener.Close()
+	}
+	err := ps.tests.Wait(ctx)
+	ps.stopConns()
+	return err
 }
 
 func (ps *plainServer) ConnectionType() ndt.ConnectionType { return ndt.Plain }
 func (ps *plainServer) DataDir() string                    { return ps.datadir }
 func (ps *plainServer) Metadata() []metadata.NameValue     { return ps.metadata }
-func (ps *plainServer) LoginCeremony(conn protocol.Connection) (int, error) {
+func (ps *plainServer) ResultWriter() results.Writer       { return ps.writer }
+func (ps *plainServer) Queue() *queue.Queue                { return ps.queue }
+func (ps *plainServer) Locator() *geoip.Locator            { return ps.locator }
+func (ps *plainServer) Callbacks() *ndt.Callbacks          { return ps.cb }
+func (ps *plainServer) Running() *live.Registry            { return ps.running }
+func (ps *plainServer) LoginCeremony(conn protocol.Connection) (*protocol.ExtendedLogin, error) {
 	flex, ok := conn.(protocol.MeasuredFlexibleConnection)
 	if !ok {
-		return 0, errors.New("the connection is unable to set its encoding dynamically - this is a bug")
+		return nil, errors.New("the connection is unable to set its encoding dynamically - this is a bug")
 	}
 	v, t, err := protocol.ReadTLVMessage(conn, protocol.MsgLogin, protocol.MsgExtendedLogin)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	clientIP, _ := conn.ClientIPAndPort()
+	// Respond in the encoding of the login. Old clients use TLV, even in
+	// MsgExtendedLogin.
+	e := protocol.LoginEncoding(t, v)
+	flex.SetEncoding(e)
 	switch t {
 	case protocol.MsgExtendedLogin:
-		flex.SetEncoding(protocol.JSON)
-		msg := protocol.JSONMessage{}
-		err := json.Unmarshal(v, &msg)
-		if err != nil {
-			return 0, err
+		login := &protocol.ExtendedLogin{}
+		if err := protocol.Decode(e, v, login); err != nil {
+			return nil, err
+		}
+		if err := ps.tokens.Check(login.AccessToken, clientIP); err != nil {
+			return nil, err
 		}
-		return strconv.Atoi(msg.Tests)
+		return login, nil
 	case protocol.MsgLogin:
-		flex.SetEncoding(protocol.TLV)
-		if len(v) != 1 {
-			return 0, errors.New("MsgLogin requires a 1-byte message")
+		login := &protocol.Login{}
+		if err := protocol.Decode(e, v, login); err != nil {
+			return nil, err
 		}
-		return int(v[0]), nil
+		// MsgLogin has no room for a token.
+		if err := ps.tokens.Check("", clientIP); err != nil {
+			return nil, err
+		}
+		return &protocol.ExtendedLogin{Tests: login.Tests}, nil
 	default:
-		return 0, errors.New("Unknown message type")
+		return nil, errors.New("Unknown message type")
 	}
 }
 
 func (ps *plainServer) Addr() net.Addr {
-	return ps.listener.Addr()
+	return ps.listeners[0].Addr()
 }
 
 // Accepter defines an interface the listening server to decide whether to
@@ -212,14 +404,47 @@ type Accepter interface {
 // Server is the interface implemented by the non-HTTP-based NDT server.
 // Because it isn't run by the http.Server machinery, it has its own interface.
 type Server interface {
+	// ListenAndServe serves the clients that connect to addr, if tx accepts
+	// them, until ctx is canceled. The tests that are running then keep going
+	// until Shutdown stops them.
 	ListenAndServe(ctx context.Context, addr string, tx Accepter) error
+	// Shutdown stops accepting new tests and waits for running tests to
+	// finish, or for ctx to expire, in which case it stops them.
+	Shutdown(ctx context.Context) error
 	Addr() net.Addr
+	// EnableTLS also serves TLS clients, unless the -ndt5.sniff-tls flag is
+	// off. It must be called before ListenAndServe.
+	EnableTLS(config *tls.Config, wss http.Handler)
+	// ListenAndServeTLS serves raw NDT over TLS clients on addr, with the
+	// certificate in config.
+	ListenAndServeTLS(ctx context.Context, addr string, config *tls.Config, tx Accepter) error
+	// TLSAddr returns the address of the raw NDT over TLS server, or nil if
+	// it is not running.
+	TLSAddr() net.Addr
+	// ServeTLSConn runs the tests of a raw NDT client over a TLS connection
+	// that negotiated ALPNProtocol on another server's port, if tx accepts
+	// it.
+	ServeTLSConn(conn *tls.Conn, tx Accepter)
 }
 
 // NewServer creates a new TCP listener to serve the client. It forwards all
 // connection requests that look like HTTP to a different address (assumed to be
-// on the same host).
-func NewServer(datadir, wsAddr string, metadata []metadata.NameValue) Server {
+// on the same host). Every result is also saved with writer, which may be nil.
+// Tests wait their turn in q, which may be nil to run every test immediately.
+// Results are annotated with the client's location by loc, which may be nil.
+// Clients must present an access token that tokens accepts in their extended
+// login message, unless tokens is nil. The functions in cb, which may be nil,
+// are called as tests run. Running tests are registered with running, which
+// may be nil.
+func NewServer(datadir, wsAddr string, metadata []metadata.NameValue, writer results.Writer, q *queue.Queue, loc *geoip.Locator, tokens *admission.Checker, cb *ndt.Callbacks, running *live.Registry) Server {
+	if writer == nil {
+		writer = results.NullWriter()
+	}
+	var forwards chan struct{}
+	if *forwardMaxConns > 0 {
+		forwards = make(chan struct{}, *forwardMaxConns)
+	}
+	conns, stopConns := context.WithCancel(context.Background())
 	return &plainServer{
 		wsAddr: wsAddr,
 		// The dialer is only contacting localhost. The timeout should be set to a
@@ -228,9 +453,19 @@ func NewServer(datadir, wsAddr string, metadata []metadata.NameValue) Server {
 		dialer: &net.Dialer{
 			Timeout: 1 * time.Second,
 		},
-		datadir: datadir,
-		// No client should wait around for more than 2 minutes.
-		timeout:  2 * time.Minute,
-		metadata: metadata,
+		forwards:    forwards,
+		idleTimeout: *forwardIdleTimeout,
+		datadir:     datadir,
+		// No client should stay connected for longer than the maximum lifetime.
+		timeout:   *protocol.MaxConnectionLifetime,
+		metadata:  metadata,
+		writer:    writer,
+		queue:     q,
+		locator:   loc,
+		tokens:    tokens,
+		cb:        cb,
+		running:   running,
+		conns:     conns,
+		stopConns: stopConns,
 	}
 }
@@ -9,9 +9,11 @@ import (
 	"testing"
 	"time"
 
-	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/protocol/protocoltest"
+	"github.com/m-lab/ndt-server/ndt7/listener"
 )
 
 type fakeAccepter struct{}
@@ -48,7 +50,7 @@ func TestNewPlainServer(t *testing.T) {
 		Addr:    ":0",
 		Handler: h,
 	}
-	rtx.Must(httpx.ListenAndServeAsync(wsSrv), "Could not start server")
+	rtx.Must(listener.ListenAndServeLocalProxyAsync(wsSrv, time.Second), "Could not start server")
 	// Sanity check that the proxied server is up and running.
 	_, err = http.Get("http://" + wsSrv.Addr + "/test_url")
 	rtx.Must(err, "Proxied server could not respond to get")
@@ -57,7 +59,7 @@ func TestNewPlainServer(t *testing.T) {
 	}
 
 	// Set up the plain server
-	tcpS := NewServer(d, wsSrv.Addr, []metadata.NameValue{})
+	tcpS := NewServer(d, wsSrv.Addr, []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	fa := &fakeAccepter{}
@@ -112,7 +114,7 @@ func TestNewPlainServerBrokenForwarding(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(d)
 	// Set up the plain server forwarding to a non-open port.
-	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{})
+	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	fa := &fakeAccepter{}
@@ -126,3 +128,72 @@ func TestNewPlainServerBrokenForwarding(t *testing.T) {
 		t.Error("This should have failed")
 	}
 }
+
+func TestPlainServer_LoginCeremony(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		login    []byte
+		tests    int
+		version  string
+		encoding protocol.Encoding
+	}{
+		{"login", []byte{byte(protocol.MsgLogin), 0, 1, 22}, 22, "", protocol.TLV},
+		{"json", append([]byte{byte(protocol.MsgExtendedLogin), 0, 29}, `{"msg":"v3.7.0","tests":"22"}`...), 22, "v3.7.0", protocol.JSON},
+		{"binary", append([]byte{byte(protocol.MsgExtendedLogin), 0, 7, 22}, "v3.6.4"...), 22, "v3.6.4", protocol.TLV},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := protocoltest.Pipe()
+			defer client.Close()
+			go client.Write(tt.login)
+			ps := &plainServer{}
+			login, err := ps.LoginCeremony(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if login.Tests != tt.tests || login.Version != tt.version || conn.Messager().Encoding() != tt.encoding {
+				t.Errorf("LoginCeremony() = %+v with %s, want %d and %q with %s",
+					login, conn.Messager().Encoding(), tt.tests, tt.version, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestPlainServer_acceptors(t *testing.T) {
+	success := 0
+	h := &http.ServeMux{}
+	h.HandleFunc("/test_url", func(w http.ResponseWriter, r *http.Request) {
+		success++
+	})
+	wsSrv := &http.Server{
+		Addr:    ":0",
+		Handler: h,
+	}
+	rtx.Must(listener.ListenAndServeLocalProxyAsync(wsSrv, time.Second), "Could not start server")
+	defer wsSrv.Close()
+
+	defer func(n int) { *acceptors = n }(*acceptors)
+	*acceptors = 4
+	tcpS := NewServer(t.TempDir(), wsSrv.Addr, []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtx.Must(tcpS.ListenAndServe(ctx, "127.0.0.1:0", &fakeAccepter{}), "Could not start tcp server")
+	if n := len(tcpS.(*plainServer).listeners); n != 4 {
+		t.Fatalf("the server has %d listeners, want 4", n)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 8; i++ {
+		r, err := client.Get("http://" + tcpS.Addr().String() + "/test_url")
+		if err != nil || r.StatusCode != http.StatusOK {
+			t.Fatalf("GET = %v, %v", r, err)
+		}
+		r.Body.Close()
+	}
+	if success != 8 {
+		t.Errorf("%d GETs were forwarded, want 8", success)
+	}
+
+	*acceptors = 0
+	if err := NewServer(t.TempDir(), wsSrv.Addr, nil, nil, nil, nil, nil, nil, nil).ListenAndServe(ctx, ":0", &fakeAccepter{}); err == nil {
+		t.Error("ListenAndServe() accepted -ndt5.acceptors=0")
+	}
+}
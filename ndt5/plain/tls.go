@@ -0,0 +1,263 @@
+package plain
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/proxyproto"
+	"github.com/m-lab/ndt-server/privacy"
+)
+
+var sniffTLS = flag.Bool("ndt5.sniff-tls", false, "Also accept TLS connections on the raw ndt5 port when a certificate is configured, so that one port serves NDT, NDT over WS, NDT over WSS, and NDT over TLS clients")
+
+// ALPNProtocol is the ALPN protocol of raw NDT over TLS. Clients that offer it
+// run raw NDT tests, even on TLS ports that otherwise serve WSS clients.
+const ALPNProtocol = "ndt/5"
+
+const (
+	// recordTypeHandshake is the first byte of a TLS ClientHello.
+	recordTypeHandshake = 0x16
+	// tlsHandshakeTimeout is how long a client may take to complete the TLS
+	// handshake on the raw port.
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// bufferedConn is a net.Conn whose first bytes have already been read into r.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handedConn is a connection handed to the WSS server. done is closed when
+// the WSS server closes the connection.
+type handedConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *handedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// connListener is a net.Listener that accepts the connections that the raw
+// server hands to it.
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// EnableTLS terminates TLS connections on the raw port with config, if the
+// -ndt5.sniff-tls flag is set. After the handshake, clients that negotiated
+// ALPNProtocol run raw NDT tests over TLS, and clients that negotiated
+// http/1.1 are served by wss. Clients that negotiated neither are sniffed
+// again. EnableTLS must be called before ListenAndServe.
+func (ps *plainServer) EnableTLS(config *tls.Config, wss http.Handler) {
+	if !*sniffTLS {
+		return
+	}
+	ps.tlsConfig = WithALPN(config)
+	ps.wss = wss
+}
+
+// WithALPN returns a copy of config that offers ALPNProtocol and http/1.1 to
+// clients, ahead of any other protocols in config, e.g. acme-tls/1.
+func WithALPN(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	protos := []string{ALPNProtocol, "http/1.1"}
+	for _, p := range config.NextProtos {
+		if p != ALPNProtocol && p != "http/1.1" {
+			protos = append(protos, p)
+		}
+	}
+	config.NextProtos = protos
+	return config
+}
+
+// oneConnListener is a net.Listener that accepts a single connection, which
+// another server accepted, so that an Accepter can vet it.
+type oneConnListener struct {
+	conn net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, net.ErrClosed
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// ServeTLSConn runs the tests of a raw NDT client over conn, a TLS connection
+// that negotiated ALPNProtocol on another server's port, if tx accepts it. It
+// closes conn. Like the tests of the server's own ports, the tests run until
+// they end, or until Shutdown stops them.
+func (ps *plainServer) ServeTLSConn(conn *tls.Conn, tx Accepter) {
+	defer conn.Close()
+	if _, err := tx.Accept(&oneConnListener{conn: conn}); err != nil {
+		ndt5metrics.AcceptErrors.WithLabelValues(acceptRejected).Inc()
+		logging.Logger.WithError(err).Warn("Failed to accept connection")
+		return
+	}
+	if !ps.tests.Start() {
+		return
+	}
+	defer ps.tests.Done()
+	// Clear the deadlines of the server that accepted conn. The tests have
+	// their own.
+	conn.SetDeadline(time.Time{})
+	ctx, cancel := context.WithTimeout(ps.conns, ps.timeout)
+	defer cancel()
+	logger := logging.Logger.WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String()))
+	ps.handleControl(ctx, conn, bufio.NewReader(conn), nil, logger)
+}
+
+// ListenAndServeTLS serves raw NDT clients over TLS on addr, with the
+// certificate in config, until ctx is canceled. Only the control connection is
+// encrypted: the c2s and s2c tests run on plain TCP ports, as for other raw
+// clients. It returns once the server is listening.
+func (ps *plainServer) ListenAndServeTLS(ctx context.Context, addr string, config *tls.Config, tx Accepter) error {
+	ln, err := netx.Listen(addr)
+	if err != nil {
+		return err
+	}
+	ps.tlsListener = tls.NewListener(netx.NewListener(ln), WithALPN(config))
+	ps.serve(ctx, ps.tlsListener, tx, ps.handleTLSConn)
+	return nil
+}
+
+// TLSAddr returns the address of the raw NDT over TLS server, or nil if it is
+// not running.
+func (ps *plainServer) TLSAddr() net.Addr {
+	if ps.tlsListener == nil {
+		return nil
+	}
+	return ps.tlsListener.Addr()
+}
+
+// handleTLSConn completes the TLS handshake of a connection accepted by
+// ListenAndServeTLS and runs the client's tests.
+func (ps *plainServer) handleTLSConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	logger := logging.Logger.WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String()))
+	tlsConn := conn.(*tls.Conn)
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		logger.WithError(err).Warn("Could not complete TLS handshake")
+		return
+	}
+	ps.handleControl(ctx, tlsConn, bufio.NewReader(tlsConn), nil, logger)
+}
+
+// serveWSS serves the WebSocket clients that connect to the raw port over TLS
+// until ctx is canceled.
+func (ps *plainServer) serveWSS(ctx context.Context) {
+	ps.wssConns = newConnListener(ps.Addr())
+	srv := &http.Server{
+		Handler: ps.wss,
+		// The same absolute timeouts as the WSS server.
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+	go srv.Serve(ps.wssConns)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+}
+
+// handleTLS completes the TLS handshake of conn, whose first bytes were read
+// into input, and then sniffs the decrypted connection in the same way as
+// sniffThenHandle.
+func (ps *plainServer) handleTLS(ctx context.Context, conn net.Conn, input *bufio.Reader, proxied *proxyproto.Header, logger log.Interface) error {
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: input}, ps.tlsConfig)
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		return err
+	}
+	tlsInput := bufio.NewReader(tlsConn)
+	switch tlsConn.ConnectionState().NegotiatedProtocol {
+	case ALPNProtocol:
+		ps.handleControl(ctx, tlsConn, tlsInput, proxied, logger)
+		return nil
+	case "http/1.1":
+	default:
+		lead, err := tlsInput.Peek(3)
+		if err != nil {
+			return err
+		}
+		if string(lead) != "GET" {
+			ps.handleControl(ctx, tlsConn, tlsInput, proxied, logger)
+			return nil
+		}
+	}
+	// Hand WebSocket clients to the WSS server, and wait for it to finish with
+	// the connection so that it counts as a running test.
+	hc := &handedConn{Conn: &bufferedConn{Conn: tlsConn, r: tlsInput}, done: make(chan struct{})}
+	select {
+	case ps.wssConns.conns <- hc:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-hc.done:
+	case <-ctx.Done():
+		hc.Close()
+	}
+	return nil
+}
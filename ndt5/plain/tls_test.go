@@ -0,0 +1,192 @@
+package plain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/netx"
+)
+
+// selfSignedCert returns a certificate for localhost.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rtx.Must(err, "Could not generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	rtx.Must(err, "Could not create certificate")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSSniffing(t *testing.T) {
+	*sniffTLS = true
+	defer func() { *sniffTLS = false }()
+	d := t.TempDir()
+
+	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+	tcpS.EnableTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("wss"))
+		}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtx.Must(tcpS.ListenAndServe(ctx, ":0", &fakeAccepter{}), "Could not start tcp server")
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + tcpS.Addr().String() + "/ndt_protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET over TLS returned %s, want 200 from the WSS handler", resp.Status)
+	}
+}
+
+func TestALPN(t *testing.T) {
+	*sniffTLS = true
+	defer func() { *sniffTLS = false }()
+	d := t.TempDir()
+
+	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+	tcpS.EnableTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}, http.NotFoundHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtx.Must(tcpS.ListenAndServe(ctx, ":0", &fakeAccepter{}), "Could not start tcp server")
+
+	// A raw client that negotiates ALPNProtocol receives the kickoff message
+	// without sending anything.
+	conn, err := tls.Dial("tcp", tcpS.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ALPNProtocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().NegotiatedProtocol; got != ALPNProtocol {
+		t.Errorf("negotiated %q, want %q", got, ALPNProtocol)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	kickoff := make([]byte, len("123456 654321"))
+	if _, err := io.ReadFull(conn, kickoff); err != nil || string(kickoff) != "123456 654321" {
+		t.Errorf("read %q, %v, want the kickoff message", kickoff, err)
+	}
+	shutdown(t, tcpS, conn)
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	d := t.TempDir()
+	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	rtx.Must(tcpS.ListenAndServeTLS(ctx, "127.0.0.1:0", config, &fakeAccepter{}), "Could not start TLS server")
+
+	conn, err := tls.Dial("tcp", tcpS.TLSAddr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	kickoff := make([]byte, len("123456 654321"))
+	if _, err := io.ReadFull(conn, kickoff); err != nil || string(kickoff) != "123456 654321" {
+		t.Errorf("read %q, %v, want the kickoff message", kickoff, err)
+	}
+	shutdown(t, tcpS, conn)
+}
+
+// shutdown closes the connection of the client and waits for the server to
+// finish its test, which writes the result into the TempDir of t.
+func shutdown(t *testing.T, s Server, conn net.Conn) {
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
+
+// rejectingAccepter rejects every connection, as the limits of the server do
+// for the clients over them.
+type rejectingAccepter struct{}
+
+func (rejectingAccepter) Accept(l net.Listener) (net.Conn, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return nil, errors.New("rejected")
+}
+
+func TestServeTLSConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		tx      Accepter
+		kickoff bool
+	}{
+		{name: "accepted", tx: &fakeAccepter{}, kickoff: true},
+		{name: "rejected", tx: rejectingAccepter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcpS := NewServer(t.TempDir(), "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil)
+			tcpLn, err := netx.Listen("127.0.0.1:0")
+			rtx.Must(err, "Could not listen")
+			ln := tls.NewListener(netx.NewListener(tcpLn), WithALPN(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}))
+			defer ln.Close()
+			// Another server hands the connections that negotiated
+			// ALPNProtocol to the raw server.
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				tcpS.ServeTLSConn(conn.(*tls.Conn), tt.tx)
+			}()
+
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{ALPNProtocol},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			kickoff := make([]byte, len("123456 654321"))
+			_, err = io.ReadFull(conn, kickoff)
+			if got := err == nil && string(kickoff) == "123456 654321"; got != tt.kickoff {
+				t.Errorf("read %q, %v, want kickoff %t", kickoff, err, tt.kickoff)
+			}
+			shutdown(t, tcpS, conn)
+		})
+	}
+}
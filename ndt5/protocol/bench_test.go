@@ -0,0 +1,263 @@
+package protocol_test
+
+// The benchmarks of the measurement paths of ndt5, run with
+//
+//	go test -run XXX -bench . ./ndt5/protocol/
+//
+// send and receive over loopback, so they measure the server's overhead per
+// byte rather than the network.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/web100"
+)
+
+// wsPair returns the server's end of a WebSocket connection over loopback,
+// and the client's end. If secure is set, the connection uses TLS.
+func wsPair(b *testing.B, secure bool) (protocol.MeasuredConnection, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- ws
+	})
+	var srv *httptest.Server
+	dialer := *websocket.DefaultDialer
+	url := ""
+	if secure {
+		srv = httptest.NewTLSServer(handler)
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		url = "wss" + strings.TrimPrefix(srv.URL, "https")
+	} else {
+		srv = httptest.NewServer(handler)
+		url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	}
+	b.Cleanup(srv.Close)
+	client, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+	ws := <-conns
+	ws.SetReadLimit(-1)
+	return protocol.AdaptWsConn(ws), client
+}
+
+// rawPair returns the server's end of a TCP connection over loopback, and
+// the client's end.
+func rawPair(b *testing.B) (protocol.MeasuredConnection, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return protocol.AdaptNetConn(conn, bufio.NewReader(conn)), client
+}
+
+// benchmarkReadBytesWS measures the c2s receive path of WebSocket clients,
+// which send the data of the test in messages of up to 1MiB.
+func benchmarkReadBytesWS(b *testing.B, secure bool) {
+	conn, client := wsPair(b, secure)
+	msg, err := websocket.NewPreparedMessage(websocket.BinaryMessage, make([]byte, 1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for client.WritePreparedMessage(msg) == nil {
+		}
+	}()
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n, err := conn.ReadBytes(); err != nil || n != 1<<20 {
+			b.Fatalf("ReadBytes() = %d, %v", n, err)
+		}
+	}
+}
+
+func BenchmarkReadBytes_ws(b *testing.B) {
+	benchmarkReadBytesWS(b, false)
+}
+
+func BenchmarkReadBytes_wss(b *testing.B) {
+	benchmarkReadBytesWS(b, true)
+}
+
+// BenchmarkReadBytes_raw measures the c2s receive path of raw clients.
+func BenchmarkReadBytes_raw(b *testing.B) {
+	conn, client := rawPair(b)
+	go io.Copy(client, zeros{})
+	var total int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := conn.ReadBytes()
+		if err != nil {
+			b.Fatal(err)
+		}
+		total += n
+	}
+	b.SetBytes(total / int64(b.N))
+}
+
+// fillDuration is how long each FillUntil of the benchmarks sends for.
+const fillDuration = 10 * time.Millisecond
+
+// benchmarkFillUntil measures the s2c send path of conn.
+func benchmarkFillUntil(b *testing.B, conn protocol.MeasuredConnection) {
+	data := protocol.NewPayload(make([]byte, 8192))
+	var total int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := conn.FillUntil(time.Now().Add(fillDuration), data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		total += n
+	}
+	b.SetBytes(total / int64(b.N))
+}
+
+// drainWS reads and discards the messages that client receives, until it is
+// closed.
+func drainWS(client *websocket.Conn) {
+	for {
+		_, r, err := client.NextReader()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, r)
+	}
+}
+
+func BenchmarkFillUntil_raw(b *testing.B) {
+	conn, client := rawPair(b)
+	go io.Copy(io.Discard, client)
+	benchmarkFillUntil(b, conn)
+}
+
+func BenchmarkFillUntil_ws(b *testing.B) {
+	conn, client := wsPair(b, false)
+	go drainWS(client)
+	benchmarkFillUntil(b, conn)
+}
+
+func BenchmarkFillUntil_wss(b *testing.B) {
+	conn, client := wsPair(b, true)
+	go drainWS(client)
+	benchmarkFillUntil(b, conn)
+}
+
+// BenchmarkWriteTLVMessage measures the encoding and sending of control
+// messages.
+func BenchmarkWriteTLVMessage(b *testing.B) {
+	conn, client := rawPair(b)
+	go io.Copy(io.Discard, client)
+	msg := strings.Repeat("x", 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := protocol.WriteTLVMessage(conn, protocol.TestMsg, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkJSONMessager_Send measures the encoding of the JSON messages sent
+// to WebSocket clients.
+func BenchmarkJSONMessager_Send(b *testing.B) {
+	m := protocol.JSON.Messager(&fakeConnection{})
+	msg := &protocol.TestMessage{Text: strings.Repeat("x", 1000)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkJSONMessager_ReceiveMessage measures the decoding of the JSON
+// messages received from WebSocket clients.
+func BenchmarkJSONMessager_ReceiveMessage(b *testing.B) {
+	body, err := json.Marshal(protocol.JSONMessage{Msg: strings.Repeat("x", 1000)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := append([]byte{byte(protocol.TestMsg), byte(len(body) >> 8), byte(len(body))}, body...)
+	m := protocol.JSON.Messager(&fakeConnection{data: data})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ReceiveMessage(protocol.TestMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendMetrics measures the sending of the web100 variables at the
+// end of a test, a JSON message each.
+func BenchmarkSendMetrics(b *testing.B) {
+	// The fields that can't be sent are logged, which would dominate.
+	defer func(l log.Level) { logging.Logger.Level = l }(logging.Logger.Level)
+	logging.Logger.Level = log.ErrorLevel
+	m := protocol.JSON.Messager(&fakeConnection{})
+	metrics := &web100.Metrics{MaxRTT: 100, MinRTT: 10, DataBytesOut: 1 << 30, CurMSS: 1448}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := protocol.SendMetrics(metrics, m, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecode_extendedLogin measures the decoding of the JSON login
+// messages of clients.
+func BenchmarkDecode_extendedLogin(b *testing.B) {
+	body := []byte(`{"msg":"v5.0-NDTinGO","tests":"22","access_token":"token","congestion_control":"bbr"}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var login protocol.ExtendedLogin
+		if err := protocol.Decode(protocol.JSON, body, &login); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,34 @@
+package protocol
+
+import "sync"
+
+// bufferSize is the size of the pooled buffers, which is the size of the
+// reads of the data of c2s tests.
+const bufferSize = 8192
+
+// maxPooledSize is the size of the largest buffers kept in the pool, so that
+// an unusually large message doesn't stay in memory.
+const maxPooledSize = 64 << 10
+
+// buffers are shared by the connections of all the tests, so that reading and
+// writing doesn't allocate memory for every test or every message.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+// getBuffer returns a buffer of at least bufferSize bytes from the pool.
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+// putBuffer returns b to the pool. The caller must not use it afterwards.
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledSize {
+		return
+	}
+	*b = (*b)[:cap(*b)]
+	buffers.Put(b)
+}
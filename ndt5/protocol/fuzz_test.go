@@ -0,0 +1,100 @@
+package protocol_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// fuzzMessages are the messages that FuzzDecode decodes into.
+var fuzzMessages = []func() protocol.Message{
+	func() protocol.Message { return &protocol.Login{} },
+	func() protocol.Message { return &protocol.ExtendedLogin{} },
+	func() protocol.Message { return &protocol.LoginVersion{} },
+	func() protocol.Message { return &protocol.LoginTests{} },
+	func() protocol.Message { return &protocol.Queue{} },
+	func() protocol.Message { return &protocol.Waiting{} },
+	func() protocol.Message { return &protocol.Prepare{} },
+	func() protocol.Message { return &protocol.Start{} },
+	func() protocol.Message { return &protocol.TestMessage{} },
+	func() protocol.Message { return &protocol.S2CResults{} },
+	func() protocol.Message { return &protocol.Finalize{} },
+	func() protocol.Message { return &protocol.Results{} },
+	func() protocol.Message { return &protocol.Error{} },
+	func() protocol.Message { return &protocol.Logout{} },
+}
+
+// FuzzDecode checks that decoding hostile bodies does not panic, and that the
+// messages that are decoded encode to bodies that decode to the same message.
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []struct {
+		kind uint8
+		json bool
+		body string
+	}{
+		{0, false, "\x16"},
+		{1, true, `{"msg":"v3.7.0","tests":"1046","access_token":"t"}`},
+		{1, false, "\x16v3.6.4"},
+		{3, true, `{"msg":"2 4 32"}`},
+		{4, false, "9990"},
+		{6, false, "3010 abc"},
+		{8, true, `{"msg":"125"}`},
+		{9, true, `{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3"}`},
+		{9, false, "1 2 3"},
+		{11, true, `{"msg":"UUID: x\n"}`},
+	} {
+		f.Add(seed.kind, seed.json, []byte(seed.body))
+	}
+	f.Fuzz(func(t *testing.T, kind uint8, json bool, body []byte) {
+		newMessage := fuzzMessages[int(kind)%len(fuzzMessages)]
+		e := protocol.TLV
+		if json {
+			e = protocol.JSON
+		}
+		msg := newMessage()
+		if protocol.Decode(e, body, msg) != nil {
+			return
+		}
+		// Encode may refuse bodies that grow too large once re-encoded.
+		encoded, err := protocol.Encode(e, msg)
+		if err != nil {
+			return
+		}
+		got := newMessage()
+		if err := protocol.Decode(e, encoded, got); err != nil {
+			t.Fatalf("Decode(Encode(%+v)) error = %v", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("Decode(Encode(%+v)) = %+v", msg, got)
+		}
+	})
+}
+
+// FuzzLogin decodes logins the way the server does, by guessing their encoding
+// from their bodies.
+func FuzzLogin(f *testing.F) {
+	f.Add(uint8(protocol.MsgLogin), []byte("\x16"))
+	f.Add(uint8(protocol.MsgExtendedLogin), []byte(`{"msg":"v3.7.0","tests":"22"}`))
+	f.Add(uint8(protocol.MsgExtendedLogin), []byte(`{"msg":"v3.7.0","tests":"-1"}`))
+	f.Add(uint8(protocol.MsgExtendedLogin), []byte("\x16v3.6.4"))
+	f.Add(uint8(protocol.MsgExtendedLogin), []byte("{v3.6.4"))
+	f.Fuzz(func(t *testing.T, kind uint8, body []byte) {
+		mt := protocol.MessageType(kind)
+		e := protocol.LoginEncoding(mt, body)
+		if e != protocol.TLV && e != protocol.JSON {
+			t.Fatalf("LoginEncoding(%s, %q) = %s", mt, body, e)
+		}
+		if mt == protocol.MsgLogin {
+			login := &protocol.Login{}
+			if protocol.Decode(e, body, login) == nil && (login.Tests < 0 || login.Tests > 0xFF) {
+				t.Errorf("Decode(%q) tests = %d", body, login.Tests)
+			}
+			return
+		}
+		login := &protocol.ExtendedLogin{}
+		if protocol.Decode(e, body, login) == nil && login.Tests < 0 {
+			t.Errorf("Decode(%q) tests = %d", body, login.Tests)
+		}
+	})
+}
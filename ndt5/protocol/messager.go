@@ -2,11 +2,10 @@ package protocol
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
 	"reflect"
-	"strconv"
+
+	"github.com/m-lab/ndt-server/logging"
 )
 
 // Encoding encodes the communication methods we support.
@@ -38,22 +37,23 @@ func (e Encoding) String() string {
 func (e Encoding) Messager(conn Connection) Messager {
 	switch e {
 	case Unknown:
-		log.Println("Error: Messager() called for Unknown type")
+		logging.Logger.Error("Messager() called for Unknown type")
 		return nil
 	case JSON:
 		return &jsonMessager{conn}
 	case TLV:
 		return &tlvMessager{conn}
 	}
-	log.Printf("Bad Encoding value: %d\n", int(e))
+	logging.Logger.WithField("encoding", int(e)).Error("Bad Encoding value")
 	return nil
 }
 
 // Messager allows us to send JSON and non-JSON messages using a single unified
 // interface.
 type Messager interface {
-	SendMessage(MessageType, []byte) error
-	SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error
+	// Send sends msg in the encoding of the connection, after validating its
+	// fields.
+	Send(msg Message) error
 	ReceiveMessage(MessageType) ([]byte, error)
 	Encoding() Encoding
 }
@@ -75,28 +75,16 @@ func (r *s2cResult) String() string {
 	return string(b)
 }
 
-func (jm *jsonMessager) SendMessage(kind MessageType, contents []byte) error {
-	return SendJSONMessage(kind, string(contents), jm.conn)
-}
-
-func (jm *jsonMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	r := &s2cResult{
-		ThroughputValue:  strconv.FormatInt(throughputKbps, 10),
-		UnsentDataAmount: strconv.FormatInt(unsentBytes, 10),
-		TotalSentByte:    strconv.FormatInt(totalSentBytes, 10),
-	}
-	return WriteTLVMessage(jm.conn, TestMsg, r.String())
+func (jm *jsonMessager) Send(msg Message) error {
+	return Send(jm.conn, JSON, msg)
 }
 
 func (jm *jsonMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
-	msg, err := ReceiveJSONMessage(jm.conn, kind)
-	if msg == nil {
-		if err == nil {
-			return nil, errors.New("empty message received without error")
-		}
+	msg := &untyped{kind: kind}
+	if err := Receive(jm.conn, JSON, msg); err != nil {
 		return nil, err
 	}
-	return []byte(msg.Msg), err
+	return []byte(msg.s), nil
 }
 
 func (jm *jsonMessager) Encoding() Encoding {
@@ -109,18 +97,16 @@ type tlvMessager struct {
 	conn Connection
 }
 
-func (tm *tlvMessager) SendMessage(kind MessageType, contents []byte) error {
-	return WriteTLVMessage(tm.conn, kind, string(contents))
-}
-
-func (tm *tlvMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	msg := fmt.Sprintf("%d %d %d", throughputKbps, unsentBytes, totalSentBytes)
-	return WriteTLVMessage(tm.conn, TestMsg, msg)
+func (tm *tlvMessager) Send(msg Message) error {
+	return Send(tm.conn, TLV, msg)
 }
 
 func (tm *tlvMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
-	b, _, err := ReadTLVMessage(tm.conn, kind)
-	return b, err
+	msg := &untyped{kind: kind}
+	if err := Receive(tm.conn, TLV, msg); err != nil {
+		return nil, err
+	}
+	return []byte(msg.s), nil
 }
 
 func (tm *tlvMessager) Encoding() Encoding {
@@ -141,13 +127,13 @@ func SendMetrics(metrics interface{}, m Messager, prefix string) error {
 		switch t.Field(i).Type.Kind() {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			msg := fmt.Sprintf("%s%s: %v\n", prefix, name, v.Field(i).Interface())
-			err := m.SendMessage(TestMsg, []byte(msg))
+			err := m.Send(&TestMessage{Text: msg})
 			if err != nil {
 				return err
 			}
 		case reflect.String:
 			msg := fmt.Sprintf("%s%s: %s\n", prefix, name, v.Field(i).String())
-			err := m.SendMessage(TestMsg, []byte(msg))
+			err := m.Send(&TestMessage{Text: msg})
 			if err != nil {
 				return err
 			}
@@ -156,15 +142,18 @@ func SendMetrics(metrics interface{}, m Messager, prefix string) error {
 			var err error
 			if s, ok := data.(fmt.Stringer); ok {
 				msg := fmt.Sprintf("%s%s: %s\n", prefix, name, s.String())
-				err = m.SendMessage(TestMsg, []byte(msg))
+				err = m.Send(&TestMessage{Text: msg})
 			} else {
 				err = SendMetrics(v.Field(i).Interface(), m, prefix+name+".")
 			}
 			if err != nil {
 				return err
 			}
+		case reflect.Slice:
+			// Slices hold series of samples, which are too large to send to
+			// clients and are only saved in the archival data.
 		default:
-			log.Println("Unhandled case in SendMetrics:", t.Field(i).Type.Kind())
+			logging.Logger.WithField("kind", t.Field(i).Type.Kind().String()).Warn("Unhandled case in SendMetrics")
 		}
 	}
 	return nil
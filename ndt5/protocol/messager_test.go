@@ -20,8 +20,12 @@ type fakeMessager struct {
 	errorAfter   int
 }
 
-func (fm *fakeMessager) SendMessage(_ MessageType, msg []byte) error {
-	fm.sentMessages = append(fm.sentMessages, string(msg))
+func (fm *fakeMessager) Send(msg Message) error {
+	s, err := msg.text()
+	if err != nil {
+		return err
+	}
+	fm.sentMessages = append(fm.sentMessages, s)
 	if fm.errorAfter > 0 {
 		defer func() { fm.errorAfter-- }()
 		if fm.errorAfter == 1 {
@@ -31,10 +35,6 @@ func (fm *fakeMessager) SendMessage(_ MessageType, msg []byte) error {
 	return nil
 }
 
-func (fm *fakeMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	return nil
-}
-
 func (fm *fakeMessager) ReceiveMessage(MessageType) ([]byte, error) { return []byte{}, nil }
 
 func (fm *fakeMessager) Encoding() Encoding {
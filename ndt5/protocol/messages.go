@@ -0,0 +1,497 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/m-lab/ndt-server/netx"
+)
+
+// Message is a control message of the NDT protocol. Each kind of message has
+// its own type, whose fields are validated when the message is encoded and
+// decoded, so that a malformed message is rejected where it is read or
+// written instead of confusing the test that uses it.
+type Message interface {
+	// Type returns the type of the message.
+	Type() MessageType
+	// text returns the text of the message, which is the body of TLV messages
+	// and the msg field of JSON messages.
+	text() (string, error)
+	// parse sets the fields of the message from its text.
+	parse(s string) error
+}
+
+// ErrBadMessage is returned, wrapped, for messages that are malformed or
+// whose fields are out of range.
+var ErrBadMessage = errors.New("bad message")
+
+// maxBodySize is the largest body that the 2-byte length of a message can
+// describe.
+const maxBodySize = 0xFFFF
+
+func badMessage(t MessageType, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrBadMessage, t, fmt.Sprintf(format, args...))
+}
+
+// Encode returns the body of msg in the encoding e. The body of JSON messages
+// is a JSONMessage whose msg field holds the text of the message.
+func Encode(e Encoding, msg Message) ([]byte, error) {
+	var body []byte
+	switch m := msg.(type) {
+	case *Login:
+		// MsgLogin is only sent by TLV clients, and is a single byte.
+		if e != TLV {
+			return nil, badMessage(m.Type(), "%s clients must use MsgExtendedLogin", e)
+		}
+		if m.Tests < 0 || m.Tests > 0xFF {
+			return nil, badMessage(m.Type(), "tests %d do not fit in a byte", m.Tests)
+		}
+		body = []byte{byte(m.Tests)}
+	case *ExtendedLogin:
+		if m.Tests < 0 {
+			return nil, badMessage(m.Type(), "negative tests %d", m.Tests)
+		}
+		if e == JSON {
+			body = []byte((&JSONMessage{Msg: m.Version, Tests: strconv.Itoa(m.Tests), AccessToken: m.AccessToken, CongestionControl: m.CongestionControl}).String())
+			break
+		}
+		// Clients without JSON support send the tests in a byte, followed by
+		// their version. They have no access token.
+		if m.Tests > 0xFF {
+			return nil, badMessage(m.Type(), "tests %d do not fit in a byte", m.Tests)
+		}
+		if m.AccessToken != "" {
+			return nil, badMessage(m.Type(), "TLV logins have no access token")
+		}
+		if m.CongestionControl != "" {
+			return nil, badMessage(m.Type(), "TLV logins have no congestion control")
+		}
+		body = append([]byte{byte(m.Tests)}, m.Version...)
+	case *S2CResults:
+		if m.ThroughputKbps < 0 || m.UnsentBytes < 0 || m.TotalSentBytes < 0 {
+			return nil, badMessage(m.Type(), "negative results %+v", *m)
+		}
+		if e == JSON {
+			r := &s2cResult{
+				ThroughputValue:  strconv.FormatInt(m.ThroughputKbps, 10),
+				UnsentDataAmount: strconv.FormatInt(m.UnsentBytes, 10),
+				TotalSentByte:    strconv.FormatInt(m.TotalSentBytes, 10),
+			}
+			body = []byte(r.String())
+			break
+		}
+		body = []byte(fmt.Sprintf("%d %d %d", m.ThroughputKbps, m.UnsentBytes, m.TotalSentBytes))
+	default:
+		s, err := msg.text()
+		if err != nil {
+			return nil, err
+		}
+		if !validText(msg, s) {
+			return nil, badMessage(msg.Type(), "text is not UTF-8")
+		}
+		switch e {
+		case JSON:
+			body = []byte((&JSONMessage{Msg: s}).String())
+		case TLV:
+			body = []byte(s)
+		default:
+			return nil, fmt.Errorf("cannot encode %s in the %s encoding", msg.Type(), e)
+		}
+	}
+	if len(body) > maxBodySize {
+		return nil, badMessage(msg.Type(), "body of %d bytes is too large", len(body))
+	}
+	return body, nil
+}
+
+// Decode sets the fields of msg from body, a body of msg's type in the
+// encoding e.
+func Decode(e Encoding, body []byte, msg Message) error {
+	switch m := msg.(type) {
+	case *Login:
+		if len(body) != 1 {
+			return badMessage(m.Type(), "body of %d bytes, want 1", len(body))
+		}
+		m.Tests = int(body[0])
+		return nil
+	case *ExtendedLogin:
+		if e != JSON {
+			if len(body) == 0 {
+				return badMessage(m.Type(), "empty body")
+			}
+			if !utf8.Valid(body[1:]) {
+				return badMessage(m.Type(), "version is not UTF-8")
+			}
+			*m = ExtendedLogin{Version: string(body[1:]), Tests: int(body[0])}
+			return nil
+		}
+		j := &JSONMessage{}
+		if err := json.Unmarshal(body, j); err != nil {
+			return badMessage(m.Type(), "%v", err)
+		}
+		tests, err := strconv.Atoi(j.Tests)
+		if err != nil || tests < 0 {
+			return badMessage(m.Type(), "tests %q are not a bitmask", j.Tests)
+		}
+		if j.CongestionControl != "" {
+			if err := netx.ValidCongestionControl(j.CongestionControl); err != nil {
+				return badMessage(m.Type(), "%v", err)
+			}
+		}
+		*m = ExtendedLogin{Version: j.Msg, Tests: tests, AccessToken: j.AccessToken, CongestionControl: j.CongestionControl}
+		return nil
+	case *S2CResults:
+		var fields []string
+		if e == JSON {
+			r := &s2cResult{}
+			if err := json.Unmarshal(body, r); err != nil {
+				return badMessage(m.Type(), "%v", err)
+			}
+			fields = []string{r.ThroughputValue, r.UnsentDataAmount, r.TotalSentByte}
+		} else {
+			fields = strings.Fields(string(body))
+		}
+		if len(fields) != 3 {
+			return badMessage(m.Type(), "%d results, want 3", len(fields))
+		}
+		var v [3]int64
+		for i, f := range fields {
+			n, err := strconv.ParseInt(f, 10, 64)
+			if err != nil || n < 0 {
+				return badMessage(m.Type(), "result %q is not a count", f)
+			}
+			v[i] = n
+		}
+		*m = S2CResults{ThroughputKbps: v[0], UnsentBytes: v[1], TotalSentBytes: v[2]}
+		return nil
+	}
+	var s string
+	switch e {
+	case JSON:
+		j := &JSONMessage{}
+		if err := json.Unmarshal(body, j); err != nil {
+			return badMessage(msg.Type(), "%v", err)
+		}
+		s = j.Msg
+	case TLV:
+		s = string(body)
+	default:
+		return fmt.Errorf("cannot decode %s in the %s encoding", msg.Type(), e)
+	}
+	if !validText(msg, s) {
+		return badMessage(msg.Type(), "text is not UTF-8")
+	}
+	return msg.parse(s)
+}
+
+// validText reports whether s is a valid text for msg. Only untyped messages
+// may have texts that are not UTF-8.
+func validText(msg Message, s string) bool {
+	if _, ok := msg.(*untyped); ok {
+		return true
+	}
+	return utf8.ValidString(s)
+}
+
+// LoginEncoding returns the encoding of a client's login, of type t with the
+// given body, which is also the encoding of the rest of its messages. Clients
+// that send MsgLogin, and the clients from before JSON support that send a
+// MsgExtendedLogin whose body is the byte of their tests followed by their
+// version, use TLV. Other clients use JSON.
+func LoginEncoding(t MessageType, body []byte) Encoding {
+	if t == MsgExtendedLogin && json.Valid(body) {
+		return JSON
+	}
+	return TLV
+}
+
+// Send writes msg to conn in the encoding e.
+func Send(conn Connection, e Encoding, msg Message) error {
+	body, err := Encode(e, msg)
+	if err != nil {
+		return err
+	}
+	return WriteTLVMessage(conn, msg.Type(), string(body))
+}
+
+// Receive reads a message of msg's type from conn in the encoding e, and sets
+// the fields of msg from it. A client whose message is too large is sent a
+// MsgError before the error is returned.
+func Receive(conn Connection, e Encoding, msg Message) error {
+	body, _, err := ReadTLVMessage(conn, msg.Type())
+	if err == ErrMessageTooLarge {
+		// Tell the client why it is being disconnected.
+		Send(conn, e, &Error{Text: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	return Decode(e, body, msg)
+}
+
+// Login is the MsgLogin of a TLV client, with the bitmask of the tests it
+// requests.
+type Login struct {
+	Tests int
+}
+
+// Type returns MsgLogin.
+func (*Login) Type() MessageType { return MsgLogin }
+
+// The text of a Login is its byte, which Encode and Decode handle.
+func (*Login) text() (string, error) { return "", errors.New("unreachable") }
+func (*Login) parse(string) error    { return errors.New("unreachable") }
+
+// ExtendedLogin is the MsgExtendedLogin of a client, with its version, the
+// bitmask of the tests it requests, its access token, if any, and the
+// congestion control algorithm that it asks the s2c test to use, if any. Its
+// body is JSON, or for TLV clients, the byte of the tests followed by the
+// version.
+type ExtendedLogin struct {
+	Version           string
+	Tests             int
+	AccessToken       string
+	CongestionControl string
+}
+
+// Type returns MsgExtendedLogin.
+func (*ExtendedLogin) Type() MessageType { return MsgExtendedLogin }
+
+// The body of an ExtendedLogin depends on the encoding, which Encode and
+// Decode handle.
+func (*ExtendedLogin) text() (string, error) { return "", errors.New("unreachable") }
+func (*ExtendedLogin) parse(string) error    { return errors.New("unreachable") }
+
+// LoginVersion is the first MsgLogin that the server sends, with its version.
+type LoginVersion struct {
+	Version string
+}
+
+// Type returns MsgLogin.
+func (*LoginVersion) Type() MessageType { return MsgLogin }
+
+func (m *LoginVersion) text() (string, error) {
+	if m.Version == "" {
+		return "", badMessage(m.Type(), "no version")
+	}
+	return m.Version, nil
+}
+
+func (m *LoginVersion) parse(s string) error {
+	m.Version = s
+	_, err := m.text()
+	return err
+}
+
+// LoginTests is the second MsgLogin that the server sends, with the bits of
+// the tests that it will run, in order.
+type LoginTests struct {
+	Tests []int
+}
+
+// Type returns MsgLogin.
+func (*LoginTests) Type() MessageType { return MsgLogin }
+
+func (m *LoginTests) text() (string, error) {
+	s := make([]string, len(m.Tests))
+	for i, t := range m.Tests {
+		if t <= 0 {
+			return "", badMessage(m.Type(), "test %d is not a test bit", t)
+		}
+		s[i] = strconv.Itoa(t)
+	}
+	return strings.Join(s, " "), nil
+}
+
+func (m *LoginTests) parse(s string) error {
+	m.Tests = nil
+	for _, f := range strings.Fields(s) {
+		t, err := strconv.Atoi(f)
+		if err != nil || t <= 0 {
+			return badMessage(m.Type(), "test %q is not a test bit", f)
+		}
+		m.Tests = append(m.Tests, t)
+	}
+	return nil
+}
+
+// Queue is a SrvQueue, which tells a client how long it has to wait: zero
+// when its tests start, and otherwise its place in the queue or one of the
+// special values of the protocol, such as 9988 when the server is busy.
+type Queue struct {
+	Wait int
+}
+
+// Type returns SrvQueue.
+func (*Queue) Type() MessageType { return SrvQueue }
+
+func (m *Queue) text() (string, error) {
+	if m.Wait < 0 {
+		return "", badMessage(m.Type(), "negative wait %d", m.Wait)
+	}
+	return strconv.Itoa(m.Wait), nil
+}
+
+func (m *Queue) parse(s string) error {
+	w, err := strconv.Atoi(s)
+	if err != nil || w < 0 {
+		return badMessage(m.Type(), "wait %q is not a count", s)
+	}
+	m.Wait = w
+	return nil
+}
+
+// Waiting is the MsgWaiting with which a queued client answers a heartbeat.
+// Its body is ignored.
+type Waiting struct{}
+
+// Type returns MsgWaiting.
+func (*Waiting) Type() MessageType     { return MsgWaiting }
+func (*Waiting) text() (string, error) { return "", nil }
+func (*Waiting) parse(string) error    { return nil }
+
+// Prepare is the TestPrepare that tells the client the port of a test's
+// server, if the test has one, followed by the test's own arguments, such as a
+// token or a duration.
+type Prepare struct {
+	Port int
+	Args []string
+}
+
+// Type returns TestPrepare.
+func (*Prepare) Type() MessageType { return TestPrepare }
+
+func (m *Prepare) text() (string, error) {
+	if m.Port < 0 || m.Port > 0xFFFF {
+		return "", badMessage(m.Type(), "port %d is out of range", m.Port)
+	}
+	if m.Port == 0 {
+		if len(m.Args) > 0 {
+			return "", badMessage(m.Type(), "arguments without a port")
+		}
+		return "", nil
+	}
+	s := []string{strconv.Itoa(m.Port)}
+	for _, a := range m.Args {
+		// Arguments are split on the spaces that parse splits them on.
+		if a == "" || strings.IndexFunc(a, unicode.IsSpace) >= 0 {
+			return "", badMessage(m.Type(), "argument %q is empty or has spaces", a)
+		}
+		s = append(s, a)
+	}
+	return strings.Join(s, " "), nil
+}
+
+func (m *Prepare) parse(s string) error {
+	*m = Prepare{}
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return nil
+	}
+	p, err := strconv.Atoi(f[0])
+	if err != nil || p <= 0 || p > 0xFFFF {
+		return badMessage(m.Type(), "port %q is out of range", f[0])
+	}
+	m.Port = p
+	if len(f) > 1 {
+		m.Args = f[1:]
+	}
+	return nil
+}
+
+// Start is the TestStart that tells the client that a test is starting.
+type Start struct{}
+
+// Type returns TestStart.
+func (*Start) Type() MessageType     { return TestStart }
+func (*Start) text() (string, error) { return "", nil }
+func (m *Start) parse(s string) error {
+	if s != "" {
+		return badMessage(m.Type(), "unexpected body %q", s)
+	}
+	return nil
+}
+
+// TestMessage is a TestMsg sent during a test, whose text depends on the test.
+type TestMessage struct {
+	Text string
+}
+
+// Type returns TestMsg.
+func (*TestMessage) Type() MessageType       { return TestMsg }
+func (m *TestMessage) text() (string, error) { return m.Text, nil }
+func (m *TestMessage) parse(s string) error  { m.Text = s; return nil }
+
+// S2CResults is the TestMsg with which the server tells the client the results
+// of the s2c test.
+type S2CResults struct {
+	ThroughputKbps int64
+	UnsentBytes    int64
+	TotalSentBytes int64
+}
+
+// Type returns TestMsg.
+func (*S2CResults) Type() MessageType { return TestMsg }
+
+// The text of an S2CResults depends on the encoding, which Encode and Decode
+// handle.
+func (*S2CResults) text() (string, error) { return "", errors.New("unreachable") }
+func (*S2CResults) parse(string) error    { return errors.New("unreachable") }
+
+// Finalize is the TestFinalize that tells the client that a test is over.
+type Finalize struct{}
+
+// Type returns TestFinalize.
+func (*Finalize) Type() MessageType     { return TestFinalize }
+func (*Finalize) text() (string, error) { return "", nil }
+func (m *Finalize) parse(s string) error {
+	if s != "" {
+		return badMessage(m.Type(), "unexpected body %q", s)
+	}
+	return nil
+}
+
+// Results is a MsgResults, with some of the results of the tests.
+type Results struct {
+	Text string
+}
+
+// Type returns MsgResults.
+func (*Results) Type() MessageType       { return MsgResults }
+func (m *Results) text() (string, error) { return m.Text, nil }
+func (m *Results) parse(s string) error  { m.Text = s; return nil }
+
+// Error is a MsgError, which tells the client why it is being disconnected.
+type Error struct {
+	Text string
+}
+
+// Type returns MsgError.
+func (*Error) Type() MessageType       { return MsgError }
+func (m *Error) text() (string, error) { return m.Text, nil }
+func (m *Error) parse(s string) error  { m.Text = s; return nil }
+
+// Logout is the MsgLogout that ends the control connection.
+type Logout struct{}
+
+// Type returns MsgLogout.
+func (*Logout) Type() MessageType     { return MsgLogout }
+func (*Logout) text() (string, error) { return "", nil }
+func (*Logout) parse(string) error    { return nil }
+
+// untyped is a message of any type whose text is not validated. It implements
+// ReceiveMessage and the deprecated functions, which take the type and body of
+// messages separately.
+type untyped struct {
+	kind MessageType
+	s    string
+}
+
+func (m *untyped) Type() MessageType     { return m.kind }
+func (m *untyped) text() (string, error) { return m.s, nil }
+func (m *untyped) parse(s string) error  { m.s = s; return nil }
@@ -0,0 +1,148 @@
+package protocol_test
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		e    protocol.Encoding
+		msg  protocol.Message
+		body string
+	}{
+		{"login", protocol.TLV, &protocol.Login{Tests: 22}, "\x16"},
+		{"extended-login", protocol.JSON, &protocol.ExtendedLogin{Version: "v3.7.0", Tests: 1046, AccessToken: "t"}, `{"msg":"v3.7.0","tests":"1046","access_token":"t"}`},
+		{"extended-login-cc", protocol.JSON, &protocol.ExtendedLogin{Version: "v3.7.0", Tests: 22, CongestionControl: "bbr"}, `{"msg":"v3.7.0","tests":"22","congestion_control":"bbr"}`},
+		{"extended-login-tlv", protocol.TLV, &protocol.ExtendedLogin{Version: "v3.6.4", Tests: 22}, "\x16v3.6.4"},
+		{"login-version", protocol.TLV, &protocol.LoginVersion{Version: "v5.0-NDTinGO"}, "v5.0-NDTinGO"},
+		{"login-tests-json", protocol.JSON, &protocol.LoginTests{Tests: []int{2, 4, 32}}, `{"msg":"2 4 32"}`},
+		{"queue", protocol.TLV, &protocol.Queue{Wait: 9990}, "9990"},
+		{"prepare", protocol.TLV, &protocol.Prepare{Port: 3010, Args: []string{"abc"}}, "3010 abc"},
+		{"prepare-empty", protocol.JSON, &protocol.Prepare{}, `{"msg":""}`},
+		{"start", protocol.TLV, &protocol.Start{}, ""},
+		{"test-message", protocol.JSON, &protocol.TestMessage{Text: "125"}, `{"msg":"125"}`},
+		{"s2c-results-tlv", protocol.TLV, &protocol.S2CResults{ThroughputKbps: 1, UnsentBytes: 2, TotalSentBytes: 3}, "1 2 3"},
+		{"s2c-results-json", protocol.JSON, &protocol.S2CResults{ThroughputKbps: 1, UnsentBytes: 2, TotalSentBytes: 3},
+			`{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3"}`},
+		{"finalize", protocol.TLV, &protocol.Finalize{}, ""},
+		{"results", protocol.JSON, &protocol.Results{Text: "UUID: x\n"}, `{"msg":"UUID: x\n"}`},
+		{"error", protocol.TLV, &protocol.Error{Text: "message too large"}, "message too large"},
+		{"logout", protocol.TLV, &protocol.Logout{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := protocol.Encode(tt.e, tt.msg)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("Encode() = %q, want %q", body, tt.body)
+			}
+			got := reflect.New(reflect.TypeOf(tt.msg).Elem()).Interface().(protocol.Message)
+			if err := protocol.Decode(tt.e, body, got); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestEncode_Invalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		e    protocol.Encoding
+		msg  protocol.Message
+	}{
+		{"json-login", protocol.JSON, &protocol.Login{Tests: 22}},
+		{"wide-login", protocol.TLV, &protocol.Login{Tests: 1024}},
+		{"tlv-token", protocol.TLV, &protocol.ExtendedLogin{Tests: 22, AccessToken: "t"}},
+		{"tlv-congestion-control", protocol.TLV, &protocol.ExtendedLogin{Tests: 22, CongestionControl: "bbr"}},
+		{"negative-queue", protocol.TLV, &protocol.Queue{Wait: -1}},
+		{"port-range", protocol.TLV, &protocol.Prepare{Port: 70000}},
+		{"args-without-port", protocol.TLV, &protocol.Prepare{Args: []string{"abc"}}},
+		{"spaced-arg", protocol.TLV, &protocol.Prepare{Port: 1, Args: []string{"a b"}}},
+		{"unicode-spaced-arg", protocol.TLV, &protocol.Prepare{Port: 1, Args: []string{"a\u00a0b"}}},
+		{"zero-test", protocol.TLV, &protocol.LoginTests{Tests: []int{0}}},
+		{"no-version", protocol.TLV, &protocol.LoginVersion{}},
+		{"not-utf8", protocol.TLV, &protocol.Results{Text: "\xff"}},
+		{"too-large", protocol.TLV, &protocol.TestMessage{Text: string(make([]byte, 0x10000))}},
+		{"unknown-encoding", protocol.Unknown, &protocol.Start{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := protocol.Encode(tt.e, tt.msg); err == nil {
+				t.Errorf("Encode(%+v) did not fail", tt.msg)
+			}
+		})
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		e    protocol.Encoding
+		body string
+		msg  protocol.Message
+	}{
+		{"long-login", protocol.TLV, "\x16\x00", &protocol.Login{}},
+		{"non-numeric-tests", protocol.JSON, `{"msg":"v3.7.0","tests":"all"}`, &protocol.ExtendedLogin{}},
+		{"missing-tests", protocol.JSON, `{"msg":"v3.7.0"}`, &protocol.ExtendedLogin{}},
+		{"empty-tlv-login", protocol.TLV, "", &protocol.ExtendedLogin{}},
+		{"unknown-congestion-control", protocol.JSON, `{"msg":"v3.7.0","tests":"22","congestion_control":"vegas"}`, &protocol.ExtendedLogin{}},
+		{"not-json", protocol.JSON, `125`, &protocol.TestMessage{}},
+		{"queue", protocol.TLV, "soon", &protocol.Queue{}},
+		{"prepare-port", protocol.TLV, "0 abc", &protocol.Prepare{}},
+		{"start-body", protocol.TLV, "now", &protocol.Start{}},
+		{"s2c-results-count", protocol.TLV, "1 2", &protocol.S2CResults{}},
+		{"s2c-results-negative", protocol.TLV, "1 -2 3", &protocol.S2CResults{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := protocol.Decode(tt.e, []byte(tt.body), tt.msg)
+			if !errors.Is(err, protocol.ErrBadMessage) {
+				t.Errorf("Decode(%q) error = %v, want %v", tt.body, err, protocol.ErrBadMessage)
+			}
+		})
+	}
+}
+
+func TestLoginEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		t    protocol.MessageType
+		body string
+		want protocol.Encoding
+	}{
+		{protocol.MsgLogin, "\x16", protocol.TLV},
+		{protocol.MsgExtendedLogin, `{"msg":"v3.7.0","tests":"22"}`, protocol.JSON},
+		{protocol.MsgExtendedLogin, ` {"msg":"v3.7.0","tests":"22"}`, protocol.JSON},
+		{protocol.MsgExtendedLogin, "\x16v3.6.4", protocol.TLV},
+		// The tests byte of a TLV login may be a '{'.
+		{protocol.MsgExtendedLogin, "{v3.6.4", protocol.TLV},
+	} {
+		if got := protocol.LoginEncoding(tt.t, []byte(tt.body)); got != tt.want {
+			t.Errorf("LoginEncoding(%s, %q) = %s, want %s", tt.t, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sender := protocol.AdaptNetConn(client, client)
+	receiver := protocol.AdaptNetConn(server, server)
+	go protocol.Send(sender, protocol.JSON, &protocol.Prepare{Port: 3010, Args: []string{"abc"}})
+	got := &protocol.Prepare{}
+	if err := protocol.Receive(receiver, protocol.JSON, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Port != 3010 || !reflect.DeepEqual(got.Args, []string{"abc"}) {
+		t.Errorf("Receive() = %+v", got)
+	}
+}
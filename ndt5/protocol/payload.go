@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// payloadBatch is how many copies of the data of a Payload raw connections
+// write with a single writev(2).
+const payloadBatch = 16
+
+// Payload is the data that a download test sends over and over, prepared once
+// for every kind of connection, so that the tests that run at once share it.
+// The data must not be modified.
+type Payload struct {
+	data []byte
+	// batch refers to data payloadBatch times.
+	batch net.Buffers
+
+	once sync.Once
+	msg  *websocket.PreparedMessage
+	err  error
+}
+
+// NewPayload returns the Payload of data.
+func NewPayload(data []byte) *Payload {
+	p := &Payload{data: data, batch: make(net.Buffers, payloadBatch)}
+	for i := range p.batch {
+		p.batch[i] = data
+	}
+	return p
+}
+
+// Bytes returns the data of p.
+func (p *Payload) Bytes() []byte {
+	return p.data
+}
+
+// message returns the data of p as a WebSocket message.
+func (p *Payload) message() (*websocket.PreparedMessage, error) {
+	p.once.Do(func() {
+		p.msg, p.err = websocket.NewPreparedMessage(websocket.BinaryMessage, p.data)
+	})
+	return p.msg, p.err
+}
+
+// buffersWriter is implemented by the connections that write net.Buffers with
+// writev(2) although they wrap a *net.TCPConn, like netx.Conn.
+type buffersWriter interface {
+	WriteBuffers(b *net.Buffers) (int64, error)
+}
+
+// writeBuffers writes b to conn, with writev(2) if conn is or wraps a
+// *net.TCPConn, and with a write per buffer otherwise.
+func writeBuffers(conn net.Conn, b *net.Buffers) (int64, error) {
+	if w, ok := conn.(buffersWriter); ok {
+		return w.WriteBuffers(b)
+	}
+	return b.WriteTo(conn)
+}
+
+// fillUntil writes the data of p to conn in batches until t. The last batch
+// is cut short at t, so that a slow client doesn't make the test run longer.
+func fillUntil(conn net.Conn, t time.Time, p *Payload) (bytesWritten int64, err error) {
+	conn.SetWriteDeadline(t)
+	defer conn.SetWriteDeadline(time.Time{})
+	batch := make(net.Buffers, len(p.batch))
+	bufs := new(net.Buffers)
+	for time.Now().Before(t) {
+		// Writing consumes bufs and batch, but not the data they refer to.
+		copy(batch, p.batch)
+		*bufs = batch
+		n, err := writeBuffers(conn, bufs)
+		bytesWritten += n
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return bytesWritten, nil
+		}
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
+	return bytesWritten, nil
+}
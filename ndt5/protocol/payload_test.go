@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_fillUntil(t *testing.T) {
+	p := NewPayload([]byte("0123456789"))
+	server, client := net.Pipe()
+	defer server.Close()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+	n, err := fillUntil(server, time.Now().Add(50*time.Millisecond), p)
+	if err != nil || n == 0 {
+		t.Fatalf("fillUntil() = %d, %v", n, err)
+	}
+	server.Close()
+	b := <-received
+	if int64(len(b)) != n || !bytes.Equal(b, bytes.Repeat(p.Bytes(), len(b)/10)) {
+		t.Errorf("fillUntil() wrote %d bytes, and the client received %d", n, len(b))
+	}
+}
+
+func Test_fillUntil_slowClient(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	// The client never reads, so the writes end at the deadline.
+	start := time.Now()
+	n, err := fillUntil(server, start.Add(50*time.Millisecond), NewPayload(make([]byte, 8192)))
+	if err != nil || n != 0 {
+		t.Errorf("fillUntil() = %d, %v, want 0, nil", n, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("fillUntil() returned after %v, want 50ms", d)
+	}
+	// The deadline is removed afterwards.
+	go client.Read(make([]byte, 1))
+	if _, err := server.Write([]byte("x")); err != nil {
+		t.Errorf("Write() after fillUntil() = %v", err)
+	}
+}
+
+// countingWriter is a net.Conn that writes net.Buffers itself.
+type countingWriter struct {
+	net.Conn
+	calls int
+}
+
+func (c *countingWriter) WriteBuffers(b *net.Buffers) (int64, error) {
+	c.calls++
+	return b.WriteTo(c.Conn)
+}
+
+func Test_writeBuffers(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, client)
+	w := &countingWriter{Conn: server}
+	b := net.Buffers{[]byte("a"), []byte("b")}
+	if n, err := writeBuffers(w, &b); n != 2 || err != nil || w.calls != 1 {
+		t.Errorf("writeBuffers() = %d, %v with %d calls to WriteBuffers", n, err, w.calls)
+	}
+}
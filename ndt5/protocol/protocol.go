@@ -8,19 +8,44 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
+	"sync/atomic"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/gorilla/websocket"
 
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/web100"
 	"github.com/m-lab/ndt-server/netx"
 )
 
-var verbose = flag.Bool("ndt5.protocol.verbose", false, "Print the contents of every message to the log")
+var (
+	verbose     = flag.Bool("ndt5.protocol.verbose", false, "Print the contents of every message to the log")
+	idleTimeout = flag.Duration("ndt5.protocol.idle-timeout", 30*time.Second, "How long to wait for a client to send or receive a single control message. Zero means forever")
+
+	// MaxConnectionLifetime is the longest time a client may keep a control
+	// connection open.
+	MaxConnectionLifetime = flag.Duration("ndt5.protocol.max-lifetime", 2*time.Minute, "The maximum lifetime of an ndt5 control connection")
+	// TestDuration is how long the c2s and s2c tests transfer data.
+	TestDuration = flag.Duration("ndt5.protocol.test-duration", 10*time.Second, "How long ndt5 c2s and s2c tests transfer data")
+	// MaxMessageSize is the largest body of a control message, such as a login
+	// or META message, that clients may send.
+	MaxMessageSize = flag.Int("ndt5.protocol.max-message-size", 8192, "The largest body, in bytes, of an ndt5 control message a client may send. Clients that send larger messages are disconnected")
+)
+
+// ErrMessageTooLarge is returned when a client sends a control message whose
+// body is larger than MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ControlReadLimit returns the read limit of WebSocket control connections:
+// the largest control message, including its type and length.
+func ControlReadLimit() int64 {
+	return int64(*MaxMessageSize) + 3
+}
 
 // MessageType is the full set opf NDT protocol messages we understand.
 type MessageType byte
@@ -89,9 +114,11 @@ type Connection interface {
 	ReadMessage() (_ int, p []byte, err error) // The first value in the returned tuple should be ignored. It is included in the API for websocket.Conn compatibility.
 	ReadBytes() (count int64, err error)
 	WriteMessage(messageType int, data []byte) error
-	FillUntil(t time.Time, buffer []byte) (bytesWritten int64, err error)
+	FillUntil(t time.Time, p *Payload) (bytesWritten int64, err error)
 	ServerIPAndPort() (string, int)
 	ClientIPAndPort() (string, int)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 	Close() error
 	UUID() string
 	String() string
@@ -100,12 +127,22 @@ type Connection interface {
 
 var badUUID = "ERROR_DISCOVERING_UUID"
 
+// EndTime returns the end of an interval that started at start and ends now,
+// and the interval's duration, both from the monotonic clock. Rates must be
+// computed from the duration, and archived with the end time, so that a step
+// of the wall clock during a test, e.g. by NTP, corrupts neither. start must
+// come from c.Now(), not e.g. its UTC(), which has no monotonic reading.
+func EndTime(c clock.Clock, start time.Time) (time.Time, time.Duration) {
+	elapsed := c.Since(start)
+	return start.Add(elapsed), elapsed
+}
+
 // UUIDToFile converts a UUID into a newly-created open file with the extension '.json'.
 func UUIDToFile(dir, uuid string) (*os.File, error) {
 	if uuid == badUUID {
 		f, err := ioutil.TempFile(dir, badUUID+"*.json")
 		if err != nil {
-			log.Println("Could not create filename for data")
+			logging.Logger.WithError(err).Warn("Could not create filename for data")
 			return nil, err
 		}
 		return f, nil
@@ -115,7 +152,20 @@ func UUIDToFile(dir, uuid string) (*os.File, error) {
 
 // Measurable things can be measured over a given timeframe.
 type Measurable interface {
+	// EnableBBR sets the BBR congestion control on the underlying socket, if
+	// it is supported by the kernel. It must be called before sending data.
+	EnableBBR() error
+	// SetCongestionControl sets the congestion control algorithm of the
+	// underlying socket to name, and returns the algorithm that it uses
+	// afterwards. It must be called before sending data.
+	SetCongestionControl(name string) (string, error)
+	// SetMaxPacingRate caps the rate at which the underlying socket sends, in
+	// bytes per second.
+	SetMaxPacingRate(bytesPerSecond uint64) error
 	StartMeasuring(ctx context.Context)
+	// LatestSnapshot returns the most recent sample of a running measurement,
+	// or nil if none was taken yet.
+	LatestSnapshot() *web100.Snapshot
 	StopMeasuring() (*web100.Metrics, error)
 }
 
@@ -131,6 +181,8 @@ type MeasuredConnection interface {
 type measurer struct {
 	summaryC                 <-chan *web100.Metrics
 	cancelMeasurementContext context.CancelFunc
+	// latest is read by other goroutines while the measurement runs.
+	latest atomic.Pointer[web100.Latest]
 }
 
 // newMeasurer creates a measurer struct with sensible and safe defaults.
@@ -151,7 +203,15 @@ func newMeasurer() *measurer {
 func (m *measurer) StartMeasuring(ctx context.Context, ci netx.ConnInfo) {
 	var newctx context.Context
 	newctx, m.cancelMeasurementContext = context.WithCancel(ctx)
-	m.summaryC = web100.MeasureViaPolling(newctx, ci)
+	latest := &web100.Latest{}
+	m.latest.Store(latest)
+	m.summaryC = web100.MeasureViaPolling(newctx, ci, latest)
+}
+
+// LatestSnapshot returns the most recent sample taken since StartMeasuring, or
+// nil if none was taken yet.
+func (m *measurer) LatestSnapshot() *web100.Snapshot {
+	return m.latest.Load().Get()
 }
 
 // StopMeasuring stops the measurement process and returns the collected
@@ -172,6 +232,9 @@ func (m *measurer) StopMeasuring() (*web100.Metrics, error) {
 type wsConnection struct {
 	*websocket.Conn
 	*measurer
+	// client overrides the connection's remote address when the upgrade
+	// request came through a trusted proxy.
+	client *net.TCPAddr
 }
 
 // AdaptWsConn turns a websocket Connection into a struct which implements both Measurer and Connection
@@ -179,8 +242,15 @@ func AdaptWsConn(ws *websocket.Conn) MeasuredConnection {
 	return &wsConnection{Conn: ws, measurer: newMeasurer()}
 }
 
-func (ws *wsConnection) FillUntil(t time.Time, bytes []byte) (bytesWritten int64, err error) {
-	messageToSend, err := websocket.NewPreparedMessage(websocket.BinaryMessage, bytes)
+// AdaptProxiedWsConn is like AdaptWsConn, but for connections upgraded through
+// a trusted proxy. The client address reported by the proxy is used instead
+// of the connection's own remote address, unless it is nil.
+func AdaptProxiedWsConn(ws *websocket.Conn, client *net.TCPAddr) MeasuredConnection {
+	return &wsConnection{Conn: ws, measurer: newMeasurer(), client: client}
+}
+
+func (ws *wsConnection) FillUntil(t time.Time, p *Payload) (bytesWritten int64, err error) {
+	messageToSend, err := p.message()
 	if err != nil {
 		return 0, err
 	}
@@ -189,11 +259,23 @@ func (ws *wsConnection) FillUntil(t time.Time, bytes []byte) (bytesWritten int64
 		if err != nil {
 			return bytesWritten, err
 		}
-		bytesWritten += int64(len(bytes))
+		bytesWritten += int64(len(p.data))
 	}
 	return bytesWritten, nil
 }
 
+func (ws *wsConnection) EnableBBR() error {
+	return netx.ToConnInfo(ws.UnderlyingConn()).EnableBBR()
+}
+
+func (ws *wsConnection) SetCongestionControl(name string) (string, error) {
+	return netx.ToConnInfo(ws.UnderlyingConn()).SetCongestionControl(name)
+}
+
+func (ws *wsConnection) SetMaxPacingRate(bytesPerSecond uint64) error {
+	return netx.ToConnInfo(ws.UnderlyingConn()).SetMaxPacingRate(bytesPerSecond)
+}
+
 func (ws *wsConnection) StartMeasuring(ctx context.Context) {
 	ci := netx.ToConnInfo(ws.UnderlyingConn())
 	ws.measurer.StartMeasuring(ctx, ci)
@@ -203,7 +285,7 @@ func (ws *wsConnection) UUID() string {
 	ci := netx.ToConnInfo(ws.UnderlyingConn())
 	id, err := ci.GetUUID()
 	if err != nil {
-		log.Println("Could not discover UUID:", err)
+		logging.Logger.WithError(err).Warn("Could not discover UUID")
 		// TODO: increment a metric
 		return badUUID
 	}
@@ -215,24 +297,41 @@ func (ws *wsConnection) ServerIPAndPort() (string, int) {
 	return localAddr.IP.String(), localAddr.Port
 }
 
+func (ws *wsConnection) clientAddr() net.Addr {
+	if ws.client != nil {
+		return ws.client
+	}
+	return ws.RemoteAddr()
+}
+
 func (ws *wsConnection) ClientIPAndPort() (string, int) {
-	remoteAddr := netx.ToTCPAddr(ws.UnderlyingConn().RemoteAddr())
+	remoteAddr := netx.ToTCPAddr(ws.clientAddr())
 	return remoteAddr.IP.String(), remoteAddr.Port
 }
 
-// ReadBytes reads some bytes and discards them. This method is in service of
-// the c2s test.
+// ReadBytes reads and discards a message, without keeping it in memory.
 func (ws *wsConnection) ReadBytes() (int64, error) {
+	_, r, err := ws.NextReader()
+	if err != nil {
+		return 0, err
+	}
+	b := getBuffer()
+	defer putBuffer(b)
 	var count int64
-	_, buff, err := ws.ReadMessage()
-	if buff != nil {
-		count = int64(len(buff))
+	for {
+		n, err := r.Read(*b)
+		count += int64(n)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
 	}
-	return count, err
 }
 
 func (ws *wsConnection) String() string {
-	return ws.LocalAddr().String() + "<=WS(S),JSON=>" + ws.RemoteAddr().String()
+	return ws.LocalAddr().String() + "<=WS(S),JSON=>" + ws.clientAddr().String()
 }
 
 func (ws *wsConnection) Messager() Messager {
@@ -245,9 +344,12 @@ func (ws *wsConnection) Messager() Messager {
 type netConnection struct {
 	net.Conn
 	*measurer
-	input     io.Reader
-	c2sBuffer []byte
-	encoding  Encoding
+	input    io.Reader
+	encoding Encoding
+	// client and server override the connection's own addresses when it was
+	// accepted through a proxy.
+	client *net.TCPAddr
+	server *net.TCPAddr
 }
 
 func (nc *netConnection) ReadMessage() (int, []byte, error) {
@@ -257,6 +359,10 @@ func (nc *netConnection) ReadMessage() (int, []byte, error) {
 		return 0, []byte{}, err
 	}
 	size := int64(firstThree[1])<<8 + int64(firstThree[2])
+	if size > int64(*MaxMessageSize) {
+		// Don't read the body. ReadTLVMessage reports the error.
+		return 0, firstThree, nil
+	}
 	bytes := make([]byte, size)
 	_, err = nc.input.Read(bytes)
 	return 0, append(firstThree, bytes...), err
@@ -269,19 +375,26 @@ func (nc *netConnection) WriteMessage(_messageType int, data []byte) error {
 }
 
 func (nc *netConnection) ReadBytes() (bytesRead int64, err error) {
-	n, err := nc.input.Read(nc.c2sBuffer)
+	b := getBuffer()
+	defer putBuffer(b)
+	n, err := nc.input.Read(*b)
 	return int64(n), err
 }
 
-func (nc *netConnection) FillUntil(t time.Time, bytes []byte) (bytesWritten int64, err error) {
-	for time.Now().Before(t) {
-		n, err := nc.Write(bytes)
-		if err != nil {
-			return bytesWritten, err
-		}
-		bytesWritten += int64(n)
-	}
-	return bytesWritten, nil
+func (nc *netConnection) FillUntil(t time.Time, p *Payload) (bytesWritten int64, err error) {
+	return fillUntil(nc.Conn, t, p)
+}
+
+func (nc *netConnection) EnableBBR() error {
+	return netx.ToConnInfo(nc.Conn).EnableBBR()
+}
+
+func (nc *netConnection) SetCongestionControl(name string) (string, error) {
+	return netx.ToConnInfo(nc.Conn).SetCongestionControl(name)
+}
+
+func (nc *netConnection) SetMaxPacingRate(bytesPerSecond uint64) error {
+	return netx.ToConnInfo(nc.Conn).SetMaxPacingRate(bytesPerSecond)
 }
 
 func (nc *netConnection) StartMeasuring(ctx context.Context) {
@@ -292,30 +405,44 @@ func (nc *netConnection) StartMeasuring(ctx context.Context) {
 func (nc *netConnection) UUID() string {
 	ci := netx.ToConnInfo(nc.Conn)
 	if ci == nil {
-		log.Println("Connection is not a TCPConn")
+		logging.Logger.Warn("Connection is not a TCPConn")
 		return badUUID
 	}
 	id, err := ci.GetUUID()
 	if err != nil {
-		log.Println("Could not discover UUID")
+		logging.Logger.WithError(err).Warn("Could not discover UUID")
 		// TODO: increment a metric
 		return badUUID
 	}
 	return id
 }
 
+func (nc *netConnection) serverAddr() *net.TCPAddr {
+	if nc.server != nil {
+		return nc.server
+	}
+	return netx.ToTCPAddr(nc.LocalAddr())
+}
+
+func (nc *netConnection) clientAddr() *net.TCPAddr {
+	if nc.client != nil {
+		return nc.client
+	}
+	return netx.ToTCPAddr(nc.RemoteAddr())
+}
+
 func (nc *netConnection) ServerIPAndPort() (string, int) {
-	localAddr := netx.ToTCPAddr(nc.LocalAddr())
+	localAddr := nc.serverAddr()
 	return localAddr.IP.String(), localAddr.Port
 }
 
 func (nc *netConnection) ClientIPAndPort() (string, int) {
-	remoteAddr := netx.ToTCPAddr(nc.RemoteAddr())
+	remoteAddr := nc.clientAddr()
 	return remoteAddr.IP.String(), remoteAddr.Port
 }
 
 func (nc *netConnection) String() string {
-	return nc.LocalAddr().String() + "<=PLAIN," + nc.encoding.String() + "=>" + nc.RemoteAddr().String()
+	return nc.serverAddr().String() + "<=PLAIN," + nc.encoding.String() + "=>" + nc.clientAddr().String()
 }
 
 func (nc *netConnection) SetEncoding(e Encoding) {
@@ -334,11 +461,27 @@ type MeasuredFlexibleConnection interface {
 
 // AdaptNetConn turns a non-WS-based TCP connection into a protocol.MeasuredConnection that can have its encoding set on the fly.
 func AdaptNetConn(conn net.Conn, input io.Reader) MeasuredFlexibleConnection {
-	return &netConnection{Conn: conn, measurer: newMeasurer(), input: input, c2sBuffer: make([]byte, 8192)}
+	return &netConnection{Conn: conn, measurer: newMeasurer(), input: input}
+}
+
+// AdaptProxiedNetConn is like AdaptNetConn, but for connections accepted
+// through a proxy. The client and server addresses reported by the proxy are
+// used instead of the connection's own addresses.
+func AdaptProxiedNetConn(conn net.Conn, input io.Reader, client, server *net.TCPAddr) MeasuredFlexibleConnection {
+	return &netConnection{
+		Conn:     conn,
+		measurer: newMeasurer(),
+		input:    input,
+		client:   client,
+		server:   server,
+	}
 }
 
 // ReadTLVMessage reads a single NDT message out of the connection.
 func ReadTLVMessage(ws Connection, expectedTypes ...MessageType) ([]byte, MessageType, error) {
+	if *idleTimeout > 0 {
+		ws.SetReadDeadline(time.Now().Add(*idleTimeout))
+	}
 	_, inbuff, err := ws.ReadMessage()
 	if err != nil {
 		return nil, MsgUnknown, err
@@ -355,6 +498,9 @@ func ReadTLVMessage(ws Connection, expectedTypes ...MessageType) ([]byte, Messag
 	}
 	// Verify that the expected length matches the given data.
 	expectedLen := int(inbuff[1])<<8 + int(inbuff[2])
+	if expectedLen > *MaxMessageSize || len(inbuff[3:]) > *MaxMessageSize {
+		return nil, MessageType(inbuff[0]), ErrMessageTooLarge
+	}
 	if expectedLen != len(inbuff[3:]) {
 		return nil, MessageType(inbuff[0]), fmt.Errorf("Message length (%d) does not match length of data received (%d)",
 			expectedLen, len(inbuff[3:]))
@@ -364,16 +510,23 @@ func ReadTLVMessage(ws Connection, expectedTypes ...MessageType) ([]byte, Messag
 
 // WriteTLVMessage write a single NDT message to the connection.
 func WriteTLVMessage(ws Connection, msgType MessageType, message string) error {
-	msgBytes := []byte(message)
 	if *verbose {
-		log.Printf("%s is getting sent a TLV of: %s, %d, %q\n", ws.String(), msgType.String(), len(msgBytes), message)
+		logging.Logger.WithFields(log.Fields{
+			"conn":    ws.String(),
+			"type":    msgType.String(),
+			"length":  len(message),
+			"message": message,
+		}).Info("Sending TLV message")
 	}
-	outbuff := make([]byte, 3+len(msgBytes))
-	outbuff[0] = byte(msgType)
-	outbuff[1] = byte((len(msgBytes) >> 8) & 0xFF)
-	outbuff[2] = byte(len(msgBytes) & 0xFF)
-	for i := range msgBytes {
-		outbuff[i+3] = msgBytes[i]
+	// The connections are done with the message when WriteMessage returns,
+	// so it is encoded in a pooled buffer.
+	b := getBuffer()
+	defer putBuffer(b)
+	outbuff := append((*b)[:0], byte(msgType), byte((len(message)>>8)&0xFF), byte(len(message)&0xFF))
+	outbuff = append(outbuff, message...)
+	*b = outbuff
+	if *idleTimeout > 0 {
+		ws.SetWriteDeadline(time.Now().Add(*idleTimeout))
 	}
 	return ws.WriteMessage(websocket.BinaryMessage, outbuff)
 }
@@ -384,6 +537,13 @@ func WriteTLVMessage(ws Connection, msgType MessageType, message string) error {
 type JSONMessage struct {
 	Msg   string `json:"msg"`
 	Tests string `json:"tests,omitempty"`
+	// AccessToken is sent by clients in MsgExtendedLogin to be admitted by a
+	// server that requires access tokens.
+	AccessToken string `json:"access_token,omitempty"`
+	// CongestionControl is sent by clients in MsgExtendedLogin to choose the
+	// congestion control algorithm of the s2c test, e.g. bbr. The c2s test has
+	// none to choose, since the client sends its data.
+	CongestionControl string `json:"congestion_control,omitempty"`
 }
 
 // String serializes the message to a string.
@@ -393,9 +553,16 @@ func (n *JSONMessage) String() string {
 }
 
 // ReceiveJSONMessage reads a single NDT message in JSON format.
+//
+// Deprecated: use Receive with the Message of the expected type, which
+// validates its fields.
 func ReceiveJSONMessage(ws Connection, expectedType MessageType) (*JSONMessage, error) {
 	message := &JSONMessage{}
 	jsonString, _, err := ReadTLVMessage(ws, expectedType)
+	if err == ErrMessageTooLarge {
+		// Tell the client why it is being disconnected.
+		SendJSONMessage(MsgError, err.Error(), ws)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -407,7 +574,9 @@ func ReceiveJSONMessage(ws Connection, expectedType MessageType) (*JSONMessage,
 }
 
 // SendJSONMessage writes a single NDT message in JSON format.
+//
+// Deprecated: use Send with a Message of the type to send, which validates its
+// fields.
 func SendJSONMessage(msgType MessageType, msg string, ws Connection) error {
-	message := &JSONMessage{Msg: msg}
-	return WriteTLVMessage(ws, msgType, message.String())
+	return Send(ws, JSON, &untyped{kind: msgType, s: msg})
 }
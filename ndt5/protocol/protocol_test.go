@@ -2,12 +2,14 @@ package protocol_test
 
 import (
 	"encoding/json"
+	"io"
 	"net"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/clock"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
 )
 
@@ -81,15 +83,17 @@ type fakeConnection struct {
 func (fc *fakeConnection) ReadMessage() (int, []byte, error)               { return 0, fc.data, fc.err }
 func (fc *fakeConnection) ReadBytes() (count int64, err error)             { return }
 func (fc *fakeConnection) WriteMessage(messageType int, data []byte) error { return nil }
-func (fc *fakeConnection) FillUntil(t time.Time, buffer []byte) (bytesWritten int64, err error) {
+func (fc *fakeConnection) FillUntil(t time.Time, p *protocol.Payload) (bytesWritten int64, err error) {
 	return
 }
-func (fc *fakeConnection) ServerIPAndPort() (string, int) { return "", 0 }
-func (fc *fakeConnection) ClientIPAndPort() (string, int) { return "", 0 }
-func (fc *fakeConnection) Close() error                   { return nil }
-func (fc *fakeConnection) UUID() string                   { return "" }
-func (fc *fakeConnection) String() string                 { return "" }
-func (fc *fakeConnection) Messager() protocol.Messager    { return nil }
+func (fc *fakeConnection) ServerIPAndPort() (string, int)   { return "", 0 }
+func (fc *fakeConnection) ClientIPAndPort() (string, int)   { return "", 0 }
+func (fc *fakeConnection) SetReadDeadline(time.Time) error  { return nil }
+func (fc *fakeConnection) SetWriteDeadline(time.Time) error { return nil }
+func (fc *fakeConnection) Close() error                     { return nil }
+func (fc *fakeConnection) UUID() string                     { return "" }
+func (fc *fakeConnection) String() string                   { return "" }
+func (fc *fakeConnection) Messager() protocol.Messager      { return nil }
 
 func assertFakeConnectionIsConnection(fc *fakeConnection) {
 	func(c protocol.Connection) {}(fc)
@@ -144,6 +148,17 @@ func Test_ReceiveJSONMessage(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Oversized data",
+			args: args{
+				ws: &fakeConnection{
+					data: append([]byte{byte(protocol.TestMsg), 0x40, 0}, make([]byte, 0x4000)...),
+					err:  nil,
+				},
+				expectedType: protocol.TestMsg,
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -157,3 +172,37 @@ func Test_ReceiveJSONMessage(t *testing.T) {
 		})
 	}
 }
+
+func Test_netConnReadTooLargeMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// Announce a 64KiB message, but only send its header.
+		client.Write([]byte{byte(protocol.MsgExtendedLogin), 0xff, 0xff})
+		// Drain the MsgError reply.
+		io.Copy(io.Discard, client)
+	}()
+	conn := protocol.AdaptNetConn(server, server)
+	_, err := protocol.ReceiveJSONMessage(conn, protocol.MsgExtendedLogin)
+	if err != protocol.ErrMessageTooLarge {
+		t.Errorf("ReceiveJSONMessage() error = %v, want %v", err, protocol.ErrMessageTooLarge)
+	}
+	server.Close()
+}
+
+func TestEndTime(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := fake.Now()
+	fake.Advance(10 * time.Second)
+	// NTP steps the wall clock back during the test.
+	fake.Step(-time.Hour)
+	end, elapsed := protocol.EndTime(fake, start)
+	if elapsed != 10*time.Second {
+		t.Errorf("EndTime() elapsed = %v, want 10s", elapsed)
+	}
+	// Archived times have no monotonic clock reading. Their difference must
+	// still be the elapsed time that rates are computed from.
+	if d := end.Round(0).Sub(start.Round(0)); d != elapsed {
+		t.Errorf("archived end - start = %v, want %v", d, elapsed)
+	}
+}
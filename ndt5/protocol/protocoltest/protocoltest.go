@@ -0,0 +1,222 @@
+// Package protocoltest provides test doubles of the ndt5 protocol: an
+// in-memory protocol.Connection backed by a pipe, and a Messager that records
+// the messages sent to the client. They let the control channel and the tests
+// be tested end-to-end without sockets.
+package protocoltest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/web100"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// countingConn counts the bytes read from and written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// Conn is the server's end of an in-memory connection. Its measurements are
+// simulated: their TCP_INFO counts the bytes that the server read and wrote as
+// BytesReceived and BytesAcked.
+type Conn struct {
+	protocol.MeasuredFlexibleConnection
+	conn *countingConn
+
+	// ID is the connection's UUID, and Server and Client are its addresses.
+	ID     string
+	Server *net.TCPAddr
+	Client *net.TCPAddr
+
+	mu        sync.Mutex
+	measuring bool
+	latest    *web100.Snapshot
+	snapshots []web100.Snapshot
+}
+
+// Pipe returns the server's end of a new in-memory connection, which uses the
+// TLV encoding until SetEncoding is called, and the client's end.
+func Pipe() (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	cc := &countingConn{Conn: server}
+	// The buffer lets messages with empty bodies be read, which net.Pipe
+	// would block on until the next write.
+	c := &Conn{
+		MeasuredFlexibleConnection: protocol.AdaptNetConn(cc, bufio.NewReader(cc)),
+		conn:                       cc,
+		ID:                         "protocoltest-uuid",
+		Server:                     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3001},
+		Client:                     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321},
+	}
+	c.SetEncoding(protocol.TLV)
+	return c, client
+}
+
+// UUID returns c.ID.
+func (c *Conn) UUID() string { return c.ID }
+
+// ServerIPAndPort returns the address in c.Server.
+func (c *Conn) ServerIPAndPort() (string, int) { return c.Server.IP.String(), c.Server.Port }
+
+// ClientIPAndPort returns the address in c.Client.
+func (c *Conn) ClientIPAndPort() (string, int) { return c.Client.IP.String(), c.Client.Port }
+
+func (c *Conn) String() string {
+	return c.Server.String() + "<=PIPE=>" + c.Client.String()
+}
+
+// EnableBBR fails: pipes have no congestion control.
+func (c *Conn) EnableBBR() error {
+	return errors.New("protocoltest: BBR is not supported")
+}
+
+// SetCongestionControl fails: pipes have no congestion control.
+func (c *Conn) SetCongestionControl(name string) (string, error) {
+	return "", errors.New("protocoltest: congestion control is not supported")
+}
+
+// SetMaxPacingRate fails: pipes are not paced.
+func (c *Conn) SetMaxPacingRate(bytesPerSecond uint64) error {
+	return errors.New("protocoltest: pacing is not supported")
+}
+
+// snapshot returns a Snapshot of the bytes transferred so far.
+func (c *Conn) snapshot() web100.Snapshot {
+	return web100.Snapshot{
+		Time: time.Now(),
+		TCPInfo: tcp.LinuxTCPInfo{
+			BytesReceived: c.conn.read.Load(),
+			BytesAcked:    c.conn.written.Load(),
+		},
+	}
+}
+
+// StartMeasuring takes a first snapshot. Another is taken by LatestSnapshot
+// and by StopMeasuring, but not when ctx is canceled.
+func (c *Conn) StartMeasuring(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.snapshot()
+	c.measuring = true
+	c.latest = &s
+	c.snapshots = []web100.Snapshot{s}
+}
+
+// LatestSnapshot takes and returns a snapshot, or returns nil if c is not
+// being measured.
+func (c *Conn) LatestSnapshot() *web100.Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.measuring {
+		return c.latest
+	}
+	s := c.snapshot()
+	c.latest = &s
+	c.snapshots = append(c.snapshots, s)
+	return c.latest
+}
+
+// StopMeasuring takes a last snapshot and returns the metrics of them all.
+func (c *Conn) StopMeasuring() (*web100.Metrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.measuring {
+		return nil, errors.New("protocoltest: not measuring")
+	}
+	c.measuring = false
+	s := c.snapshot()
+	c.snapshots = append(c.snapshots, s)
+	return &web100.Metrics{
+		TCPInfo:   s.TCPInfo,
+		Snapshots: c.snapshots,
+		CountRTT:  uint32(len(c.snapshots)),
+	}, nil
+}
+
+// Message is a message sent over the control channel.
+type Message struct {
+	Type protocol.MessageType
+	Body []byte
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%s %q", m.Type, m.Body)
+}
+
+// Recorder is a protocol.Messager that records the messages sent, and that
+// receives the messages it was created with, in order.
+type Recorder struct {
+	mu       sync.Mutex
+	sent     []Message
+	received []Message
+}
+
+// NewRecorder returns a Recorder whose ReceiveMessage returns the messages in
+// received, in order.
+func NewRecorder(received ...Message) *Recorder {
+	return &Recorder{received: received}
+}
+
+// Send records msg, with its body in the TLV encoding. It fails, like the
+// messagers of connections, if the fields of msg are not valid.
+func (r *Recorder) Send(msg protocol.Message) error {
+	body, err := protocol.Encode(protocol.TLV, msg)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, Message{Type: msg.Type(), Body: body})
+	return nil
+}
+
+// ReceiveMessage returns the body of the next message that r was created
+// with. It fails if the message is not of type t, and returns io.EOF once
+// there are no more messages.
+func (r *Recorder) ReceiveMessage(t protocol.MessageType) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.received) == 0 {
+		return nil, io.EOF
+	}
+	m := r.received[0]
+	r.received = r.received[1:]
+	if m.Type != t {
+		return nil, fmt.Errorf("protocoltest: received %s, want %s", m.Type, t)
+	}
+	return m.Body, nil
+}
+
+// Encoding returns protocol.TLV.
+func (r *Recorder) Encoding() protocol.Encoding {
+	return protocol.TLV
+}
+
+// Sent returns the messages sent so far.
+func (r *Recorder) Sent() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.sent...)
+}
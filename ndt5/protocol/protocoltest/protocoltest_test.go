@@ -0,0 +1,55 @@
+package protocoltest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+func TestPipe(t *testing.T) {
+	server, client := Pipe()
+	defer server.Close()
+	defer client.Close()
+	cc := protocol.AdaptNetConn(client, bufio.NewReader(client))
+	cc.SetEncoding(protocol.TLV)
+
+	go server.Messager().Send(&protocol.Start{})
+	if _, err := cc.Messager().ReceiveMessage(protocol.TestStart); err != nil {
+		t.Errorf("ReceiveMessage() of an empty message = %v", err)
+	}
+
+	server.StartMeasuring(context.Background())
+	go client.Write([]byte("hello"))
+	if _, err := server.ReadBytes(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := server.StopMeasuring()
+	if err != nil || m.TCPInfo.BytesReceived != 5 {
+		t.Errorf("StopMeasuring() = %+v, %v, want 5 bytes received", m, err)
+	}
+	if ip, port := server.ClientIPAndPort(); ip != "127.0.0.1" || port != 54321 {
+		t.Errorf("ClientIPAndPort() = %s, %d", ip, port)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(Message{Type: protocol.MsgWaiting})
+	r.Send(&protocol.Queue{Wait: 1})
+	r.Send(&protocol.S2CResults{ThroughputKbps: 100, TotalSentBytes: 5000})
+	if _, err := r.ReceiveMessage(protocol.MsgWaiting); err != nil {
+		t.Errorf("ReceiveMessage() = %v", err)
+	}
+	if _, err := r.ReceiveMessage(protocol.MsgWaiting); err != io.EOF {
+		t.Errorf("ReceiveMessage() without messages = %v, want EOF", err)
+	}
+	if err := r.Send(&protocol.Queue{Wait: -1}); err == nil {
+		t.Error("Send() of an invalid message = nil, want an error")
+	}
+	sent := r.Sent()
+	if len(sent) != 2 || sent[0].Type != protocol.SrvQueue || string(sent[1].Body) != "100 0 5000" {
+		t.Errorf("Sent() = %v", sent)
+	}
+}
@@ -0,0 +1,286 @@
+// Package queue limits the number of ndt5 tests that run at the same time.
+// Clients that arrive when the server is busy wait in a FIFO queue until a
+// running test completes.
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/flowlimit"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ratelimit"
+)
+
+// ErrFull is returned by Join when the queue has no room for another client.
+var ErrFull = errors.New("queue is full")
+
+// ErrDraining is returned by Join while the queue is draining.
+var ErrDraining = errors.New("queue is draining")
+
+// ErrClientLimited is returned by JoinFrom when the client has started too
+// many tests recently.
+var ErrClientLimited = errors.New("client has exceeded its test rate limit")
+
+// Queue admits up to a fixed number of concurrent tests. A nil *Queue admits
+// every test immediately.
+type Queue struct {
+	maxActive  int
+	maxWaiting int
+	timeout    time.Duration
+	clock      clock.Clock
+	flows      *flowlimit.Limiter
+	clientRate *ratelimit.Limiter
+	subnetRate *ratelimit.Limiter
+	subnets    *ratelimit.Concurrency
+
+	mu       sync.Mutex
+	active   int
+	waiting  []*Ticket
+	draining bool
+}
+
+// New creates a Queue that runs at most maxActive tests at once, and allows at
+// most maxWaiting clients to wait for up to timeout to be admitted.
+func New(maxActive, maxWaiting int, timeout time.Duration) *Queue {
+	return &Queue{
+		maxActive:  maxActive,
+		maxWaiting: maxWaiting,
+		timeout:    timeout,
+		clock:      clock.Real,
+	}
+}
+
+// WithClock makes the clients of q wait with c, e.g. a fake clock in tests,
+// and returns q.
+func (q *Queue) WithClock(c clock.Clock) *Queue {
+	q.clock = c
+	return q
+}
+
+// WithLimiter makes the tests admitted by q also run as flows of l, which is
+// shared with the other protocols, and returns q.
+func (q *Queue) WithLimiter(l *flowlimit.Limiter) *Queue {
+	q.flows = l
+	return q
+}
+
+// WithClientLimit makes clients that join q with JoinFrom subject to the
+// per-client test rate limit of rate, and returns q.
+func (q *Queue) WithClientLimit(rate *ratelimit.Limiter) *Queue {
+	q.clientRate = rate
+	return q
+}
+
+// WithSubnetLimits makes clients that join q with JoinFrom subject to the
+// per-subnet test rate limit of rate and the per-subnet concurrency limit of c,
+// and returns q. Either may be nil.
+func (q *Queue) WithSubnetLimits(rate *ratelimit.Limiter, c *ratelimit.Concurrency) *Queue {
+	q.subnetRate = rate
+	q.subnets = c
+	return q
+}
+
+// Clock returns the clock that clients of q wait with.
+func (q *Queue) Clock() clock.Clock {
+	if q == nil {
+		return clock.Real
+	}
+	return q.clock
+}
+
+// Timeout returns how long a client may wait to be admitted.
+func (q *Queue) Timeout() time.Duration {
+	if q == nil {
+		return 0
+	}
+	return q.timeout
+}
+
+// Ticket is a client's place in the queue.
+type Ticket struct {
+	q     *Queue
+	ready chan struct{}
+	done  bool
+	flow  *flowlimit.Flow
+	// ip is the client whose subnet t counts against, if any.
+	ip string
+}
+
+// Join adds a client to the queue. The client may run its test once the
+// Ticket's Ready channel is closed, and must call Done when the test is over
+// or when it gives up waiting.
+func (q *Queue) Join() (*Ticket, error) {
+	t := &Ticket{q: q, ready: make(chan struct{})}
+	if q == nil {
+		close(t.ready)
+		return t, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.updateMetrics()
+	if q.draining {
+		return nil, ErrDraining
+	}
+	if len(q.waiting) == 0 && q.active < q.maxActive {
+		q.active++
+		close(t.ready)
+		return t, nil
+	}
+	if len(q.waiting) >= q.maxWaiting {
+		return nil, ErrFull
+	}
+	q.waiting = append(q.waiting, t)
+	return t, nil
+}
+
+// JoinFrom is like Join for a client at ip. It returns ErrClientLimited if the
+// client has started too many tests recently, ratelimit.ErrLimited if its
+// subnet has, and ratelimit.ErrBusy if its subnet is already running as many
+// as it may.
+func (q *Queue) JoinFrom(ip string) (*Ticket, error) {
+	if q == nil {
+		return q.Join()
+	}
+	if q.Draining() {
+		return nil, ErrDraining
+	}
+	if !q.clientRate.Allow(ip) {
+		return nil, ErrClientLimited
+	}
+	if !q.subnetRate.Allow(ip) {
+		return nil, ratelimit.ErrLimited
+	}
+	if !q.subnets.Acquire(ip) {
+		return nil, ratelimit.ErrBusy
+	}
+	t, err := q.Join()
+	if err != nil {
+		q.subnets.Release(ip)
+		return nil, err
+	}
+	t.ip = ip
+	return t, nil
+}
+
+// Drain turns new clients away with ErrDraining, e.g. while the server is in
+// lame duck mode, until Resume is called. The clients that are running or
+// waiting are unaffected.
+func (q *Queue) Drain() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.draining = true
+}
+
+// Resume admits new clients again after Drain.
+func (q *Queue) Resume() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.draining = false
+}
+
+// Draining reports whether q turns new clients away.
+func (q *Queue) Draining() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.draining
+}
+
+// Ready returns a channel that is closed once the test may run.
+func (t *Ticket) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// JoinFlow joins the flow limiter of t's queue, if any, once t has been
+// admitted. The test may only run once the returned channel is closed. The
+// flow is released by Done.
+func (t *Ticket) JoinFlow() (<-chan struct{}, error) {
+	var l *flowlimit.Limiter
+	if t.q != nil {
+		l = t.q.flows
+	}
+	f, err := l.Join()
+	if err != nil {
+		return nil, err
+	}
+	t.flow = f
+	return f.Ready(), nil
+}
+
+// Position returns the number of clients ahead of t plus one, or zero if the
+// test has been admitted.
+func (t *Ticket) Position() int {
+	if t.q == nil {
+		return 0
+	}
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	for i, w := range t.q.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Done releases t's place in the queue and its flow, admitting the next
+// waiting client if t was admitted. Calling Done more than once has no effect.
+func (t *Ticket) Done() {
+	if t.flow != nil {
+		t.flow.Done()
+	}
+	if t.q == nil {
+		return
+	}
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.done {
+		return
+	}
+	defer q.updateMetrics()
+	t.done = true
+	if t.ip != "" {
+		q.subnets.Release(t.ip)
+	}
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+	q.active--
+	for q.active < q.maxActive && len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		close(next.ready)
+	}
+}
+
+// updateMetrics exports the queue depth. It must be called with q.mu held.
+func (q *Queue) updateMetrics() {
+	ndt5metrics.QueueDepth.WithLabelValues("active").Set(float64(q.active))
+	ndt5metrics.QueueDepth.WithLabelValues("waiting").Set(float64(len(q.waiting)))
+}
+
+// Len returns the number of running and waiting tests.
+func (q *Queue) Len() (active, waiting int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active, len(q.waiting)
+}
@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ratelimit"
+)
+
+func isReady(t *Ticket) bool {
+	select {
+	case <-t.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := New(1, 2, time.Minute)
+	first, err := q.Join()
+	if err != nil || !isReady(first) || first.Position() != 0 {
+		t.Fatalf("first Join() = %v, ready=%t", err, isReady(first))
+	}
+	second, _ := q.Join()
+	third, _ := q.Join()
+	if isReady(second) || second.Position() != 1 || third.Position() != 2 {
+		t.Errorf("positions = %d, %d, want 1, 2", second.Position(), third.Position())
+	}
+	if _, err := q.Join(); err != ErrFull {
+		t.Errorf("Join() on a full queue = %v, want ErrFull", err)
+	}
+
+	// A waiting client that gives up moves everyone behind it forward.
+	second.Done()
+	if third.Position() != 1 {
+		t.Errorf("third.Position() = %d, want 1", third.Position())
+	}
+	first.Done()
+	first.Done() // Extra calls must not admit more tests.
+	if !isReady(third) || third.Position() != 0 {
+		t.Error("third should be admitted after first is done")
+	}
+	if active, waiting := q.Len(); active != 1 || waiting != 0 {
+		t.Errorf("Len() = %d, %d, want 1, 0", active, waiting)
+	}
+	third.Done()
+	if active, _ := q.Len(); active != 0 {
+		t.Errorf("Len() active = %d, want 0", active)
+	}
+}
+
+func TestQueue_Nil(t *testing.T) {
+	var q *Queue
+	ticket, err := q.Join()
+	if err != nil || !isReady(ticket) || ticket.Position() != 0 {
+		t.Error("a nil Queue should admit every test")
+	}
+	ticket.Done()
+	if q.Timeout() != 0 {
+		t.Error("a nil Queue should have no timeout")
+	}
+}
+
+func TestQueue_Drain(t *testing.T) {
+	q := New(1, 1, time.Minute)
+	running, _ := q.Join()
+	q.Drain()
+	if _, err := q.Join(); err != ErrDraining || !q.Draining() {
+		t.Errorf("Join() while draining = %v, want ErrDraining", err)
+	}
+	if _, err := q.JoinFrom("192.0.2.1"); err != ErrDraining {
+		t.Errorf("JoinFrom() while draining = %v, want ErrDraining", err)
+	}
+	running.Done()
+	q.Resume()
+	if ticket, err := q.Join(); err != nil || !isReady(ticket) {
+		t.Errorf("Join() after Resume() = %v", err)
+	}
+}
+
+func TestQueue_JoinFrom(t *testing.T) {
+	subnets := ratelimit.Subnets{IPv4: 24, IPv6: 64}
+	q := New(10, 10, time.Minute).WithSubnetLimits(ratelimit.New(3600, 3).WithSubnets(subnets), ratelimit.NewConcurrency(1, subnets))
+	first, err := q.JoinFrom("1.2.3.4")
+	if err != nil || !isReady(first) {
+		t.Fatalf("first JoinFrom() = %v", err)
+	}
+	if _, err := q.JoinFrom("1.2.3.5"); err != ratelimit.ErrBusy {
+		t.Errorf("JoinFrom() from a busy subnet = %v, want ErrBusy", err)
+	}
+	first.Done()
+	first.Done() // Extra calls must not release the subnet twice.
+	second, err := q.JoinFrom("1.2.3.5")
+	if err != nil {
+		t.Fatalf("JoinFrom() after Done = %v", err)
+	}
+	second.Done()
+	// The three attempts allowed in a row have been used up by now.
+	if _, err := q.JoinFrom("1.2.3.6"); err != ratelimit.ErrLimited {
+		t.Errorf("JoinFrom() over the rate limit = %v, want ErrLimited", err)
+	}
+	if active, _ := q.Len(); active != 0 {
+		t.Errorf("Len() active = %d, want 0", active)
+	}
+}
+
+func TestQueue_WithClientLimit(t *testing.T) {
+	q := New(10, 10, time.Minute).WithClientLimit(ratelimit.New(3600, 1))
+	first, err := q.JoinFrom("1.2.3.4")
+	if err != nil {
+		t.Fatalf("first JoinFrom() = %v", err)
+	}
+	first.Done()
+	if _, err := q.JoinFrom("1.2.3.4"); err != ErrClientLimited {
+		t.Errorf("JoinFrom() over the client's limit = %v, want ErrClientLimited", err)
+	}
+	// Other clients have their own limit.
+	other, err := q.JoinFrom("1.2.3.5")
+	if err != nil {
+		t.Fatalf("JoinFrom() of another client = %v", err)
+	}
+	other.Done()
+}
@@ -0,0 +1,33 @@
+// Package recovery keeps a bug triggered by one client from crashing the whole
+// server: the goroutines that handle connections and run tests defer Recover.
+package recovery
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/apex/log"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+)
+
+// Recover must be deferred by the goroutine of the named handler. If the
+// goroutine panics, Recover logs the panic and its stack with logger, which
+// should identify the test, counts it, and closes c, if it is not nil, so that
+// the client is disconnected cleanly.
+func Recover(logger log.Interface, handler string, c io.Closer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.WithFields(log.Fields{
+		"handler": handler,
+		"panic":   fmt.Sprint(r),
+		"stack":   string(debug.Stack()),
+	}).Error("Recovered from panic")
+	metrics.HandlerPanicCount.WithLabelValues(handler).Inc()
+	if c != nil {
+		c.Close()
+	}
+}
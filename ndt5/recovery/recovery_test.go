@@ -0,0 +1,44 @@
+package recovery
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+)
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRecover(t *testing.T) {
+	before := testutil.ToFloat64(metrics.HandlerPanicCount.WithLabelValues("test"))
+	c := &closer{}
+	func() {
+		defer Recover(log.Log, "test", c)
+		panic(errors.New("bug"))
+	}()
+	if !c.closed {
+		t.Error("Recover() did not close the connection")
+	}
+	if got := testutil.ToFloat64(metrics.HandlerPanicCount.WithLabelValues("test")); got != before+1 {
+		t.Errorf("HandlerPanicCount = %v, want %v", got, before+1)
+	}
+
+	// Without a panic, nothing happens.
+	c = &closer{}
+	func() {
+		defer Recover(log.Log, "test", c)
+	}()
+	if c.closed {
+		t.Error("Recover() closed the connection without a panic")
+	}
+}
@@ -0,0 +1,104 @@
+package s2c
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
+)
+
+// probeInterval is the minimum time between the starts of two latency probes.
+const probeInterval = 100 * time.Millisecond
+
+// Responsiveness is the latency of the control channel while the download
+// saturates the path, i.e. the latency that interactive applications would
+// experience under load.
+type Responsiveness struct {
+	// RTTs are the round-trip times of the probes, in order.
+	RTTs []time.Duration
+	// MedianRTT is the median of RTTs.
+	MedianRTT time.Duration
+	// RPM is the number of round trips per minute at MedianRTT.
+	RPM float64
+	// Bufferbloat is MedianRTT divided by the minimum RTT of the download's
+	// TCP connection: how much queueing delay the download added.
+	Bufferbloat float64 `json:",omitempty"`
+}
+
+// newResponsiveness summarizes rtts, or returns nil if there are none.
+func newResponsiveness(rtts []time.Duration, minRTT time.Duration) *Responsiveness {
+	if len(rtts) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration{}, rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	r := &Responsiveness{RTTs: rtts, MedianRTT: sorted[len(sorted)/2]}
+	if r.MedianRTT > 0 {
+		r.RPM = float64(time.Minute) / float64(r.MedianRTT)
+	}
+	if minRTT > 0 {
+		r.Bufferbloat = float64(r.MedianRTT) / float64(minRTT)
+	}
+	return r
+}
+
+// lockedMessager serializes the messages that several goroutines send.
+type lockedMessager struct {
+	protocol.Messager
+	mu sync.Mutex
+}
+
+func (l *lockedMessager) Send(msg protocol.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Messager.Send(msg)
+}
+
+// probeLatency measures the round-trip time of the control channel until the
+// returned function is called, which returns the RTTs. Every probeInterval at
+// most, the client is sent a TestMsg "ping <n>", which it must answer with a
+// TestMsg "pong <n>" right away. Only one probe is outstanding at a time, and
+// the returned function waits for its answer.
+func probeLatency(m protocol.Messager, logger log.Interface) func() []time.Duration {
+	done := make(chan struct{})
+	var rtts []time.Duration
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recovery.Recover(logger, "s2c.probes", nil)
+		t := time.NewTicker(probeInterval)
+		defer t.Stop()
+		for n := 0; ; n++ {
+			start := time.Now()
+			if err := m.Send(&protocol.TestMessage{Text: fmt.Sprintf("ping %d", n)}); err != nil {
+				logger.WithError(err).Warn("Could not send a latency probe")
+				return
+			}
+			pong, err := m.ReceiveMessage(protocol.TestMsg)
+			if err != nil {
+				logger.WithError(err).Warn("Could not receive a latency probe")
+				return
+			}
+			if string(pong) != fmt.Sprintf("pong %d", n) {
+				logger.WithField("pong", string(pong)).Warn("Unexpected answer to a latency probe")
+				return
+			}
+			rtts = append(rtts, time.Since(start))
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return func() []time.Duration {
+		close(done)
+		wg.Wait()
+		return rtts
+	}
+}
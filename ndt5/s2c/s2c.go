@@ -2,18 +2,112 @@ package s2c
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"flag"
+	"net"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/egress"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
+	"github.com/m-lab/ndt-server/ndt5/singleserving"
+	"github.com/m-lab/ndt-server/ndt5/web100"
+	"github.com/m-lab/ndt-server/tracing"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/tcp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var (
+	enableBBR         = flag.Bool("ndt5.s2c.bbr", false, "Use BBR congestion control for ndt5 download tests, if supported by the kernel. Deprecated: use -ndt5.s2c.congestion-control=bbr")
+	maxPacingRate     = flag.Float64("ndt5.s2c.max-pacing-rate", 0, "The maximum rate in Mbit/s at which the server sends the data of ndt5 download tests, set with SO_MAX_PACING_RATE and recorded in the results. It is enforced by the fq qdisc or, on kernels 4.13 and later, by TCP itself. By default the rate is not capped")
+	egressCap         = flag.Float64("ndt5.s2c.egress-cap", 0, "The maximum aggregate rate in Mbit/s at which the server sends the data of all the ndt5 download tests that run at once, which they share equally. It is recorded in the results. By default the rate is not capped")
+	interleaveWrites  = flag.Bool("ndt5.s2c.interleave-writes", false, "Whether the ndt5 download tests that run at once take turns writing their data, a chunk each, so that none of them systematically gets more of the server's CPU and network. Tests whose client can't take more data do not hold the others back")
+	congestionControl ndt.CongestionControl
+
+	egressOnce    sync.Once
+	egressLimiter *egress.Limiter
+	// senders are the download tests sending data.
+	senders = egress.NewCoordinator()
+)
+
+// tracer traces the steps of the tests.
+var tracer = otel.Tracer("github.com/m-lab/ndt-server/ndt5/s2c")
+
+func init() {
+	flag.Var(&congestionControl, "ndt5.s2c.congestion-control", "The congestion control algorithm of ndt5 download tests: cubic, bbr, or reno. Clients may choose another one in their login message. By default the kernel's net.ipv4.tcp_congestion_control is used")
+}
+
+// dataToSend is the data that every download test sends over and over. It is
+// never modified, so the tests that run at once share it.
+var dataToSend = func() *protocol.Payload {
+	b := make([]byte, 8192)
+	for i := range b {
+		b[i] = byte(((i * 101) % (122 - 33)) + 33)
+	}
+	return protocol.NewPayload(b)
+}()
+
+// snapshotInterval is the minimum time between the TCP_INFO snapshots saved
+// in the ArchivalData. The socket is polled more often than this to get
+// accurate RTT statistics.
+const snapshotInterval = 250 * time.Millisecond
+
+// TCPInfoSnapshot is a TCP_INFO sample taken during the test.
+type TCPInfoSnapshot struct {
+	// ElapsedTime is the time since the start of the test.
+	ElapsedTime time.Duration
+	TCPInfo     tcp.LinuxTCPInfo
+	BBRInfo     *inetdiag.BBRInfo `json:",omitempty"`
+}
+
+// Interval summarizes the transfer since the previous interval, or since the
+// start of the test.
+type Interval struct {
+	// ElapsedTime is the time since the start of the test at the end of the
+	// interval.
+	ElapsedTime time.Duration
+	// ThroughputMbps is the rate at which the client acknowledged data during
+	// the interval.
+	ThroughputMbps float64
+	// RTT is the smoothed RTT at the end of the interval.
+	RTT time.Duration
+	// Cwnd is the congestion window at the end of the interval, in packets.
+	Cwnd uint32
+}
+
+// newInterval returns the Interval from prev, which is nil at the start of the
+// test, to cur.
+func newInterval(prev *TCPInfoSnapshot, cur TCPInfoSnapshot) Interval {
+	var elapsed time.Duration
+	var acked int64
+	if prev != nil {
+		elapsed, acked = prev.ElapsedTime, prev.TCPInfo.BytesAcked
+	}
+	i := Interval{
+		ElapsedTime: cur.ElapsedTime,
+		RTT:         time.Duration(cur.TCPInfo.RTT) * time.Microsecond,
+		Cwnd:        cur.TCPInfo.SndCwnd,
+	}
+	if d := cur.ElapsedTime - elapsed; d > 0 {
+		i.ThroughputMbps = 8 * float64(cur.TCPInfo.BytesAcked-acked) / d.Seconds() / 1e6
+	}
+	return i
+}
+
 // ArchivalData is the data saved by the S2C test. If a researcher wants deeper
 // data, then they should use the UUID to get deeper data from tcp-info.
 type ArchivalData struct {
@@ -39,17 +133,77 @@ type ArchivalData struct {
 	SumRTT             time.Duration
 	CountRTT           uint32
 	ClientReportedMbps float64
-	// TODO: Add TCPEngine (bbr, cubic, reno, etc.), MaxThroughputKbps, and Jitter
+	// TCPEngine is the congestion control algorithm of the test, e.g. bbr, if
+	// the client or the server chose one, and empty otherwise.
+	TCPEngine string `json:",omitempty"`
+	// TCPEngineError is why the chosen algorithm could not be set, in which
+	// case the test used TCPEngine, the kernel's default, instead.
+	TCPEngineError string `json:",omitempty"`
+	// DSCP is the DSCP that the server marked the packets of the test with, if
+	// any.
+	DSCP int `json:",omitempty"`
+	// EgressCapMbps is the cap on the aggregate rate at which the server sent
+	// the data of all its download tests, if any. The test got an equal share
+	// of it with the tests that ran at the same time.
+	EgressCapMbps float64 `json:",omitempty"`
+	// ConcurrentTests is the largest number of other download tests that the
+	// server sent data for while it sent the data of this one. Tests that ran
+	// concurrently shared the server's CPU and network.
+	ConcurrentTests int `json:",omitempty"`
+	// MaxPacingRateMbps is the cap on the rate at which the server sent, if
+	// it was paced. MeanThroughputMbps can't exceed it.
+	MaxPacingRateMbps float64 `json:",omitempty"`
+	// TODO: Add MaxThroughputKbps and Jitter
 
 	TCPInfo *tcp.LinuxTCPInfo `json:",omitempty"`
-	Error   string            `json:",omitempty"`
+	// Retransmissions are the loss counters of TCPInfo.
+	Retransmissions *web100.Retransmissions `json:",omitempty"`
+	// RTT is the kernel's RTT estimate in TCPInfo.
+	RTT *web100.RTT `json:",omitempty"`
+	// ECN is whether the test connection used ECN, per TCPInfo.
+	ECN *web100.ECN `json:",omitempty"`
+	// BBRInfo is the last BBR sample of the test, if BBR was enabled.
+	BBRInfo *inetdiag.BBRInfo `json:",omitempty"`
+	// Snapshots holds TCP_INFO samples taken at least snapshotInterval apart.
+	Snapshots []TCPInfoSnapshot `json:",omitempty"`
+	// Intervals summarizes the transfer between consecutive Snapshots.
+	Intervals []Interval `json:",omitempty"`
+	// Responsiveness is the latency of the control channel during the
+	// transfer, if the client asked for it to be measured.
+	Responsiveness *Responsiveness `json:",omitempty"`
+	Error          string          `json:",omitempty"`
+	// ErrorType classifies Error by the step of the test that failed, using the
+	// same values as the ndt5_client_test_errors_total metric.
+	ErrorType string `json:",omitempty"`
+}
+
+// Options are the optional parts of the test, which clients ask for in their
+// login message.
+type Options struct {
+	// Interim sends the client an Interval as a TestMsg every
+	// snapshotInterval during the transfer.
+	Interim bool
+	// Responsiveness measures the latency of the control channel during the
+	// transfer. See probeLatency.
+	Responsiveness bool
+	// CongestionControl is the congestion control algorithm that the client
+	// chose, if any, which takes precedence over the server's.
+	CongestionControl string
 }
 
-// ManageTest manages the s2c test lifecycle
-func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server) (record *ArchivalData, err error) {
-	localCtx, localCancel := context.WithTimeout(ctx, 30*time.Second)
+// ManageTest manages the s2c test lifecycle.
+func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server, opts Options) (record *ArchivalData, err error) {
+	localCtx, localCancel := context.WithTimeout(ctx, *protocol.TestDuration+20*time.Second)
 	defer localCancel()
 	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("test", "s2c")
+	// step is the span of the step of the test that is running, so that the
+	// step that fails is the one marked with the error.
+	_, step := tracer.Start(ctx, "ndt5.s2c.prepare")
+	defer func() {
+		tracing.SetError(step, err)
+		step.End()
+	}()
 	defer func() {
 		if err != nil {
 			record.Error = err.Error()
@@ -57,57 +211,120 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	}()
 
 	connType := s.ConnectionType().Label()
+	fail := func(errType string) {
+		record.ErrorType = errType
+		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", errType).Inc()
+	}
 
 	srv, err := s.SingleServingServer("s2c")
 	if err != nil {
-		log.Println("Could not start single serving server", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "StartSingleServingServer").Inc()
+		logger.WithError(err).Warn("Could not start single serving server")
+		fail("StartSingleServingServer")
 		return record, err
 	}
 	m := controlConn.Messager()
-	err = m.SendMessage(protocol.TestPrepare, []byte(strconv.Itoa(srv.Port())))
+	err = m.Send(ndt.PrepareMessage(srv))
 	if err != nil {
-		log.Println("Could not send TestPrepare", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestPrepare").Inc()
+		logger.WithError(err).Warn("Could not send TestPrepare")
+		fail("TestPrepare")
 		return record, err
 	}
 
 	testConn, err := srv.ServeOnce(localCtx)
 	if err != nil || testConn == nil {
-		log.Println("Could not successfully ServeOnce", err)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "ServeOnce").Inc()
+		logger.WithError(err).Warn("Could not successfully ServeOnce")
+		fail("ServeOnce")
 		if err == nil {
 			err = errors.New("nil testConn, but also a nil error")
 		}
 		return record, err
 	}
+	// A client that stops reading can block FillUntil forever. Closing the
+	// test connection when the test's context is done unblocks it.
+	go func() {
+		<-localCtx.Done()
+		testConn.Close()
+	}()
 	record.UUID = testConn.UUID()
+	logger = logger.WithField("test_uuid", record.UUID)
 	record.ServerIP, record.ServerPort = testConn.ServerIPAndPort()
 	record.ClientIP, record.ClientPort = testConn.ClientIPAndPort()
+	record.DSCP = singleserving.DSCP()
 
-	dataToSend := make([]byte, 8192)
-	for i := range dataToSend {
-		dataToSend[i] = byte(((i * 101) % (122 - 33)) + 33)
+	def := congestionControl
+	if def == "" && *enableBBR {
+		def = "bbr"
 	}
+	var ccErr error
+	record.TCPEngine, ccErr = ndt.SetCongestionControl(testConn, "s2c", opts.CongestionControl, def)
+	if ccErr != nil {
+		logger.WithError(ccErr).WithField("tcp_engine", record.TCPEngine).Warn("Could not set the congestion control")
+		record.TCPEngineError = ccErr.Error()
+	}
+	if *maxPacingRate > 0 {
+		if err := testConn.SetMaxPacingRate(uint64(*maxPacingRate * 1e6 / 8)); err != nil {
+			logger.WithError(err).Warn("Could not set the maximum pacing rate")
+		} else {
+			record.MaxPacingRateMbps = *maxPacingRate
+		}
+	}
+	record.EgressCapMbps = sharedEgress().Mbps()
 
-	err = m.SendMessage(protocol.TestStart, []byte{})
+	step.End()
+	_, step = tracer.Start(ctx, "ndt5.s2c.transfer")
+	step.SetAttributes(attribute.String("test_uuid", record.UUID))
+	err = m.Send(&protocol.Start{})
 	if err != nil {
 		warnonerror.Close(testConn, "Could not close test connection")
-		log.Println("Could not write TestStart", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestStart").Inc()
+		logger.WithError(err).Warn("Could not write TestStart")
+		fail("TestStart")
 		return record, err
 	}
 
 	testConn.StartMeasuring(localCtx)
-	record.StartTime = time.Now()
-	testConn.FillUntil(time.Now().Add(10*time.Second), dataToSend)
-	record.EndTime = time.Now()
+	record.StartTime = clock.Real.Now()
+	live.FromContext(ctx).Measure("s2c", func() int64 {
+		if sample := testConn.LatestSnapshot(); sample != nil {
+			return sample.TCPInfo.BytesAcked
+		}
+		return 0
+	})
+	// The control channel is shared by the goroutines that run during the
+	// transfer.
+	var during protocol.Messager = m
+	if opts.Interim && opts.Responsiveness {
+		during = &lockedMessager{Messager: m}
+	}
+	stopInterim := func() {}
+	if opts.Interim {
+		stopInterim = sendIntervals(during, testConn, record.StartTime, logger)
+	}
+	stopProbes := func() []time.Duration { return nil }
+	if opts.Responsiveness {
+		stopProbes = probeLatency(during, logger)
+	}
+	turn := senders.Join()
+	var interleaved *egress.Turn
+	if *interleaveWrites {
+		interleaved = turn
+	}
+	err = fill(localCtx, testConn, time.Now().Add(*protocol.TestDuration), dataToSend, sharedEgress(), interleaved)
+	if err != nil {
+		// The client may still report its rate, so the test goes on.
+		logger.WithError(err).Warn("Could not send the download data")
+	}
+	turn.Done()
+	record.ConcurrentTests = turn.MaxConcurrent() - 1
+	var elapsed time.Duration
+	record.EndTime, elapsed = protocol.EndTime(clock.Real, record.StartTime)
+	stopInterim()
+	rtts := stopProbes()
 
 	web100metrics, err := testConn.StopMeasuring()
 	if err != nil {
 		warnonerror.Close(testConn, "Could not close test connection")
-		log.Println("Could not read metrics", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "web100Metrics").Inc()
+		logger.WithError(err).Warn("Could not read metrics")
+		fail("web100Metrics")
 		return record, err
 	}
 
@@ -122,7 +339,7 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	// test.  The duration of the test is supposed to be 10 seconds, but it
 	// can vary in practice, so we divide by the actual duration instead of
 	// assuming it was 10.
-	bps := 8 * float64(web100metrics.TCPInfo.BytesAcked) / record.EndTime.Sub(record.StartTime).Seconds()
+	bps := 8 * float64(web100metrics.TCPInfo.BytesAcked) / elapsed.Seconds()
 	kbps := bps / 1000
 	record.MinRTT = time.Duration(web100metrics.MinRTT) * time.Millisecond
 	record.MaxRTT = time.Duration(web100metrics.MaxRTT) * time.Millisecond
@@ -130,50 +347,187 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	record.CountRTT = web100metrics.CountRTT
 	record.MeanThroughputMbps = kbps / 1000 // Convert Kbps to Mbps
 	record.TCPInfo = &web100metrics.TCPInfo
+	record.Retransmissions = web100.NewRetransmissions(record.TCPInfo)
+	record.RTT = web100.NewRTT(record.TCPInfo)
+	record.ECN = web100.NewECN(record.TCPInfo)
+	record.BBRInfo = web100metrics.BBRInfo
+	record.Snapshots = thinSnapshots(web100metrics.Snapshots, record.StartTime)
+	record.Intervals = intervals(record.Snapshots)
+	record.Responsiveness = newResponsiveness(rtts, record.MinRTT)
 
 	// Send download results to the client.
-	err = m.SendS2CResults(int64(kbps), 0, web100metrics.TCPInfo.BytesAcked)
+	step.End()
+	_, step = tracer.Start(ctx, "ndt5.s2c.results")
+	err = m.Send(&protocol.S2CResults{ThroughputKbps: int64(kbps), TotalSentBytes: web100metrics.TCPInfo.BytesAcked})
 	if err != nil {
-		log.Println("Could not write a TestMsg", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestMsgSend").Inc()
+		logger.WithError(err).Warn("Could not write a TestMsg")
+		fail("TestMsgSend")
 		return record, err
 	}
 
 	clientRateMsg, err := m.ReceiveMessage(protocol.TestMsg)
 	// Do not return with an error if we got anything at all from the client.
 	if err != nil && clientRateMsg == nil {
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestMsgRcv").Inc()
-		log.Println("Could not receive a TestMsg", err, record.UUID)
+		fail("TestMsgRcv")
+		logger.WithError(err).Warn("Could not receive a TestMsg")
 		return record, err
 	}
-	log.Println("We measured", kbps, "and the client sent us", string(clientRateMsg))
+	logger.WithFields(log.Fields{"kbps": kbps, "client_kbps": string(clientRateMsg)}).Info("Client download rate")
 	clientRateKbps, err := strconv.ParseFloat(string(clientRateMsg), 64)
 	if err == nil {
 		record.ClientReportedMbps = clientRateKbps / 1000
 	} else {
-		log.Println("Could not parse number sent from client")
+		logger.WithError(err).Warn("Could not parse number sent from client")
 		// Being unable to parse the number should not be a fatal error, so continue.
 	}
 
 	err = protocol.SendMetrics(web100metrics, m, "")
 	if err != nil {
-		log.Println("Could not SendMetrics for the legacy data", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "SendMetricsLegacy").Inc()
+		logger.WithError(err).Warn("Could not SendMetrics for the legacy data")
+		fail("SendMetricsLegacy")
 		return record, err
 	}
 	err = protocol.SendMetrics(record, m, "NDTResult.S2C.")
 	if err != nil {
-		log.Println("Could not SendMetrics for the archival data", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "SendMetricsArchival").Inc()
+		logger.WithError(err).Warn("Could not SendMetrics for the archival data")
+		fail("SendMetricsArchival")
 		return record, err
 	}
+	// Only clients of servers that enabled BBR receive its measurements.
+	if record.BBRInfo != nil {
+		err = protocol.SendMetrics(record.BBRInfo, m, "NDTResult.S2C.BBRInfo.")
+		if err != nil {
+			logger.WithError(err).Warn("Could not SendMetrics for the BBR data")
+			fail("SendMetricsBBR")
+			return record, err
+		}
+	}
 
-	err = m.SendMessage(protocol.TestFinalize, []byte{})
+	err = m.Send(&protocol.Finalize{})
 	if err != nil {
-		log.Println("Could not send TestFinalize", err, record.UUID)
-		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestFinalize").Inc()
+		logger.WithError(err).Warn("Could not send TestFinalize")
+		fail("TestFinalize")
 		return record, err
 	}
 
 	return record, nil
 }
+
+// sharedEgress returns the Limiter of -ndt5.s2c.egress-cap, or nil if the
+// rate is not capped.
+func sharedEgress() *egress.Limiter {
+	egressOnce.Do(func() {
+		if *egressCap > 0 {
+			egressLimiter = egress.New(*egressCap * 1e6)
+		}
+	})
+	return egressLimiter
+}
+
+// fill sends data on conn until deadline, at the rate that l allows. If turn
+// is not nil, every write waits for its turn. A write that is cut short by the
+// deadline, because the client reads too slowly or not at all, ends the
+// transfer without an error.
+func fill(ctx context.Context, conn protocol.MeasuredConnection, deadline time.Time, data *protocol.Payload, l *egress.Limiter, turn *egress.Turn) error {
+	if l == nil && turn == nil {
+		_, err := conn.FillUntil(deadline, data)
+		return err
+	}
+	s := l.Join()
+	defer s.Done()
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	conn.SetWriteDeadline(deadline)
+	defer conn.SetWriteDeadline(time.Time{})
+	for s.Wait(ctx, len(data.Bytes())) == nil && turn.Begin(ctx) == nil {
+		err := conn.WriteMessage(websocket.BinaryMessage, data.Bytes())
+		turn.End()
+		if timedOut(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timedOut returns whether err is that of a write cut short by its deadline.
+// The websocket package hides os.ErrDeadlineExceeded behind a net.Error of its
+// own.
+func timedOut(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// sendIntervals sends the client an Interval every snapshotInterval, computed
+// from the latest sample of conn's measurement, until the returned function is
+// called. Once it returns, nothing more is sent on m.
+func sendIntervals(m protocol.Messager, conn protocol.MeasuredConnection, start time.Time, logger log.Interface) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recovery.Recover(logger, "s2c.intervals", nil)
+		t := time.NewTicker(snapshotInterval)
+		defer t.Stop()
+		var prev *TCPInfoSnapshot
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			sample := conn.LatestSnapshot()
+			if sample == nil || (prev != nil && sample.Time.Sub(start) == prev.ElapsedTime) {
+				continue
+			}
+			cur := TCPInfoSnapshot{ElapsedTime: sample.Time.Sub(start), TCPInfo: sample.TCPInfo}
+			b, _ := json.Marshal(newInterval(prev, cur))
+			prev = &cur
+			if err := m.Send(&protocol.TestMessage{Text: string(b)}); err != nil {
+				// The client will notice that the control connection failed.
+				logger.WithError(err).Warn("Could not send an interim measurement")
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// intervals returns the Intervals between consecutive snaps.
+func intervals(snaps []TCPInfoSnapshot) []Interval {
+	var is []Interval
+	for i := range snaps {
+		var prev *TCPInfoSnapshot
+		if i > 0 {
+			prev = &snaps[i-1]
+		}
+		is = append(is, newInterval(prev, snaps[i]))
+	}
+	return is
+}
+
+// thinSnapshots converts samples to TCPInfoSnapshots relative to start, keeping
+// only samples at least snapshotInterval apart. The last sample is always kept
+// because it has the final counters for the test.
+func thinSnapshots(samples []web100.Snapshot, start time.Time) []TCPInfoSnapshot {
+	snaps := []TCPInfoSnapshot{}
+	var last time.Time
+	for i, sample := range samples {
+		if i != len(samples)-1 && !last.IsZero() && sample.Time.Sub(last) < snapshotInterval {
+			continue
+		}
+		last = sample.Time
+		snaps = append(snaps, TCPInfoSnapshot{
+			ElapsedTime: sample.Time.Sub(start),
+			TCPInfo:     sample.TCPInfo,
+			BBRInfo:     sample.BBRInfo,
+		})
+	}
+	return snaps
+}
@@ -0,0 +1,156 @@
+package s2c
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt-server/egress"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/protocol/protocoltest"
+	"github.com/m-lab/ndt-server/ndt5/web100"
+)
+
+func Test_thinSnapshots(t *testing.T) {
+	start := time.Now()
+	samples := []web100.Snapshot{}
+	for i := 0; i <= 10; i++ {
+		samples = append(samples, web100.Snapshot{Time: start.Add(time.Duration(i) * 100 * time.Millisecond)})
+	}
+	got := thinSnapshots(samples, start)
+	want := []time.Duration{0, 300 * time.Millisecond, 600 * time.Millisecond, 900 * time.Millisecond, time.Second}
+	if len(got) != len(want) {
+		t.Fatalf("thinSnapshots() returned %d snapshots, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ElapsedTime != want[i] {
+			t.Errorf("snapshot %d ElapsedTime = %v, want %v", i, got[i].ElapsedTime, want[i])
+		}
+	}
+}
+
+func Test_intervals(t *testing.T) {
+	snaps := []TCPInfoSnapshot{
+		{ElapsedTime: 250 * time.Millisecond},
+		{ElapsedTime: 500 * time.Millisecond},
+	}
+	snaps[0].TCPInfo.BytesAcked = 1250000
+	snaps[0].TCPInfo.RTT = 20000
+	snaps[0].TCPInfo.SndCwnd = 10
+	snaps[1].TCPInfo.BytesAcked = 2500000
+	snaps[1].TCPInfo.RTT = 30000
+	snaps[1].TCPInfo.SndCwnd = 20
+	got := intervals(snaps)
+	want := []Interval{
+		{ElapsedTime: 250 * time.Millisecond, ThroughputMbps: 40, RTT: 20 * time.Millisecond, Cwnd: 10},
+		{ElapsedTime: 500 * time.Millisecond, ThroughputMbps: 40, RTT: 30 * time.Millisecond, Cwnd: 20},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("intervals() returned %d intervals, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("interval %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func Test_newResponsiveness(t *testing.T) {
+	if r := newResponsiveness(nil, time.Millisecond); r != nil {
+		t.Errorf("newResponsiveness(nil) = %+v, want nil", r)
+	}
+	rtts := []time.Duration{300 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+	r := newResponsiveness(rtts, 20*time.Millisecond)
+	if r.MedianRTT != 200*time.Millisecond || r.RPM != 300 || r.Bufferbloat != 10 {
+		t.Errorf("newResponsiveness() = %+v, want a median of 200ms, 300 RPM, and a bufferbloat of 10", r)
+	}
+	if rtts[0] != 300*time.Millisecond {
+		t.Error("newResponsiveness() reordered the RTTs")
+	}
+}
+
+func Test_fill(t *testing.T) {
+	conn, client := protocoltest.Pipe()
+	defer conn.Close()
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, client)
+		received <- n
+	}()
+	// 8Mbit/s for 200ms is 200kB.
+	fill(context.Background(), conn, time.Now().Add(200*time.Millisecond), protocol.NewPayload(make([]byte, 8192)), egress.New(8e6), nil)
+	client.Close()
+	if n := <-received; n < 150000 || n > 250000 {
+		t.Errorf("fill() sent %d bytes at 8Mbit/s in 200ms, want about 200000", n)
+	}
+}
+
+func Test_fill_interleaved(t *testing.T) {
+	conn, client := protocoltest.Pipe()
+	defer conn.Close()
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, client)
+		received <- n
+	}()
+	c := egress.NewCoordinator()
+	// Another sender that is still writing does not hold this one back.
+	other := c.Join()
+	if err := other.Begin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fill(context.Background(), conn, time.Now().Add(100*time.Millisecond), protocol.NewPayload(make([]byte, 8192)), nil, c.Join())
+	client.Close()
+	if n := <-received; n < 8192 {
+		t.Errorf("fill() sent %d bytes, want more than a write", n)
+	}
+}
+
+func Test_fill_stalled(t *testing.T) {
+	// The client's end of the pipe is never read, so every write blocks.
+	conn, client := protocoltest.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	start := time.Now()
+	err := fill(context.Background(), conn, start.Add(100*time.Millisecond), protocol.NewPayload(make([]byte, 8192)), egress.New(1e9), nil)
+	if err != nil {
+		t.Errorf("fill() = %v, want nil when the deadline cuts a write short", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fill() took %v with a client that stopped reading, want about 100ms", elapsed)
+	}
+}
+
+func Test_fill_stalledWebsocket(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	defer srv.Close()
+	// The client never reads, so the socket buffers fill up and writes block.
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := protocol.AdaptWsConn(<-conns)
+	defer conn.Close()
+	start := time.Now()
+	err = fill(context.Background(), conn, start.Add(300*time.Millisecond), protocol.NewPayload(make([]byte, 1<<20)), nil, egress.NewCoordinator().Join())
+	if err != nil {
+		t.Errorf("fill() = %v, want nil when the deadline cuts a write short", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fill() took %v with a client that stopped reading, want about 300ms", elapsed)
+	}
+}
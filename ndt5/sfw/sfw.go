@@ -0,0 +1,198 @@
+// Package sfw implements the legacy NDT simple firewall (SFW) test. The client
+// and the server each try to open a connection to a port the other one
+// listens on. A connection that cannot be established within the test's
+// timeout suggests that a firewall filters inbound connections on that side.
+package sfw
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/recovery"
+)
+
+var (
+	// Enabled controls whether the server offers the SFW test to clients.
+	Enabled = flag.Bool("ndt5.sfw.enabled", true, "Run the simple firewall test for ndt5 clients that request it")
+	timeout = flag.Duration("ndt5.sfw.timeout", 3*time.Second, "How long each side of the ndt5 simple firewall test may take to connect")
+)
+
+// message is sent over both test connections.
+const message = "Simple firewall test"
+
+// Result is the outcome of one direction of the test. The values are those
+// of the legacy protocol.
+type Result int
+
+// The possible Results.
+const (
+	NotTested        = Result(0)
+	NoFirewall       = Result(1)
+	Unknown          = Result(2)
+	PossibleFirewall = Result(3)
+)
+
+// ArchivalData is the data saved by the SFW test.
+type ArchivalData struct {
+	// ServerPort is the port the client was asked to connect to, and ClientPort
+	// the port the client asked the server to connect to.
+	ServerPort int
+	ClientIP   string
+	ClientPort int
+
+	StartTime time.Time
+	EndTime   time.Time
+
+	// ClientToServer is the outcome of the client's connection to the server,
+	// and ServerToClient that of the server's connection to the client, as
+	// seen by the server. The client may see the latter differently.
+	ClientToServer Result
+	ServerToClient Result
+
+	Error string `json:",omitempty"`
+	// ErrorType classifies Error by the step of the test that failed, using the
+	// same values as the ndt5_client_test_errors_total metric.
+	ErrorType string `json:",omitempty"`
+}
+
+// ManageTest manages the SFW test lifecycle.
+func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Server) (record *ArchivalData, err error) {
+	localCtx, localCancel := context.WithTimeout(ctx, *timeout+20*time.Second)
+	defer localCancel()
+	defer func() {
+		if err != nil && record != nil {
+			record.Error = err.Error()
+		}
+	}()
+	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("test", "sfw")
+
+	m := controlConn.Messager()
+	connType := s.ConnectionType().Label()
+	fail := func(errType string) {
+		record.ErrorType = errType
+		metrics.ClientTestErrors.WithLabelValues(connType, "sfw", errType).Inc()
+	}
+
+	srv, err := s.SingleServingServer("sfw")
+	if err != nil {
+		logger.WithError(err).Warn("Could not start SingleServingServer")
+		fail("StartSingleServingServer")
+		return record, err
+	}
+	record.ServerPort = srv.Port()
+
+	// The legacy protocol gives the timeout in whole seconds.
+	seconds := int(math.Ceil(timeout.Seconds()))
+	err = m.Send(&protocol.Prepare{Port: record.ServerPort, Args: []string{strconv.Itoa(seconds)}})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestPrepare")
+		fail("TestPrepare")
+		return record, err
+	}
+
+	portMsg, err := m.ReceiveMessage(protocol.TestMsg)
+	if err != nil {
+		logger.WithError(err).Warn("Could not receive the client's port")
+		fail("TestMsgRcv")
+		return record, err
+	}
+	record.ClientPort, err = strconv.Atoi(strings.TrimSpace(string(portMsg)))
+	if err != nil || record.ClientPort <= 0 || record.ClientPort > 65535 {
+		logger.WithField("port", string(portMsg)).Warn("Invalid client port")
+		fail("ClientPort")
+		return record, errors.New("invalid client port")
+	}
+	record.ClientIP, _ = controlConn.ClientIPAndPort()
+
+	err = m.Send(&protocol.Start{})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestStart")
+		fail("TestStart")
+		return record, err
+	}
+
+	record.StartTime = time.Now()
+	testCtx, testCancel := context.WithTimeout(localCtx, *timeout)
+	defer testCancel()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer recovery.Recover(logger, "sfw.accept", nil)
+		record.ClientToServer = accept(testCtx, srv, m.Encoding())
+	}()
+	go func() {
+		defer wg.Done()
+		defer recovery.Recover(logger, "sfw.connect", nil)
+		addr := net.JoinHostPort(record.ClientIP, strconv.Itoa(record.ClientPort))
+		record.ServerToClient = connect(testCtx, addr, m.Encoding())
+	}()
+	wg.Wait()
+	record.EndTime = time.Now()
+	logger.WithFields(log.Fields{
+		"client_to_server": record.ClientToServer,
+		"server_to_client": record.ServerToClient,
+	}).Info("SFW test done")
+
+	err = m.Send(&protocol.TestMessage{Text: strconv.Itoa(int(record.ClientToServer))})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestMsg with SFW results")
+		fail("TestMsgSend")
+		return record, err
+	}
+	err = m.Send(&protocol.Finalize{})
+	if err != nil {
+		logger.WithError(err).Warn("Could not send TestFinalize")
+		fail("TestFinalize")
+		return record, err
+	}
+	return record, nil
+}
+
+// accept waits for the client to connect to srv and send the test message.
+func accept(ctx context.Context, srv ndt.SingleMeasurementServer, e protocol.Encoding) Result {
+	conn, err := srv.ServeOnce(ctx)
+	if err != nil || conn == nil {
+		return PossibleFirewall
+	}
+	defer warnonerror.Close(conn, "Could not close SFW connection")
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	msg, err := e.Messager(conn).ReceiveMessage(protocol.TestMsg)
+	if err != nil || string(msg) != message {
+		// Something answered, but it was not the client.
+		return Unknown
+	}
+	return NoFirewall
+}
+
+// connect connects to the client at addr and sends it the test message.
+func connect(ctx context.Context, addr string, e protocol.Encoding) Result {
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return PossibleFirewall
+	}
+	defer warnonerror.Close(c, "Could not close SFW connection")
+	c.SetDeadline(time.Now().Add(*timeout))
+	if err := e.Messager(protocol.AdaptNetConn(c, c)).Send(&protocol.TestMessage{Text: message}); err != nil {
+		return Unknown
+	}
+	return NoFirewall
+}
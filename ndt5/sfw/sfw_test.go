@@ -0,0 +1,47 @@
+package sfw
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+func TestConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer c.Close()
+		msg, _, err := protocol.ReadTLVMessage(protocol.AdaptNetConn(c, c), protocol.TestMsg)
+		if err != nil {
+			received <- ""
+			return
+		}
+		received <- string(msg)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if got := connect(ctx, l.Addr().String(), protocol.TLV); got != NoFirewall {
+		t.Errorf("connect() = %d, want NoFirewall", got)
+	}
+	if msg := <-received; msg != message {
+		t.Errorf("the client received %q, want %q", msg, message)
+	}
+
+	// Nothing listens once the listener is closed.
+	addr := l.Addr().String()
+	l.Close()
+	if got := connect(ctx, addr, protocol.TLV); got != PossibleFirewall {
+		t.Errorf("connect() to a closed port = %d, want PossibleFirewall", got)
+	}
+}
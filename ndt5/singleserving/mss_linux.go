@@ -0,0 +1,15 @@
+package singleserving
+
+import "syscall"
+
+// setMSS sets the TCP maximum segment size of the socket c, which must not be
+// connected yet.
+func setMSS(c syscall.RawConn, mss int) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package singleserving
+
+import "syscall"
+
+// setMSS has no effect on platforms other than Linux.
+func setMSS(c syscall.RawConn, mss int) error {
+	return nil
+}
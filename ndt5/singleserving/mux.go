@@ -0,0 +1,125 @@
+package singleserving
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// TokenPrefix starts every measurement connection made to a shared port. It is
+// followed by the TokenLength characters of the token of the test. No control
+// connection can start with it, as the first byte of a TLV message is a small
+// message type.
+const TokenPrefix = "TEST "
+
+// TokenLength is the length of a test token.
+const TokenLength = 32
+
+// Mux hands the measurement connections that arrive on the control port to
+// the single-serving servers waiting for them, so that a server can run every
+// test on a single port.
+type Mux struct {
+	port    int
+	mu      sync.Mutex
+	waiting map[string]chan protocol.MeasuredConnection
+}
+
+// NewMux creates a Mux for the shared port.
+func NewMux(port int) *Mux {
+	return &Mux{
+		port:    port,
+		waiting: make(map[string]chan protocol.MeasuredConnection),
+	}
+}
+
+// Listen starts a single-serving server that receives the next connection
+// that Dispatch is given with its token.
+func (m *Mux) Listen(direction string) (ndt.SingleMeasurementServer, error) {
+	b := make([]byte, TokenLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &muxServer{
+		mux:       m,
+		token:     hex.EncodeToString(b),
+		direction: direction,
+		conns:     make(chan protocol.MeasuredConnection, 1),
+	}
+	m.mu.Lock()
+	m.waiting[s.token] = s.conns
+	m.mu.Unlock()
+	ndt5metrics.MeasurementServerStart.WithLabelValues(string(ndt.Plain)).Inc()
+	return s, nil
+}
+
+// Dispatch gives conn to the server waiting for token. It returns false if no
+// server is waiting for it, in which case the caller still owns conn.
+func (m *Mux) Dispatch(token string, conn protocol.MeasuredConnection) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.waiting[token]
+	if !ok {
+		return false
+	}
+	// Each token is good for one connection only.
+	delete(m.waiting, token)
+	c <- conn
+	return true
+}
+
+// muxServer is a single-serving server that shares the port of a Mux.
+type muxServer struct {
+	mux       *Mux
+	token     string
+	direction string
+	conns     chan protocol.MeasuredConnection
+	once      sync.Once
+}
+
+func (s *muxServer) Port() int {
+	return s.mux.port
+}
+
+// Token returns the token that the client must send to reach this server.
+func (s *muxServer) Token() string {
+	return s.token
+}
+
+func (s *muxServer) ServeOnce(ctx context.Context) (protocol.MeasuredConnection, error) {
+	// NOTE: set an absolute timeouts for single serving servers.
+	derivedCtx, derivedCancel := context.WithTimeout(ctx, time.Minute)
+	defer derivedCancel()
+	defer s.Close()
+
+	select {
+	case conn := <-s.conns:
+		// Because the client has contacted the test server successfully, count the test.
+		ndt5metrics.MeasurementServerAccept.WithLabelValues(ndt.Plain.String(), s.direction)
+		return conn, nil
+	case <-derivedCtx.Done():
+		return nil, errors.New("nil conn, nil err: " + derivedCtx.Err().Error())
+	}
+}
+
+func (s *muxServer) Close() {
+	s.once.Do(func() {
+		ndt5metrics.MeasurementServerStop.WithLabelValues(string(ndt.Plain)).Inc()
+		s.mux.mu.Lock()
+		delete(s.mux.waiting, s.token)
+		s.mux.mu.Unlock()
+		// Dispatch sends while holding the lock, so any connection it handed over
+		// is already buffered.
+		select {
+		case conn := <-s.conns:
+			conn.Close()
+		default:
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package singleserving
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+func TestMux(t *testing.T) {
+	m := NewMux(3001)
+	srv, err := m.Listen("c2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, ok := srv.(ndt.SharedPortServer)
+	if !ok {
+		t.Fatal("the server does not share a port")
+	}
+	if len(shared.Token()) != TokenLength {
+		t.Errorf("Token() = %q, want %d characters", shared.Token(), TokenLength)
+	}
+	body, err := protocol.Encode(protocol.TLV, ndt.PrepareMessage(srv))
+	if got, want := string(body), "3001 "+shared.Token(); err != nil || got != want {
+		t.Errorf("PrepareMessage() = %q, %v, want %q", got, err, want)
+	}
+
+	c, _ := net.Pipe()
+	conn := protocol.AdaptNetConn(c, c)
+	if m.Dispatch("wrong", conn) {
+		t.Error("Dispatch() with the wrong token succeeded")
+	}
+	if !m.Dispatch(shared.Token(), conn) {
+		t.Fatal("Dispatch() with the right token failed")
+	}
+	if m.Dispatch(shared.Token(), conn) {
+		t.Error("Dispatch() reused a token")
+	}
+	got, err := srv.ServeOnce(context.Background())
+	if err != nil || got != conn {
+		t.Errorf("ServeOnce() = %v, %v, want the dispatched connection", got, err)
+	}
+
+	// A closed server no longer waits for its connection.
+	srv, _ = m.Listen("s2c")
+	srv.Close()
+	if m.Dispatch(srv.(ndt.SharedPortServer).Token(), conn) {
+		t.Error("Dispatch() to a closed server succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := srv.ServeOnce(ctx); err == nil {
+		t.Error("ServeOnce() on a closed server succeeded")
+	}
+}
@@ -0,0 +1,81 @@
+package singleserving
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrPortRangeExhausted is returned when every port of the port range is in
+// use.
+var ErrPortRangeExhausted = errors.New("no free port in the port range")
+
+// PortRange is an inclusive range of ports. It implements flag.Value, so it
+// can be set from a string such as "10000-10100". The zero PortRange lets the
+// kernel choose any free port.
+type PortRange struct {
+	First, Last int
+	// next is the offset in the range of the port to try first, so that
+	// consecutive tests do not all contend for the lowest ports.
+	next uint32
+}
+
+var ports PortRange
+
+func init() {
+	flag.Var(&ports, "port-range", "The range of ports, such as 10000-10100, used by the single-serving servers of the ndt5 c2s, s2c, MID and SFW tests. By default any free port is used")
+}
+
+// Set parses a range of the form "first-last".
+func (r *PortRange) Set(s string) error {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("invalid port range %q: want first-last", s)
+	}
+	f, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	l, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil {
+		return fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if f <= 0 || l > 65535 || f > l {
+		return fmt.Errorf("invalid port range %q", s)
+	}
+	r.First, r.Last = f, l
+	return nil
+}
+
+// String returns the range as "first-last", or "" for the zero PortRange.
+func (r *PortRange) String() string {
+	if r.First == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// Listen listens with lc on a free TCP port of the range. It returns an error
+// wrapping ErrPortRangeExhausted if there is none.
+func (r *PortRange) Listen(lc *net.ListenConfig) (net.Listener, error) {
+	if r.First == 0 {
+		return lc.Listen(context.Background(), "tcp", ":0")
+	}
+	n := r.Last - r.First + 1
+	start := int(atomic.AddUint32(&r.next, 1)-1) % n
+	var err error
+	for i := 0; i < n; i++ {
+		port := r.First + (start+i)%n
+		var l net.Listener
+		l, err = lc.Listen(context.Background(), "tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s: %v", ErrPortRangeExhausted, r, err)
+}
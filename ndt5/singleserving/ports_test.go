@@ -0,0 +1,45 @@
+package singleserving
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestPortRange(t *testing.T) {
+	for _, bad := range []string{"", "10000", "a-b", "10100-10000", "0-10", "65000-70000"} {
+		var r PortRange
+		if err := r.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+
+	// Find a free port to build a one-port range.
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	want := fmt.Sprintf("%d-%d", port, port)
+	var r PortRange
+	if err := r.Set(want); err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != want {
+		t.Errorf("String() = %q, want %q", r.String(), want)
+	}
+	l, err = r.Listen(&net.ListenConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := l.Addr().(*net.TCPAddr).Port; got != port {
+		t.Errorf("Listen() used port %d, want %d", got, port)
+	}
+	if _, err := r.Listen(&net.ListenConfig{}); !errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("Listen() on a used range = %v, want ErrPortRangeExhausted", err)
+	}
+}
@@ -2,13 +2,15 @@ package singleserving
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
 	"net"
 	"net/http"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/m-lab/ndt-server/logging"
 	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
@@ -36,6 +38,9 @@ func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.newConnErr = err
 		return
 	}
+	if measured(s.direction) {
+		Tune(wsc.UnderlyingConn())
+	}
 	s.newConn = protocol.AdaptWsConn(wsc)
 	// The websocket upgrade process hijacks the connection. Only un-hijacked
 	// connections are terminated on server shutdown.
@@ -66,7 +71,7 @@ func (s *wsServer) ServeOnce(ctx context.Context) (protocol.MeasuredConnection,
 	// ensure that the race gets resolved in just one way for the following if().
 	err := closeErr
 	if s.newConn == nil && err != nil && err != http.ErrServerClosed {
-		log.Println("Server closed incorrectly:", err)
+		logging.Logger.WithError(err).Warn("Server closed incorrectly")
 		return nil, errors.New("Server did not close correctly")
 	}
 
@@ -118,7 +123,7 @@ func listenWS(direction string) (*wsServer, error) {
 	mux.Handle("/ndt_protocol", s)
 
 	// Start listening right away to ensure that subsequent connections succeed.
-	l, err := net.Listen("tcp", ":0")
+	l, err := ports.Listen(listenConfig(direction))
 	if err != nil {
 		return nil, err
 	}
@@ -129,10 +134,9 @@ func listenWS(direction string) (*wsServer, error) {
 }
 
 // wssServer is a single-serving server for encrypted websockets. A wssServer is
-// just a wsServer with a different start method and two extra fields.
+// just a wsServer with a different start method.
 type wssServer struct {
 	*wsServer
-	certFile, keyFile string
 }
 
 // ListenWSS starts a single-serving encrypted websocket server. When this method
@@ -141,20 +145,18 @@ type wssServer struct {
 // actually respond until ServeOnce() is called, but the connect() will not fail
 // as long as ServeOnce is called soon ("soon" is defined by os-level timeouts)
 // after this returns.
-func ListenWSS(direction, certFile, keyFile string) (ndt.SingleMeasurementServer, error) {
+// The server's certificates are those of config.
+func ListenWSS(direction string, config *tls.Config) (ndt.SingleMeasurementServer, error) {
 	ndt5metrics.MeasurementServerStart.WithLabelValues(string(ndt.WSS)).Inc()
 	ws, err := listenWS(direction)
 	if err != nil {
 		return nil, err
 	}
-	wss := wssServer{
-		wsServer: ws,
-		certFile: certFile,
-		keyFile:  keyFile,
-	}
+	wss := wssServer{wsServer: ws}
 	wss.kind = ndt.WSS
+	wss.srv.TLSConfig = config
 	wss.serve = func(l net.Listener) error {
-		return wss.srv.ServeTLS(l, wss.certFile, wss.keyFile)
+		return wss.srv.ServeTLS(l, "", "")
 	}
 	return &wss, nil
 }
@@ -194,6 +196,9 @@ func (ps *plainServer) ServeOnce(ctx context.Context) (protocol.MeasuredConnecti
 	if conn == nil {
 		return nil, errors.New("nil conn, nil err: " + derivedCtx.Err().Error())
 	}
+	if measured(ps.direction) {
+		Tune(conn)
+	}
 	// Because the client has contacted the test server successfully, count the test.
 	ndt5metrics.MeasurementServerAccept.WithLabelValues(ndt.Plain.String(), ps.direction)
 	return protocol.AdaptNetConn(conn, conn), nil
@@ -207,11 +212,28 @@ func (ps *plainServer) ServeOnce(ctx context.Context) (protocol.MeasuredConnecti
 // timeouts) after this returns.
 func ListenPlain(direction string) (ndt.SingleMeasurementServer, error) {
 	ndt5metrics.MeasurementServerStart.WithLabelValues(string(ndt.Plain)).Inc()
+	return listenPlain(listenConfig(direction), direction)
+}
+
+// ListenPlainMSS is like ListenPlain, but asks the kernel to use a maximum
+// segment size of mss for the accepted connection, so that the MID test can
+// detect middleboxes that rewrite it.
+func ListenPlainMSS(direction string, mss int) (ndt.SingleMeasurementServer, error) {
+	ndt5metrics.MeasurementServerStart.WithLabelValues(string(ndt.Plain)).Inc()
+	lc := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setMSS(c, mss)
+		},
+	}
+	return listenPlain(lc, direction)
+}
+
+func listenPlain(lc *net.ListenConfig, direction string) (*plainServer, error) {
 	// Start listening right away to ensure that subsequent connections succeed.
 	s := &plainServer{
 		direction: direction,
 	}
-	l, err := net.Listen("tcp", ":0")
+	l, err := ports.Listen(lc)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,68 @@
+package singleserving
+
+import (
+	"flag"
+	"net"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/privacy"
+)
+
+// socketOptions are set on the sockets of the c2s and s2c tests.
+var socketOptions = netx.SocketOptions{NoDelay: true}
+
+// ecn is whether the kernel is made to accept ECN on the test connections.
+var ecn bool
+
+func init() {
+	flag.IntVar(&socketOptions.SendBuffer, "ndt5.socket.sndbuf", 0, "The size in bytes of the send buffer (SO_SNDBUF) of the ndt5 c2s and s2c test sockets, which disables its autotuning. The kernel caps it at net.core.wmem_max. By default the kernel autotunes it")
+	flag.IntVar(&socketOptions.ReceiveBuffer, "ndt5.socket.rcvbuf", 0, "The size in bytes of the receive buffer (SO_RCVBUF) of the ndt5 c2s and s2c test sockets, which disables its autotuning. The kernel caps it at net.core.rmem_max. By default the kernel autotunes it")
+	flag.BoolVar(&socketOptions.NoDelay, "ndt5.socket.nodelay", true, "Whether to disable Nagle's algorithm (TCP_NODELAY) on the ndt5 c2s and s2c test sockets")
+	flag.IntVar(&socketOptions.NotSentLowat, "ndt5.socket.notsent-lowat", 0, "The TCP_NOTSENT_LOWAT of the ndt5 c2s and s2c test sockets: the number of unsent bytes below which the socket can be written to again. By default the kernel's net.ipv4.tcp_notsent_lowat is used")
+	flag.DurationVar(&socketOptions.KeepAliveIdle, "ndt5.socket.keepalive-idle", 0, "The idle time before the first TCP keepalive probe (TCP_KEEPIDLE) on the ndt5 c2s and s2c test sockets. By default 3m")
+	flag.DurationVar(&socketOptions.KeepAliveInterval, "ndt5.socket.keepalive-interval", 0, "The time between TCP keepalive probes (TCP_KEEPINTVL) on the ndt5 c2s and s2c test sockets. By default 3m")
+	flag.Var(&socketOptions.DSCP, "ndt5.socket.dscp", "The DSCP, from 0 to 63, that the packets of the ndt5 c2s and s2c tests are marked with, e.g. 8 for CS1, so that networks can classify them. It is recorded in the results. By default the packets are not marked")
+	flag.IntVar(&socketOptions.KeepAliveCount, "ndt5.socket.keepalive-count", 0, "The number of unanswered TCP keepalive probes (TCP_KEEPCNT) after which the ndt5 c2s and s2c test connections are dropped. By default the kernel's net.ipv4.tcp_keepalive_probes is used")
+	flag.BoolVar(&ecn, "ndt5.socket.ecn", false, "Whether to accept ECN on the connections of clients that ask for it. ECN can't be enabled per socket, so this sets net.ipv4.tcp_ecn to 2 at startup if it is 0, which needs CAP_NET_ADMIN, and applies to every connection of the network namespace. Whether the ndt5 c2s and s2c tests used ECN, and the CE marks seen, are recorded in the results either way")
+}
+
+// EnableECN makes the kernel accept ECN on the test connections, if
+// -ndt5.socket.ecn is set.
+func EnableECN() error {
+	if !ecn {
+		return nil
+	}
+	return netx.EnableECN()
+}
+
+// DSCP returns the DSCP that the packets of the c2s and s2c tests are marked
+// with, which is 0 if they are not marked.
+func DSCP() int {
+	return int(socketOptions.DSCP)
+}
+
+// measured reports whether the connections of the tests of direction carry
+// the measurement, and so get the socket options.
+func measured(direction string) bool {
+	return direction == "c2s" || direction == "s2c"
+}
+
+// listenConfig returns the ListenConfig of the server of the tests of
+// direction.
+func listenConfig(direction string) *net.ListenConfig {
+	if !measured(direction) {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: socketOptions.Control}
+}
+
+// Tune sets the socket options of the c2s and s2c tests on conn. It is called
+// for every measurement connection, including the ones that the control
+// server receives in single-port mode. Options that can't be set are logged,
+// and the test runs without them.
+func Tune(conn net.Conn) {
+	if err := socketOptions.Apply(conn); err != nil {
+		logging.Logger.WithError(err).WithField("remote_addr", privacy.Addr(conn.RemoteAddr().String())).Warn("Could not set the socket options of the test connection")
+	}
+}
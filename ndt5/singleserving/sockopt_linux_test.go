@@ -0,0 +1,41 @@
+package singleserving
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server/netx"
+	"golang.org/x/sys/unix"
+)
+
+func TestListenPlain_socketOptions(t *testing.T) {
+	defer func(o netx.SocketOptions) { socketOptions = o }(socketOptions)
+	socketOptions.ReceiveBuffer = 48 << 10
+	rcvbuf := func(direction string) int {
+		ps, err := listenPlain(listenConfig(direction), direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ps.listener.Close()
+		rc, err := ps.listener.(*netx.Listener).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		rc.Control(func(fd uintptr) {
+			v, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// The kernel doubles the buffer sizes for its bookkeeping.
+	for _, direction := range []string{"c2s", "s2c"} {
+		if got := rcvbuf(direction); got != 2*socketOptions.ReceiveBuffer {
+			t.Errorf("SO_RCVBUF of the %s server = %d, want %d", direction, got, 2*socketOptions.ReceiveBuffer)
+		}
+	}
+	if got := rcvbuf("sfw"); got == 2*socketOptions.ReceiveBuffer {
+		t.Errorf("the sfw server has the SO_RCVBUF of the measurement servers")
+	}
+}
@@ -0,0 +1,71 @@
+package ndt5
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+// Summary is the machine-readable form of the results, sent to the client as
+// a JSON object in the last MsgResults so that it doesn't have to parse the
+// human-readable ones. Rates are in kbps, like in the other results, and
+// times are in milliseconds.
+type Summary struct {
+	UUID          string
+	ServerVersion string
+	C2SRateKbps   float64 `json:",omitempty"`
+	S2CRateKbps   float64 `json:",omitempty"`
+	// ClientReportedS2CRateKbps is the download rate measured by the client.
+	ClientReportedS2CRateKbps float64 `json:",omitempty"`
+	// MinRTTMs and AvgRTTMs are the RTTs of the s2c test.
+	MinRTTMs float64 `json:",omitempty"`
+	AvgRTTMs float64 `json:",omitempty"`
+	// SmoothedRTTMs and RTTVarMs are the kernel's RTT estimate at the end of
+	// the s2c test.
+	SmoothedRTTMs float64 `json:",omitempty"`
+	RTTVarMs      float64 `json:",omitempty"`
+	// LossFraction is the fraction of the s2c data segments that were
+	// retransmitted.
+	LossFraction float64 `json:",omitempty"`
+	// RPM is the responsiveness under load measured during the s2c test, if
+	// the client asked for it.
+	RPM float64 `json:",omitempty"`
+}
+
+// newSummary returns the Summary of record.
+func newSummary(record *data.NDT5Result) *Summary {
+	s := &Summary{
+		UUID:          record.Control.UUID,
+		ServerVersion: record.Version,
+	}
+	if record.C2S != nil {
+		s.C2SRateKbps = record.C2S.MeanThroughputMbps * 1000
+	}
+	if r := record.S2C; r != nil {
+		s.S2CRateKbps = r.MeanThroughputMbps * 1000
+		s.ClientReportedS2CRateKbps = r.ClientReportedMbps * 1000
+		s.MinRTTMs = float64(r.MinRTT) / float64(time.Millisecond)
+		if r.CountRTT > 0 {
+			s.AvgRTTMs = float64(r.SumRTT) / float64(time.Millisecond) / float64(r.CountRTT)
+		}
+		if r.RTT != nil {
+			s.SmoothedRTTMs = float64(r.RTT.SmoothedRTT) / float64(time.Millisecond)
+			s.RTTVarMs = float64(r.RTT.RTTVar) / float64(time.Millisecond)
+		}
+		if r.Responsiveness != nil {
+			s.RPM = r.Responsiveness.RPM
+		}
+		if r.TCPInfo != nil && r.TCPInfo.DataSegsOut > 0 {
+			s.LossFraction = float64(r.TCPInfo.TotalRetrans) / float64(r.TCPInfo.DataSegsOut)
+		}
+	}
+	return s
+}
+
+// message returns the MsgResults message of s.
+func (s *Summary) message() *protocol.Results {
+	b, _ := json.Marshal(s)
+	return &protocol.Results{Text: string(b)}
+}
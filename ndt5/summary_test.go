@@ -0,0 +1,45 @@
+package ndt5
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt5/web100"
+)
+
+func TestSummary(t *testing.T) {
+	record := &data.NDT5Result{
+		Version: "v0.1.0",
+		Control: &control.ArchivalData{UUID: "test-uuid"},
+		C2S:     &c2s.ArchivalData{MeanThroughputMbps: 1.5},
+		S2C: &s2c.ArchivalData{
+			MeanThroughputMbps: 20,
+			MinRTT:             10 * time.Millisecond,
+			SumRTT:             60 * time.Millisecond,
+			CountRTT:           4,
+			RTT:                &web100.RTT{SmoothedRTT: 12500 * time.Microsecond, RTTVar: 2 * time.Millisecond},
+		},
+	}
+	got := &Summary{}
+	if err := json.Unmarshal([]byte(newSummary(record).message().Text), got); err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		UUID:          "test-uuid",
+		ServerVersion: "v0.1.0",
+		C2SRateKbps:   1500,
+		S2CRateKbps:   20000,
+		MinRTTMs:      10,
+		AvgRTTMs:      15,
+		SmoothedRTTMs: 12.5,
+		RTTVarMs:      2,
+	}
+	if *got != want {
+		t.Errorf("newSummary() = %+v, want %+v", *got, want)
+	}
+}
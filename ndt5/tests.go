@@ -0,0 +1,159 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/latency"
+	"github.com/m-lab/ndt-server/ndt5/meta"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/mid"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt5/sfw"
+)
+
+// Test is a test that clients may request in their login message.
+type Test struct {
+	// Bit is the test's bit in the login message.
+	Bit int
+	// Name names the test in metrics. The message of a failed test starts with
+	// its upper-case form.
+	Name string
+	// Supported reports whether s can run the test. A nil Supported means that
+	// every server can.
+	Supported func(s ndt.Server) bool
+	// Run runs the test over the control connection conn and saves its results
+	// in cfg.Record.
+	Run func(ctx context.Context, conn protocol.Connection, cfg *Config) error
+}
+
+// Config is everything besides the control connection that a test may need.
+type Config struct {
+	Server ndt.Server
+	Record *data.NDT5Result
+	// IsMon is "true" if the client is a monitoring client.
+	IsMon string
+	// S2C are the options of the s2c test that the client asked for.
+	S2C s2c.Options
+}
+
+// registry holds the tests in the order that they run.
+var registry []Test
+
+// Register adds t to the tests that clients may request. Tests run in the
+// order that they were registered. Register must be called before the server
+// starts, e.g. from an init function, and panics if t's bit is not a single
+// bit or is already used.
+func Register(t Test) {
+	if bits.OnesCount(uint(t.Bit)) != 1 || t.Bit == cTestStatus || t.Bit == cInterim || t.Bit == cResponsiveness {
+		panic(fmt.Sprintf("ndt5: invalid bit %d for test %q", t.Bit, t.Name))
+	}
+	for _, r := range registry {
+		if r.Bit == t.Bit {
+			panic(fmt.Sprintf("ndt5: test %q uses the bit %d of test %q", t.Name, t.Bit, r.Name))
+		}
+	}
+	registry = append(registry, t)
+}
+
+// plainOnly is the Supported function of the tests that only raw clients
+// implement, which need plain TCP connections.
+func plainOnly(s ndt.Server) bool {
+	return s.ConnectionType() == ndt.Plain
+}
+
+func init() {
+	Register(Test{Bit: cTestMID, Name: "mid", Supported: plainOnly, Run: runMID})
+	Register(Test{
+		Bit:       cTestSFW,
+		Name:      "sfw",
+		Supported: func(s ndt.Server) bool { return plainOnly(s) && *sfw.Enabled },
+		Run:       runSFW,
+	})
+	Register(Test{Bit: cTestC2S, Name: "c2s", Run: runC2S})
+	Register(Test{Bit: cTestS2C, Name: "s2c", Run: runS2C})
+	Register(Test{Bit: cTestMETA, Name: "meta", Run: runMeta})
+	Register(Test{
+		Bit:       cTestLatency,
+		Name:      "latency",
+		Supported: func(ndt.Server) bool { return latency.Current() != nil },
+		Run:       runLatency,
+	})
+}
+
+func runMID(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	var err error
+	connType := cfg.Server.ConnectionType().Label()
+	cfg.Record.MID, err = mid.ManageTest(ctx, conn, cfg.Server)
+	ndt5metrics.ClientTestResults.WithLabelValues(connType, "mid", metrics.GetResultLabel(err, cfg.Record.MID.MeanThroughputMbps)).Inc()
+	return err
+}
+
+func runSFW(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	var err error
+	connType := cfg.Server.ConnectionType().Label()
+	cfg.Record.SFW, err = sfw.ManageTest(ctx, conn, cfg.Server)
+	ndt5metrics.ClientTestResults.WithLabelValues(connType, "sfw", metrics.GetResultLabel(err, 0)).Inc()
+	return err
+}
+
+func runC2S(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	var err error
+	record := cfg.Record
+	connType := cfg.Server.ConnectionType().Label()
+	record.C2S, err = c2s.ManageTest(ctx, conn, cfg.Server)
+	if record.C2S != nil && record.C2S.MeanThroughputMbps != 0 {
+		rate := record.C2S.MeanThroughputMbps
+		metrics.ObserveTestRate(connType, "c2s", cfg.IsMon, record.C2S.UUID, rate)
+		metrics.ObserveASNTestRate("c2s", record.ClientASN, rate)
+	}
+	if record.C2S != nil && record.C2S.TCPInfo != nil {
+		metrics.ObserveTransfer(connType, "c2s", record.C2S.EndTime.Sub(record.C2S.StartTime), record.C2S.TCPInfo.BytesReceived)
+	}
+	r := metrics.GetResultLabel(err, record.C2S.MeanThroughputMbps)
+	ndt5metrics.ClientTestResults.WithLabelValues(connType, "c2s", r).Inc()
+	return err
+}
+
+func runS2C(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	var err error
+	record := cfg.Record
+	connType := cfg.Server.ConnectionType().Label()
+	record.S2C, err = s2c.ManageTest(ctx, conn, cfg.Server, cfg.S2C)
+	if record.S2C != nil && record.S2C.MeanThroughputMbps != 0 {
+		rate := record.S2C.MeanThroughputMbps
+		metrics.ObserveTestRate(connType, "s2c", cfg.IsMon, record.S2C.UUID, rate)
+		metrics.ObserveASNTestRate("s2c", record.ClientASN, rate)
+	}
+	if record.S2C != nil && record.S2C.TCPInfo != nil {
+		metrics.ObserveTransfer(connType, "s2c", record.S2C.EndTime.Sub(record.S2C.StartTime), record.S2C.TCPInfo.BytesAcked)
+	}
+	r := metrics.GetResultLabel(err, record.S2C.MeanThroughputMbps)
+	ndt5metrics.ClientTestResults.WithLabelValues(connType, "s2c", r).Inc()
+	return err
+}
+
+func runMeta(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	var err error
+	cfg.Record.Control.ClientMetadata, err = meta.ManageTest(ctx, conn.Messager(), cfg.Server)
+	return err
+}
+
+func runLatency(ctx context.Context, conn protocol.Connection, cfg *Config) error {
+	srv := latency.Current()
+	if srv == nil {
+		return errors.New("the latency server is not running")
+	}
+	var err error
+	connType := cfg.Server.ConnectionType().Label()
+	cfg.Record.Latency, err = latency.ManageTest(ctx, conn, cfg.Server, srv)
+	ndt5metrics.ClientTestResults.WithLabelValues(connType, "latency", metrics.GetResultLabel(err, 0)).Inc()
+	return err
+}
@@ -0,0 +1,22 @@
+package ndt5
+
+import "testing"
+
+func TestRegister(t *testing.T) {
+	for _, bit := range []int{0, 3, cTestStatus, cInterim, cResponsiveness, cTestC2S} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register() with bit %d did not panic", bit)
+				}
+			}()
+			Register(Test{Bit: bit, Name: "bad"})
+		}()
+	}
+	if got := panicMsgToErrType("SFW - Could not run sfw test"); got != "SFW" {
+		t.Errorf("panicMsgToErrType() = %q, want SFW", got)
+	}
+	if got := panicMsgToErrType("BAD - Could not run bad test"); got != "panic" {
+		t.Errorf("panicMsgToErrType() = %q, want panic", got)
+	}
+}
@@ -0,0 +1,167 @@
+package ndt5_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt5"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
+	"github.com/m-lab/ndt-server/ndt5/plain"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/ndt5/protocol/protocoltest"
+)
+
+// step is a message of a transcript, sent by the client or expected from the
+// server.
+type step struct {
+	line   int
+	client bool
+	kind   protocol.MessageType
+	body   string
+	// match, if not nil, matches the body expected from the server instead
+	// of body.
+	match *regexp.Regexp
+}
+
+// messageTypes maps the names of message types to the types.
+func messageTypes() map[string]protocol.MessageType {
+	types := map[string]protocol.MessageType{}
+	for t := 0; t < 256; t++ {
+		types[protocol.MessageType(t).String()] = protocol.MessageType(t)
+	}
+	return types
+}
+
+// parseTranscript parses a transcript of the control channel. Each of its
+// lines is a message sent by the client, "c TYPE BODY", a message expected
+// from the server, "s TYPE BODY", or one whose body matches a regular
+// expression, "s~ TYPE REGEXP". Bodies are quoted Go strings, which may be
+// raw strings. Empty lines and lines that start with '#' are ignored.
+func parseTranscript(name string) ([]step, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	types := messageTypes()
+	steps := []step{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want DIRECTION TYPE BODY", name, n)
+		}
+		kind, ok := types[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown message type %q", name, n, fields[1])
+		}
+		body, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: body %s is not quoted: %v", name, n, fields[2], err)
+		}
+		st := step{line: n, kind: kind, body: body}
+		switch fields[0] {
+		case "c":
+			st.client = true
+		case "s":
+		case "s~":
+			st.match, err = regexp.Compile(body)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown direction %q", name, n, fields[0])
+		}
+		steps = append(steps, st)
+	}
+	return steps, s.Err()
+}
+
+// readMessage reads a message from the client's end of the control channel.
+func readMessage(r io.Reader) (protocol.MessageType, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	body := make([]byte, int(header[1])<<8+int(header[2]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", err
+	}
+	return protocol.MessageType(header[0]), string(body), nil
+}
+
+// replay runs the control channel of a raw server, plays the client's side of
+// steps, and checks the server's side. The server must close the connection
+// once the steps are over.
+func replay(t *testing.T, steps []step) {
+	srv := plain.NewServer(t.TempDir(), "127.0.0.1:1", []metadata.NameValue{}, nil, nil, nil, nil, nil, nil).(ndt.Server)
+	conn, client := protocoltest.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ndt5.HandleControlChannel(ctx, conn, srv, "false")
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	for _, st := range steps {
+		if st.client {
+			frame := append([]byte{byte(st.kind), byte(len(st.body) >> 8), byte(len(st.body))}, st.body...)
+			if _, err := client.Write(frame); err != nil {
+				t.Fatalf("line %d: could not send %s: %v", st.line, st.kind, err)
+			}
+			continue
+		}
+		kind, body, err := readMessage(client)
+		if err != nil {
+			t.Fatalf("line %d: could not receive %s: %v", st.line, st.kind, err)
+		}
+		if kind != st.kind {
+			t.Fatalf("line %d: received %s %q, want %s", st.line, kind, body, st.kind)
+		}
+		if st.match != nil && !st.match.MatchString(body) {
+			t.Errorf("line %d: received %s %q, want a match of %q", st.line, kind, body, st.match)
+		} else if st.match == nil && body != st.body {
+			t.Errorf("line %d: received %s %q, want %q", st.line, kind, body, st.body)
+		}
+	}
+	if kind, body, err := readMessage(client); err == nil {
+		t.Errorf("received %s %q after the end of the transcript", kind, body)
+	}
+	<-done
+}
+
+// TestTranscripts replays the transcripts of the control channels of known
+// clients in testdata/transcripts. Their tests run over the control channel,
+// and the transcripts of WebSocket clients are replayed over a raw connection,
+// whose messages are framed the same way.
+func TestTranscripts(t *testing.T) {
+	files, err := filepath.Glob("testdata/transcripts/*.txt")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no transcripts: %v", err)
+	}
+	for _, name := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(name), ".txt"), func(t *testing.T) {
+			steps, err := parseTranscript(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replay(t, steps)
+		})
+	}
+}
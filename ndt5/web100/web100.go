@@ -3,7 +3,48 @@
 // it only needs to measure once.
 package web100
 
-import "github.com/m-lab/tcp-info/tcp"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// Snapshot is a single TCP_INFO sample taken while measuring. BBRInfo is only
+// set if the connection uses BBR.
+type Snapshot struct {
+	Time    time.Time
+	TCPInfo tcp.LinuxTCPInfo
+	BBRInfo *inetdiag.BBRInfo
+}
+
+// Latest holds the most recent Snapshot taken while measuring, so that it can
+// be reported before the measurement is over. A nil *Latest holds nothing.
+type Latest struct {
+	mu   sync.Mutex
+	snap *Snapshot
+}
+
+func (l *Latest) set(s Snapshot) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.snap = &s
+}
+
+// Get returns the most recent Snapshot, or nil if none was taken yet.
+func (l *Latest) Get() *Snapshot {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snap
+}
 
 // Metrics holds web100 data. According to the NDT5 protocol, each of these
 // metrics is required. That does not mean each is required to be non-zero, but
@@ -26,4 +67,128 @@ type Metrics struct {
 	// Useful metrics that are not part of the required set.
 	BytesPerSecond float64
 	TCPInfo        tcp.LinuxTCPInfo
+	// BBRInfo is the last BBR sample, or nil if the connection did not use BBR.
+	BBRInfo *inetdiag.BBRInfo
+
+	// Snapshots holds every sample taken, in order.
+	Snapshots []Snapshot
+}
+
+// Retransmissions are the loss and retransmission counters of a connection's
+// last TCP_INFO snapshot. They are the server's counters: for a connection
+// that the client sends data over, they count the server's ACKs, not the data.
+type Retransmissions struct {
+	TotalRetrans uint32
+	Lost         uint32
+	SegsOut      uint32
+	SegsIn       uint32
+	DataSegsOut  uint32
+	DataSegsIn   uint32
+	// RetransRate is the fraction of the data segments sent that were
+	// retransmissions.
+	RetransRate float64
+}
+
+// NewRetransmissions returns the Retransmissions of info, or nil if info is
+// nil.
+func NewRetransmissions(info *tcp.LinuxTCPInfo) *Retransmissions {
+	if info == nil {
+		return nil
+	}
+	r := &Retransmissions{
+		TotalRetrans: info.TotalRetrans,
+		Lost:         info.Lost,
+		SegsOut:      uint32(info.SegsOut),
+		SegsIn:       uint32(info.SegsIn),
+		DataSegsOut:  info.DataSegsOut,
+		DataSegsIn:   info.DataSegsIn,
+	}
+	if r.DataSegsOut > 0 {
+		r.RetransRate = float64(r.TotalRetrans) / float64(r.DataSegsOut)
+	}
+	return r
+}
+
+// ResultsMessage returns r in the "name: value" form of the other results
+// sent to the client at the end of the tests, with names that start with
+// prefix, e.g. "S2C.".
+func (r *Retransmissions) ResultsMessage(prefix string) string {
+	return fmt.Sprintf("%sTotalRetrans: %d\n%sLost: %d\n%sRetransRate: %.4f\n",
+		prefix, r.TotalRetrans, prefix, r.Lost, prefix, r.RetransRate)
+}
+
+// RTT is the kernel's estimate of a connection's round-trip time in its last
+// TCP_INFO snapshot.
+type RTT struct {
+	// MinRTT is tcpi_min_rtt, the minimum RTT over the connection's lifetime.
+	MinRTT time.Duration
+	// SmoothedRTT is tcpi_rtt, and RTTVar is tcpi_rttvar, its variation.
+	SmoothedRTT time.Duration
+	RTTVar      time.Duration
+}
+
+// NewRTT returns the RTT of info, or nil if info is nil.
+func NewRTT(info *tcp.LinuxTCPInfo) *RTT {
+	if info == nil {
+		return nil
+	}
+	return &RTT{
+		MinRTT:      time.Duration(info.MinRTT) * time.Microsecond,
+		SmoothedRTT: time.Duration(info.RTT) * time.Microsecond,
+		RTTVar:      time.Duration(info.RTTVar) * time.Microsecond,
+	}
+}
+
+// ResultsMessage returns r in the "name: value" form of the other results
+// sent to the client at the end of the tests, with names that start with
+// prefix, e.g. "S2C.". Times are in milliseconds.
+func (r *RTT) ResultsMessage(prefix string) string {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return fmt.Sprintf("%sMinRTT: %.3f\n%sSmoothedRTT: %.3f\n%sRTTVar: %.3f\n",
+		prefix, ms(r.MinRTT), prefix, ms(r.SmoothedRTT), prefix, ms(r.RTTVar))
+}
+
+// The tcpi_options bits of ECN.
+const (
+	optECN     = 8  // TCPI_OPT_ECN
+	optECNSeen = 16 // TCPI_OPT_ECN_SEEN
+)
+
+// ECN is whether a connection used Explicit Congestion Notification, and the
+// congestion it signaled, in its last TCP_INFO snapshot.
+type ECN struct {
+	// Negotiated is whether the client and the server agreed to use ECN.
+	Negotiated bool
+	// ECTSeen is whether the server received packets marked ECN-capable.
+	ECTSeen bool
+	// DeliveredCE is tcpi_delivered_ce, the number of packets sent by the
+	// server that the client reported as marked Congestion Experienced. The
+	// kernel only counts the marks on the packets it sends, so it is 0 for a
+	// connection that the client sends data over.
+	DeliveredCE uint32
+}
+
+// NewECN returns the ECN of info, or nil if info is nil.
+func NewECN(info *tcp.LinuxTCPInfo) *ECN {
+	if info == nil {
+		return nil
+	}
+	return &ECN{
+		Negotiated:  info.Options&optECN != 0,
+		ECTSeen:     info.Options&optECNSeen != 0,
+		DeliveredCE: info.DeliveredCE,
+	}
+}
+
+// ResultsMessage returns e in the "name: value" form of the other results
+// sent to the client at the end of the tests, with names that start with
+// prefix, e.g. "S2C.". Booleans are 0 or 1.
+func (e *ECN) ResultsMessage(prefix string) string {
+	b := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	return fmt.Sprintf("%sECN: %d\n%sECNDeliveredCE: %d\n", prefix, b(e.Negotiated), prefix, e.DeliveredCE)
 }
@@ -3,22 +3,23 @@ package web100
 import (
 	"context"
 	"errors"
-	"log"
 	"time"
 
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/netx"
-	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/inetdiag"
 )
 
-func summarize(snaps []tcp.LinuxTCPInfo) (*Metrics, error) {
-	if len(snaps) == 0 {
+func summarize(samples []Snapshot) (*Metrics, error) {
+	if len(samples) == 0 {
 		return nil, errors.New("zero-length list of data collected")
 	}
 	sumrtt := uint32(0)
 	countrtt := uint32(0)
 	maxrtt := uint32(0)
 	minrtt := uint32(0)
-	for _, snap := range snaps {
+	for _, sample := range samples {
+		snap := sample.TCPInfo
 		countrtt++
 		sumrtt += snap.RTT
 		if snap.RTT < minrtt || minrtt == 0 {
@@ -28,9 +29,11 @@ func summarize(snaps []tcp.LinuxTCPInfo) (*Metrics, error) {
 			maxrtt = snap.RTT
 		}
 	}
-	lastSnap := snaps[len(snaps)-1]
+	lastSnap := samples[len(samples)-1].TCPInfo
 	info := &Metrics{
-		TCPInfo: snaps[len(snaps)-1], // Save the last snapshot of TCPInfo data into the metric struct.
+		TCPInfo:   lastSnap, // Save the last snapshot of TCPInfo data into the metric struct.
+		BBRInfo:   samples[len(samples)-1].BBRInfo,
+		Snapshots: samples,
 
 		MinRTT: minrtt / 1000, // tcpinfo is microsecond data, web100 needs milliseconds
 		MaxRTT: maxrtt / 1000, // tcpinfo is microsecond data, web100 needs milliseconds
@@ -45,18 +48,19 @@ func summarize(snaps []tcp.LinuxTCPInfo) (*Metrics, error) {
 		// If we are using web100 variables to measure terabit connections then
 		// something has gone horribly wrong. Please switch to NDT7+tcpinfo or
 		// whatever their successor is.
-		PktsOut: uint32(lastSnap.SegsOut),
+		PktsOut:     uint32(lastSnap.SegsOut),
+		PktsRetrans: lastSnap.TotalRetrans,
 	}
 	return info, nil
 }
 
-func measureUntilContextCancellation(ctx context.Context, ci netx.ConnInfo) (*Metrics, error) {
+func measureUntilContextCancellation(ctx context.Context, ci netx.ConnInfo, latest *Latest) (*Metrics, error) {
 	ticker := time.NewTicker(100 * time.Millisecond)
 	// We need to make sure fp is closed when the polling loop ends to ensure legacy
 	// clients work. See https://github.com/m-lab/ndt-server/issues/160.
 	defer ticker.Stop()
 
-	snaps := make([]tcp.LinuxTCPInfo, 0, 200) // Enough space for 20 seconds of data.
+	snaps := make([]Snapshot, 0, 200) // Enough space for 20 seconds of data.
 
 	// Poll until the context is canceled, but never more than once per ticker-firing.
 	//
@@ -66,11 +70,17 @@ func measureUntilContextCancellation(ctx context.Context, ci netx.ConnInfo) (*Me
 	// case the most recent measurement should count as the last measurement).
 	for ; ctx.Err() == nil; <-ticker.C {
 		// Get the tcp_cc metrics
-		_, snapshot, err := ci.ReadInfo()
+		bbrinfo, snapshot, err := ci.ReadInfo()
 		if err == nil {
-			snaps = append(snaps, snapshot)
+			snap := Snapshot{Time: time.Now(), TCPInfo: snapshot}
+			// ReadInfo returns an empty BBRInfo unless BBR is enabled.
+			if bbrinfo != (inetdiag.BBRInfo{}) {
+				snap.BBRInfo = &bbrinfo
+			}
+			snaps = append(snaps, snap)
+			latest.set(snap)
 		} else {
-			log.Println("Getsockopt error:", err)
+			logging.Logger.WithError(err).Warn("Getsockopt error")
 		}
 	}
 	return summarize(snaps)
@@ -79,14 +89,15 @@ func measureUntilContextCancellation(ctx context.Context, ci netx.ConnInfo) (*Me
 // MeasureViaPolling collects all required data by polling and returns a channel
 // for the results. This function may or may not send socket information along
 // the channel, depending on whether or not an error occurred. The value is sent
-// along the channel sometime after the context is canceled.
-func MeasureViaPolling(ctx context.Context, ci netx.ConnInfo) <-chan *Metrics {
+// along the channel sometime after the context is canceled. Every sample is
+// also stored in latest, which may be nil.
+func MeasureViaPolling(ctx context.Context, ci netx.ConnInfo, latest *Latest) <-chan *Metrics {
 	// Give a capacity of 1 because we will only ever send one message and the
 	// buffer allows the component goroutine to exit when done, no matter what the
 	// client does.
 	c := make(chan *Metrics, 1)
 	go func() {
-		summary, err := measureUntilContextCancellation(ctx, ci)
+		summary, err := measureUntilContextCancellation(ctx, ci, latest)
 		if err == nil {
 			c <- summary
 		}
@@ -1,3 +1,4 @@
+//go:build !linux
 // +build !linux
 
 package web100
@@ -10,7 +11,7 @@ import (
 
 // MeasureViaPolling collects all required data by polling. It is required for
 // non-BBR connections because MinRTT is one of our critical metrics.
-func MeasureViaPolling(ctx context.Context, ci netx.ConnInfo) <-chan *Metrics {
+func MeasureViaPolling(ctx context.Context, ci netx.ConnInfo, latest *Latest) <-chan *Metrics {
 	// Just a stub.
 	return nil
 }
@@ -0,0 +1,56 @@
+package web100
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestNewRetransmissions(t *testing.T) {
+	if NewRetransmissions(nil) != nil {
+		t.Error("NewRetransmissions(nil) != nil")
+	}
+	r := NewRetransmissions(&tcp.LinuxTCPInfo{TotalRetrans: 5, Lost: 2, DataSegsOut: 200})
+	if r.RetransRate != 0.025 {
+		t.Errorf("RetransRate = %v, want 0.025", r.RetransRate)
+	}
+	want := "S2C.TotalRetrans: 5\nS2C.Lost: 2\nS2C.RetransRate: 0.0250\n"
+	if got := r.ResultsMessage("S2C."); got != want {
+		t.Errorf("ResultsMessage() = %q, want %q", got, want)
+	}
+	if r := NewRetransmissions(&tcp.LinuxTCPInfo{}); r.RetransRate != 0 {
+		t.Errorf("RetransRate without data = %v, want 0", r.RetransRate)
+	}
+}
+
+func TestNewRTT(t *testing.T) {
+	if NewRTT(nil) != nil {
+		t.Error("NewRTT(nil) != nil")
+	}
+	r := NewRTT(&tcp.LinuxTCPInfo{MinRTT: 9000, RTT: 12500, RTTVar: 1500})
+	if r.MinRTT != 9*time.Millisecond || r.SmoothedRTT != 12500*time.Microsecond || r.RTTVar != 1500*time.Microsecond {
+		t.Errorf("NewRTT() = %+v", r)
+	}
+	want := "C2S.MinRTT: 9.000\nC2S.SmoothedRTT: 12.500\nC2S.RTTVar: 1.500\n"
+	if got := r.ResultsMessage("C2S."); got != want {
+		t.Errorf("ResultsMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestNewECN(t *testing.T) {
+	if NewECN(nil) != nil {
+		t.Error("NewECN(nil) != nil")
+	}
+	e := NewECN(&tcp.LinuxTCPInfo{Options: optECN | optECNSeen | 4, DeliveredCE: 17})
+	if !e.Negotiated || !e.ECTSeen || e.DeliveredCE != 17 {
+		t.Errorf("NewECN() = %+v", e)
+	}
+	want := "S2C.ECN: 1\nS2C.ECNDeliveredCE: 17\n"
+	if got := e.ResultsMessage("S2C."); got != want {
+		t.Errorf("ResultsMessage() = %q, want %q", got, want)
+	}
+	if e := NewECN(&tcp.LinuxTCPInfo{Options: 4}); e.Negotiated || e.ECTSeen {
+		t.Errorf("NewECN() without ECN = %+v", e)
+	}
+}
@@ -1,12 +1,32 @@
 package ws
 
 import (
+	"flag"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var allowedOrigins = flag.String("ndt5.ws.allowed-origins", "", "Comma-separated web origins, such as https://www.example.org, whose pages may run ndt5 WS and WSS tests. A * in place of the leading labels of a hostname matches any subdomain, e.g. https://*.example.org, and a lone * matches any origin. Clients that send no Origin header, such as non-browser clients, are always allowed. Empty means any origin")
+
+// origins holds the -ndt5.ws.allowed-origins patterns once they are loaded.
+var origins atomic.Pointer[[]string]
+
+// LoadAllowedOrigins makes CheckOrigin use the current value of the
+// -ndt5.ws.allowed-origins flag. It must be called once the flags are parsed,
+// and again whenever the flag is changed, because requests never read the
+// flag itself. Until then, every origin is allowed.
+func LoadAllowedOrigins() {
+	var patterns []string
+	if *allowedOrigins != "" {
+		patterns = strings.Split(*allowedOrigins, ",")
+	}
+	origins.Store(&patterns)
+}
+
 // Upgrader returns a struct that can hijack an HTTP(S) connection into a WS(S)
 // connection.
 func Upgrader(protocol string) *websocket.Upgrader {
@@ -16,9 +36,34 @@ func Upgrader(protocol string) *websocket.Upgrader {
 		Subprotocols:      []string{protocol},
 		EnableCompression: false,
 		HandshakeTimeout:  10 * time.Second,
-		CheckOrigin: func(r *http.Request) bool {
-			// TODO: make this check more appropriate -- added to get initial html5 widget to work.
+		CheckOrigin:       CheckOrigin,
+	}
+}
+
+// CheckOrigin reports whether the Origin of r is allowed by the
+// -ndt5.ws.allowed-origins flag, as of the last LoadAllowedOrigins.
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	patterns := origins.Load()
+	if origin == "" || patterns == nil || len(*patterns) == 0 {
+		return true
+	}
+	return originAllowed(origin, *patterns)
+}
+
+// originAllowed reports whether origin matches any of patterns.
+func originAllowed(origin string, patterns []string) bool {
+	origin = strings.ToLower(origin)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "*" || p == origin {
+			return true
+		}
+		// https://*.example.org matches https://www.example.org.
+		scheme, host, ok := strings.Cut(p, "://*.")
+		if ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
 			return true
-		},
+		}
 	}
+	return false
 }
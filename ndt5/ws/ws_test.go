@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	patterns := []string{"https://www.example.org", "https://*.example.com", "http://localhost:8080"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://www.example.org", true},
+		{"HTTPS://WWW.EXAMPLE.ORG", true},
+		{"https://example.org", false},
+		{"http://www.example.org", false},
+		{"https://a.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"http://a.example.com", false},
+		{"https://evilexample.com", false},
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, patterns); got != tt.want {
+			t.Errorf("originAllowed(%q) = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+	if !originAllowed("https://anything.example", []string{"*"}) {
+		t.Error("* did not match any origin")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	defer func(o string) {
+		*allowedOrigins = o
+		LoadAllowedOrigins()
+	}(*allowedOrigins)
+	r := httptest.NewRequest(http.MethodGet, "/ndt_protocol", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	*allowedOrigins = "https://www.example.org"
+	if !CheckOrigin(r) {
+		t.Error("origins should be allowed until they are loaded")
+	}
+	LoadAllowedOrigins()
+	if CheckOrigin(r) {
+		t.Error("an origin that is not allowed was accepted")
+	}
+	*allowedOrigins = ""
+	LoadAllowedOrigins()
+	if !CheckOrigin(r) {
+		t.Error("every origin should be allowed without patterns")
+	}
+}
@@ -68,9 +68,12 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData,
 	}
 
 	// Record measurement start time, and prepare recording of the endtime on return.
-	data.StartTime = time.Now().UTC()
+	// The end time is measured with the monotonic clock of start, so that it
+	// is not affected by steps of the wall clock.
+	start := time.Now()
+	data.StartTime = start.UTC()
 	defer func() {
-		data.EndTime = time.Now().UTC()
+		data.EndTime = data.StartTime.Add(time.Since(start))
 	}()
 	var totalSent int64
 	for {
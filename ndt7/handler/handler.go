@@ -18,6 +18,8 @@ import (
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/warnonerror"
 	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/live"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/metrics"
@@ -25,10 +27,12 @@ import (
 	"github.com/m-lab/ndt-server/ndt7/download/sender"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
-	"github.com/m-lab/ndt-server/ndt7/results"
+	ndt7results "github.com/m-lab/ndt-server/ndt7/results"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/ndt7/upload"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/forwarded"
+	"github.com/m-lab/ndt-server/results"
 	"github.com/m-lab/ndt-server/version"
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/tcp-info/inetdiag"
@@ -48,6 +52,15 @@ type Handler struct {
 	CompressResults bool
 	// Events is for reporting new connections to the event server.
 	Events eventsocket.Server
+	// Results, if not nil, is used to save every result in addition to the
+	// per-test files in DataDir.
+	Results results.Writer
+	// Locator, if not nil, is used to annotate results with the client's
+	// location.
+	Locator *geoip.Locator
+	// Running, if not nil, registers the running subtests so that they can
+	// be listed and canceled.
+	Running *live.Registry
 }
 
 // warnAndClose emits message as a warning and the sends a Bad Request
@@ -78,6 +91,19 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 		return
 	}
 
+	// Apply the country policy before upgrading, so that the client can be
+	// told why it is turned away.
+	clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	decision, country := h.Locator.Decide(h.Locator.Locate(clientIP))
+	metrics.CountryDecisions.WithLabelValues("ndt7", country, string(decision)).Inc()
+	if decision != geoip.Admit {
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "country-"+string(decision)).Inc()
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte(decision.Explanation()))
+		return
+	}
+
 	// Setup websocket connection.
 	conn := setupConn(rw, req)
 	if conn == nil {
@@ -111,12 +137,36 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 	data.ServerMetadata = h.ServerMetadata
 	// Create ultimate result.
 	result, id := setupResult(conn)
-	result.StartTime = time.Now().UTC()
+	if client := forwarded.FromContext(req.Context()); client != nil {
+		// Record the client behind a trusted proxy. The socket ID still
+		// refers to the proxy's connection, which is the one being measured.
+		result.ClientIP, result.ClientPort = client.IP.String(), client.Port
+	}
+	// Canceling the subtest closes the connection.
+	test := h.Running.Add(data.UUID, result.ClientIP, ndt7metrics.ConnLabel(conn), cancel)
+	defer test.Done()
+	ci := netx.ToConnInfo(conn.UnderlyingConn())
+	test.Measure(string(kind), func() int64 {
+		_, info, err := ci.ReadInfo()
+		if err != nil {
+			return 0
+		}
+		if kind == spec.SubtestUpload {
+			return info.BytesReceived
+		}
+		return info.BytesAcked
+	})
+	result.ClientGeo = h.Locator.Locate(result.ClientIP)
+	result.ClientASN = h.Locator.ASN(result.ClientIP)
+	// The UTC times have no monotonic clock reading, so durations are
+	// measured from start, whose wall clock may step during the test.
+	start := time.Now()
+	result.StartTime = start.UTC()
 	h.Events.FlowCreated(result.StartTime, data.UUID, id)
 
 	// Guarantee results are written even if subtest functions panic.
 	defer func() {
-		result.EndTime = time.Now().UTC()
+		result.EndTime = result.StartTime.Add(time.Since(start))
 		h.writeResult(data.UUID, kind, result)
 		h.Events.FlowDeleted(result.EndTime, data.UUID)
 	}()
@@ -134,12 +184,16 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 	}
 
 	proto := ndt7metrics.ConnLabel(conn)
+	if bytes := transferred(kind, data.ServerMeasurements); bytes > 0 {
+		metrics.ObserveTransfer(proto, string(kind), time.Since(start), bytes)
+	}
 	ndt7metrics.ClientTestResults.WithLabelValues(
 		proto, string(kind), metrics.GetResultLabel(err, rate)).Inc()
 	if rate > 0 {
 		isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(req.Context())))
 		// Update the common (ndt5+ndt7) measurement rates histogram.
-		metrics.TestRate.WithLabelValues(proto, string(kind), isMon).Observe(rate)
+		metrics.ObserveTestRate(proto, string(kind), isMon, data.UUID, rate)
+		metrics.ObserveASNTestRate(string(kind), result.ClientASN, rate)
 	}
 }
 
@@ -201,7 +255,19 @@ func setupResult(conn *websocket.Conn) (*data.NDT7Result, inetdiag.SockID) {
 }
 
 func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *data.NDT7Result) {
-	fp, err := results.NewFile(uuid, h.DataDir, kind, h.CompressResults)
+	result = result.Anonymized()
+	if h.Results != nil {
+		err := h.Results.Write(context.Background(), &results.Result{
+			Datatype:  "ndt7",
+			UUID:      uuid,
+			StartTime: result.StartTime,
+			Data:      result,
+		})
+		if err != nil {
+			logging.Logger.WithError(err).Warn("failed to write result")
+		}
+	}
+	fp, err := ndt7results.NewFile(uuid, h.DataDir, kind, h.CompressResults)
 	if err != nil {
 		logging.Logger.WithError(err).Warn("results.NewFile failed")
 		return
@@ -235,6 +301,19 @@ func upRate(m []model.Measurement) float64 {
 	return mbps
 }
 
+// transferred returns the number of bytes sent by the sender of the subtest,
+// according to the last TCPInfo measurement.
+func transferred(kind spec.SubtestKind, m []model.Measurement) int64 {
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	if len(m) == 0 || m[len(m)-1].TCPInfo == nil {
+		return 0
+	}
+	if kind == spec.SubtestUpload {
+		return m[len(m)-1].TCPInfo.BytesReceived
+	}
+	return m[len(m)-1].TCPInfo.BytesAcked
+}
+
 func downRate(m []model.Measurement) float64 {
 	var mbps float64
 	// NOTE: on non-Linux platforms, TCPInfo will be nil.
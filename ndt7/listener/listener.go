@@ -14,8 +14,10 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/netx/proxyproto"
 )
 
 var logFatalf = log.Fatalf
@@ -40,8 +42,22 @@ func serve(server *http.Server, listener net.Listener) {
 // server.Addr is set to :0, then after this function returns server.Addr will
 // contain the address and port which this server is listening on.
 func ListenAndServeAsync(server *http.Server) error {
+	return listenAndServeAsync(server, func(l net.Listener) net.Listener { return l })
+}
+
+// ListenAndServeLocalProxyAsync is like ListenAndServeAsync, but the
+// connections that the host makes to the server may start with a PROXY
+// protocol header, which is read within timeout and gives the address of the
+// client that they forward. See proxyproto.LocalListener.
+func ListenAndServeLocalProxyAsync(server *http.Server, timeout time.Duration) error {
+	return listenAndServeAsync(server, func(l net.Listener) net.Listener {
+		return &proxyproto.LocalListener{Listener: l, Timeout: timeout}
+	})
+}
+
+func listenAndServeAsync(server *http.Server, wrap func(net.Listener) net.Listener) error {
 	// Start listening synchronously.
-	listener, err := net.Listen("tcp", server.Addr)
+	listener, err := netx.Listen(server.Addr)
 	if err != nil {
 		return err
 	}
@@ -51,7 +67,7 @@ func ListenAndServeAsync(server *http.Server) error {
 		server.Addr = listener.Addr().String()
 	}
 	// Serve asynchronously.
-	go serve(server, netx.NewListener(listener.(*net.TCPListener)))
+	go serve(server, wrap(netx.NewListener(listener)))
 	return nil
 }
 
@@ -72,7 +88,7 @@ func serveTLS(server *http.Server, listener net.Listener, certFile, keyFile stri
 // fatal error if the server dies for a reason besides ErrServerClosed.
 func ListenAndServeTLSAsync(server *http.Server, certFile, keyFile string) error {
 	// Start listening synchronously.
-	listener, err := net.Listen("tcp", server.Addr)
+	listener, err := netx.Listen(server.Addr)
 	if err != nil {
 		return err
 	}
@@ -87,6 +103,6 @@ func ListenAndServeTLSAsync(server *http.Server, certFile, keyFile string) error
 	// do nothing in an attempt to avoid making a bad situation worse.
 
 	// Serve asynchronously.
-	go serveTLS(server, netx.NewListener(listener.(*net.TCPListener)), certFile, keyFile)
+	go serveTLS(server, netx.NewListener(listener), certFile, keyFile)
 	return nil
 }
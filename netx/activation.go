@@ -0,0 +1,112 @@
+package netx
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/m-lab/ndt-server/logging"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, after stdin, stdout, and stderr.
+const listenFDsStart = 3
+
+// activation holds the listening sockets passed by systemd that were not yet
+// claimed by Listen.
+var activation struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []*net.TCPListener
+	err       error
+}
+
+// inherit returns the listening sockets passed to this process with the
+// LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES environment variables of systemd
+// socket activation, starting at the file descriptor first. The variables are
+// removed from the environment, so they are not passed on to child processes.
+func inherit(first int) ([]*net.TCPListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		// The sockets, if any, were meant for another process.
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var listeners []*net.TCPListener
+	for i := 0; i < n; i++ {
+		fd := first + i
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener uses a copy of the file descriptor.
+		f.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("socket %s is not a listening socket: %v", name, err)
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return listeners, fmt.Errorf("socket %s is not a TCP socket", name)
+		}
+		listeners = append(listeners, tl)
+	}
+	return listeners, nil
+}
+
+// matches reports whether a socket bound to a can serve the address addr, as
+// given to net.Listen. Sockets bound to any address match the addresses
+// without a host, or with an unspecified one.
+func matches(a *net.TCPAddr, addr string) bool {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || want.Port == 0 || want.Port != a.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return true
+	}
+	return want.IP.Equal(a.IP)
+}
+
+// Listen returns a TCP listener on addr. When the server runs under systemd
+// socket activation, the listening socket passed by systemd for the port of
+// addr is used, so that the socket outlives restarts of the server. Otherwise
+// a new socket is opened.
+func Listen(addr string) (*net.TCPListener, error) {
+	activation.once.Do(func() {
+		activation.listeners, activation.err = inherit(listenFDsStart)
+	})
+	activation.mu.Lock()
+	defer activation.mu.Unlock()
+	if activation.err != nil {
+		return nil, activation.err
+	}
+	for i, l := range activation.listeners {
+		if matches(l.Addr().(*net.TCPAddr), addr) {
+			activation.listeners = append(activation.listeners[:i], activation.listeners[i+1:]...)
+			logging.Logger.WithField("addr", l.Addr().String()).Info("Using the listening socket passed by systemd")
+			return l, nil
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
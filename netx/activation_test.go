@@ -0,0 +1,91 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func Test_matches(t *testing.T) {
+	wildcard := &net.TCPAddr{IP: net.IPv6unspecified, Port: 3001}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3002}
+	tests := []struct {
+		a    *net.TCPAddr
+		addr string
+		want bool
+	}{
+		{wildcard, ":3001", true},
+		{wildcard, "[::]:3001", true},
+		{wildcard, "0.0.0.0:3001", true},
+		{wildcard, ":3002", false},
+		{local, "127.0.0.1:3002", true},
+		{local, ":3002", true},
+		{local, "10.0.0.1:3002", false},
+		{local, "127.0.0.1:0", false},
+		{local, "not an address", false},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.a, tt.addr); got != tt.want {
+			t.Errorf("matches(%v, %q) = %v, want %v", tt.a, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func Test_inherit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inherit takes ownership of the file descriptor, as it does of the ones
+	// passed by systemd.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if listeners, err := inherit(fd); err != nil || len(listeners) != 0 {
+		t.Fatalf("inherit() = %v, %v, want no sockets for another process", listeners, err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "ndt5")
+	listeners, err := inherit(fd)
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("inherit() = %v, %v, want one socket", listeners, err)
+	}
+	defer listeners[0].Close()
+	if got := listeners[0].Addr().String(); got != ln.Addr().String() {
+		t.Errorf("inherit() returned a socket on %s, want %s", got, ln.Addr())
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("inherit() did not remove LISTEN_FDS from the environment")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	if _, err := inherit(fd); err == nil {
+		t.Errorf("inherit() accepted an invalid LISTEN_FDS")
+	}
+}
+
+func TestListen(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().(*net.TCPAddr).Port == 0 {
+		t.Errorf("Listen() is not bound to a port: %v", ln.Addr())
+	}
+}
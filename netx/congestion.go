@@ -0,0 +1,18 @@
+package netx
+
+import "fmt"
+
+// CongestionControls are the congestion control algorithms that tests may
+// use.
+var CongestionControls = []string{"cubic", "bbr", "reno"}
+
+// ValidCongestionControl returns an error if name is not one of
+// CongestionControls.
+func ValidCongestionControl(name string) error {
+	for _, cc := range CongestionControls {
+		if name == cc {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported congestion control %q, want one of %v", name, CongestionControls)
+}
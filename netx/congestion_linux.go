@@ -0,0 +1,35 @@
+package netx
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCongestionControl sets the TCP_CONGESTION option of the socket fp, and
+// reads it back.
+func setCongestionControl(fp *os.File, name string) (string, error) {
+	rc, err := fp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var cur string
+	var serr, gerr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, name)
+		cur, gerr = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	})
+	if err != nil {
+		return "", err
+	}
+	// The name is padded with NULs to the maximum length.
+	cur = strings.TrimRight(cur, "\x00")
+	if serr != nil {
+		// ENOENT means that the kernel has no such algorithm, and EPERM that
+		// it is not in net.ipv4.tcp_allowed_congestion_control.
+		return cur, fmt.Errorf("could not set congestion control %q: %w", name, serr)
+	}
+	return cur, gerr
+}
@@ -0,0 +1,40 @@
+package netx
+
+import (
+	"net"
+	"testing"
+)
+
+// accept returns a connection accepted by a Listener, which is closed when
+// the test ends.
+func accept(t *testing.T) *Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln.(*net.TCPListener))
+	t.Cleanup(func() { l.Close() })
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*Conn)
+}
+
+func TestConn_SetCongestionControl(t *testing.T) {
+	ci := ToConnInfo(accept(t))
+	// Reno is built into every kernel.
+	if cc, err := ci.SetCongestionControl("reno"); err != nil || cc != "reno" {
+		t.Errorf("SetCongestionControl(reno) = %q, %v", cc, err)
+	}
+	cc, err := ci.SetCongestionControl("no-such-algorithm")
+	if err == nil || cc != "reno" {
+		t.Errorf("SetCongestionControl(no-such-algorithm) = %q, %v, want an error and reno", cc, err)
+	}
+}
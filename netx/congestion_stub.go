@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import (
+	"errors"
+	"os"
+)
+
+// setCongestionControl fails on platforms other than Linux, where TCP
+// connections have no TCP_CONGESTION option.
+func setCongestionControl(fp *os.File, name string) (string, error) {
+	return "", errors.New("congestion control can only be set on Linux")
+}
@@ -0,0 +1,16 @@
+package netx
+
+import "testing"
+
+func TestValidCongestionControl(t *testing.T) {
+	for _, name := range CongestionControls {
+		if err := ValidCongestionControl(name); err != nil {
+			t.Errorf("ValidCongestionControl(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "vegas", "BBR"} {
+		if err := ValidCongestionControl(name); err == nil {
+			t.Errorf("ValidCongestionControl(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package netx
+
+// tcpECN is the sysctl that controls the negotiation of ECN.
+var tcpECN = "/proc/sys/net/ipv4/tcp_ecn"
+
+// EnableECN makes the kernel negotiate Explicit Congestion Notification on the
+// TCP connections that the server accepts, when their clients ask for it.
+// Linux has no socket option for it: ECN is negotiated by every socket of the
+// network namespace as net.ipv4.tcp_ecn says. EnableECN sets it to 2, which
+// accepts ECN without asking for it on outgoing connections, if it was 0.
+// Changing it needs CAP_NET_ADMIN.
+func EnableECN() error {
+	return enableECN(tcpECN)
+}
@@ -0,0 +1,22 @@
+package netx
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func enableECN(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read net.ipv4.tcp_ecn: %w", err)
+	}
+	if strings.TrimSpace(string(b)) != "0" {
+		// ECN is already accepted.
+		return nil
+	}
+	if err := os.WriteFile(path, []byte("2\n"), 0644); err != nil {
+		return fmt.Errorf("could not set net.ipv4.tcp_ecn to 2: %w", err)
+	}
+	return nil
+}
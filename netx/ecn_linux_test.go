@@ -0,0 +1,33 @@
+package netx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_enableECN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"0\n", "2\n"},
+		{"1\n", "1\n"},
+		{"2\n", "2\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "tcp_ecn")
+		if err := os.WriteFile(path, []byte(tt.value), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := enableECN(path); err != nil {
+			t.Errorf("enableECN() with %q = %v", tt.value, err)
+		}
+		if b, _ := os.ReadFile(path); string(b) != tt.want {
+			t.Errorf("enableECN() set %q to %q, want %q", tt.value, b, tt.want)
+		}
+	}
+	if err := enableECN(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("enableECN() without the sysctl succeeded")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import "errors"
+
+// enableECN fails on platforms other than Linux.
+func enableECN(string) error {
+	return errors.New("ECN can only be enabled on Linux")
+}
@@ -0,0 +1,154 @@
+// Package forwarded recovers the address of a client whose HTTP requests
+// reach the server through a trusted reverse proxy, from the proxy's
+// Forwarded (RFC 7239) or X-Forwarded-For header.
+package forwarded
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Trusted is a list of networks whose proxies may report the client address.
+// It implements flag.Value, so it can be set from a comma-separated list of
+// CIDRs. An empty Trusted list trusts no one.
+type Trusted []*net.IPNet
+
+// Set appends the comma-separated CIDRs in s to t.
+func (t *Trusted) Set(s string) error {
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy network %q: %w", cidr, err)
+		}
+		*t = append(*t, n)
+	}
+	return nil
+}
+
+// String returns the networks in t as a comma-separated list.
+func (t Trusted) String() string {
+	s := make([]string, len(t))
+	for i, n := range t {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Contains reports whether ip is in one of the trusted networks.
+func (t Trusted) Contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns the address of the client that made r, or nil if r did not
+// come from a trusted proxy or the proxy did not say who the client is. The
+// forwarding chain is walked from the most recent hop, and the first address
+// that is not itself a trusted proxy is the client. Ports are zero unless the
+// Forwarded header reports them.
+func (t Trusted) Client(r *http.Request) *net.TCPAddr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !t.Contains(net.ParseIP(host)) {
+		return nil
+	}
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = split(r.Header.Values("X-Forwarded-For"))
+	}
+	var client *net.TCPAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr := parseNode(hops[i])
+		if addr == nil {
+			// An obfuscated or malformed hop hides everything before it.
+			break
+		}
+		client = addr
+		if !t.Contains(addr.IP) {
+			break
+		}
+	}
+	return client
+}
+
+type contextKey struct{}
+
+// Then wraps next so that requests from a trusted proxy have their RemoteAddr
+// replaced by the client's address, which is also available to next through
+// FromContext. Other requests are passed on unchanged.
+func (t Trusted) Then(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := t.Client(r); client != nil {
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, client))
+			r.RemoteAddr = client.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FromContext returns the client address found by Then, or nil if the request
+// did not come through a trusted proxy.
+func FromContext(ctx context.Context) *net.TCPAddr {
+	client, _ := ctx.Value(contextKey{}).(*net.TCPAddr)
+	return client
+}
+
+// split returns the comma-separated elements of all header values.
+func split(values []string) []string {
+	var elems []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				elems = append(elems, e)
+			}
+		}
+	}
+	return elems
+}
+
+// forwardedFor returns the "for" parameter of every element of the Forwarded
+// header values. Elements without one are reported as "unknown".
+func forwardedFor(values []string) []string {
+	elems := split(values)
+	nodes := make([]string, len(elems))
+	for i, e := range elems {
+		nodes[i] = "unknown"
+		for _, pair := range strings.Split(e, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				nodes[i] = strings.Trim(v, `"`)
+			}
+		}
+	}
+	return nodes
+}
+
+// parseNode parses a node as found in X-Forwarded-For or in the "for"
+// parameter of Forwarded: an IP address optionally followed by a port, with
+// IPv6 addresses in brackets when a port is given.
+func parseNode(node string) *net.TCPAddr {
+	if ip := net.ParseIP(strings.Trim(node, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	// Obfuscated ports such as "_8080" are allowed by RFC 7239 and ignored.
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
@@ -0,0 +1,123 @@
+package forwarded
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrusted_Client(t *testing.T) {
+	var trusted Trusted
+	if err := trusted.Set("10.0.0.0/8, 2001:db8:1::/48"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			name:       "untrusted-peer",
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+		},
+		{
+			name:       "no-header",
+			remoteAddr: "10.1.1.1:1234",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.1.1.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "198.51.100.7:0",
+		},
+		{
+			name:       "x-forwarded-for-spoofed-chain",
+			remoteAddr: "10.1.1.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7", "10.2.2.2"}},
+			want:       "198.51.100.7:0",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "[2001:db8:1::1]:1234",
+			header:     http.Header{"Forwarded": {`for=192.0.2.60;proto=http, For="[2001:db8:cafe::17]:4711"`}},
+			want:       "[2001:db8:cafe::17]:4711",
+		},
+		{
+			name:       "forwarded-preferred",
+			remoteAddr: "10.1.1.1:1234",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.7:80"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "198.51.100.7:80",
+		},
+		{
+			name:       "forwarded-obfuscated",
+			remoteAddr: "10.1.1.1:1234",
+			header:     http.Header{"Forwarded": {"for=_hidden"}},
+		},
+		{
+			name:       "all-trusted",
+			remoteAddr: "10.1.1.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.3.3.3, 10.2.2.2"}},
+			want:       "10.3.3.3:0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header = tt.header
+			got := trusted.Client(r)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("Client() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("Client() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrusted_Then(t *testing.T) {
+	var trusted Trusted
+	if err := trusted.Set("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	var remoteAddr string
+	var fromContext bool
+	h := trusted.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		fromContext = FromContext(r.Context()) != nil
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.1.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if remoteAddr != "198.51.100.7:0" || !fromContext {
+		t.Errorf("got RemoteAddr %q, in context %t", remoteAddr, fromContext)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if remoteAddr != "192.0.2.1:1234" || fromContext {
+		t.Errorf("got RemoteAddr %q, in context %t", remoteAddr, fromContext)
+	}
+}
+
+func TestTrusted_Set(t *testing.T) {
+	var trusted Trusted
+	if err := trusted.Set("10.0.0.1"); err == nil {
+		t.Error("Set() should reject addresses without a prefix length")
+	}
+	if err := trusted.Set("10.0.0.0/8,192.168.0.0/16"); err != nil || trusted.String() != "10.0.0.0/8,192.168.0.0/16" {
+		t.Errorf("Set() = %v, String() = %q", err, trusted.String())
+	}
+}
@@ -2,7 +2,7 @@ package netx
 
 import (
 	"crypto/tls"
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"sync"
@@ -14,6 +14,7 @@ import (
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/ndt-server/bbr"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/netx/iface"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/tcp"
@@ -82,6 +83,8 @@ type Addr struct {
 type ConnInfo interface {
 	GetUUID() (string, error)
 	EnableBBR() error
+	SetCongestionControl(name string) (string, error)
+	SetMaxPacingRate(bytesPerSecond uint64) error
 	ReadInfo() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error)
 }
 
@@ -116,12 +119,32 @@ func (mc *Conn) Close() error {
 	return mc.Conn.Close()
 }
 
+// WriteBuffers writes b to the connection, consuming it. Unlike b.WriteTo(mc),
+// it uses a single writev(2) when the connection is a *net.TCPConn.
+func (mc *Conn) WriteBuffers(b *net.Buffers) (int64, error) {
+	return b.WriteTo(mc.Conn)
+}
+
 // EnableBBR sets the BBR congestion control on the TCP connection, if supported
 // by the kernel. If unsupported, EnableBBR has no effect.
 func (mc *Conn) EnableBBR() error {
 	return bbr.Enable(mc.fp)
 }
 
+// SetCongestionControl sets the congestion control algorithm of the TCP
+// connection to name, e.g. cubic, and returns the algorithm that the
+// connection uses afterwards, which is the previous one if it failed.
+func (mc *Conn) SetCongestionControl(name string) (string, error) {
+	return setCongestionControl(mc.fp, name)
+}
+
+// SetMaxPacingRate caps the rate at which the TCP connection sends, in bytes
+// per second. The cap is enforced by the fq qdisc or, on kernels 4.13 and
+// later, by TCP itself.
+func (mc *Conn) SetMaxPacingRate(bytesPerSecond uint64) error {
+	return setMaxPacingRate(mc.fp, bytesPerSecond)
+}
+
 // ReadInfo reads metadata about the TCP connections. If BBR was not enabled on
 // the underlying connection, then ReadInfo will return an empty BBRInfo struct.
 // If TCP info metrics cannot be read, an error is returned.
@@ -180,7 +203,7 @@ func ToTCPAddr(addr net.Addr) *net.TCPAddr {
 	case *net.TCPAddr:
 		return a
 	default:
-		log.Printf("unsupported conn type: %T", a)
+		logging.Logger.WithField("type", fmt.Sprintf("%T", a)).Warn("unsupported conn type")
 		return nil
 	}
 }
@@ -195,7 +218,12 @@ func ToConnInfo(conn net.Conn) ConnInfo {
 	case *tls.Conn:
 		return c.LocalAddr().(*Addr).parentConn
 	default:
-		log.Printf("unsupported conn type: %T", c)
+		// Connections that wrap a *Conn, such as the TLS connections that the
+		// raw ndt5 server hands to its WSS server, still report its address.
+		if a, ok := c.LocalAddr().(*Addr); ok {
+			return a.parentConn
+		}
+		logging.Logger.WithField("type", fmt.Sprintf("%T", c)).Warn("unsupported conn type")
 		return nil
 	}
 }
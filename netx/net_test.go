@@ -279,3 +279,34 @@ func TestToConnInfo(t *testing.T) {
 		t.Errorf("ToConnInfo() returned ConInfo for unsupported type: %#v", got)
 	}
 }
+
+func TestConn_WriteBuffers(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to listen during unit test")
+	ln := NewListener(tcpl)
+	defer ln.Close()
+	received := make(chan string)
+	go func() {
+		c, err := net.Dial("tcp", tcpl.Addr().String())
+		if err != nil {
+			t.Error(err)
+			received <- ""
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := net.Buffers{[]byte("ab"), []byte("cd"), []byte("e")}
+	if n, err := conn.(*Conn).WriteBuffers(&b); n != 5 || err != nil || len(b) != 0 {
+		t.Errorf("WriteBuffers() = %d, %v, left %q", n, err, b)
+	}
+	conn.Close()
+	if got := <-received; got != "abcde" {
+		t.Errorf("received %q, want abcde", got)
+	}
+}
@@ -0,0 +1,29 @@
+package netx
+
+import (
+	"math"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setMaxPacingRate sets the SO_MAX_PACING_RATE option of the socket fp.
+// Kernels before 4.20 only accept 32-bit rates.
+func setMaxPacingRate(fp *os.File, bytesPerSecond uint64) error {
+	rc, err := fp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if bytesPerSecond <= math.MaxUint32 {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, int(bytesPerSecond))
+			return
+		}
+		serr = unix.SetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, bytesPerSecond)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,18 @@
+package netx
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConn_SetMaxPacingRate(t *testing.T) {
+	conn := accept(t)
+	const rate = 1250000 // 10 Mbit/s
+	if err := conn.SetMaxPacingRate(rate); err != nil {
+		t.Fatal(err)
+	}
+	if got := getsockopt(t, conn.fp, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE); got != rate {
+		t.Errorf("SO_MAX_PACING_RATE = %d, want %d", got, rate)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import (
+	"errors"
+	"os"
+)
+
+// setMaxPacingRate fails on platforms other than Linux, which have no
+// SO_MAX_PACING_RATE option.
+func setMaxPacingRate(fp *os.File, bytesPerSecond uint64) error {
+	return errors.New("the pacing rate can only be set on Linux")
+}
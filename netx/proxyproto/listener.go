@@ -0,0 +1,90 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// LocalListener is a net.Listener whose connections from the host itself,
+// such as those of a forwarder in front of the server, may start with a PROXY
+// protocol header, whose source address is then their RemoteAddr. The headers
+// of other connections are not removed, and their addresses are never
+// replaced, so remote clients cannot claim another address.
+type LocalListener struct {
+	net.Listener
+	// Timeout bounds the wait for the header of a local connection.
+	Timeout time.Duration
+}
+
+// Accept returns the next connection of l. The header of a local connection
+// is read by its first Read or RemoteAddr, so that Accept doesn't wait for it.
+func (l *LocalListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !isLocal(conn) {
+		return conn, err
+	}
+	return &localConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.Timeout}, nil
+}
+
+// isLocal reports whether conn comes from the host itself, on the loopback
+// interface or from the address that it connects to.
+func isLocal(conn net.Conn) bool {
+	remote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	local, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(remote)
+	return ip.IsLoopback() || ip.Equal(net.ParseIP(local))
+}
+
+// localConn is a connection of a LocalListener that may start with a header.
+type localConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	source *net.TCPAddr
+	err    error
+}
+
+// readHeader reads the header of c, if it has one. It clears the read
+// deadline of c.
+func (c *localConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		h, err := Read(c.r)
+		switch {
+		case err == ErrNoHeader:
+		case err != nil:
+			c.err = err
+		case h.Source != nil:
+			c.source = h.Source
+		}
+	})
+}
+
+func (c *localConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address of the header of c, or the address of
+// its peer if it has none.
+func (c *localConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,167 @@
+// Package proxyproto parses the PROXY protocol headers that load balancers
+// such as HAProxy and AWS NLB prepend to TCP connections to report the
+// original client and server addresses. Both the text (v1) and binary (v2)
+// formats are supported. See
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHeader is returned by Read when the connection does not start with a
+// PROXY protocol header.
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest possible v1 header, including the CRLF.
+const v1MaxLength = 107
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+	// Source and Destination are the addresses of the original connection.
+	// They are nil when the proxy sent no addresses, e.g. for its own health
+	// checks, in which case the connection's own addresses should be used.
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Read reads and removes a PROXY protocol header from the start of r.
+func Read(r *bufio.Reader) (*Header, error) {
+	if lead, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(lead, v2Signature) {
+		return readV2(r)
+	}
+	if lead, err := r.Peek(len(v1Prefix)); err == nil && bytes.Equal(lead, v1Prefix) {
+		return readV1(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, errors.New("PROXY v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header does not end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	var err error
+	if h.Source, err = parseV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return nil, fmt.Errorf("invalid IP %q in PROXY v1 header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY v1 header", port)
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: 2}
+	switch verCmd & 0xF {
+	case 0x0: // LOCAL: the proxy's own connection, with no addresses.
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0xF)
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable addresses.
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("PROXY v2 address block is too short")
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	// Any remaining bytes are TLVs, which are not needed.
+	return h, nil
+}
+
+// WriteV1 writes the v1 header of a connection from src to dst to w. The
+// header is "PROXY UNKNOWN" if an address is nil, or if they are not of the
+// same family.
+func WriteV1(w io.Writer, src, dst *net.TCPAddr) error {
+	family := ""
+	switch {
+	case src == nil || dst == nil:
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		family = "TCP4"
+	case src.IP.To4() == nil && dst.IP.To4() == nil:
+		family = "TCP6"
+	}
+	if family == "" {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+	return err
+}
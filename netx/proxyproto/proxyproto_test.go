@@ -0,0 +1,203 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, family byte, body string) string {
+	return string(v2Signature) + string([]byte{0x20 | cmd, family, 0, byte(len(body))}) + body
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		version int
+		src     string
+		dst     string
+		wantErr bool
+	}{
+		{
+			name:    "v1-tcp4",
+			input:   "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3001\r\n",
+			version: 1,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.1:3001",
+		},
+		{
+			name:    "v1-tcp6",
+			input:   "PROXY TCP6 2001:db8::1 2001:db8::2 56324 3001\r\n",
+			version: 1,
+			src:     "[2001:db8::1]:56324",
+			dst:     "[2001:db8::2]:3001",
+		},
+		{
+			name:    "v1-unknown",
+			input:   "PROXY UNKNOWN\r\n",
+			version: 1,
+		},
+		{
+			name: "v2-tcp4",
+			input: v2Header(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x0b\xb9"+
+				"\x03\x00\x04abcd"), // Followed by a TLV which is ignored.
+			version: 2,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.1:3001",
+		},
+		{
+			name:    "v2-local",
+			input:   v2Header(0, 0x00, ""),
+			version: 2,
+		},
+		{
+			name:    "v1-malformed",
+			input:   "PROXY TCP4 192.0.2.1\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1-bad-port",
+			input:   "PROXY TCP4 192.0.2.1 198.51.100.1 99999 3001\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1-too-long",
+			input:   "PROXY " + strings.Repeat("x", 200),
+			wantErr: true,
+		},
+		{
+			name:    "v2-short-addresses",
+			input:   v2Header(1, 0x11, "\xc0\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "no-header",
+			input:   "GET / HTTP/1.1\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "rest"))
+			h, err := Read(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if h.Version != tt.version {
+				t.Errorf("Read() version = %d, want %d", h.Version, tt.version)
+			}
+			if tt.src == "" {
+				if h.Source != nil || h.Destination != nil {
+					t.Errorf("Read() returned addresses %v, %v", h.Source, h.Destination)
+				}
+			} else if h.Source.String() != tt.src || h.Destination.String() != tt.dst {
+				t.Errorf("Read() = %v, %v, want %s, %s", h.Source, h.Destination, tt.src, tt.dst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Errorf("Read() left %q, want the rest of the stream", rest)
+			}
+		})
+	}
+}
+
+func TestWriteV1(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 3001}
+	tests := []struct {
+		name     string
+		src, dst *net.TCPAddr
+		want     string
+	}{
+		{name: "tcp4", src: v4, dst: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3001}, want: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3001\r\n"},
+		{name: "tcp6", src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, dst: v6, want: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 3001\r\n"},
+		{name: "mixed", src: v4, dst: v6, want: "PROXY UNKNOWN\r\n"},
+		{name: "nil", src: v4, want: "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			if err := WriteV1(b, tt.src, tt.dst); err != nil || b.String() != tt.want {
+				t.Fatalf("WriteV1() = %q, %v, want %q", b, err, tt.want)
+			}
+			// The header can be read back.
+			if _, err := Read(bufio.NewReader(b)); err != nil {
+				t.Errorf("Read() = %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &LocalListener{Listener: tcp, Timeout: time.Second}
+	defer l.Close()
+	tests := []struct {
+		name  string
+		input string
+		addr  string
+	}{
+		{name: "header", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3001\r\nGET", addr: "192.0.2.1:56324"},
+		{name: "unknown", input: "PROXY UNKNOWN\r\nGET", addr: "127.0.0.1"},
+		{name: "none", input: "GET / HTTP/1.1\r\n", addr: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", tcp.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.input))
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if addr := conn.RemoteAddr().String(); !strings.HasPrefix(addr, tt.addr) {
+				t.Errorf("RemoteAddr() = %s, want %s", addr, tt.addr)
+			}
+			if b, err := io.ReadAll(io.LimitReader(conn, 3)); err != nil || string(b) != "GET" {
+				t.Errorf("Read() = %q, %v, want the request", b, err)
+			}
+		})
+	}
+}
+
+// addrConn is a connection between local and remote.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func Test_isLocal(t *testing.T) {
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3001}
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{remote: "127.0.0.1", want: true},
+		{remote: "::1", want: true},
+		{remote: "198.51.100.1", want: true},
+		{remote: "192.0.2.1", want: false},
+	}
+	for _, tt := range tests {
+		conn := addrConn{local: server, remote: &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 4321}}
+		if got := isLocal(conn); got != tt.want {
+			t.Errorf("isLocal(%s) = %t, want %t", tt.remote, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package netx
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ListenReusePort returns n TCP listeners on addr that share its port with
+// SO_REUSEPORT, so that the kernel spreads the new connections across them
+// and each can be served by its own accept loop. If the port of addr is 0, all
+// the listeners use the port chosen for the first one.
+func ListenReusePort(addr string, n int) ([]*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setReusePort(c)
+		},
+	}
+	var listeners []*net.TCPListener
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = ln.Addr().String()
+		}
+		listeners = append(listeners, ln.(*net.TCPListener))
+	}
+	return listeners, nil
+}
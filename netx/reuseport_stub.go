@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReusePort fails on platforms other than Linux, where SO_REUSEPORT does
+// not spread connections across the sockets that share a port.
+func setReusePort(c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux")
+}
@@ -0,0 +1,32 @@
+package netx
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	listeners, err := ListenReusePort("127.0.0.1:0", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if len(listeners) != 3 {
+		t.Fatalf("ListenReusePort() returned %d listeners, want 3", len(listeners))
+	}
+	addr := listeners[0].Addr().String()
+	for _, l := range listeners[1:] {
+		if l.Addr().String() != addr {
+			t.Errorf("listener on %s, want %s", l.Addr(), addr)
+		}
+	}
+	// A socket without SO_REUSEPORT can't share the port.
+	if ln, err := net.Listen("tcp", addr); err == nil {
+		ln.Close()
+		t.Errorf("net.Listen(%q) succeeded on a port in use", addr)
+	}
+}
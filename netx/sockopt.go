@@ -0,0 +1,100 @@
+package netx
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SocketOptions are the options of the sockets of measurement connections,
+// whose defaults can change the results on paths with a high
+// bandwidth-delay product. The zero value of every field but NoDelay keeps the
+// kernel's default.
+type SocketOptions struct {
+	// SendBuffer and ReceiveBuffer are the sizes of the socket buffers, in
+	// bytes. Setting them disables their autotuning, and the kernel clamps
+	// them to net.core.wmem_max and net.core.rmem_max.
+	SendBuffer    int
+	ReceiveBuffer int
+	// NoDelay disables Nagle's algorithm, as Go does by default.
+	NoDelay bool
+	// NotSentLowat is the number of unsent bytes in the send buffer below
+	// which the socket is writable again.
+	NotSentLowat int
+	// KeepAliveIdle is the idle time before the first keepalive probe,
+	// KeepAliveInterval the time between probes, and KeepAliveCount the number
+	// of unanswered probes after which the connection is dropped.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// DSCP is the Differentiated Services Code Point that the packets are
+	// marked with, in the IPv4 TOS or the IPv6 traffic class, so that networks
+	// can classify them.
+	DSCP DSCP
+}
+
+// DSCP is a Differentiated Services Code Point, from 0 to 63. It implements
+// flag.Value.
+type DSCP int
+
+// Set sets d to the DSCP s, e.g. 8 for CS1.
+func (d *DSCP) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return fmt.Errorf("invalid DSCP %q, want a number from 0 to 63", s)
+	}
+	*d = DSCP(v)
+	return nil
+}
+
+func (d *DSCP) String() string {
+	return strconv.Itoa(int(*d))
+}
+
+// sockopt is an integer socket option. Options with a family are only set on
+// the sockets of that address family, e.g. unix.AF_INET6.
+type sockopt struct {
+	level, name, value int
+	family             int
+}
+
+// Control sets the options of o that connections inherit from the listening
+// socket c, i.e. the socket buffers and the DSCP. It has the signature of
+// net.ListenConfig.Control, so that they are set before the window scale of
+// the connections is negotiated and the SYN-ACK is sent.
+func (o *SocketOptions) Control(network, address string, c syscall.RawConn) error {
+	if o == nil {
+		return nil
+	}
+	return setsockopts(c, o.listenOpts())
+}
+
+// Apply sets the options of the connection conn, which must be a *Conn, a
+// *tls.Conn of one, or another connection with a file descriptor, e.g. a
+// *net.TCPConn.
+func (o *SocketOptions) Apply(conn net.Conn) error {
+	if o == nil {
+		return nil
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	var sc syscall.Conn
+	switch c := conn.(type) {
+	case *Conn:
+		sc = c.fp
+	case syscall.Conn:
+		sc = c
+	default:
+		return errors.New("the connection has no file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setsockopts(rc, append(o.listenOpts(), o.connOpts()...))
+}
@@ -0,0 +1,87 @@
+package netx
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenOpts returns the options of o that accepted connections inherit from
+// the listening socket.
+func (o *SocketOptions) listenOpts() []sockopt {
+	var opts []sockopt
+	if o.SendBuffer > 0 {
+		opts = append(opts, sockopt{level: unix.SOL_SOCKET, name: unix.SO_SNDBUF, value: o.SendBuffer})
+	}
+	if o.ReceiveBuffer > 0 {
+		opts = append(opts, sockopt{level: unix.SOL_SOCKET, name: unix.SO_RCVBUF, value: o.ReceiveBuffer})
+	}
+	if o.DSCP > 0 {
+		// The DSCP is the upper six bits of the TOS, whose lower two bits are
+		// the ECN field. IPv6 sockets also take IP_TOS, for the IPv4 clients
+		// that they accept.
+		tos := int(o.DSCP) << 2
+		opts = append(opts,
+			sockopt{level: unix.IPPROTO_IP, name: unix.IP_TOS, value: tos},
+			sockopt{level: unix.IPPROTO_IPV6, name: unix.IPV6_TCLASS, value: tos, family: unix.AF_INET6})
+	}
+	return opts
+}
+
+// connOpts returns the other options of o.
+func (o *SocketOptions) connOpts() []sockopt {
+	nodelay := 0
+	if o.NoDelay {
+		nodelay = 1
+	}
+	opts := []sockopt{{level: unix.IPPROTO_TCP, name: unix.TCP_NODELAY, value: nodelay}}
+	if o.NotSentLowat > 0 {
+		opts = append(opts, sockopt{level: unix.IPPROTO_TCP, name: unix.TCP_NOTSENT_LOWAT, value: o.NotSentLowat})
+	}
+	if o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0 {
+		opts = append(opts, sockopt{level: unix.SOL_SOCKET, name: unix.SO_KEEPALIVE, value: 1})
+	}
+	if o.KeepAliveIdle > 0 {
+		opts = append(opts, sockopt{level: unix.IPPROTO_TCP, name: unix.TCP_KEEPIDLE, value: seconds(o.KeepAliveIdle)})
+	}
+	if o.KeepAliveInterval > 0 {
+		opts = append(opts, sockopt{level: unix.IPPROTO_TCP, name: unix.TCP_KEEPINTVL, value: seconds(o.KeepAliveInterval)})
+	}
+	if o.KeepAliveCount > 0 {
+		opts = append(opts, sockopt{level: unix.IPPROTO_TCP, name: unix.TCP_KEEPCNT, value: o.KeepAliveCount})
+	}
+	return opts
+}
+
+// seconds returns d in whole seconds, the unit of the keepalive options, and
+// at least one.
+func seconds(d time.Duration) int {
+	if s := int((d + time.Second - 1) / time.Second); s > 1 {
+		return s
+	}
+	return 1
+}
+
+// setsockopts sets opts on the socket c, and returns the first error.
+func setsockopts(c syscall.RawConn, opts []sockopt) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		var family int
+		family, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			return
+		}
+		for _, opt := range opts {
+			if opt.family != 0 && opt.family != family {
+				continue
+			}
+			if err = unix.SetsockoptInt(int(fd), opt.level, opt.name, opt.value); err != nil {
+				return
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
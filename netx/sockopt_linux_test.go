@@ -0,0 +1,113 @@
+package netx
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, conn syscall.Conn, level, name int) int {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = unix.GetsockoptInt(int(fd), level, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestSocketOptions(t *testing.T) {
+	o := &SocketOptions{
+		SendBuffer:        64 << 10,
+		ReceiveBuffer:     32 << 10,
+		NotSentLowat:      16 << 10,
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 1500 * time.Millisecond,
+		KeepAliveCount:    4,
+		DSCP:              10,
+	}
+	lc := net.ListenConfig{Control: o.Control}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := NewListener(ln.(*net.TCPListener))
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fp := conn.(*Conn).fp
+	// The kernel doubles the buffer sizes for its bookkeeping.
+	if got := getsockopt(t, fp, unix.SOL_SOCKET, unix.SO_RCVBUF); got != 2*o.ReceiveBuffer {
+		t.Errorf("SO_RCVBUF inherited from the listener = %d, want %d", got, 2*o.ReceiveBuffer)
+	}
+
+	if err := o.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		level, opt int
+		want       int
+	}{
+		{"SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF, 2 * o.SendBuffer},
+		{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, 0},
+		{"TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, o.NotSentLowat},
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 2},
+		{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 4},
+		{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, 10 << 2},
+	}
+	for _, tt := range tests {
+		if got := getsockopt(t, fp, tt.level, tt.opt); got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	var none *SocketOptions
+	if err := none.Apply(conn); err != nil {
+		t.Errorf("Apply() of nil options = %v", err)
+	}
+	pipe, _ := net.Pipe()
+	if err := o.Apply(pipe); err == nil {
+		t.Errorf("Apply() succeeded on a connection without a socket")
+	}
+}
+
+func TestSocketOptions_Control_ipv6(t *testing.T) {
+	o := &SocketOptions{DSCP: 46}
+	lc := net.ListenConfig{Control: o.Control}
+	ln, err := lc.Listen(context.Background(), "tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := getsockopt(t, f, unix.IPPROTO_IPV6, unix.IPV6_TCLASS); got != 46<<2 {
+		t.Errorf("IPV6_TCLASS = %d, want %d", got, 46<<2)
+	}
+}
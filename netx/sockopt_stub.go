@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import "syscall"
+
+// listenOpts and connOpts return no options on platforms other than Linux, so
+// SocketOptions have no effect there.
+func (o *SocketOptions) listenOpts() []sockopt { return nil }
+func (o *SocketOptions) connOpts() []sockopt   { return nil }
+
+func setsockopts(c syscall.RawConn, opts []sockopt) error { return nil }
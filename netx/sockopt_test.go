@@ -0,0 +1,18 @@
+package netx
+
+import "testing"
+
+func TestDSCP_Set(t *testing.T) {
+	var d DSCP
+	if err := d.Set("46"); err != nil || d.String() != "46" {
+		t.Errorf("Set(46) = %v, value %s", err, d.String())
+	}
+	for _, s := range []string{"-1", "64", "EF"} {
+		if err := d.Set(s); err == nil {
+			t.Errorf("Set(%q) succeeded", s)
+		}
+	}
+	if d != 46 {
+		t.Errorf("invalid values changed the DSCP to %d", d)
+	}
+}
@@ -0,0 +1,153 @@
+// Package pcap captures the packet headers of every test with tcpdump, so that
+// operators can debug anomalous throughput results. The capture of a test is
+// saved in the data directory next to the test results, and it is capped in
+// size. Captures start once the test is registered, so they miss the TCP
+// handshake and, for ndt5, the login.
+package pcap
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// maxRunning is the maximum number of captures that run at once. Tests that
+// start while as many are running are not captured.
+const maxRunning = 16
+
+// Capturer captures the packets of running tests. A nil *Capturer captures
+// nothing.
+type Capturer struct {
+	ctx      context.Context
+	datadir  string
+	tcpdump  string
+	iface    string
+	snaplen  int
+	maxBytes int64
+	running  chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	captures map[string]context.CancelFunc // By test UUID.
+}
+
+// New creates a Capturer that runs the tcpdump binary on the iface network
+// interface, keeps the first snaplen bytes of every packet, and saves at most
+// maxBytes of every test in datadir. Captures stop when ctx is done.
+func New(ctx context.Context, datadir, tcpdump, iface string, snaplen int, maxBytes int64) *Capturer {
+	return &Capturer{
+		ctx:      ctx,
+		datadir:  datadir,
+		tcpdump:  tcpdump,
+		iface:    iface,
+		snaplen:  snaplen,
+		maxBytes: maxBytes,
+		running:  make(chan struct{}, maxRunning),
+		captures: map[string]context.CancelFunc{},
+	}
+}
+
+// TestStarted starts capturing the packets of the client of the test s,
+// unless too many captures are running. With TestDone, it makes c a
+// live.Observer.
+func (c *Capturer) TestStarted(s live.Status) {
+	if c == nil || s.ClientIP == "" {
+		return
+	}
+	select {
+	case c.running <- struct{}{}:
+	default:
+		metrics.PacketCaptures.WithLabelValues("busy").Inc()
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.mu.Lock()
+	c.captures[s.UUID] = cancel
+	c.mu.Unlock()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.running }()
+		defer cancel()
+		c.capture(ctx, cancel, s.UUID, s.ClientIP)
+	}()
+}
+
+// TestDone stops capturing the packets of the test s.
+func (c *Capturer) TestDone(s live.Status) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	cancel, ok := c.captures[s.UUID]
+	delete(c.captures, s.UUID)
+	c.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// capture saves the packets to and from ip for the test uuid until ctx is
+// done or the capture is full, when it calls cancel.
+func (c *Capturer) capture(ctx context.Context, cancel context.CancelFunc, uuid, ip string) {
+	logger := logging.Logger.WithField("uuid", uuid)
+	start := time.Now().UTC()
+	dir := path.Join(c.datadir, "pcap", start.Format("2006/01/02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		metrics.PacketCaptures.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not create the packet capture directory")
+		return
+	}
+	name := path.Join(dir, "pcap-"+start.Format("20060102T150405.000000000Z")+"."+uuid+".pcap")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		metrics.PacketCaptures.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not create the packet capture file")
+		return
+	}
+	defer f.Close()
+
+	// Packets are written as soon as they are captured (-U), so that the
+	// capture is complete when tcpdump is interrupted.
+	cmd := exec.CommandContext(ctx, c.tcpdump, "-i", c.iface, "-s", strconv.Itoa(c.snaplen), "-U", "-w", "-", "host", ip)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Second
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		metrics.PacketCaptures.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not start tcpdump")
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(out, c.maxBytes))
+	cancel()
+	cmd.Wait()
+	switch {
+	case err != nil:
+		metrics.PacketCaptures.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not save the packet capture")
+	case n == c.maxBytes:
+		metrics.PacketCaptures.WithLabelValues("truncated").Inc()
+	default:
+		metrics.PacketCaptures.WithLabelValues("ok").Inc()
+	}
+}
+
+// Wait waits until the running captures are over.
+func (c *Capturer) Wait() {
+	if c == nil {
+		return
+	}
+	c.wg.Wait()
+}
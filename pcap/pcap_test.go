@@ -0,0 +1,77 @@
+package pcap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/live"
+)
+
+// fakeTcpdump writes a script that runs script instead of tcpdump.
+func fakeTcpdump(t *testing.T, script string) string {
+	name := filepath.Join(t.TempDir(), "tcpdump")
+	if err := os.WriteFile(name, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// captures returns the contents of the captures in datadir.
+func captures(t *testing.T, datadir string) []string {
+	files, err := filepath.Glob(filepath.Join(datadir, "pcap", "*", "*", "*", "pcap-*.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestCapturer(t *testing.T) {
+	dir := t.TempDir()
+	c := New(context.Background(), dir, fakeTcpdump(t, `echo "$@"; exec sleep 10`), "eth0", 128, 1<<20)
+	s := live.Status{UUID: "uuid", ClientIP: "192.0.2.1"}
+	start := time.Now()
+	c.TestStarted(s)
+	// Wait until tcpdump is running.
+	for got := captures(t, dir); len(got) != 1 || got[0] == ""; got = captures(t, dir) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.TestDone(s)
+	c.Wait()
+	if time.Since(start) > 5*time.Second {
+		t.Error("TestDone() did not stop the capture")
+	}
+	got := captures(t, dir)
+	if len(got) != 1 || !strings.HasSuffix(got[0], "-i eth0 -s 128 -U -w - host 192.0.2.1\n") {
+		t.Errorf("got captures %q", got)
+	}
+}
+
+func TestCapturer_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	c := New(context.Background(), dir, fakeTcpdump(t, "exec yes"), "eth0", 128, 100)
+	c.TestStarted(live.Status{UUID: "uuid", ClientIP: "192.0.2.1"})
+	c.Wait()
+	if got := captures(t, dir); len(got) != 1 || len(got[0]) != 100 {
+		t.Errorf("got %d captures, want one of 100 bytes", len(got))
+	}
+}
+
+func TestCapturer_Nil(t *testing.T) {
+	var c *Capturer
+	s := live.Status{UUID: "uuid", ClientIP: "192.0.2.1"}
+	c.TestStarted(s)
+	c.TestDone(s)
+	c.Wait()
+}
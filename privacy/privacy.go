@@ -0,0 +1,79 @@
+// Package privacy keeps full client IPs out of what the server saves and
+// emits, for operators in jurisdictions that treat IPs as personal data. It is
+// enabled by the -anonymize.ip=netblock flag of
+// github.com/m-lab/go/anonymize, which truncates IPv4 addresses to their /24
+// and IPv6 addresses to their /48. When it is enabled:
+//
+//   - archived results carry the truncated client IP, only the continent and
+//     the country of the client, and the Policy with which they were
+//     anonymized;
+//   - logs, traces, the access log, the event socket, and the running tests of
+//     the admin API show truncated client IPs.
+//
+// Metrics never carry client IPs. Rate limiting, abuse detection, and the
+// other defenses of the server still see the full IPs, which they only keep
+// in memory.
+package privacy
+
+import (
+	"net"
+
+	"github.com/m-lab/go/anonymize"
+)
+
+// version is the version of the anonymization policy. It is incremented
+// whenever what is anonymized, or how, changes.
+const version = "v1"
+
+var (
+	method     = anonymize.None
+	anonymizer = anonymize.New(anonymize.None)
+)
+
+// Configure anonymizes client IPs with m, usually
+// anonymize.IPAnonymizationFlag. It must be called before any client IP is
+// handled.
+func Configure(m anonymize.Method) {
+	anonymizer = anonymize.New(m)
+	method = m
+}
+
+// Enabled reports whether client IPs are anonymized.
+func Enabled() bool {
+	return method != anonymize.None
+}
+
+// Policy returns the anonymization policy, e.g. "netblock-v1", or "" if
+// client IPs are not anonymized.
+func Policy() string {
+	if !Enabled() {
+		return ""
+	}
+	return string(method) + "-" + version
+}
+
+// IP returns ip, anonymized. Strings that are not IPs are dropped when client
+// IPs are anonymized, since they can't be truncated.
+func IP(ip string) string {
+	if !Enabled() {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	anonymizer.IP(parsed)
+	return parsed.String()
+}
+
+// Addr returns the host:port address addr with its host anonymized.
+func Addr(addr string) string {
+	if !Enabled() {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return IP(addr)
+	}
+	return net.JoinHostPort(IP(host), port)
+}
@@ -0,0 +1,38 @@
+package privacy
+
+import (
+	"testing"
+
+	"github.com/m-lab/go/anonymize"
+)
+
+func TestIP(t *testing.T) {
+	defer Configure(anonymize.None)
+	if IP("192.0.2.13") != "192.0.2.13" || Policy() != "" || Enabled() {
+		t.Error("IPs are anonymized by default")
+	}
+
+	Configure(anonymize.Netblock)
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.13", "192.0.2.0"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1::"},
+		{"not an IP", ""},
+	}
+	for _, tt := range tests {
+		if got := IP(tt.ip); got != tt.want {
+			t.Errorf("IP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+	if got := Addr("[2001:db8:1:2::1]:443"); got != "[2001:db8:1::]:443" {
+		t.Errorf("Addr() = %q", got)
+	}
+	if got := Addr("192.0.2.13"); got != "192.0.2.0" {
+		t.Errorf("Addr() without a port = %q", got)
+	}
+	if !Enabled() || Policy() != "netblock-v1" {
+		t.Errorf("Policy() = %q", Policy())
+	}
+}
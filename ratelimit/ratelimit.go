@@ -0,0 +1,319 @@
+// Package ratelimit limits how often a single client IP, or a single subnet,
+// may start tests and how many tests it may run at once, so that one client or
+// network cannot monopolize the server.
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// ErrLimited is returned by Accept when a connection is rejected.
+var ErrLimited = errors.New("client has exceeded its test rate limit")
+
+// ErrBusy is returned when a client's subnet already runs as many tests as it
+// may.
+var ErrBusy = errors.New("client's subnet is running too many tests")
+
+// sweepInterval is how often buckets of idle clients are removed.
+const sweepInterval = time.Minute
+
+// bucket is a token bucket for a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter keyed by client IP. Every client may
+// start up to burst tests at once, after which tokens are refilled at a
+// steady rate. A nil *Limiter allows every test.
+type Limiter struct {
+	subnets *Subnets // If not nil, buckets are keyed by subnet.
+
+	mu        sync.Mutex
+	rate      float64 // Tokens per second.
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New creates a Limiter that allows each client IP perHour tests per hour on
+// average, and up to burst tests in a row. If perHour is zero, every test is
+// allowed until the limits are changed with SetLimits.
+func New(perHour float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      perHour / 3600,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimits changes the limits of l for every client, including the ones that
+// already have a bucket. A bucket with more tokens than the new burst is
+// emptied down to the burst on its next test.
+func (l *Limiter) SetLimits(perHour float64, burst int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = perHour / 3600
+	l.burst = float64(burst)
+}
+
+// WithSubnets makes every client of a subnet share a single bucket, and
+// returns l.
+func (l *Limiter) WithSubnets(s Subnets) *Limiter {
+	l.subnets = &s
+	return l
+}
+
+// Allow reports whether the client at ip may start a test now, and takes a
+// token from its bucket if so.
+func (l *Limiter) Allow(ip string) bool {
+	if l == nil {
+		return true
+	}
+	if l.subnets != nil {
+		ip = l.subnets.Of(ip)
+	}
+	return l.allowAt(ip, time.Now())
+}
+
+// limited counts a connection rejected by l.
+func (l *Limiter) limited(label string) {
+	if l.subnets != nil {
+		metrics.SubnetLimitedConnections.WithLabelValues(label, "rate").Inc()
+		return
+	}
+	metrics.RateLimitedConnections.WithLabelValues(label).Inc()
+}
+
+func (l *Limiter) allowAt(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets that have refilled completely, because they are
+// indistinguishable from new buckets.
+func (l *Limiter) sweep(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// hostOf returns the IP part of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Accepter is implemented by listeners' gatekeepers, such as the one used by
+// the ndt5 plain server.
+type Accepter interface {
+	Accept(l net.Listener) (net.Conn, error)
+}
+
+type limitedAccepter struct {
+	limiter   *Limiter
+	next      Accepter
+	label     string
+	onLimited func(ip string)
+}
+
+// Accept accepts a connection using next, then closes it and returns
+// ErrLimited if the client is over its limit.
+func (a *limitedAccepter) Accept(l net.Listener) (net.Conn, error) {
+	conn, err := a.next.Accept(l)
+	if err != nil {
+		return nil, err
+	}
+	if ip := hostOf(conn.RemoteAddr().String()); !a.limiter.Allow(ip) {
+		a.limiter.limited(a.label)
+		if a.onLimited != nil {
+			a.onLimited(ip)
+		}
+		conn.Close()
+		return nil, ErrLimited
+	}
+	return conn, nil
+}
+
+// Accepter wraps next so that connections from clients over their limit are
+// closed as soon as they are accepted. The label names the server in the
+// rejection metric. If onLimited is not nil, it is called with the IP of every
+// rejected client.
+func (l *Limiter) Accepter(next Accepter, label string, onLimited func(ip string)) Accepter {
+	if l == nil {
+		return next
+	}
+	return &limitedAccepter{limiter: l, next: next, label: label, onLimited: onLimited}
+}
+
+// Then wraps next so that requests from clients over their limit are answered
+// with 429 Too Many Requests. The label names the server in the rejection
+// metric. If onLimited is not nil, it is called with the IP of every rejected
+// client.
+func (l *Limiter) Then(next http.Handler, label string, onLimited func(ip string)) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := hostOf(r.RemoteAddr); !l.Allow(ip) {
+			l.limited(label)
+			if onLimited != nil {
+				onLimited(ip)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Subnets groups client IPs by the subnet they belong to, e.g. to treat the
+// clients behind a carrier-grade NAT as one.
+type Subnets struct {
+	// IPv4 is the prefix length of IPv4 subnets, e.g. 24.
+	IPv4 int
+	// IPv6 is the prefix length of IPv6 subnets, e.g. 64.
+	IPv6 int
+}
+
+// Of returns the subnet of ip in CIDR notation. Invalid IPs are their own
+// subnet.
+func (s Subnets) Of(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(s.IPv4, 32)), Mask: net.CIDRMask(s.IPv4, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(s.IPv6, 128)), Mask: net.CIDRMask(s.IPv6, 128)}).String()
+}
+
+// Concurrency limits the number of tests that the clients of a single subnet
+// may run at once. A nil *Concurrency allows every test.
+type Concurrency struct {
+	subnets Subnets
+
+	mu     sync.Mutex
+	max    int
+	active map[string]int
+}
+
+// NewConcurrency creates a Concurrency that allows the clients of each of
+// subnets to run up to max tests at once. If max is zero, every test is
+// allowed until the limit is changed with SetMax.
+func NewConcurrency(max int, subnets Subnets) *Concurrency {
+	return &Concurrency{max: max, subnets: subnets, active: map[string]int{}}
+}
+
+// SetMax changes the number of tests the clients of each subnet may run at
+// once. Subnets already running more tests keep them, but may not start any
+// other until they are below max.
+func (c *Concurrency) SetMax(max int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+}
+
+// Acquire reports whether the client at ip may start a test now, and counts
+// the test against its subnet if so. Every successful Acquire must be followed
+// by Release.
+func (c *Concurrency) Acquire(ip string) bool {
+	if c == nil {
+		return true
+	}
+	subnet := c.subnets.Of(ip)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max > 0 && c.active[subnet] >= c.max {
+		return false
+	}
+	c.active[subnet]++
+	return true
+}
+
+// Release marks a test acquired for the client at ip as complete.
+func (c *Concurrency) Release(ip string) {
+	if c == nil {
+		return
+	}
+	subnet := c.subnets.Of(ip)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[subnet]--; c.active[subnet] <= 0 {
+		delete(c.active, subnet)
+	}
+}
+
+// Active returns the number of tests run by the clients of ip's subnet.
+func (c *Concurrency) Active(ip string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active[c.subnets.Of(ip)]
+}
+
+// Then wraps next so that requests from subnets already running as many tests
+// as they may are answered with 429 Too Many Requests. The label names the
+// server in the rejection metric. If onLimited is not nil, it is called with
+// the IP of every rejected client.
+func (c *Concurrency) Then(next http.Handler, label string, onLimited func(ip string)) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := hostOf(r.RemoteAddr)
+		if !c.Acquire(ip) {
+			metrics.SubnetLimitedConnections.WithLabelValues(label, "concurrency").Inc()
+			if onLimited != nil {
+				onLimited(ip)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer c.Release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,176 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_allowAt(t *testing.T) {
+	l := New(3600, 2) // One test per second, two in a row.
+	now := time.Now()
+	if !l.allowAt("1.2.3.4", now) || !l.allowAt("1.2.3.4", now) {
+		t.Fatal("the first burst of tests should be allowed")
+	}
+	if l.allowAt("1.2.3.4", now) {
+		t.Error("tests beyond the burst should be rejected")
+	}
+	if !l.allowAt("5.6.7.8", now) {
+		t.Error("other clients should not be limited")
+	}
+	if !l.allowAt("1.2.3.4", now.Add(time.Second)) {
+		t.Error("tokens should refill over time")
+	}
+	// After the sweep interval, idle clients with full buckets are removed.
+	l.allowAt("1.2.3.4", now.Add(2*sweepInterval))
+	if _, ok := l.buckets["5.6.7.8"]; ok {
+		t.Error("the idle client's bucket should have been swept")
+	}
+}
+
+func TestLimiter_SetLimits(t *testing.T) {
+	l := New(0, 1)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allowAt("1.2.3.4", now) {
+			t.Fatal("a Limiter without a rate should allow every test")
+		}
+	}
+	l.SetLimits(3600, 1)
+	if !l.allowAt("1.2.3.4", now) || l.allowAt("1.2.3.4", now) {
+		t.Error("the new limits should apply")
+	}
+	l.SetLimits(0, 1)
+	if !l.allowAt("1.2.3.4", now) {
+		t.Error("removing the limit should allow every test")
+	}
+	var none *Limiter
+	none.SetLimits(1, 1)
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *Limiter
+	if !l.Allow("1.2.3.4") {
+		t.Error("a nil Limiter should allow everything")
+	}
+	h := http.NotFoundHandler()
+	if l.Then(h, "test", nil) == nil || l.Accepter(nil, "test", nil) != nil {
+		t.Error("a nil Limiter should not wrap anything")
+	}
+}
+
+func TestLimiter_Then(t *testing.T) {
+	l := New(1, 1)
+	limited := []string{}
+	h := l.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "test",
+		func(ip string) { limited = append(limited, ip) })
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ndt_protocol", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		h.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("got status codes %v", codes)
+	}
+	if len(limited) != 1 || limited[0] != "1.2.3.4" {
+		t.Errorf("onLimited was called with %v, want [1.2.3.4]", limited)
+	}
+}
+
+func TestSubnets_Of(t *testing.T) {
+	s := Subnets{IPv4: 24, IPv6: 64}
+	for ip, want := range map[string]string{
+		"1.2.3.4":              "1.2.3.0/24",
+		"::ffff:1.2.3.4":       "1.2.3.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"not-an-ip":            "not-an-ip",
+	} {
+		if got := s.Of(ip); got != want {
+			t.Errorf("Of(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestLimiter_WithSubnets(t *testing.T) {
+	l := New(1, 1).WithSubnets(Subnets{IPv4: 24, IPv6: 64})
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("the first test of the subnet should be allowed")
+	}
+	if l.Allow("1.2.3.5") {
+		t.Error("other clients of the subnet should share its limit")
+	}
+	if !l.Allow("1.2.4.5") {
+		t.Error("clients of other subnets should not be limited")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	c := NewConcurrency(2, Subnets{IPv4: 24, IPv6: 64})
+	if !c.Acquire("1.2.3.4") || !c.Acquire("1.2.3.5") {
+		t.Fatal("the first tests of the subnet should be allowed")
+	}
+	if c.Acquire("1.2.3.6") {
+		t.Error("tests beyond the limit should be rejected")
+	}
+	if !c.Acquire("2001:db8::1") {
+		t.Error("clients of other subnets should not be limited")
+	}
+	c.Release("1.2.3.4")
+	if c.Active("1.2.3.99") != 1 || !c.Acquire("1.2.3.6") {
+		t.Error("a released test should make room for another")
+	}
+	c.Release("1.2.3.5")
+	c.Release("1.2.3.6")
+	c.Release("2001:db8::1")
+	if len(c.active) != 0 {
+		t.Errorf("idle subnets should be forgotten, got %v", c.active)
+	}
+	var none *Concurrency
+	if !none.Acquire("1.2.3.4") || none.Then(http.NotFoundHandler(), "test", nil) == nil {
+		t.Error("a nil Concurrency should allow everything")
+	}
+}
+
+func TestConcurrency_SetMax(t *testing.T) {
+	c := NewConcurrency(0, Subnets{IPv4: 24, IPv6: 64})
+	if !c.Acquire("1.2.3.4") || !c.Acquire("1.2.3.5") {
+		t.Fatal("a Concurrency without a maximum should allow every test")
+	}
+	c.SetMax(2)
+	if c.Acquire("1.2.3.6") {
+		t.Error("the new maximum should apply")
+	}
+	c.Release("1.2.3.4")
+	if !c.Acquire("1.2.3.6") {
+		t.Error("a released test should make room for another")
+	}
+}
+
+func TestConcurrency_Then(t *testing.T) {
+	c := NewConcurrency(1, Subnets{IPv4: 24, IPv6: 64})
+	limited := []string{}
+	inner := httptest.NewRecorder()
+	h := c.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A second client of the subnet arrives while the test runs.
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "1.2.3.5:5678"
+		c.Then(http.NotFoundHandler(), "test", func(ip string) { limited = append(limited, ip) }).ServeHTTP(inner, req)
+	}), "test", nil)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || inner.Code != http.StatusTooManyRequests {
+		t.Errorf("got status codes %d, %d", rec.Code, inner.Code)
+	}
+	if len(limited) != 1 || limited[0] != "1.2.3.5" {
+		t.Errorf("onLimited was called with %v, want [1.2.3.5]", limited)
+	}
+	if c.Active("1.2.3.4") != 0 {
+		t.Error("the test should be released once the request is served")
+	}
+}
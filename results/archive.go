@@ -0,0 +1,236 @@
+// Package results saves completed test results. In addition to the per-test
+// files written by ndt5 and ndt7, results can be appended as lines of JSON to
+// an archive of rotating files, one series of files per datatype.
+package results
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/logging"
+)
+
+// Result is a completed test result, ready to be saved.
+type Result struct {
+	// Datatype names the kind of result, e.g. "ndt5" or "ndt7".
+	Datatype string
+	// UUID identifies the test.
+	UUID string
+	// StartTime is when the test started.
+	StartTime time.Time
+	// Data is the archival record of the test. It must be JSON serializable.
+	Data interface{}
+}
+
+// Rotation is how often an archive file is closed and a new one is started.
+type Rotation string
+
+// The supported rotation periods.
+const (
+	Hourly = Rotation("hourly")
+	Daily  = Rotation("daily")
+)
+
+// Start returns the start of the rotation period containing t.
+func (r Rotation) Start(t time.Time) time.Time {
+	t = t.UTC()
+	if r == Hourly {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// ParseRotation converts s into a Rotation, returning an error if s is not a
+// supported rotation period.
+func ParseRotation(s string) (Rotation, error) {
+	switch r := Rotation(s); r {
+	case Hourly, Daily:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unsupported rotation %q: must be %q or %q", s, Hourly, Daily)
+	}
+}
+
+// segment is the archive file currently being written for a single datatype.
+type segment struct {
+	start time.Time
+	fp    *os.File
+	gzip  *gzip.Writer
+	w     io.Writer
+}
+
+func (s *segment) close() error {
+	defer MarkClosed(s.fp.Name())
+	if s.gzip != nil {
+		if err := s.gzip.Close(); err != nil {
+			s.fp.Close()
+			return err
+		}
+	}
+	return s.fp.Close()
+}
+
+// Archive appends results as JSON lines to files in a data directory. Files
+// follow the same layout as per-test results, i.e.
+//
+//	<datadir>/<datatype>/YYYY/MM/DD/<datatype>-YYYYMMDDTHHMMSSZ.jsonl[.gz]
+//
+// where the timestamp is the start of the rotation period. Archive is a Writer
+// and is safe for concurrent use.
+type Archive struct {
+	datadir  string
+	rotation Rotation
+	compress bool
+	clock    clock.Clock
+
+	mu       sync.Mutex
+	segments map[string]*segment
+}
+
+// NewArchive creates an Archive that saves results under datadir, starting a
+// new file for each datatype every rotation period.
+func NewArchive(datadir string, rotation Rotation, compress bool) (*Archive, error) {
+	if _, err := ParseRotation(string(rotation)); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		datadir:  datadir,
+		rotation: rotation,
+		compress: compress,
+		clock:    clock.Real,
+		segments: map[string]*segment{},
+	}, nil
+}
+
+// WithClock makes a tell the time with c, e.g. a fake clock in tests, and
+// returns a.
+func (a *Archive) WithClock(c clock.Clock) *Archive {
+	a.clock = c
+	return a
+}
+
+// open creates or appends to the archive file for datatype and the rotation
+// period starting at start. Appending to a compressed file is safe because a
+// sequence of gzip members is itself a valid gzip file.
+func (a *Archive) open(datatype string, start time.Time) (*segment, error) {
+	dir := path.Join(a.datadir, datatype, start.Format("2006/01/02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := path.Join(dir, datatype+"-"+start.Format("20060102T150405Z")+".jsonl")
+	if a.compress {
+		name += ".gz"
+	}
+	fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{start: start, fp: fp, w: fp}
+	if a.compress {
+		s.gzip, err = gzip.NewWriterLevel(fp, gzip.BestSpeed)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		s.w = s.gzip
+	}
+	MarkOpen(name)
+	return s, nil
+}
+
+// Write appends r to the current archive file for its datatype, rotating the
+// file first if its period has ended.
+func (a *Archive) Write(ctx context.Context, r *Result) error {
+	b, err := json.Marshal(r.Data)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The period is that of the time the lock is taken, so that a file that
+	// finish closed is never reopened.
+	start := a.rotation.Start(a.clock.Now())
+	s := a.segments[r.Datatype]
+	if s != nil && !s.start.Equal(start) {
+		delete(a.segments, r.Datatype)
+		if err := s.close(); err != nil {
+			return err
+		}
+		s = nil
+	}
+	if s == nil {
+		s, err = a.open(r.Datatype, start)
+		if err != nil {
+			return err
+		}
+		a.segments[r.Datatype] = s
+	}
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	// Flush every line so that a crash never loses more than the current
+	// result, even though this costs some compression.
+	if s.gzip != nil {
+		return s.gzip.Flush()
+	}
+	return nil
+}
+
+// finish closes the archive files whose rotation periods ended before now.
+func (a *Archive) finish(now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var firstErr error
+	for datatype, s := range a.segments {
+		if a.rotation.End(s.start).After(now) {
+			continue
+		}
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(a.segments, datatype)
+	}
+	return firstErr
+}
+
+// Run closes the archive files at the end of their rotation periods, so that
+// they are complete when they are uploaded, until ctx is canceled. Without
+// Run, a file is only closed by the next Write of its datatype.
+func (a *Archive) Run(ctx context.Context) {
+	t := a.clock.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			if err := a.finish(a.clock.Now()); err != nil {
+				logging.Logger.WithError(err).Warn("Could not close an archive file")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes all open archive files.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var firstErr error
+	for datatype, s := range a.segments {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(a.segments, datatype)
+	}
+	return firstErr
+}
@@ -0,0 +1,158 @@
+package results
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+)
+
+func readLines(t *testing.T, name string, compressed bool) []map[string]string {
+	fp, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q) error = %v", name, err)
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if compressed {
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() error = %v", err)
+		}
+		r = gz
+	}
+	lines := []map[string]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		m := map[string]string{}
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", s.Text(), err)
+		}
+		lines = append(lines, m)
+	}
+	// A gzip file without its trailer fails to read to the end.
+	if err := s.Err(); err != nil {
+		t.Fatalf("reading %q: %v", name, err)
+	}
+	return lines
+}
+
+func TestArchive_Write(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		a, err := NewArchive(dir, Hourly, compress)
+		if err != nil {
+			t.Fatalf("NewArchive() error = %v", err)
+		}
+		for _, id := range []string{"a", "b"} {
+			r := &Result{Datatype: "ndt5", UUID: id, Data: map[string]string{"UUID": id}}
+			if err := a.Write(context.Background(), r); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		// Reopening the archive within the same period appends to the same file.
+		a, _ = NewArchive(dir, Hourly, compress)
+		a.Write(context.Background(), &Result{Datatype: "ndt5", UUID: "c", Data: map[string]string{"UUID": "c"}})
+		a.Close()
+
+		files, _ := filepath.Glob(filepath.Join(dir, "ndt5", "*", "*", "*", "ndt5-*.jsonl*"))
+		if len(files) != 1 {
+			t.Fatalf("found archive files %v, want exactly 1", files)
+		}
+		lines := readLines(t, files[0], compress)
+		if len(lines) != 3 || lines[0]["UUID"] != "a" || lines[2]["UUID"] != "c" {
+			t.Errorf("compress=%t: got lines %v", compress, lines)
+		}
+	}
+}
+
+func TestArchive_WriteRotates(t *testing.T) {
+	dir := t.TempDir()
+	fake := clock.NewFake(time.Date(2022, 3, 4, 5, 59, 0, 0, time.UTC))
+	a, _ := NewArchive(dir, Hourly, true)
+	a.WithClock(fake)
+	defer a.Close()
+	if err := a.Write(context.Background(), &Result{Datatype: "ndt7", Data: map[string]string{"UUID": "a"}}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	fake.Advance(2 * time.Minute)
+	if err := a.Write(context.Background(), &Result{Datatype: "ndt7", Data: map[string]string{"UUID": "b"}}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	first := filepath.Join(dir, "ndt7", "2022", "03", "04", "ndt7-20220304T050000Z.jsonl.gz")
+	second := filepath.Join(dir, "ndt7", "2022", "03", "04", "ndt7-20220304T060000Z.jsonl.gz")
+	files, _ := filepath.Glob(filepath.Join(dir, "ndt7", "*", "*", "*", "*.jsonl.gz"))
+	if len(files) != 2 || files[0] != first || files[1] != second {
+		t.Fatalf("found archive files %v, want %s and %s", files, first, second)
+	}
+	// The first file was closed by the rotation, so its gzip trailer is
+	// already written.
+	if lines := readLines(t, first, true); len(lines) != 1 || lines[0]["UUID"] != "a" {
+		t.Errorf("got lines %v in the first file", lines)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if lines := readLines(t, second, true); len(lines) != 1 || lines[0]["UUID"] != "b" {
+		t.Errorf("got lines %v in the second file", lines)
+	}
+}
+
+func TestArchive_Run(t *testing.T) {
+	dir := t.TempDir()
+	fake := clock.NewFake(time.Date(2022, 3, 4, 5, 59, 0, 0, time.UTC))
+	a, _ := NewArchive(dir, Hourly, true)
+	a.WithClock(fake)
+	defer a.Close()
+	a.Write(context.Background(), &Result{Datatype: "ndt5", Data: map[string]string{"UUID": "a"}})
+	name := filepath.Join(dir, "ndt5", "2022", "03", "04", "ndt5-20220304T050000Z.jsonl.gz")
+	if !isOpen(name) {
+		t.Fatalf("isOpen(%q) = false while it is written", name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	fake.BlockUntil(1)
+	// The file is closed once its period is over, without another Write.
+	fake.Advance(time.Minute + 10*time.Second)
+	for isOpen(name) {
+		time.Sleep(time.Millisecond)
+	}
+	if lines := readLines(t, name, true); len(lines) != 1 || lines[0]["UUID"] != "a" {
+		t.Errorf("got lines %v", lines)
+	}
+}
+
+func TestParseRotation(t *testing.T) {
+	for _, s := range []string{"hourly", "daily"} {
+		if r, err := ParseRotation(s); err != nil || string(r) != s {
+			t.Errorf("ParseRotation(%q) = %q, %v", s, r, err)
+		}
+	}
+	if _, err := ParseRotation("weekly"); err == nil {
+		t.Error("ParseRotation(weekly) should fail")
+	}
+	if _, err := NewArchive("", Rotation("weekly"), false); err == nil {
+		t.Error("NewArchive(weekly) should fail")
+	}
+}
+
+func TestRotation_start(t *testing.T) {
+	ts := time.Date(2022, 3, 4, 5, 6, 7, 8, time.UTC)
+	if got := Hourly.Start(ts); !got.Equal(time.Date(2022, 3, 4, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("Hourly.Start() = %v", got)
+	}
+	if got := Daily.Start(ts); !got.Equal(time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Daily.Start() = %v", got)
+	}
+}
@@ -0,0 +1,357 @@
+// Package bigquery lands results in BigQuery tables laid out like the NDT
+// tables of the public M-Lab platform, so that queries written for the public
+// data also run against the data of self-hosted servers.
+//
+// Every row has the standard columns of the M-Lab tables: id, the UUID of the
+// test; date, the day of the test, by which tables are partitioned; a, a
+// summary of the test; parser, where the row comes from; and raw, the
+// archival record of the test. Rows are streamed into one table per datatype,
+// e.g. ndt7, with the insertAll API, and authenticate as the default service
+// account of the GCE instance, so the writer only works when running on GCP.
+package bigquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/go/prometheusx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/results/gcp"
+	"github.com/m-lab/ndt-server/results/push"
+	"github.com/m-lab/ndt-server/version"
+)
+
+// SchemaVersion is the version of the layout of Row. It is incremented
+// whenever a column is added to the standard columns. To preserve
+// compatibility with historical data, columns are never removed.
+const SchemaVersion = 1
+
+// Summary is the "a" column: the download, or the upload if there is no
+// download, of the test.
+type Summary struct {
+	UUID     string
+	TestTime time.Time
+	// CongestionControl is "bbr" for ndt7 downloads that were measured with
+	// BBR.
+	CongestionControl  string `json:",omitempty" bigquery:",nullable"`
+	MeanThroughputMbps float64
+	// MinRTT is in milliseconds.
+	MinRTT float64
+	// LossRate is the fraction of the segments that were retransmitted. It is
+	// only known for downloads.
+	LossRate float64 `json:",omitempty" bigquery:",nullable"`
+}
+
+// Parser is the "parser" column. On the public platform it describes the ETL
+// parser that loaded the row; here the server itself is the parser.
+type Parser struct {
+	Version       string
+	Time          time.Time
+	GitCommit     string
+	SchemaVersion int
+}
+
+// Row is a row of the table of a datatype, whose archival record is a Raw,
+// e.g. a data.NDT7Result. Its schema is inferred from its fields, like the
+// schemas of the archival records.
+type Row[Raw any] struct {
+	ID     string   `json:"id" bigquery:"id"`
+	Date   string   `json:"date" bigquery:"date"` // YYYY-MM-DD
+	A      *Summary `json:"a,omitempty" bigquery:"a"`
+	Parser Parser   `json:"parser" bigquery:"parser"`
+	Raw    *Raw     `json:"raw" bigquery:"raw"`
+}
+
+// NewRow returns the row of r, whose data must be a *Raw.
+func NewRow[Raw any](r *results.Result) (*Row[Raw], error) {
+	raw, ok := r.Data.(*Raw)
+	if !ok {
+		return nil, fmt.Errorf("result %s of datatype %q is a %T", r.UUID, r.Datatype, r.Data)
+	}
+	row := &Row[Raw]{
+		ID:   r.UUID,
+		Date: r.StartTime.UTC().Format("2006-01-02"),
+		A:    summarize(r),
+		Parser: Parser{
+			Version:       version.Version,
+			Time:          time.Now().UTC(),
+			GitCommit:     prometheusx.GitShortCommit,
+			SchemaVersion: SchemaVersion,
+		},
+		Raw: raw,
+	}
+	return row, nil
+}
+
+// summarize returns the summary of r, or nil if neither subtest has one.
+func summarize(r *results.Result) *Summary {
+	points := push.Points(r)
+	if len(points) == 0 {
+		return nil
+	}
+	p := points[0]
+	for _, q := range points {
+		if q.Direction == "download" {
+			p = q
+			break
+		}
+	}
+	s := &Summary{
+		UUID:               r.UUID,
+		TestTime:           p.Time.UTC(),
+		MeanThroughputMbps: p.RateMbps,
+		MinRTT:             p.MinRTTMs,
+	}
+	if p.Loss > 0 {
+		s.LossRate = p.Loss
+	}
+	if d, ok := r.Data.(*data.NDT7Result); ok && p.Direction == "download" {
+		s.CongestionControl = congestionControl(d.Download)
+	}
+	return s
+}
+
+// congestionControl returns "bbr" if the ndt7 subtest a was measured with
+// BBR, and "" if its congestion control algorithm is unknown.
+func congestionControl(a *model.ArchivalData) string {
+	if a == nil {
+		return ""
+	}
+	for _, m := range a.ServerMeasurements {
+		if m.BBRInfo != nil {
+			return "bbr"
+		}
+	}
+	return ""
+}
+
+// maxQueuedRows is the number of rows that may wait to be inserted. Results
+// that are written while the queue is full are dropped.
+const maxQueuedRows = 10000
+
+// insertRow is a row of an insertAll request.
+type insertRow struct {
+	table string
+	// InsertID lets BigQuery drop the rows of a batch that is retried after
+	// it was inserted.
+	InsertID string      `json:"insertId"`
+	JSON     interface{} `json:"json"`
+}
+
+// Inserter streams results into BigQuery. It implements results.Writer.
+type Inserter struct {
+	endpoint string
+	client   *http.Client
+	token    *gcp.Token
+	rows     chan insertRow
+	sendMu   sync.Mutex
+
+	// Interval is how often queued rows are inserted.
+	Interval time.Duration
+	// BatchSize is the maximum number of rows in a single request.
+	BatchSize int
+	// Attempts is the number of times a batch is tried before it is dropped.
+	Attempts int
+	// Backoff is the delay after the first failed attempt. It doubles after
+	// every subsequent failure.
+	Backoff time.Duration
+}
+
+// insertURL is the root of the BigQuery API.
+var insertURL = "https://bigquery.googleapis.com/bigquery/v2/"
+
+// New creates an Inserter that streams results into the tables of dataset in
+// project. The tables, one per datatype, must already exist with the schemas
+// of Row. Rows are only inserted while Run is running, and when the Inserter
+// is closed.
+func New(project, dataset string) (*Inserter, error) {
+	if project == "" || dataset == "" {
+		return nil, fmt.Errorf("empty BigQuery project or dataset")
+	}
+	return &Inserter{
+		endpoint:  insertURL + "projects/" + url.PathEscape(project) + "/datasets/" + url.PathEscape(dataset) + "/tables/",
+		client:    &http.Client{Timeout: 30 * time.Second},
+		token:     gcp.NewToken(),
+		rows:      make(chan insertRow, maxQueuedRows),
+		Interval:  time.Second,
+		BatchSize: 500,
+		Attempts:  3,
+		Backoff:   time.Second,
+	}, nil
+}
+
+// Write queues the row of r to be inserted.
+func (i *Inserter) Write(ctx context.Context, r *results.Result) error {
+	var row interface{}
+	var err error
+	switch r.Datatype {
+	case "ndt5":
+		row, err = NewRow[data.NDT5Result](r)
+	case "ndt7":
+		row, err = NewRow[data.NDT7Result](r)
+	default:
+		err = fmt.Errorf("no BigQuery table for datatype %q", r.Datatype)
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case i.rows <- insertRow{table: r.Datatype, InsertID: r.UUID, JSON: row}:
+		return nil
+	default:
+		metrics.ResultsPublished.WithLabelValues("bigquery", "dropped").Inc()
+		return fmt.Errorf("bigquery queue is full, dropped result %s", r.UUID)
+	}
+}
+
+// Close inserts the rows that are left, for a few seconds at most.
+func (i *Inserter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	i.flush(ctx)
+	return nil
+}
+
+// Run inserts the queued rows every Interval until ctx is canceled.
+func (i *Inserter) Run(ctx context.Context) {
+	t := time.NewTicker(i.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			i.flush(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush inserts every queued row, in batches of at most BatchSize rows of the
+// same table.
+func (i *Inserter) flush(ctx context.Context) {
+	i.sendMu.Lock()
+	defer i.sendMu.Unlock()
+	for {
+		batches := map[string][]insertRow{}
+		n := 0
+	fill:
+		for n < i.BatchSize {
+			select {
+			case r := <-i.rows:
+				batches[r.table] = append(batches[r.table], r)
+				n++
+			default:
+				break fill
+			}
+		}
+		if n == 0 {
+			return
+		}
+		for table, batch := range batches {
+			if err := i.insert(ctx, table, batch); err != nil {
+				metrics.ResultsPublished.WithLabelValues("bigquery", "error").Add(float64(len(batch)))
+				logging.Logger.WithError(err).WithFields(log.Fields{
+					"table": table,
+					"rows":  len(batch),
+				}).Warn("Could not insert results into BigQuery")
+			} else {
+				metrics.ResultsPublished.WithLabelValues("bigquery", "ok").Add(float64(len(batch)))
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// insert tries to insert a batch into table, backing off between failed
+// attempts.
+func (i *Inserter) insert(ctx context.Context, table string, batch []insertRow) error {
+	body, err := json.Marshal(struct {
+		Rows []insertRow `json:"rows"`
+	}{batch})
+	if err != nil {
+		return err
+	}
+	backoff := i.Backoff
+	attempts := i.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for n := 0; ; n++ {
+		err = i.send(ctx, table, body)
+		if err == nil || n+1 >= attempts {
+			return err
+		}
+		logging.Logger.WithError(err).WithFields(log.Fields{
+			"table":    table,
+			"attempt":  n + 1,
+			"attempts": attempts,
+		}).Warn("BigQuery insert failed")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// insertResponse is the answer of BigQuery to an insertAll request.
+type insertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+func (i *Inserter) send(ctx context.Context, table string, body []byte) error {
+	token, err := i.token.Get(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint+url.PathEscape(table)+"/insertAll", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("BigQuery returned %s: %s", resp.Status, msg)
+	}
+	var inserted insertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&inserted); err != nil {
+		return err
+	}
+	for _, e := range inserted.InsertErrors {
+		for _, detail := range e.Errors {
+			// The rows that were not rejected themselves are "stopped" when
+			// another row of the batch is invalid.
+			if detail.Reason != "stopped" {
+				return fmt.Errorf("row %d was rejected: %s: %s", e.Index, detail.Reason, detail.Message)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/ndt-server/results/gcp"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+var (
+	start = time.Date(2023, 4, 5, 23, 59, 50, 0, time.UTC)
+	end   = start.Add(20 * time.Second)
+)
+
+func TestNewRow(t *testing.T) {
+	r := &results.Result{Datatype: "ndt7", UUID: "uuid", StartTime: start, Data: &data.NDT7Result{
+		Download: &model.ArchivalData{
+			EndTime: end,
+			ServerMeasurements: []model.Measurement{{
+				BBRInfo: &model.BBRInfo{},
+				TCPInfo: &model.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{BytesAcked: 10000000, MinRTT: 12500, SegsOut: 1000, TotalRetrans: 1},
+					ElapsedTime:  1000000,
+				},
+			}},
+		},
+	}}
+	row, err := NewRow[data.NDT7Result](r)
+	if err != nil {
+		t.Fatalf("NewRow() error = %v", err)
+	}
+	want := &Summary{UUID: "uuid", TestTime: end, CongestionControl: "bbr", MeanThroughputMbps: 80, MinRTT: 12.5, LossRate: 0.001}
+	if row.ID != "uuid" || row.Date != "2023-04-05" || row.Raw != r.Data || !reflect.DeepEqual(row.A, want) {
+		t.Errorf("NewRow() = %+v, a = %+v", row, row.A)
+	}
+	if row.Parser.SchemaVersion != SchemaVersion {
+		t.Errorf("NewRow() schema version = %d", row.Parser.SchemaVersion)
+	}
+
+	if _, err := NewRow[data.NDT5Result](r); err == nil {
+		t.Error("NewRow() should fail when the result is of another type")
+	}
+}
+
+func TestInserter(t *testing.T) {
+	var gotPath, gotAuth string
+	var got struct {
+		Rows []struct {
+			InsertID string          `json:"insertId"`
+			JSON     json.RawMessage `json:"json"`
+		} `json:"rows"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"fake-token","expires_in":3600}`))
+	})
+	mux.HandleFunc("/bigquery/", func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+		if strings.Contains(string(b), "invalid") {
+			w.Write([]byte(`{"insertErrors":[{"index":0,"errors":[{"reason":"invalid","message":"no such field"}]}]}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	gcp.TokenURL = srv.URL + "/token"
+	insertURL = srv.URL + "/bigquery/"
+
+	i, err := New("project", "dataset")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	i.Attempts = 1
+	r := &results.Result{Datatype: "ndt5", UUID: "uuid", StartTime: start, Data: &data.NDT5Result{
+		S2C: &s2c.ArchivalData{EndTime: end, MeanThroughputMbps: 90, MinRTT: 10 * time.Millisecond},
+	}}
+	if err := i.Write(context.Background(), r); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := i.Write(context.Background(), &results.Result{Datatype: "unknown"}); err == nil {
+		t.Error("Write() should fail for a datatype without a table")
+	}
+	i.Close()
+	if gotPath != "/bigquery/projects/project/datasets/dataset/tables/ndt5/insertAll" || gotAuth != "Bearer fake-token" {
+		t.Errorf("insert path = %q, auth = %q", gotPath, gotAuth)
+	}
+	if len(got.Rows) != 1 || got.Rows[0].InsertID != "uuid" {
+		t.Fatalf("inserted rows = %+v", got.Rows)
+	}
+	var row Row[data.NDT5Result]
+	if err := json.Unmarshal(got.Rows[0].JSON, &row); err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != "uuid" || row.A == nil || row.A.MeanThroughputMbps != 90 || row.Raw == nil || row.Raw.S2C == nil {
+		t.Errorf("inserted row = %+v", row)
+	}
+
+	if err := i.send(context.Background(), "ndt5", []byte(`{"rows":[{"json":"invalid"}]}`)); err == nil {
+		t.Error("send() should fail when a row is rejected")
+	}
+}
@@ -0,0 +1,62 @@
+// Package gcp authenticates requests to Google Cloud APIs as the default
+// service account of the GCE instance, so it only works when running on GCP.
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenURL is where the metadata server hands out access tokens.
+var TokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// Token is an access token of the default service account.
+type Token struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewToken creates a Token that is fetched when it is first needed.
+func NewToken() *Token {
+	return &Token{client: &http.Client{Timeout: time.Minute}}
+}
+
+// Get returns the cached access token, fetching a new one from the metadata
+// server if the cached token is about to expire.
+func (t *Token) Get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, TokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	t.token = tok.AccessToken
+	t.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return t.token, nil
+}
@@ -0,0 +1,33 @@
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestToken_Get(t *testing.T) {
+	tokens := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token":"fake-token","expires_in":3600}`))
+	}))
+	defer srv.Close()
+	TokenURL = srv.URL
+
+	token := NewToken()
+	for i := 0; i < 2; i++ {
+		got, err := token.Get(context.Background())
+		if err != nil || got != "fake-token" {
+			t.Fatalf("Get() = %q, %v", got, err)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("fetched %d tokens, want 1 cached token", tokens)
+	}
+}
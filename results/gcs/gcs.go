@@ -0,0 +1,59 @@
+// Package gcs uploads archive files to Google Cloud Storage. It uses the GCS
+// JSON API directly and authenticates as the default service account of the
+// GCE instance, so it only works when running on GCP.
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/m-lab/ndt-server/results/gcp"
+)
+
+var uploadURL = "https://storage.googleapis.com/upload/storage/v1/b/"
+
+// Bucket is a GCS bucket. It implements results.Bucket.
+type Bucket struct {
+	name   string
+	client *http.Client
+	token  *gcp.Token
+}
+
+// New creates a Bucket that uploads objects to the named bucket.
+func New(name string) *Bucket {
+	return &Bucket{
+		name:   name,
+		client: &http.Client{Timeout: 10 * time.Minute},
+		token:  gcp.NewToken(),
+	}
+}
+
+// Upload saves body as the named object using a simple media upload.
+func (b *Bucket) Upload(ctx context.Context, name string, body io.Reader, size int64) error {
+	token, err := b.token.Get(ctx)
+	if err != nil {
+		return err
+	}
+	u := uploadURL + url.PathEscape(b.name) + "/o?uploadType=media&name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload of gs://%s/%s failed: %s: %s", b.name, name, resp.Status, msg)
+	}
+	return nil
+}
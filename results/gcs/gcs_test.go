@@ -0,0 +1,60 @@
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/ndt-server/results/gcp"
+)
+
+func TestBucket_Upload(t *testing.T) {
+	tokens := 0
+	var gotPath, gotName, gotAuth, gotBody string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token":"fake-token","expires_in":3600}`))
+	})
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotName = r.URL.Query().Get("name")
+		gotAuth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		if strings.HasSuffix(gotName, "fail") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	gcp.TokenURL = srv.URL + "/token"
+	uploadURL = srv.URL + "/upload/"
+
+	b := New("test-bucket")
+	for i := 0; i < 2; i++ {
+		err := b.Upload(context.Background(), "ndt/ndt5/a b.jsonl", strings.NewReader("data"), 4)
+		if err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+	}
+	if gotPath != "/upload/test-bucket/o" || gotName != "ndt/ndt5/a b.jsonl" {
+		t.Errorf("Upload() path = %q, name = %q", gotPath, gotName)
+	}
+	if gotAuth != "Bearer fake-token" || gotBody != "data" {
+		t.Errorf("Upload() auth = %q, body = %q", gotAuth, gotBody)
+	}
+	if tokens != 1 {
+		t.Errorf("fetched %d tokens, want 1 cached token", tokens)
+	}
+	if err := b.Upload(context.Background(), "fail", strings.NewReader(""), 0); err == nil {
+		t.Error("Upload() should fail when the server returns an error")
+	}
+}
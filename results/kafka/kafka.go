@@ -0,0 +1,150 @@
+// Package kafka publishes results to a Kafka topic. Records are produced
+// directly to the brokers of the cluster, with the Kafka protocol.
+//
+// Every result is published as a record whose key is the UUID of the test and
+// whose value is the JSON archival record of the test. Delivery is at least
+// once: a batch whose delivery fails is retried as a whole.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/segmentio/kafka-go"
+)
+
+// maxQueuedRecords is the number of records that may wait to be published.
+// Results that are written while the queue is full are dropped.
+const maxQueuedRecords = 10000
+
+// Publisher publishes results to a Kafka topic. It implements results.Writer.
+type Publisher struct {
+	writer  *kafka.Writer
+	records chan kafka.Message
+	sendMu  sync.Mutex
+
+	// Interval is how often queued records are published.
+	Interval time.Duration
+	// BatchSize is the maximum number of records in a single request.
+	BatchSize int
+}
+
+// New creates a Publisher that produces records to topic on the cluster of
+// brokers, the host:port addresses of some of its brokers, e.g.
+// localhost:9092. Records are only published while Run is running, and when
+// the Publisher is closed.
+func New(brokers []string, topic string) (*Publisher, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("no Kafka brokers")
+	}
+	for _, b := range brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return nil, fmt.Errorf("invalid Kafka broker %q: %w", b, err)
+		}
+	}
+	if topic == "" {
+		return nil, errors.New("empty Kafka topic")
+	}
+	return &Publisher{
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+			// The records of a test all go to the same partition.
+			Balancer:        &kafka.Hash{},
+			RequiredAcks:    kafka.RequireAll,
+			MaxAttempts:     3,
+			WriteBackoffMin: time.Second,
+			// Batches are assembled by flush, so the writer has no reason
+			// to wait for more records.
+			BatchTimeout: 10 * time.Millisecond,
+			ErrorLogger:  kafka.LoggerFunc(logging.Logger.Warnf),
+		},
+		records:   make(chan kafka.Message, maxQueuedRecords),
+		Interval:  time.Second,
+		BatchSize: 100,
+	}, nil
+}
+
+// Write queues r to be published.
+func (p *Publisher) Write(ctx context.Context, r *results.Result) error {
+	value, err := json.Marshal(r.Data)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.records <- kafka.Message{Key: []byte(r.UUID), Value: value}:
+		return nil
+	default:
+		metrics.ResultsPublished.WithLabelValues("kafka", "dropped").Inc()
+		return fmt.Errorf("kafka queue is full, dropped result %s", r.UUID)
+	}
+}
+
+// Close publishes the records that are left, for a few seconds at most.
+func (p *Publisher) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.flush(ctx)
+	return p.writer.Close()
+}
+
+// Run publishes the queued records every Interval until ctx is canceled.
+func (p *Publisher) Run(ctx context.Context) {
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.flush(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush publishes every queued record, in batches of at most BatchSize.
+func (p *Publisher) flush(ctx context.Context) {
+	// Batches are sent one at a time, so that records stay in order.
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	for {
+		var batch []kafka.Message
+	fill:
+		for len(batch) < p.BatchSize {
+			select {
+			case r := <-p.records:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		err := p.writer.WriteMessages(ctx, batch...)
+		failed := 0
+		var errs kafka.WriteErrors
+		if errors.As(err, &errs) {
+			// Only some of the records could not be published.
+			failed = errs.Count()
+		} else if err != nil {
+			failed = len(batch)
+		}
+		if err != nil {
+			logging.Logger.WithError(err).WithField("records", failed).Warn("Could not publish results to Kafka")
+		}
+		metrics.ResultsPublished.WithLabelValues("kafka", "error").Add(float64(failed))
+		metrics.ResultsPublished.WithLabelValues("kafka", "ok").Add(float64(len(batch) - failed))
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/results"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// fakeCluster is a cluster with a topic of two partitions. It implements
+// kafka.RoundTripper.
+type fakeCluster struct {
+	topic string
+
+	mu sync.Mutex
+	// failures is the number of produce requests to fail with an error that
+	// the writer retries.
+	failures int
+	// records are the values of the produced records by key, and their
+	// partitions.
+	records    map[string]string
+	partitions map[string]int32
+}
+
+func (c *fakeCluster) RoundTrip(ctx context.Context, addr net.Addr, req kafka.Request) (kafka.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch req := req.(type) {
+	case *metadata.Request:
+		return &metadata.Response{
+			Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}},
+			Topics: []metadata.ResponseTopic{{
+				Name:       c.topic,
+				Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1}, {PartitionIndex: 1, LeaderID: 1}},
+			}},
+		}, nil
+	case *produce.Request:
+		t := req.Topics[0]
+		p := t.Partitions[0]
+		res := &produce.Response{Topics: []produce.ResponseTopic{{
+			Topic:      t.Topic,
+			Partitions: []produce.ResponsePartition{{Partition: p.Partition}},
+		}}}
+		if t.Topic != c.topic {
+			return nil, errors.New("unknown topic " + t.Topic)
+		}
+		if c.failures > 0 {
+			c.failures--
+			res.Topics[0].Partitions[0].ErrorCode = int16(kafka.LeaderNotAvailable)
+			return res, nil
+		}
+		for {
+			r, err := p.RecordSet.Records.ReadRecord()
+			if err == io.EOF {
+				return res, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			key, _ := protocol.ReadAll(r.Key)
+			value, _ := protocol.ReadAll(r.Value)
+			c.records[string(key)] = string(value)
+			c.partitions[string(key)] = p.Partition
+		}
+	}
+	return nil, errors.New("unexpected request")
+}
+
+func TestPublisher(t *testing.T) {
+	cluster := &fakeCluster{
+		topic:      "ndt",
+		failures:   1,
+		records:    map[string]string{},
+		partitions: map[string]int32{},
+	}
+	p, err := New([]string{"localhost:9092"}, "ndt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.writer.Transport = cluster
+	p.writer.WriteBackoffMin = time.Millisecond
+	p.BatchSize = 2
+	for _, uuid := range []string{"a", "b", "c"} {
+		if err := p.Write(context.Background(), &results.Result{UUID: uuid, Data: map[string]string{"UUID": uuid}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": `{"UUID":"a"}`, "b": `{"UUID":"b"}`, "c": `{"UUID":"c"}`}
+	if len(cluster.records) != len(want) {
+		t.Fatalf("got records %v, want %v", cluster.records, want)
+	}
+	for key, value := range want {
+		if cluster.records[key] != value {
+			t.Errorf("got record %s = %s, want %s", key, cluster.records[key], value)
+		}
+	}
+	// The partition of a record is chosen by its key.
+	b := &kafka.Hash{}
+	for key, partition := range cluster.partitions {
+		if got := b.Balance(kafka.Message{Key: []byte(key)}, 0, 1); got != int(partition) {
+			t.Errorf("record %s went to partition %d, want %d", key, partition, got)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		brokers []string
+		topic   string
+	}{
+		{nil, "ndt"},
+		{[]string{"localhost"}, "ndt"},
+		{[]string{"localhost:9092", "http://localhost:9093"}, "ndt"},
+		{[]string{"localhost:9092"}, ""},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.brokers, tt.topic); err == nil {
+			t.Errorf("New(%q, %q) succeeded, want an error", tt.brokers, tt.topic)
+		}
+	}
+	if _, err := New([]string{"kafka-1:9092", "kafka-2:9092"}, "ndt"); err != nil {
+		t.Errorf("New() = %v", err)
+	}
+}
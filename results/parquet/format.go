@@ -0,0 +1,465 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// magic starts and ends every Parquet file.
+const magic = "PAR1"
+
+// Physical types, converted types, repetitions, encodings, codecs, and page
+// types of the Parquet format, from parquet.thrift.
+const (
+	typeBoolean   = 0
+	typeInt32     = 1
+	typeInt64     = 2
+	typeFloat     = 4
+	typeDouble    = 5
+	typeByteArray = 6
+
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+	convertedUint8           = 11
+	convertedUint16          = 12
+	convertedUint32          = 13
+	convertedUint64          = 14
+	convertedJSON            = 19
+
+	required = 0
+	optional = 1
+	repeated = 2
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageData = 0
+)
+
+// field is a field of the schema of a file: either a group of fields, or a
+// column.
+type field struct {
+	name       string
+	repetition int32
+	fields     []*field // Of a group.
+	column     *column  // Of a column.
+}
+
+// columns returns the columns of f and of the groups within f, in the order
+// of the schema.
+func (f *field) columns() []*column {
+	if f.column != nil {
+		return []*column{f.column}
+	}
+	var columns []*column
+	for _, c := range f.fields {
+		columns = append(columns, c.columns()...)
+	}
+	return columns
+}
+
+// column is a column of a row group that is being built. Values are PLAIN
+// encoded as they are added. The levels of every value, null or not, are kept
+// as well: the repetition level, if the column is within a repeated field, and
+// the definition level, if it is within an optional or repeated field.
+type column struct {
+	path      []string
+	physical  int32
+	converted int32
+	// maxRep is the number of repeated fields on the path of the column, and
+	// maxDef the number of optional or repeated ones.
+	maxRep, maxDef int
+
+	values bytes.Buffer
+	bools  []bool // The values of a boolean column, which are bit-packed.
+	reps   []byte
+	defs   []byte
+	n      int // The number of values, including nulls.
+}
+
+// level records the levels of a value.
+func (c *column) level(rep, def int) {
+	c.n++
+	if c.maxRep > 0 {
+		c.reps = append(c.reps, byte(rep))
+	}
+	if c.maxDef > 0 {
+		c.defs = append(c.defs, byte(def))
+	}
+}
+
+// addNull adds a null, whose innermost defined field is at level def.
+func (c *column) addNull(rep, def int) {
+	c.level(rep, def)
+}
+
+func (c *column) addBool(v bool, rep int) {
+	c.level(rep, c.maxDef)
+	c.bools = append(c.bools, v)
+}
+
+func (c *column) addInt32(v int32, rep int) {
+	c.level(rep, c.maxDef)
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *column) addInt64(v int64, rep int) {
+	c.level(rep, c.maxDef)
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *column) addFloat(v float32, rep int) {
+	c.level(rep, c.maxDef)
+	binary.Write(&c.values, binary.LittleEndian, math.Float32bits(v))
+}
+
+func (c *column) addDouble(v float64, rep int) {
+	c.level(rep, c.maxDef)
+	binary.Write(&c.values, binary.LittleEndian, math.Float64bits(v))
+}
+
+func (c *column) addBytes(v []byte, rep int) {
+	c.level(rep, c.maxDef)
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(v)))
+	c.values.Write(v)
+}
+
+// size returns the size of the values and levels of c.
+func (c *column) size() int {
+	return c.values.Len() + len(c.bools)/8 + len(c.reps) + len(c.defs)
+}
+
+func (c *column) reset() {
+	c.values.Reset()
+	c.bools = c.bools[:0]
+	c.reps = c.reps[:0]
+	c.defs = c.defs[:0]
+	c.n = 0
+}
+
+// page returns the contents of the single data page of c: the repetition
+// levels and the definition levels, if c has them, followed by the values.
+func (c *column) page() []byte {
+	var b bytes.Buffer
+	for _, l := range []struct {
+		levels []byte
+		max    int
+	}{{c.reps, c.maxRep}, {c.defs, c.maxDef}} {
+		if l.max == 0 {
+			continue
+		}
+		levels := rle(l.levels)
+		binary.Write(&b, binary.LittleEndian, uint32(len(levels)))
+		b.Write(levels)
+	}
+	if c.physical == typeBoolean {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		b.Write(packed)
+	}
+	b.Write(c.values.Bytes())
+	return b.Bytes()
+}
+
+// rle encodes levels as runs of the RLE/bit-packing hybrid encoding. Levels
+// are at most 255, so that the value of every run fits in a byte, whatever
+// the bit width of the levels.
+func rle(levels []byte) []byte {
+	var b []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, uint64(j-i)<<1)
+		b = append(b, levels[i])
+		i = j
+	}
+	return b
+}
+
+// chunk is the metadata of a column chunk that was written to the file.
+type chunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+// rowGroup is the metadata of a row group that was written to the file.
+type rowGroup struct {
+	rows   int64
+	bytes  int64
+	chunks []chunk
+}
+
+// file writes a Parquet file, one row group at a time. Every column chunk is
+// a single PLAIN encoded data page.
+type file struct {
+	w       io.Writer
+	offset  int64
+	schema  []*field
+	columns []*column
+	gzip    bool
+	groups  []rowGroup
+	// rows is the number of rows of the row group that is being built.
+	rows int
+}
+
+// newFile writes the start of a file whose rows have the fields of schema.
+func newFile(w io.Writer, schema []*field, compress bool) (*file, error) {
+	f := &file{w: w, schema: schema, gzip: compress}
+	for _, field := range schema {
+		f.columns = append(f.columns, field.columns()...)
+	}
+	return f, f.write([]byte(magic))
+}
+
+func (f *file) write(b []byte) error {
+	n, err := f.w.Write(b)
+	f.offset += int64(n)
+	return err
+}
+
+// buffered returns the size of the row group that is being built.
+func (f *file) buffered() int {
+	n := 0
+	for _, c := range f.columns {
+		n += c.size()
+	}
+	return n
+}
+
+// flush writes the row group that is being built, if it has any rows.
+func (f *file) flush() error {
+	if f.rows == 0 {
+		return nil
+	}
+	g := rowGroup{rows: int64(f.rows)}
+	for _, c := range f.columns {
+		page := c.page()
+		data := page
+		if f.gzip {
+			var b bytes.Buffer
+			gz := gzip.NewWriter(&b)
+			gz.Write(page)
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			data = b.Bytes()
+		}
+		var h compact
+		h.beginStruct()
+		h.i32(1, pageData)
+		h.i32(2, int32(len(page)))
+		h.i32(3, int32(len(data)))
+		h.field(5, ctStruct)
+		h.beginStruct()
+		h.i32(1, int32(c.n))
+		h.i32(2, encodingPlain)
+		h.i32(3, encodingRLE)
+		h.i32(4, encodingRLE)
+		h.endStruct()
+		h.endStruct()
+
+		ch := chunk{
+			offset:       f.offset,
+			values:       int64(c.n),
+			uncompressed: int64(h.b.Len() + len(page)),
+			compressed:   int64(h.b.Len() + len(data)),
+		}
+		if err := f.write(h.b.Bytes()); err != nil {
+			return err
+		}
+		if err := f.write(data); err != nil {
+			return err
+		}
+		g.bytes += ch.uncompressed
+		g.chunks = append(g.chunks, ch)
+		c.reset()
+	}
+	f.groups = append(f.groups, g)
+	f.rows = 0
+	return nil
+}
+
+// elements returns the number of elements of the schema of fields, which are
+// listed depth first.
+func elements(fields []*field) int {
+	n := len(fields)
+	for _, f := range fields {
+		n += elements(f.fields)
+	}
+	return n
+}
+
+// writeSchema writes the elements of the schema of fields.
+func writeSchema(m *compact, fields []*field) {
+	for _, f := range fields {
+		m.beginStruct()
+		if c := f.column; c != nil {
+			m.i32(1, c.physical)
+		}
+		m.i32(3, f.repetition)
+		m.binary(4, f.name)
+		if f.column == nil {
+			m.i32(5, int32(len(f.fields)))
+		} else if c := f.column; c.converted != convertedNone {
+			m.i32(6, c.converted)
+		}
+		m.endStruct()
+		writeSchema(m, f.fields)
+	}
+}
+
+// close writes the row group that is being built and the footer of the file.
+func (f *file) close() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	codec := int32(codecUncompressed)
+	if f.gzip {
+		codec = codecGzip
+	}
+	var rows int64
+	for _, g := range f.groups {
+		rows += g.rows
+	}
+
+	var m compact
+	m.beginStruct()
+	m.i32(1, 1)
+	m.list(2, ctStruct, elements(f.schema)+1)
+	m.beginStruct()
+	m.binary(4, "schema")
+	m.i32(5, int32(len(f.schema)))
+	m.endStruct()
+	writeSchema(&m, f.schema)
+	m.i64(3, rows)
+	m.list(4, ctStruct, len(f.groups))
+	for _, g := range f.groups {
+		m.beginStruct()
+		m.list(1, ctStruct, len(g.chunks))
+		for i, ch := range g.chunks {
+			c := f.columns[i]
+			m.beginStruct()
+			m.i64(2, ch.offset)
+			m.field(3, ctStruct)
+			m.beginStruct()
+			m.i32(1, c.physical)
+			m.list(2, ctI32, 2)
+			m.varint(encodingPlain)
+			m.varint(encodingRLE)
+			m.list(3, ctBinary, len(c.path))
+			for _, name := range c.path {
+				m.bytes(name)
+			}
+			m.i32(4, codec)
+			m.i64(5, ch.values)
+			m.i64(6, ch.uncompressed)
+			m.i64(7, ch.compressed)
+			m.i64(9, ch.offset)
+			m.endStruct()
+			m.endStruct()
+		}
+		m.i64(2, g.bytes)
+		m.i64(3, g.rows)
+		m.endStruct()
+	}
+	m.binary(6, "ndt-server")
+	m.endStruct()
+
+	if err := f.write(m.b.Bytes()); err != nil {
+		return err
+	}
+	var footer [8]byte
+	binary.LittleEndian.PutUint32(footer[:4], uint32(m.b.Len()))
+	copy(footer[4:], magic)
+	return f.write(footer[:])
+}
+
+// Types of the Thrift compact protocol.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compact encodes Thrift structs with the compact protocol, which is how the
+// Parquet metadata is serialized.
+type compact struct {
+	b    bytes.Buffer
+	last []int16 // The ID of the last field of every open struct.
+}
+
+func (c *compact) beginStruct() {
+	c.last = append(c.last, 0)
+}
+
+func (c *compact) endStruct() {
+	c.b.WriteByte(0)
+	c.last = c.last[:len(c.last)-1]
+}
+
+func (c *compact) field(id int16, typ byte) {
+	last := &c.last[len(c.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.b.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		c.b.WriteByte(typ)
+		c.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint writes v as a zigzag varint.
+func (c *compact) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	c.b.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (c *compact) bytes(s string) {
+	var b [binary.MaxVarintLen64]byte
+	c.b.Write(b[:binary.PutUvarint(b[:], uint64(len(s)))])
+	c.b.WriteString(s)
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, ctI32)
+	c.varint(int64(v))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, ctI64)
+	c.varint(v)
+}
+
+func (c *compact) binary(id int16, s string) {
+	c.field(id, ctBinary)
+	c.bytes(s)
+}
+
+// list writes the header of a list of n elements of type elem.
+func (c *compact) list(id int16, elem byte, n int) {
+	c.field(id, ctList)
+	if n < 15 {
+		c.b.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	c.b.WriteByte(0xf0 | elem)
+	var b [binary.MaxVarintLen64]byte
+	c.b.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
@@ -0,0 +1,395 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readStruct decodes a Thrift struct of the compact protocol into a map of
+// field IDs to values.
+func readStruct(t *testing.T, r *bytes.Reader) map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("truncated struct: %v", err)
+		}
+		if b == 0 {
+			return fields
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, _ := binary.ReadVarint(r)
+			id = int16(v)
+		}
+		last = id
+		fields[id] = readValue(t, r, b&0x0f)
+	}
+}
+
+func readValue(t *testing.T, r *bytes.Reader, typ byte) interface{} {
+	switch typ {
+	case 1, 2: // Booleans are encoded in the type.
+		return typ == 1
+	case 3: // i8
+		b, _ := r.ReadByte()
+		return int64(int8(b))
+	case 4, ctI32, ctI64: // i16, i32, i64
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	case ctBinary:
+		n, _ := binary.ReadUvarint(r)
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	case ctList:
+		h, _ := r.ReadByte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n, _ = binary.ReadUvarint(r)
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			elem := h & 0x0f
+			if elem == 1 { // Booleans of lists take a byte.
+				b, _ := r.ReadByte()
+				list = append(list, b == 1)
+				continue
+			}
+			list = append(list, readValue(t, r, elem))
+		}
+		return list
+	case ctStruct:
+		return readStruct(t, r)
+	}
+	t.Fatalf("unexpected Thrift type %d", typ)
+	return nil
+}
+
+// readLevels decodes n levels of bit width w from the runs of the
+// RLE/bit-packing hybrid encoding, which are preceded by their size.
+func readLevels(t *testing.T, r *bytes.Reader, n, w int) []int {
+	var size uint32
+	binary.Read(r, binary.LittleEndian, &size)
+	runs := make([]byte, size)
+	io.ReadFull(r, runs)
+	rr := bytes.NewReader(runs)
+	levels := []int{}
+	for len(levels) < n {
+		h, err := binary.ReadUvarint(rr)
+		if err != nil {
+			t.Fatalf("truncated levels: %v", err)
+		}
+		if h&1 == 0 {
+			// An RLE run of a value of (w+7)/8 bytes.
+			v := make([]byte, 4)
+			io.ReadFull(rr, v[:(w+7)/8])
+			for i := uint64(0); i < h>>1; i++ {
+				levels = append(levels, int(binary.LittleEndian.Uint32(v)))
+			}
+			continue
+		}
+		// A bit-packed run of groups of 8 values.
+		packed := make([]byte, int(h>>1)*w)
+		io.ReadFull(rr, packed)
+		for i := 0; i < int(h>>1)*8; i++ {
+			v := 0
+			for bit := 0; bit < w; bit++ {
+				at := i*w + bit
+				v |= int(packed[at/8]>>(at%8)&1) << bit
+			}
+			levels = append(levels, v)
+		}
+	}
+	return levels[:n]
+}
+
+// element is an element of the schema of a file.
+type element struct {
+	name       string
+	physical   int64 // -1 for a group.
+	repetition int64
+	converted  int64 // -1 if none.
+	children   int64
+}
+
+// value is a value of a column, nil for a null, with its levels.
+type value struct {
+	rep, def int
+	v        interface{}
+}
+
+// leaf is a column of the schema of a file.
+type leaf struct {
+	element
+	path           string
+	maxRep, maxDef int
+}
+
+// leaves returns the columns of the schema elements, which are listed depth
+// first, and the number of elements they take.
+func leaves(elements []element, path []string, rep, def int) ([]leaf, int) {
+	e := elements[0]
+	if e.repetition == repeated {
+		rep++
+	}
+	if e.repetition != required {
+		def++
+	}
+	path = append(path[:len(path):len(path)], e.name)
+	if e.physical >= 0 {
+		return []leaf{{e, strings.Join(path, "."), rep, def}}, 1
+	}
+	var all []leaf
+	n := 1
+	for i := int64(0); i < e.children; i++ {
+		l, m := leaves(elements[n:], path, rep, def)
+		all = append(all, l...)
+		n += m
+	}
+	return all, n
+}
+
+// readFile decodes a Parquet file with PLAIN encoded data pages into its
+// metadata, the elements of its schema but the root, and the values of its
+// columns, by dotted path.
+func readFile(t *testing.T, b []byte) (map[int16]interface{}, []element, map[string][]value) {
+	if string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		t.Fatalf("missing magic numbers")
+	}
+	size := binary.LittleEndian.Uint32(b[len(b)-8:])
+	meta := readStruct(t, bytes.NewReader(b[len(b)-8-int(size):len(b)-8]))
+
+	var schema []element
+	for _, s := range meta[2].([]interface{})[1:] {
+		s := s.(map[int16]interface{})
+		e := element{name: s[4].(string), physical: -1, converted: -1}
+		if v, ok := s[1]; ok {
+			e.physical = v.(int64)
+		}
+		e.repetition, _ = s[3].(int64)
+		if v, ok := s[5]; ok {
+			e.children = v.(int64)
+		}
+		if v, ok := s[6]; ok {
+			e.converted = v.(int64)
+		}
+		schema = append(schema, e)
+	}
+	var columns []leaf
+	for n := 0; n < len(schema); {
+		l, m := leaves(schema[n:], nil, 0, 0)
+		columns = append(columns, l...)
+		n += m
+	}
+
+	values := map[string][]value{}
+	for _, g := range meta[4].([]interface{}) {
+		for i, c := range g.(map[int16]interface{})[1].([]interface{}) {
+			col := columns[i]
+			cm := c.(map[int16]interface{})[3].(map[int16]interface{})
+			if _, ok := cm[11]; ok {
+				t.Fatalf("%s has a dictionary page", col.path)
+			}
+			r := bytes.NewReader(b[cm[9].(int64):])
+			for read := int64(0); read < cm[5].(int64); {
+				header := readStruct(t, r)
+				if header[1].(int64) != pageData {
+					t.Fatalf("%s has a page of type %d", col.path, header[1])
+				}
+				data := make([]byte, header[3].(int64))
+				io.ReadFull(r, data)
+				switch cm[4].(int64) {
+				case codecGzip:
+					gz, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, _ = io.ReadAll(gz)
+				case codecUncompressed:
+				default:
+					t.Fatalf("%s has codec %d", col.path, cm[4])
+				}
+				if int64(len(data)) != header[2].(int64) {
+					t.Fatalf("page is %d bytes, want %d", len(data), header[2])
+				}
+				dh := header[5].(map[int16]interface{})
+				if dh[2].(int64) != encodingPlain {
+					t.Fatalf("%s has encoding %d", col.path, dh[2])
+				}
+				n := int(dh[1].(int64))
+				read += int64(n)
+				page := bytes.NewReader(data)
+				reps, defs := make([]int, n), make([]int, n)
+				for i := range defs {
+					defs[i] = col.maxDef
+				}
+				if col.maxRep > 0 {
+					reps = readLevels(t, page, n, bitWidth(col.maxRep))
+				}
+				if col.maxDef > 0 {
+					defs = readLevels(t, page, n, bitWidth(col.maxDef))
+				}
+				var bools []byte
+				if col.physical == typeBoolean {
+					bools, _ = io.ReadAll(page)
+				}
+				defined := 0
+				for i := 0; i < n; i++ {
+					v := value{rep: reps[i], def: defs[i]}
+					if v.def < col.maxDef {
+						values[col.path] = append(values[col.path], v)
+						continue
+					}
+					switch col.physical {
+					case typeBoolean:
+						v.v = bools[defined/8]>>(defined%8)&1 == 1
+					case typeInt32:
+						var x int32
+						binary.Read(page, binary.LittleEndian, &x)
+						v.v = x
+					case typeInt64:
+						var x int64
+						binary.Read(page, binary.LittleEndian, &x)
+						v.v = x
+					case typeFloat:
+						var x uint32
+						binary.Read(page, binary.LittleEndian, &x)
+						v.v = math.Float32frombits(x)
+					case typeDouble:
+						var x uint64
+						binary.Read(page, binary.LittleEndian, &x)
+						v.v = math.Float64frombits(x)
+					case typeByteArray:
+						var size uint32
+						binary.Read(page, binary.LittleEndian, &size)
+						x := make([]byte, size)
+						io.ReadFull(page, x)
+						v.v = string(x)
+					}
+					defined++
+					values[col.path] = append(values[col.path], v)
+				}
+			}
+		}
+	}
+	return meta, schema, values
+}
+
+// bitWidth returns the number of bits of levels up to max.
+func bitWidth(max int) int {
+	w := 0
+	for ; max > 0; max >>= 1 {
+		w++
+	}
+	return w
+}
+
+func TestFile(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		id := &column{path: []string{"id"}, physical: typeByteArray, converted: convertedUTF8}
+		n := &column{path: []string{"g", "n"}, physical: typeInt64, converted: convertedNone, maxDef: 1}
+		ok := &column{path: []string{"g", "ok"}, physical: typeBoolean, converted: convertedNone, maxDef: 2}
+		x := &column{path: []string{"x"}, physical: typeDouble, converted: convertedNone, maxRep: 1, maxDef: 1}
+		schema := []*field{
+			{name: "id", repetition: required, column: id},
+			{name: "g", repetition: optional, fields: []*field{
+				{name: "n", repetition: required, column: n},
+				{name: "ok", repetition: optional, column: ok},
+			}},
+			{name: "x", repetition: repeated, column: x},
+		}
+		var b bytes.Buffer
+		f, err := newFile(&b, schema, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wantID, wantN, wantOK, wantX []value
+		for i := 0; i < 20; i++ {
+			id.addBytes([]byte{'a' + byte(i)}, 0)
+			wantID = append(wantID, value{0, 0, string(rune('a' + i))})
+			switch i % 3 {
+			case 0:
+				n.addNull(0, 0)
+				ok.addNull(0, 0)
+				wantN = append(wantN, value{0, 0, nil})
+				wantOK = append(wantOK, value{0, 0, nil})
+			case 1:
+				n.addInt64(int64(i), 0)
+				ok.addNull(0, 1)
+				wantN = append(wantN, value{0, 1, int64(i)})
+				wantOK = append(wantOK, value{0, 1, nil})
+			case 2:
+				n.addInt64(int64(i), 0)
+				ok.addBool(i%4 == 2, 0)
+				wantN = append(wantN, value{0, 1, int64(i)})
+				wantOK = append(wantOK, value{0, 2, i%4 == 2})
+			}
+			// x has i%3 values.
+			if i%3 == 0 {
+				x.addNull(0, 0)
+				wantX = append(wantX, value{0, 0, nil})
+			}
+			for j := 0; j < i%3; j++ {
+				x.addDouble(float64(i)/2, j)
+				wantX = append(wantX, value{j, 1, float64(i) / 2})
+			}
+			f.rows++
+			if i == 4 {
+				// Write several row groups.
+				if err := f.flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := f.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		meta, elements, values := readFile(t, b.Bytes())
+		if meta[3].(int64) != 20 || len(meta[4].([]interface{})) != 2 {
+			t.Errorf("file has %v rows in %d row groups, want 20 in 2", meta[3], len(meta[4].([]interface{})))
+		}
+		wantElements := []element{
+			{name: "id", physical: typeByteArray, repetition: required, converted: convertedUTF8},
+			{name: "g", physical: -1, repetition: optional, converted: -1, children: 2},
+			{name: "n", physical: typeInt64, repetition: required, converted: -1},
+			{name: "ok", physical: typeBoolean, repetition: optional, converted: -1},
+			{name: "x", physical: typeDouble, repetition: repeated, converted: -1},
+		}
+		if !reflect.DeepEqual(elements, wantElements) {
+			t.Errorf("compress=%v: schema = %v, want %v", compress, elements, wantElements)
+		}
+		want := map[string][]value{"id": wantID, "g.n": wantN, "g.ok": wantOK, "x": wantX}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("compress=%v: file values = %v, want %v", compress, values, want)
+		}
+	}
+}
+
+func TestCompact_longForm(t *testing.T) {
+	var c compact
+	c.beginStruct()
+	c.i32(20, -3)
+	c.list(1, ctI32, 16)
+	for i := 0; i < 16; i++ {
+		c.varint(int64(i))
+	}
+	c.endStruct()
+	got := readStruct(t, bytes.NewReader(c.b.Bytes()))
+	if got[20] != int64(-3) || len(got[1].([]interface{})) != 16 {
+		t.Errorf("readStruct() = %v", got)
+	}
+}
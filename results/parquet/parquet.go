@@ -0,0 +1,243 @@
+// Package parquet archives results as Parquet files, which are much cheaper
+// than lines of JSON to analyze in bulk with columnar engines such as DuckDB,
+// Spark, or BigQuery external tables.
+//
+// Files follow the layout of the JSONL archive, i.e.
+//
+//	<datadir>/<datatype>/YYYY/MM/DD/<datatype>-YYYYMMDDTHHMMSSZ[.<n>].parquet
+//
+// and have the schema of the archival record of their datatype, e.g.
+// data.NDT5Result for ndt5, derived from its Go type: every field of the
+// record is a column or a group of columns, with the name and nesting it has in
+// the JSONL archive. Pointers are optional, slices are repeated, fields with
+// the omitempty option are null when they are empty, times are timestamps (µs,
+// UTC), and durations are integers of nanoseconds, like in JSON.
+//
+// Unlike a JSONL file, a Parquet file is only readable once its footer is
+// written, when its rotation period is over or when the archive is closed. A
+// file that was left without a footer, e.g. by a crash, is not appended to:
+// the next file of the period gets the next <n>.
+package parquet
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/results"
+)
+
+// maxRowGroupBytes is the size of the rows that are buffered in memory before
+// they are written to the file as a row group.
+const maxRowGroupBytes = 16 << 20
+
+// segment is the archive file currently being written for a single datatype.
+type segment struct {
+	start  time.Time
+	fp     *os.File
+	buf    *bufio.Writer
+	file   *file
+	typ    reflect.Type
+	schema []*node
+}
+
+func newSegment(fp *os.File, start time.Time, typ reflect.Type, schema []*node, compress bool) (*segment, error) {
+	s := &segment{
+		start:  start,
+		fp:     fp,
+		buf:    bufio.NewWriter(fp),
+		typ:    typ,
+		schema: schema,
+	}
+	fields := make([]*field, len(schema))
+	for i, n := range schema {
+		fields[i] = n.field
+	}
+	var err error
+	s.file, err = newFile(s.buf, fields, compress)
+	return s, err
+}
+
+// add appends the row of data, the archival record of a result.
+func (s *segment) add(data interface{}) error {
+	if t := reflect.TypeOf(data); t != s.typ {
+		return fmt.Errorf("parquet: the record is a %v, not a %v like the others of the file", t, s.typ)
+	}
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return fmt.Errorf("parquet: the record is a nil %v", s.typ)
+		}
+		v = v.Elem()
+	}
+	for _, n := range s.schema {
+		n.write(v.FieldByIndex(n.index), 0, 0)
+	}
+	s.file.rows++
+	return nil
+}
+
+// flush writes the buffered rows to the file as a row group.
+func (s *segment) flush() error {
+	if err := s.file.flush(); err != nil {
+		return err
+	}
+	return s.buf.Flush()
+}
+
+func (s *segment) close() error {
+	defer results.MarkClosed(s.fp.Name())
+	err := s.file.close()
+	if err == nil {
+		err = s.buf.Flush()
+	}
+	if cerr := s.fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Archive saves results to Parquet files in a data directory. It implements
+// results.Writer and is safe for concurrent use.
+type Archive struct {
+	datadir  string
+	rotation results.Rotation
+	compress bool
+
+	mu       sync.Mutex
+	segments map[string]*segment
+}
+
+// New creates an Archive that saves results under datadir, starting a new file
+// for each datatype every rotation period. If compress is true, the pages of
+// the files are compressed with gzip. Files are finished at the end of their
+// period while Run is running, and when the Archive is closed.
+func New(datadir string, rotation results.Rotation, compress bool) (*Archive, error) {
+	if _, err := results.ParseRotation(string(rotation)); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		datadir:  datadir,
+		rotation: rotation,
+		compress: compress,
+		segments: map[string]*segment{},
+	}, nil
+}
+
+// open creates the archive file for datatype, whose records are of type typ,
+// and the rotation period starting at start.
+func (a *Archive) open(datatype string, typ reflect.Type, start time.Time) (*segment, error) {
+	schema, err := newSchema(typ)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join(a.datadir, datatype, start.Format("2006/01/02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := path.Join(dir, datatype+"-"+start.Format("20060102T150405Z"))
+	name := base + ".parquet"
+	for n := 1; ; n++ {
+		fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			name = fmt.Sprintf("%s.%d.parquet", base, n)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err := newSegment(fp, start, typ, schema, a.compress)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		results.MarkOpen(name)
+		return s, nil
+	}
+}
+
+// Write adds r to the current archive file for its datatype, finishing the
+// file first if its period has ended.
+func (a *Archive) Write(ctx context.Context, r *results.Result) error {
+	start := a.rotation.Start(time.Now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.segments[r.Datatype]
+	if s != nil && !s.start.Equal(start) {
+		delete(a.segments, r.Datatype)
+		if err := s.close(); err != nil {
+			return err
+		}
+		s = nil
+	}
+	if s == nil {
+		var err error
+		s, err = a.open(r.Datatype, reflect.TypeOf(r.Data), start)
+		if err != nil {
+			return err
+		}
+		a.segments[r.Datatype] = s
+	}
+	if err := s.add(r.Data); err != nil {
+		return err
+	}
+	if s.file.buffered() >= maxRowGroupBytes {
+		return s.flush()
+	}
+	return nil
+}
+
+// finish closes the archive files whose rotation periods ended before now.
+func (a *Archive) finish(now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var firstErr error
+	for datatype, s := range a.segments {
+		if a.rotation.End(s.start).After(now) {
+			continue
+		}
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(a.segments, datatype)
+	}
+	return firstErr
+}
+
+// Run finishes the archive files at the end of their rotation periods, so
+// that they can be uploaded, until ctx is canceled.
+func (a *Archive) Run(ctx context.Context) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := a.finish(time.Now()); err != nil {
+				logging.Logger.WithError(err).Warn("Could not finish a Parquet archive file")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close finishes all open archive files.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var firstErr error
+	for datatype, s := range a.segments {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(a.segments, datatype)
+	}
+	return firstErr
+}
@@ -0,0 +1,99 @@
+package parquet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/results"
+)
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(dir, results.Hourly, true)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	start := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	for _, r := range []*results.Result{
+		{Datatype: "ndt5", UUID: "a", StartTime: start, Data: &data.NDT5Result{
+			StartTime: start,
+			ClientASN: &geoip.ASN{ASNumber: 64496},
+			Control:   &control.ArchivalData{UUID: "a"},
+			S2C:       &s2c.ArchivalData{MeanThroughputMbps: 90, MinRTT: 10 * time.Millisecond},
+			C2S:       &c2s.ArchivalData{MeanThroughputMbps: 20},
+		}},
+		{Datatype: "ndt5", UUID: "b", StartTime: start, Data: &data.NDT5Result{}},
+	} {
+		if err := a.Write(context.Background(), r); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// Reopening the archive within the same period starts a new file.
+	a, _ = New(dir, results.Hourly, false)
+	a.Write(context.Background(), &results.Result{Datatype: "ndt5", UUID: "c", StartTime: start, Data: &data.NDT5Result{}})
+	a.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "ndt5", "*", "*", "*", "*.parquet"))
+	if len(files) != 2 {
+		t.Fatalf("archive files = %v, want 2", files)
+	}
+	// The glob sorts the second file, <...>Z.1.parquet, first.
+	first, second := files[1], files[0]
+	if want := first[:len(first)-len(".parquet")] + ".1.parquet"; second != want {
+		t.Errorf("second archive file = %s, want %s", second, want)
+	}
+	b, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, values := readFile(t, b)
+	checks := map[string][]value{
+		"StartTime":              {{0, 0, start.UnixMicro()}, {0, 0, time.Time{}.UnixMicro()}},
+		"Control.UUID":           {{0, 1, "a"}, {0, 0, nil}},
+		"ClientASN.ASNumber":     {{0, 1, int32(64496)}, {0, 0, nil}},
+		"S2C.MeanThroughputMbps": {{0, 1, 90.0}, {0, 0, nil}},
+		"S2C.MinRTT":             {{0, 1, int64(10 * time.Millisecond)}, {0, 0, nil}},
+		"S2C.TCPInfo.RTT":        {{0, 1, nil}, {0, 0, nil}},
+		"C2S.MeanThroughputMbps": {{0, 1, 20.0}, {0, 0, nil}},
+	}
+	for name, want := range checks {
+		if got := values[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestArchive_types(t *testing.T) {
+	a, _ := New(t.TempDir(), results.Hourly, false)
+	defer a.Close()
+	if err := a.Write(context.Background(), &results.Result{Datatype: "ndt7", Data: map[string]string{}}); err == nil {
+		t.Error("Write() of a map succeeded, want an error")
+	}
+	a.Write(context.Background(), &results.Result{Datatype: "ndt7", Data: &data.NDT7Result{}})
+	if err := a.Write(context.Background(), &results.Result{Datatype: "ndt7", Data: &data.NDT5Result{}}); err == nil {
+		t.Error("Write() of another type of record succeeded, want an error")
+	}
+}
+
+func TestArchive_finish(t *testing.T) {
+	a, _ := New(t.TempDir(), results.Hourly, false)
+	a.Write(context.Background(), &results.Result{Datatype: "ndt7", UUID: "a", Data: &data.NDT7Result{}})
+	if a.finish(time.Now()); len(a.segments) != 1 {
+		t.Error("finish() closed the file of the current period")
+	}
+	if a.finish(time.Now().Add(time.Hour)); len(a.segments) != 0 {
+		t.Error("finish() did not close the file of a past period")
+	}
+}
@@ -0,0 +1,258 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// node is a field of the schema of a file that was derived from a field of a
+// Go struct, with the name and nesting that the field has in JSON. It shreds
+// the values of the Go field into the columns of the Parquet field.
+//
+// Pointers are optional fields and slices are repeated fields, omitempty
+// scalars are optional fields that are null when they are empty, and structs
+// are groups. Maps, interfaces, and the elements of slices of pointers or of
+// slices are columns of JSON strings.
+type node struct {
+	field *field
+	// index is the index of the Go field within its struct.
+	index []int
+	// rep is the repetition level of the elements of a repeated field.
+	rep      int
+	children []*node                                   // Of a group.
+	add      func(c *column, v reflect.Value, rep int) // Of a column.
+}
+
+// newSchema returns the nodes of the fields of t, a struct or a pointer to a
+// struct.
+func newSchema(t reflect.Type) ([]*node, error) {
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("parquet: cannot derive a schema from %v, which is not a struct", t)
+	}
+	nodes, err := newNodes(t, nil, 0, 0, map[reflect.Type]bool{})
+	if err == nil && len(nodes) == 0 {
+		err = fmt.Errorf("parquet: %v has no fields", t)
+	}
+	return nodes, err
+}
+
+// newNodes returns the nodes of the fields of struct t, whose path is path and
+// whose levels are rep and def.
+func newNodes(t reflect.Type, path []string, rep, def int, seen map[reflect.Type]bool) ([]*node, error) {
+	if seen[t] {
+		return nil, fmt.Errorf("parquet: %v is recursive", t)
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	var nodes []*node
+	for _, sf := range reflect.VisibleFields(t) {
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if !sf.IsExported() || name == "-" && opts == "" || !promoted(t, sf.Index) {
+			continue
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			// Like in JSON, the fields of embedded structs are promoted.
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		omitEmpty := false
+		for _, opt := range strings.Split(opts, ",") {
+			omitEmpty = omitEmpty || opt == "omitempty"
+		}
+		n, err := newNode(name, sf.Type, omitEmpty, append(path[:len(path):len(path)], name), rep, def, seen)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			n.index = sf.Index
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// promoted returns whether the field of struct t with index is a field of t,
+// or is promoted to t from embedded structs, like in JSON. The fields of
+// embedded structs with a JSON name are not promoted, nor are those of
+// embedded pointers here, which may be nil.
+func promoted(t reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name != "" || sf.Type.Kind() != reflect.Struct {
+			return false
+		}
+		t = sf.Type
+	}
+	return true
+}
+
+// newNode returns the node of a field of type t, or nil for a struct without
+// fields, which Parquet can't represent.
+func newNode(name string, t reflect.Type, omitEmpty bool, path []string, rep, def int, seen map[reflect.Type]bool) (*node, error) {
+	n := &node{field: &field{name: name, repetition: required}}
+	switch {
+	case t.Kind() == reflect.Ptr:
+		n.field.repetition = optional
+		t = t.Elem()
+		def++
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		n.field.repetition = repeated
+		t = t.Elem()
+		rep++
+		def++
+		n.rep = rep
+	case t.Kind() == reflect.Map || t.Kind() == reflect.Interface || omitEmpty && t.Kind() != reflect.Struct:
+		n.field.repetition = optional
+		def++
+	}
+	c := &column{path: path, converted: convertedNone, maxRep: rep, maxDef: def}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t == timeType {
+			c.physical, c.converted = typeInt64, convertedTimestampMicros
+			n.add = func(c *column, v reflect.Value, rep int) {
+				c.addInt64(v.Interface().(time.Time).UnixMicro(), rep)
+			}
+			break
+		}
+		children, err := newNodes(t, path, rep, def, seen)
+		if err != nil || len(children) == 0 {
+			return nil, err
+		}
+		n.children = children
+		for _, child := range children {
+			n.field.fields = append(n.field.fields, child.field)
+		}
+		return n, nil
+	case reflect.String:
+		c.physical, c.converted = typeByteArray, convertedUTF8
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addBytes([]byte(v.String()), rep)
+		}
+	case reflect.Bool:
+		c.physical = typeBoolean
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addBool(v.Bool(), rep)
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		c.physical = typeInt32
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addInt32(int32(v.Int()), rep)
+		}
+	case reflect.Int, reflect.Int64:
+		c.physical = typeInt64
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addInt64(v.Int(), rep)
+		}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		c.physical, c.converted = typeInt32, convertedUint32
+		if t.Kind() == reflect.Uint8 {
+			c.converted = convertedUint8
+		} else if t.Kind() == reflect.Uint16 {
+			c.converted = convertedUint16
+		}
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addInt32(int32(uint32(v.Uint())), rep)
+		}
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		c.physical, c.converted = typeInt64, convertedUint64
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addInt64(int64(v.Uint()), rep)
+		}
+	case reflect.Float32:
+		c.physical = typeFloat
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addFloat(float32(v.Float()), rep)
+		}
+	case reflect.Float64:
+		c.physical = typeDouble
+		n.add = func(c *column, v reflect.Value, rep int) {
+			c.addDouble(v.Float(), rep)
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			c.physical = typeByteArray
+			n.add = func(c *column, v reflect.Value, rep int) {
+				c.addBytes(v.Bytes(), rep)
+			}
+			break
+		}
+		fallthrough
+	default:
+		c.physical, c.converted = typeByteArray, convertedJSON
+		n.add = func(c *column, v reflect.Value, rep int) {
+			b, err := json.Marshal(v.Interface())
+			if err != nil {
+				// The JSONL archive would not have the record at all.
+				b = []byte("null")
+			}
+			c.addBytes(b, rep)
+		}
+	}
+	n.field.column = c
+	return n, nil
+}
+
+// write shreds v, the value of n, into its columns. rep is the repetition
+// level of v and def the definition level of its parent.
+func (n *node) write(v reflect.Value, rep, def int) {
+	switch n.field.repetition {
+	case repeated:
+		if v.Len() == 0 {
+			n.null(rep, def)
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			n.writeValue(v.Index(i), rep, def+1)
+			rep = n.rep
+		}
+	case optional:
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map:
+			if v.IsNil() {
+				n.null(rep, def)
+				return
+			}
+			if v.Kind() == reflect.Ptr {
+				v = v.Elem()
+			}
+		default:
+			if v.IsZero() {
+				n.null(rep, def)
+				return
+			}
+		}
+		n.writeValue(v, rep, def+1)
+	default:
+		n.writeValue(v, rep, def)
+	}
+}
+
+// writeValue shreds v, a value of n that is defined up to level def.
+func (n *node) writeValue(v reflect.Value, rep, def int) {
+	if n.add != nil {
+		n.add(n.field.column, v, rep)
+		return
+	}
+	for _, child := range n.children {
+		child.write(v.FieldByIndex(child.index), rep, def)
+	}
+}
+
+// null adds a null to every column of n.
+func (n *node) null(rep, def int) {
+	for _, c := range n.field.columns() {
+		c.addNull(rep, def)
+	}
+}
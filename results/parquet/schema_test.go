@@ -0,0 +1,169 @@
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+)
+
+type referenceNetwork struct {
+	ASN uint32
+}
+
+type referenceGeo struct {
+	Country string
+	Cities  []string
+	Network *referenceNetwork
+}
+
+type referenceTag struct {
+	Name, Value string
+}
+
+// referenceRecord has the schema of testdata/reference.parquet.
+type referenceRecord struct {
+	Name   string
+	Time   time.Time
+	Count  int64
+	Port   uint16
+	Rate   float64
+	Ratio  float32
+	OK     bool
+	Note   string `json:",omitempty"`
+	Geo    *referenceGeo
+	Tags   []referenceTag
+	RTTs   []int64
+	hidden string
+}
+
+// referenceRecords are the rows of testdata/reference.parquet, which was
+// written by github.com/xitongsys/parquet-go v1.6.2, uncompressed and PLAIN
+// encoded, with the schema of referenceRecord: Note is an optional string, Geo
+// and Network are optional groups, Cities, Tags and RTTs are repeated.
+var referenceRecords = []referenceRecord{
+	{
+		Name: "a", Time: time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC), Count: 1, Port: 3001,
+		Rate: 90.5, Ratio: 0.25, OK: true, Note: "first",
+		Geo:  &referenceGeo{Country: "US", Cities: []string{"NYC", "LGA"}, Network: &referenceNetwork{ASN: 64496}},
+		Tags: []referenceTag{{"client", "ndt7-js"}, {"os", "linux"}},
+		RTTs: []int64{10, 20, 30},
+	},
+	{
+		Name: "b", Time: time.Date(2023, 4, 5, 6, 7, 9, 0, time.UTC), Count: -2, Port: 80,
+		Ratio: 1.5, Geo: &referenceGeo{Country: "FR"}, RTTs: []int64{5},
+	},
+	{
+		Name: "c", Time: time.Date(2023, 4, 5, 6, 8, 8, 0, time.UTC), Count: 1 << 40, Port: 65535,
+		Rate: -1, Tags: []referenceTag{{"client", "ndt5"}}, hidden: "not archived",
+	},
+}
+
+func TestReference(t *testing.T) {
+	reference, err := os.ReadFile("testdata/reference.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMeta, wantSchema, wantValues := readFile(t, reference)
+
+	schema, err := newSchema(reflect.TypeOf(referenceRecord{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []*field
+	for _, n := range schema {
+		fields = append(fields, n.field)
+	}
+	var b bytes.Buffer
+	f, err := newFile(&b, fields, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range referenceRecords {
+		v := reflect.ValueOf(r)
+		for _, n := range schema {
+			n.write(v.FieldByIndex(n.index), 0, 0)
+		}
+		f.rows++
+	}
+	if err := f.close(); err != nil {
+		t.Fatal(err)
+	}
+	meta, gotSchema, gotValues := readFile(t, b.Bytes())
+
+	if meta[3] != wantMeta[3] {
+		t.Errorf("file has %v rows, want %v", meta[3], wantMeta[3])
+	}
+	if !reflect.DeepEqual(gotSchema, wantSchema) {
+		t.Errorf("schema = %v, want %v", gotSchema, wantSchema)
+	}
+	if !reflect.DeepEqual(gotValues, wantValues) {
+		t.Errorf("values = %v, want %v", gotValues, wantValues)
+	}
+	// Spot check the reference, in case the reader misreads both files alike.
+	if got := wantValues["Geo.Cities"]; !reflect.DeepEqual(got, []value{{0, 2, "NYC"}, {1, 2, "LGA"}, {0, 1, nil}, {0, 0, nil}}) {
+		t.Errorf("reference Geo.Cities = %v", got)
+	}
+	if got := wantValues["OK"]; !reflect.DeepEqual(got, []value{{0, 0, true}, {0, 0, false}, {0, 0, false}}) {
+		t.Errorf("reference OK = %v", got)
+	}
+}
+
+func TestNewSchema(t *testing.T) {
+	columns := func(t *testing.T, typ reflect.Type) map[string]*column {
+		schema, err := newSchema(typ)
+		if err != nil {
+			t.Fatalf("newSchema(%v) error = %v", typ, err)
+		}
+		all := map[string]*column{}
+		for _, n := range schema {
+			for _, c := range n.field.columns() {
+				all[fmt.Sprint(c.path)] = c
+			}
+		}
+		return all
+	}
+	tests := []struct {
+		typ            reflect.Type
+		path           string
+		physical       int32
+		converted      int32
+		maxRep, maxDef int
+	}{
+		{reflect.TypeOf(&data.NDT5Result{}), "[StartTime]", typeInt64, convertedTimestampMicros, 0, 0},
+		{reflect.TypeOf(&data.NDT5Result{}), "[Anonymization]", typeByteArray, convertedUTF8, 0, 1},
+		{reflect.TypeOf(&data.NDT5Result{}), "[ClientASN ASNumber]", typeInt32, convertedUint32, 0, 1},
+		{reflect.TypeOf(&data.NDT5Result{}), "[S2C MinRTT]", typeInt64, convertedNone, 0, 1},
+		{reflect.TypeOf(&data.NDT5Result{}), "[S2C TCPInfo RTT]", typeInt32, convertedUint32, 0, 2},
+		{reflect.TypeOf(&data.NDT5Result{}), "[S2C Snapshots TCPInfo BytesAcked]", typeInt64, convertedNone, 1, 2},
+		{reflect.TypeOf(&data.NDT5Result{}), "[Control ClientMetadata Value]", typeByteArray, convertedUTF8, 1, 2},
+		{reflect.TypeOf(&data.NDT5Result{}), "[Analysis Congestion]", typeBoolean, convertedNone, 0, 1},
+		// The fields of the embedded tcp.LinuxTCPInfo are promoted.
+		{reflect.TypeOf(&data.NDT7Result{}), "[Download ServerMeasurements TCPInfo RTT]", typeInt32, convertedUint32, 1, 3},
+		{reflect.TypeOf(&data.NDT7Result{}), "[Download ServerMeasurements TCPInfo ElapsedTime]", typeInt64, convertedNone, 1, 3},
+	}
+	for _, tt := range tests {
+		c := columns(t, tt.typ)[tt.path]
+		if c == nil {
+			t.Errorf("%v has no column %s", tt.typ, tt.path)
+			continue
+		}
+		if c.physical != tt.physical || c.converted != tt.converted || c.maxRep != tt.maxRep || c.maxDef != tt.maxDef {
+			t.Errorf("%v column %s = %+v, want type %d, converted type %d, and levels %d and %d",
+				tt.typ, tt.path, c, tt.physical, tt.converted, tt.maxRep, tt.maxDef)
+		}
+	}
+
+	type recursive struct {
+		Next *recursive
+	}
+	for _, typ := range []reflect.Type{nil, reflect.TypeOf(""), reflect.TypeOf(recursive{}), reflect.TypeOf(struct{ a int }{})} {
+		if _, err := newSchema(typ); err == nil {
+			t.Errorf("newSchema(%v) succeeded, want an error", typ)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package push sends a summary of every test to push-based monitoring
+// systems, alongside the Prometheus metrics, as statsd metrics or InfluxDB
+// line protocol points in UDP datagrams, e.g. to a statsd daemon or a Telegraf
+// socket_listener.
+//
+// Every download and upload is summarized by its rate, its minimum RTT, and,
+// for downloads, the fraction of segments that were retransmitted. The statsd
+// metrics carry their tags in the DogStatsD format:
+//
+//	ndt.download.rate_mbps:93.1|h|#protocol:ndt7,asn:64496
+//
+// and the InfluxDB points are:
+//
+//	ndt_test,protocol=ndt7,direction=download,asn=64496 rate_mbps=93.1,min_rtt_ms=12.5,loss=0.001 1680674828000000000
+package push
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/results"
+)
+
+// Point is the summary of a download or an upload.
+type Point struct {
+	// Protocol is the datatype of the result, "ndt5" or "ndt7".
+	Protocol string
+	// Direction is "download" or "upload".
+	Direction string
+	Time      time.Time
+	RateMbps  float64
+	// MinRTTMs is zero if it is unknown.
+	MinRTTMs float64
+	// Loss is the fraction of the segments that were retransmitted, or -1 if
+	// it is unknown.
+	Loss float64
+	// ASN is the autonomous system of the client, or zero if it is unknown.
+	ASN uint32
+}
+
+// Points returns the summaries of the subtests of r.
+func Points(r *results.Result) []Point {
+	var points []Point
+	switch d := r.Data.(type) {
+	case *data.NDT5Result:
+		if s := d.S2C; s != nil {
+			p := Point{Direction: "download", Time: s.EndTime, RateMbps: s.MeanThroughputMbps, Loss: -1}
+			p.MinRTTMs = float64(s.MinRTT) / float64(time.Millisecond)
+			if s.TCPInfo != nil && s.TCPInfo.DataSegsOut > 0 {
+				p.Loss = float64(s.TCPInfo.TotalRetrans) / float64(s.TCPInfo.DataSegsOut)
+			}
+			points = append(points, p)
+		}
+		if c := d.C2S; c != nil {
+			points = append(points, Point{Direction: "upload", Time: c.EndTime, RateMbps: c.MeanThroughputMbps, Loss: -1})
+		}
+		points = withClient(points, r.Datatype, d.ClientASN)
+	case *data.NDT7Result:
+		if p, ok := ndt7Point("download", d.Download); ok {
+			points = append(points, p)
+		}
+		if p, ok := ndt7Point("upload", d.Upload); ok {
+			points = append(points, p)
+		}
+		points = withClient(points, r.Datatype, d.ClientASN)
+	}
+	return points
+}
+
+// ndt7Point summarizes the ndt7 subtest a with its last TCPInfo measurement,
+// and reports whether there is one.
+func ndt7Point(direction string, a *model.ArchivalData) (Point, bool) {
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	if a == nil || len(a.ServerMeasurements) == 0 || a.ServerMeasurements[len(a.ServerMeasurements)-1].TCPInfo == nil {
+		return Point{}, false
+	}
+	info := a.ServerMeasurements[len(a.ServerMeasurements)-1].TCPInfo
+	p := Point{Direction: direction, Time: a.EndTime, Loss: -1}
+	if info.ElapsedTime > 0 {
+		bytes := info.BytesAcked
+		if direction == "upload" {
+			bytes = info.BytesReceived
+		}
+		p.RateMbps = 8 * float64(bytes) / float64(info.ElapsedTime)
+	}
+	p.MinRTTMs = float64(info.MinRTT) / 1000
+	if direction == "download" && info.SegsOut > 0 {
+		p.Loss = float64(info.TotalRetrans) / float64(info.SegsOut)
+	}
+	return p, true
+}
+
+// withClient sets the protocol and the client ASN of points.
+func withClient(points []Point, protocol string, asn *geoip.ASN) []Point {
+	for i := range points {
+		points[i].Protocol = protocol
+		if asn != nil {
+			points[i].ASN = asn.ASNumber
+		}
+	}
+	return points
+}
+
+// Format is how points are encoded.
+type Format string
+
+// The supported formats.
+const (
+	StatsD = Format("statsd")
+	Influx = Format("influx")
+)
+
+// encode returns the lines of p in format f.
+func (f Format) encode(p Point) []string {
+	if f == Influx {
+		tags := "protocol=" + p.Protocol + ",direction=" + p.Direction
+		if p.ASN != 0 {
+			tags += ",asn=" + strconv.FormatUint(uint64(p.ASN), 10)
+		}
+		fields := []string{"rate_mbps=" + formatFloat(p.RateMbps)}
+		if p.MinRTTMs > 0 {
+			fields = append(fields, "min_rtt_ms="+formatFloat(p.MinRTTMs))
+		}
+		if p.Loss >= 0 {
+			fields = append(fields, "loss="+formatFloat(p.Loss))
+		}
+		return []string{fmt.Sprintf("ndt_test,%s %s %d", tags, strings.Join(fields, ","), p.Time.UnixNano())}
+	}
+	tags := "|#protocol:" + p.Protocol
+	if p.ASN != 0 {
+		tags += ",asn:" + strconv.FormatUint(uint64(p.ASN), 10)
+	}
+	prefix := "ndt." + p.Direction + "."
+	lines := []string{prefix + "rate_mbps:" + formatFloat(p.RateMbps) + "|h" + tags}
+	if p.MinRTTMs > 0 {
+		lines = append(lines, prefix+"min_rtt:"+formatFloat(p.MinRTTMs)+"|ms"+tags)
+	}
+	if p.Loss >= 0 {
+		lines = append(lines, prefix+"loss:"+formatFloat(p.Loss)+"|h"+tags)
+	}
+	return lines
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Writer sends the points of every result to a monitoring system. It
+// implements results.Writer.
+type Writer struct {
+	format Format
+	conn   net.Conn
+}
+
+// New creates a Writer that sends points in format to the UDP address addr,
+// e.g. localhost:8125.
+func New(format Format, addr string) (*Writer, error) {
+	if format != StatsD && format != Influx {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{format: format, conn: conn}, nil
+}
+
+// Write sends the points of r, one line per datagram.
+func (w *Writer) Write(ctx context.Context, r *results.Result) error {
+	var err error
+	for _, p := range Points(r) {
+		for _, line := range w.format.encode(p) {
+			if _, werr := w.conn.Write([]byte(line)); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	if err != nil {
+		metrics.ResultsPublished.WithLabelValues(string(w.format), "error").Inc()
+		return err
+	}
+	metrics.ResultsPublished.WithLabelValues(string(w.format), "ok").Inc()
+	return nil
+}
+
+// Close closes the connection of w.
+func (w *Writer) Close() error {
+	return w.conn.Close()
+}
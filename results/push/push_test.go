@@ -0,0 +1,94 @@
+package push
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/geoip"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/results"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+var end = time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+
+func TestPoints(t *testing.T) {
+	ndt7 := &results.Result{Datatype: "ndt7", Data: &data.NDT7Result{
+		ClientASN: &geoip.ASN{ASNumber: 64496},
+		Download: &model.ArchivalData{
+			EndTime: end,
+			ServerMeasurements: []model.Measurement{{
+				TCPInfo: &model.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{BytesAcked: 10000000, MinRTT: 12500, SegsOut: 1000, TotalRetrans: 1},
+					ElapsedTime:  1000000,
+				},
+			}},
+		},
+	}}
+	want := []Point{{Protocol: "ndt7", Direction: "download", Time: end, RateMbps: 80, MinRTTMs: 12.5, Loss: 0.001, ASN: 64496}}
+	if got := Points(ndt7); !reflect.DeepEqual(got, want) {
+		t.Errorf("Points(ndt7) = %+v, want %+v", got, want)
+	}
+
+	ndt5 := &results.Result{Datatype: "ndt5", Data: &data.NDT5Result{
+		C2S: &c2s.ArchivalData{EndTime: end, MeanThroughputMbps: 20},
+		S2C: &s2c.ArchivalData{EndTime: end, MeanThroughputMbps: 90, MinRTT: 10 * time.Millisecond},
+	}}
+	want = []Point{
+		{Protocol: "ndt5", Direction: "download", Time: end, RateMbps: 90, MinRTTMs: 10, Loss: -1},
+		{Protocol: "ndt5", Direction: "upload", Time: end, RateMbps: 20, Loss: -1},
+	}
+	if got := Points(ndt5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Points(ndt5) = %+v, want %+v", got, want)
+	}
+}
+
+func TestFormat_encode(t *testing.T) {
+	p := Point{Protocol: "ndt7", Direction: "download", Time: end, RateMbps: 93.1, MinRTTMs: 12.5, Loss: 0.001, ASN: 64496}
+	if got, want := Influx.encode(p), []string{"ndt_test,protocol=ndt7,direction=download,asn=64496 rate_mbps=93.1,min_rtt_ms=12.5,loss=0.001 1680674828000000000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Influx.encode() = %q, want %q", got, want)
+	}
+	want := []string{
+		"ndt.download.rate_mbps:93.1|h|#protocol:ndt7,asn:64496",
+		"ndt.download.min_rtt:12.5|ms|#protocol:ndt7,asn:64496",
+		"ndt.download.loss:0.001|h|#protocol:ndt7,asn:64496",
+	}
+	if got := StatsD.encode(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("StatsD.encode() = %q, want %q", got, want)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w, err := New(StatsD, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r := &results.Result{Datatype: "ndt5", Data: &data.NDT5Result{C2S: &c2s.ArchivalData{MeanThroughputMbps: 20}}}
+	if err := w.Write(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "ndt.upload.rate_mbps:20|h|#protocol:ndt5"; got != want {
+		t.Errorf("got datagram %q, want %q", got, want)
+	}
+	if _, err := New(Format("graphite"), pc.LocalAddr().String()); err == nil {
+		t.Error("New() accepted an unknown format")
+	}
+}
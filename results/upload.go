@@ -0,0 +1,230 @@
+package results
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+)
+
+// Bucket is a remote object store that archive files can be uploaded to.
+type Bucket interface {
+	// Upload saves size bytes read from body as the object with the given name.
+	Upload(ctx context.Context, name string, body io.Reader, size int64) error
+}
+
+// End returns the end of the rotation period that begins at start.
+func (r Rotation) End(start time.Time) time.Time {
+	if r == Hourly {
+		return start.Add(time.Hour)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Uploader periodically uploads completed archive files to a Bucket. Files are
+// removed locally once they have been uploaded successfully.
+type Uploader struct {
+	// Bucket receives the uploaded files.
+	Bucket Bucket
+	// DataDir is the directory the Archive saves files into.
+	DataDir string
+	// Rotation must match the rotation used by the Archive.
+	Rotation Rotation
+	// Prefix is prepended to the name of every uploaded object.
+	Prefix string
+	// Node identifies this server in uploaded object names, because archive
+	// files from every server share the same local names.
+	Node string
+	// Interval is the time between scans for completed files.
+	Interval time.Duration
+	// Attempts is the number of times an upload is tried before giving up
+	// until the next scan.
+	Attempts int
+	// Backoff is the delay after the first failed attempt. It doubles after
+	// every subsequent failure.
+	Backoff time.Duration
+}
+
+// openFiles counts, for each archive file that the Archives of this process
+// are writing, the Archives writing it.
+var openFiles = struct {
+	sync.Mutex
+	names map[string]int
+}{names: map[string]int{}}
+
+// MarkOpen records that an archive file is being written, so that no Uploader
+// uploads it until MarkClosed is called for it. Archives call it when they
+// open a file.
+func MarkOpen(name string) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	openFiles.names[filepath.Clean(name)]++
+}
+
+// MarkClosed records that an archive file that MarkOpen was called for is
+// closed.
+func MarkClosed(name string) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	name = filepath.Clean(name)
+	if openFiles.names[name]--; openFiles.names[name] <= 0 {
+		delete(openFiles.names, name)
+	}
+}
+
+// isOpen reports whether an Archive of this process is writing name.
+func isOpen(name string) bool {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	return openFiles.names[filepath.Clean(name)] > 0
+}
+
+// settleTime is how long after the end of its rotation period a file is
+// assumed to be complete. It protects writes that started just before the
+// period ended.
+const settleTime = time.Minute
+
+// ObjectName returns the name of the object for the archive file at path,
+// which must be inside the DataDir. Objects keep the archive's directory
+// layout, and the Node is added to the file name, e.g.
+//
+//	<prefix>/ndt5/2022/01/02/ndt5-20220102T000000Z-<node>.jsonl.gz
+func (u *Uploader) ObjectName(path string) (string, error) {
+	rel, err := filepath.Rel(u.DataDir, path)
+	if err != nil {
+		return "", err
+	}
+	dir, base := filepath.Split(filepath.ToSlash(rel))
+	if i := strings.Index(base, "."); i >= 0 && u.Node != "" {
+		base = base[:i] + "-" + u.Node + base[i:]
+	}
+	name := dir + base
+	if u.Prefix != "" {
+		name = strings.TrimSuffix(u.Prefix, "/") + "/" + name
+	}
+	return name, nil
+}
+
+// completed returns the archive files whose rotation periods ended before now,
+// and that no Archive of this process is still writing.
+func (u *Uploader) completed(now time.Time) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.jsonl*", "*.parquet"} {
+		matches, err := filepath.Glob(filepath.Join(u.DataDir, "*", "*", "*", "*", pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	done := []string{}
+	for _, f := range files {
+		// Archive file names are <datatype>-<period start>.jsonl[.gz] or
+		// <datatype>-<period start>[.<n>].parquet.
+		base := filepath.Base(f)
+		base = base[:strings.Index(base, ".")]
+		i := strings.LastIndex(base, "-")
+		if i < 0 {
+			continue
+		}
+		start, err := time.Parse("20060102T150405Z", base[i+1:])
+		if err != nil {
+			continue
+		}
+		if u.Rotation.End(start).Add(settleTime).Before(now) && !isOpen(f) {
+			done = append(done, f)
+		}
+	}
+	return done, nil
+}
+
+// upload tries to upload a single file, backing off between failed attempts.
+func (u *Uploader) upload(ctx context.Context, path string) error {
+	name, err := u.ObjectName(path)
+	if err != nil {
+		return err
+	}
+	backoff := u.Backoff
+	attempts := u.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for i := 0; ; i++ {
+		err = u.uploadOnce(ctx, path, name)
+		if err == nil || i+1 >= attempts {
+			return err
+		}
+		logging.Logger.WithError(err).WithFields(log.Fields{
+			"path":     path,
+			"attempt":  i + 1,
+			"attempts": attempts,
+		}).Warn("Upload failed")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (u *Uploader) uploadOnce(ctx context.Context, path, name string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	return u.Bucket.Upload(ctx, name, fp, info.Size())
+}
+
+// UploadCompleted uploads and then removes every completed archive file. It
+// returns the number of files uploaded. A file that can't be uploaded is left
+// in place to be retried later.
+func (u *Uploader) UploadCompleted(ctx context.Context) (int, error) {
+	files, err := u.completed(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		if err := u.upload(ctx, f); err != nil {
+			logging.Logger.WithError(err).WithField("path", f).Warn("Could not upload")
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			logging.Logger.WithError(err).WithField("path", f).Warn("Could not remove uploaded file")
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Run uploads completed files every Interval until ctx is canceled.
+func (u *Uploader) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+	for {
+		if n, err := u.UploadCompleted(ctx); err != nil {
+			logging.Logger.WithError(err).Warn("Could not upload archive files")
+		} else if n > 0 {
+			logging.Logger.WithField("files", n).Info("Uploaded archive files")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
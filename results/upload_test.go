@@ -0,0 +1,113 @@
+package results
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeBucket struct {
+	objects  map[string]string
+	failures int
+}
+
+func (f *fakeBucket) Upload(ctx context.Context, name string, body io.Reader, size int64) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("fake upload error")
+	}
+	b, _ := io.ReadAll(body)
+	f.objects[name] = string(b)
+	return nil
+}
+
+func writeFile(t *testing.T, dir string, start time.Time) string {
+	name := filepath.Join(dir, "ndt5", start.Format("2006/01/02"), "ndt5-"+start.Format("20060102T150405Z")+".jsonl")
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestUploader_UploadCompleted(t *testing.T) {
+	dir := t.TempDir()
+	old := writeFile(t, dir, time.Date(2022, 1, 2, 3, 0, 0, 0, time.UTC))
+	current := writeFile(t, dir, Hourly.Start(time.Now()))
+	b := &fakeBucket{objects: map[string]string{}, failures: 1}
+	u := &Uploader{
+		Bucket:   b,
+		DataDir:  dir,
+		Rotation: Hourly,
+		Prefix:   "ndt/",
+		Node:     "mlab1-abc01",
+		Attempts: 2,
+		Backoff:  time.Millisecond,
+	}
+	n, err := u.UploadCompleted(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("UploadCompleted() = %d, %v, want 1, nil", n, err)
+	}
+	want := "ndt/ndt5/2022/01/02/ndt5-20220102T030000Z-mlab1-abc01.jsonl"
+	if b.objects[want] != "{}\n" {
+		t.Errorf("uploaded objects %v, want %q", b.objects, want)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("uploaded file was not removed")
+	}
+	if _, err := os.Stat(current); err != nil {
+		t.Error("file for the current period should not be uploaded")
+	}
+}
+
+func TestUploader_UploadCompletedFailure(t *testing.T) {
+	dir := t.TempDir()
+	old := writeFile(t, dir, time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC))
+	b := &fakeBucket{objects: map[string]string{}, failures: 3}
+	u := &Uploader{Bucket: b, DataDir: dir, Rotation: Daily, Attempts: 3, Backoff: time.Millisecond}
+	if n, _ := u.UploadCompleted(context.Background()); n != 0 {
+		t.Errorf("UploadCompleted() = %d, want 0", n)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Error("file that failed to upload should be kept")
+	}
+}
+
+func TestUploader_completedParquet(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	name := filepath.Join(dir, "ndt7", "2022", "01", "02", "ndt7-20220102T000000Z.1.parquet")
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte("PAR1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := &Uploader{DataDir: dir, Rotation: Daily}
+	if got, err := u.completed(start.Add(time.Hour)); err != nil || len(got) != 0 {
+		t.Errorf("completed() during the period = %v, %v", got, err)
+	}
+	if got, err := u.completed(start.AddDate(0, 0, 2)); err != nil || len(got) != 1 || got[0] != name {
+		t.Errorf("completed() = %v, %v, want [%s]", got, err, name)
+	}
+}
+
+func TestUploader_completedOpen(t *testing.T) {
+	dir := t.TempDir()
+	name := writeFile(t, dir, time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC))
+	u := &Uploader{DataDir: dir, Rotation: Daily}
+	MarkOpen(name)
+	if got, err := u.completed(time.Now()); err != nil || len(got) != 0 {
+		t.Errorf("completed() with the file open = %v, %v", got, err)
+	}
+	MarkClosed(name)
+	if got, err := u.completed(time.Now()); err != nil || len(got) != 1 || got[0] != name {
+		t.Errorf("completed() = %v, %v, want [%s]", got, err, name)
+	}
+}
@@ -0,0 +1,252 @@
+// Package webhook delivers results to HTTPS endpoints, for lightweight
+// integrations without a message bus. Every result is POSTed as JSON to every
+// endpoint, with a signature that lets the endpoint verify that it comes from
+// the server:
+//
+//	X-Ndt-Signature-256: sha256=<hex HMAC-SHA256 of the body with the secret>
+//
+// Deliveries that still fail after the last attempt, or that are left when
+// the server shuts down, are appended to a dead-letter file as lines of JSON,
+// so that they can be replayed.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/results"
+)
+
+const (
+	// maxQueuedDeliveries is the number of deliveries that may wait to be
+	// sent. Deliveries of results that are written while the queue is full
+	// go straight to the dead-letter file.
+	maxQueuedDeliveries = 10000
+	// workers is the number of deliveries that are sent at once.
+	workers = 4
+)
+
+// delivery is a result to deliver to a single endpoint.
+type delivery struct {
+	URL      string
+	UUID     string
+	Datatype string
+	Body     json.RawMessage
+}
+
+// DeadLetter is a line of the dead-letter file.
+type DeadLetter struct {
+	URL      string
+	UUID     string
+	Datatype string
+	// Body is the result that could not be delivered.
+	Body json.RawMessage
+	// Error is why the delivery failed.
+	Error string
+	Time  time.Time
+}
+
+// Sender delivers results to webhooks. It implements results.Writer.
+type Sender struct {
+	urls       []string
+	secret     []byte
+	deadLetter string
+	client     *http.Client
+	deliveries chan delivery
+	wg         sync.WaitGroup
+
+	mu sync.Mutex // Serializes the writes to the dead-letter file.
+
+	// Attempts is the number of times a delivery is tried before it is
+	// written to the dead-letter file.
+	Attempts int
+	// Backoff is the delay after the first failed attempt. It doubles after
+	// every subsequent failure.
+	Backoff time.Duration
+}
+
+// New creates a Sender that signs results with secret, delivers them to every
+// one of the https urls, and appends the failed deliveries to the deadLetter
+// file. Results are only delivered while Run is running.
+func New(urls []string, secret []byte, deadLetter string) (*Sender, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no webhook URLs")
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "https" {
+			return nil, fmt.Errorf("invalid webhook URL %q: must be an https URL", u)
+		}
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty webhook secret")
+	}
+	return &Sender{
+		urls:       urls,
+		secret:     secret,
+		deadLetter: deadLetter,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		deliveries: make(chan delivery, maxQueuedDeliveries),
+		Attempts:   5,
+		Backoff:    time.Second,
+	}, nil
+}
+
+// Write queues the delivery of r to every webhook.
+func (s *Sender) Write(ctx context.Context, r *results.Result) error {
+	body, err := json.Marshal(r.Data)
+	if err != nil {
+		return err
+	}
+	for _, u := range s.urls {
+		d := delivery{URL: u, UUID: r.UUID, Datatype: r.Datatype, Body: body}
+		select {
+		case s.deliveries <- d:
+		default:
+			s.fail(d, errors.New("the delivery queue is full"))
+		}
+	}
+	return nil
+}
+
+// Close writes the deliveries that were not sent to the dead-letter file. It
+// waits for Run to return, so the context of Run must be done.
+func (s *Sender) Close() error {
+	s.wg.Wait()
+	for {
+		select {
+		case d := <-s.deliveries:
+			s.fail(d, errors.New("the server shut down"))
+		default:
+			return nil
+		}
+	}
+}
+
+// Run sends the queued deliveries until ctx is canceled.
+func (s *Sender) Run(ctx context.Context) {
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				select {
+				case d := <-s.deliveries:
+					if err := s.deliver(ctx, d); err != nil {
+						s.fail(d, err)
+					} else {
+						metrics.ResultsPublished.WithLabelValues("webhook", "ok").Inc()
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	s.wg.Wait()
+}
+
+// deliver tries to send d, backing off between failed attempts.
+func (s *Sender) deliver(ctx context.Context, d delivery) error {
+	backoff := s.Backoff
+	attempts := s.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for i := 0; ; i++ {
+		err := s.send(ctx, d)
+		if err == nil || i+1 >= attempts {
+			return err
+		}
+		logging.Logger.WithError(err).WithFields(log.Fields{
+			"url":      d.URL,
+			"uuid":     d.UUID,
+			"attempt":  i + 1,
+			"attempts": attempts,
+		}).Warn("Webhook delivery failed")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Sign returns the value of the X-Ndt-Signature-256 header of body.
+func Sign(secret, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Sender) send(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ndt-Datatype", d.Datatype)
+	req.Header.Set("X-Ndt-Uuid", d.UUID)
+	req.Header.Set("X-Ndt-Signature-256", Sign(s.secret, d.Body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// fail appends d to the dead-letter file.
+func (s *Sender) fail(d delivery, err error) {
+	metrics.ResultsPublished.WithLabelValues("webhook", "error").Inc()
+	logger := logging.Logger.WithError(err).WithFields(log.Fields{"url": d.URL, "uuid": d.UUID})
+	line, jerr := json.Marshal(DeadLetter{
+		URL:      d.URL,
+		UUID:     d.UUID,
+		Datatype: d.Datatype,
+		Body:     d.Body,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	})
+	if jerr != nil {
+		logger.WithField("encoding_error", jerr).Error("Could not deliver result, nor encode the dead letter")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ferr := os.OpenFile(s.deadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if ferr == nil {
+		_, ferr = f.Write(append(line, '\n'))
+		if cerr := f.Close(); ferr == nil {
+			ferr = cerr
+		}
+	}
+	if ferr != nil {
+		logger.WithField("dead_letter_error", ferr).Error("Could not deliver result, nor save it in the dead-letter file")
+		return
+	}
+	logger.Warn("Could not deliver result, saved it in the dead-letter file")
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/results"
+)
+
+func TestSender(t *testing.T) {
+	secret := []byte("secret")
+	var mu sync.Mutex
+	delivered := map[string]string{}
+	ok := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get("X-Ndt-Signature-256"), Sign(secret, body); got != want {
+			t.Errorf("got signature %q, want %q", got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[r.Header.Get("X-Ndt-Uuid")] = string(body)
+	}))
+	defer ok.Close()
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	s, err := New([]string{ok.URL, failing.URL}, secret, deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both test servers use the same certificate.
+	s.client = ok.Client()
+	s.Attempts = 2
+	s.Backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	if err := s.Write(ctx, &results.Result{Datatype: "ndt7", UUID: "uuid", Data: map[string]int{"x": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the failed delivery is in the dead-letter file.
+	for {
+		if fi, err := os.Stat(deadLetter); err == nil && fi.Size() > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	s.Close()
+
+	if delivered["uuid"] != `{"x":1}` {
+		t.Errorf("got deliveries %v", delivered)
+	}
+	f, err := os.Open(deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var letters []DeadLetter
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var l DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, l)
+	}
+	if len(letters) != 1 || letters[0].URL != failing.URL || letters[0].UUID != "uuid" || string(letters[0].Body) != `{"x":1}` {
+		t.Errorf("got dead letters %+v", letters)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New([]string{"http://example.com/hook"}, []byte("secret"), "dead"); err == nil {
+		t.Error("New() accepted an http URL")
+	}
+	if _, err := New([]string{"https://example.com/hook"}, nil, "dead"); err == nil {
+		t.Error("New() accepted an empty secret")
+	}
+	if _, err := New(nil, []byte("secret"), "dead"); err == nil {
+		t.Error("New() accepted no URLs")
+	}
+}
@@ -0,0 +1,117 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Writer saves completed results. Write is called once for every completed
+// test, possibly concurrently, so implementations must be safe for concurrent
+// use. New destinations for results should implement this interface.
+type Writer interface {
+	Write(ctx context.Context, r *Result) error
+	Close() error
+}
+
+type nullWriter struct{}
+
+func (nullWriter) Write(context.Context, *Result) error { return nil }
+func (nullWriter) Close() error                         { return nil }
+
+// NullWriter returns a Writer that discards all results.
+func NullWriter() Writer {
+	return nullWriter{}
+}
+
+// jsonWriter writes results as JSON lines to an io.Writer.
+type jsonWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONWriter returns a Writer that writes every result's data as a line of
+// JSON to w, e.g. os.Stdout. Closing the returned Writer does not close w.
+func NewJSONWriter(w io.Writer) Writer {
+	return &jsonWriter{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonWriter) Write(ctx context.Context, r *Result) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(r.Data)
+}
+
+func (j *jsonWriter) Close() error { return nil }
+
+// multiWriter writes every result to all of its writers.
+type multiWriter []Writer
+
+// NewMultiWriter returns a Writer that writes every result to each of the
+// given writers in order. All writers are tried, and the first error is
+// returned.
+func NewMultiWriter(writers ...Writer) Writer {
+	switch len(writers) {
+	case 0:
+		return NullWriter()
+	case 1:
+		return writers[0]
+	}
+	return multiWriter(writers)
+}
+
+func (m multiWriter) Write(ctx context.Context, r *Result) error {
+	var firstErr error
+	for _, w := range m {
+		if err := w.Write(ctx, r); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m multiWriter) Close() error {
+	var firstErr error
+	for _, w := range m {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Swappable is a Writer whose underlying Writer can be replaced while results
+// are being written, e.g. when the configuration of the writers is reloaded.
+type Swappable struct {
+	mu sync.RWMutex
+	w  Writer
+}
+
+// NewSwappable returns a Swappable that writes to w until it is swapped.
+func NewSwappable(w Writer) *Swappable {
+	return &Swappable{w: w}
+}
+
+// Swap makes s write to w, and returns the Writer it replaced once no result
+// is being written to it, so that it can be closed.
+func (s *Swappable) Swap(w Writer) Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.w
+	s.w = w
+	return old
+}
+
+func (s *Swappable) Write(ctx context.Context, r *Result) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.w.Write(ctx, r)
+}
+
+// Close closes the current Writer of s.
+func (s *Swappable) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.w.Close()
+}
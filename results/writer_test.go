@@ -0,0 +1,86 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeWriter struct {
+	written []*Result
+	err     error
+	closed  bool
+}
+
+func (f *fakeWriter) Write(ctx context.Context, r *Result) error {
+	f.written = append(f.written, r)
+	return f.err
+}
+
+func (f *fakeWriter) Close() error {
+	f.closed = true
+	return f.err
+}
+
+func TestNewJSONWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewJSONWriter(buf)
+	w.Write(context.Background(), &Result{Data: map[string]int{"a": 1}})
+	w.Write(context.Background(), &Result{Data: map[string]int{"b": 2}})
+	if err := w.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if got, want := buf.String(), "{\"a\":1}\n{\"b\":2}\n"; got != want {
+		t.Errorf("NewJSONWriter() wrote %q, want %q", got, want)
+	}
+}
+
+func TestNewMultiWriter(t *testing.T) {
+	if _, ok := NewMultiWriter().(nullWriter); !ok {
+		t.Error("NewMultiWriter() with no writers should return a NullWriter")
+	}
+	f := &fakeWriter{}
+	if NewMultiWriter(f) != Writer(f) {
+		t.Error("NewMultiWriter() with one writer should return it")
+	}
+	failing := &fakeWriter{err: errors.New("fake error")}
+	ok := &fakeWriter{}
+	m := NewMultiWriter(failing, ok)
+	r := &Result{UUID: "x"}
+	if err := m.Write(context.Background(), r); err != failing.err {
+		t.Errorf("Write() error = %v, want %v", err, failing.err)
+	}
+	if len(ok.written) != 1 || ok.written[0] != r {
+		t.Error("Write() should write to every writer despite errors")
+	}
+	if err := m.Close(); err != failing.err || !ok.closed {
+		t.Errorf("Close() error = %v, closed = %t", err, ok.closed)
+	}
+}
+
+func TestNullWriter(t *testing.T) {
+	w := NullWriter()
+	if err := w.Write(context.Background(), &Result{}); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSwappable(t *testing.T) {
+	first, second := &fakeWriter{}, &fakeWriter{}
+	s := NewSwappable(first)
+	s.Write(context.Background(), &Result{UUID: "a"})
+	if old := s.Swap(second); old != Writer(first) {
+		t.Errorf("Swap() = %v, want the first writer", old)
+	}
+	s.Write(context.Background(), &Result{UUID: "b"})
+	if len(first.written) != 1 || len(second.written) != 1 || second.written[0].UUID != "b" {
+		t.Errorf("results were written to %v and %v", first.written, second.written)
+	}
+	if err := s.Close(); err != nil || !second.closed || first.closed {
+		t.Errorf("Close() = %v, should close only the current writer", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package retention removes the files of the data directory once they are
+// older than a configurable age, and compresses the ones that are kept, so
+// that long-running servers do not fill their disks.
+//
+// Every kind of data file is saved in a directory of the day it was created:
+//
+//	<datadir>/<kind>/YYYY/MM/DD/
+//
+// where the kind is a datatype of results, e.g. ndt7, or pcap or traceroute.
+// The age of a file is the time since the end of its day, so a file is never
+// touched while it may still be written. Files outside of this layout, e.g.
+// the webhook dead letters, are left alone.
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// settleTime is how long after the end of its day a file is assumed to be
+// complete. It covers the tests, traceroutes, and captures that started just
+// before midnight.
+const settleTime = 10 * time.Minute
+
+// Policy says how long the files of a kind are kept.
+type Policy struct {
+	// MaxAge is the age after which files are removed. Zero means files are
+	// kept forever.
+	MaxAge time.Duration
+	// CompressAfter is the age after which files are compressed with gzip,
+	// unless they already are. Zero means files are never compressed.
+	CompressAfter time.Duration
+}
+
+// Cleaner periodically applies the retention policies to the files of a data
+// directory.
+type Cleaner struct {
+	// DataDir is the directory the results, traceroutes, and packet captures
+	// are saved into.
+	DataDir string
+	// Default is the policy of the kinds that are not in Kinds.
+	Default Policy
+	// Kinds are the policies of specific kinds of files, e.g. pcap.
+	Kinds map[string]Policy
+	// Interval is the time between scans of the data directory.
+	Interval time.Duration
+}
+
+// policy returns the policy of the files of kind.
+func (c *Cleaner) policy(kind string) Policy {
+	if p, ok := c.Kinds[kind]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// Stats counts the files that a scan removed and compressed, and the bytes
+// that it reclaimed.
+type Stats struct {
+	Removed    int
+	Compressed int
+	Bytes      int64
+}
+
+// Clean removes and compresses the files that are too old at now. Files that
+// can't be handled are logged and left in place to be retried by the next
+// scan.
+func (c *Cleaner) Clean(ctx context.Context, now time.Time) (Stats, error) {
+	var stats Stats
+	days, err := filepath.Glob(filepath.Join(c.DataDir, "*", "*", "*", "*"))
+	if err != nil {
+		return stats, err
+	}
+	for _, day := range days {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		rel, err := filepath.Rel(c.DataDir, day)
+		if err != nil {
+			continue
+		}
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		start, err := time.Parse("2006/01/02", parts[1])
+		if err != nil {
+			continue
+		}
+		kind := parts[0]
+		p := c.policy(kind)
+		age := now.Sub(start.AddDate(0, 0, 1).Add(settleTime))
+		switch {
+		case p.MaxAge > 0 && age > p.MaxAge:
+			c.removeDay(kind, day, &stats)
+		case p.CompressAfter > 0 && age > p.CompressAfter:
+			c.compressDay(kind, day, &stats)
+		}
+	}
+	return stats, nil
+}
+
+// files returns the regular files in the day directory.
+func files(day string) []os.FileInfo {
+	entries, err := os.ReadDir(day)
+	if err != nil {
+		return nil
+	}
+	var infos []os.FileInfo
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// removeDay removes the files of the day directory, and then the directories
+// that it leaves empty.
+func (c *Cleaner) removeDay(kind, day string, stats *Stats) {
+	for _, info := range files(day) {
+		name := filepath.Join(day, info.Name())
+		if err := os.Remove(name); err != nil {
+			metrics.RetentionFiles.WithLabelValues(kind, "error").Inc()
+			logging.Logger.WithError(err).WithField("path", name).Warn("Could not remove expired file")
+			continue
+		}
+		metrics.RetentionFiles.WithLabelValues(kind, "removed").Inc()
+		metrics.RetentionReclaimedBytes.WithLabelValues(kind, "removed").Add(float64(info.Size()))
+		stats.Removed++
+		stats.Bytes += info.Size()
+	}
+	// Removing a directory that is not empty fails, which stops at the first
+	// month or year that still has files.
+	for dir := day; dir != filepath.Join(c.DataDir, kind); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// compressDay compresses the files of the day directory that are not already
+// compressed.
+func (c *Cleaner) compressDay(kind, day string, stats *Stats) {
+	for _, info := range files(day) {
+		// Parquet files are compressed page by page, if at all, and must stay
+		// readable as they are.
+		if strings.HasSuffix(info.Name(), ".gz") || strings.HasSuffix(info.Name(), ".parquet") ||
+			strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		name := filepath.Join(day, info.Name())
+		size, err := compress(name, info)
+		if err != nil {
+			metrics.RetentionFiles.WithLabelValues(kind, "error").Inc()
+			logging.Logger.WithError(err).WithField("path", name).Warn("Could not compress old file")
+			continue
+		}
+		reclaimed := info.Size() - size
+		metrics.RetentionFiles.WithLabelValues(kind, "compressed").Inc()
+		metrics.RetentionReclaimedBytes.WithLabelValues(kind, "compressed").Add(float64(reclaimed))
+		stats.Compressed++
+		stats.Bytes += reclaimed
+	}
+}
+
+// compress replaces the file name with name.gz, and returns the size of the
+// compressed file. The compressed file keeps the modification time of the
+// original one.
+func compress(name string, info os.FileInfo) (int64, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	// The temporary file is hidden from the uploader, which only looks for
+	// archive file names, until it is complete.
+	out, err := os.CreateTemp(filepath.Dir(name), ".retention-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	compressed, err := os.Stat(out.Name())
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		return 0, err
+	}
+	if err := os.Chtimes(out.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(out.Name(), name+".gz"); err != nil {
+		return 0, err
+	}
+	return compressed.Size(), os.Remove(name)
+}
+
+// Run scans the data directory every Interval until ctx is canceled.
+func (c *Cleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if s, err := c.Clean(ctx, time.Now()); err != nil {
+			logging.Logger.WithError(err).Warn("Could not apply the retention policy")
+		} else if s.Removed > 0 || s.Compressed > 0 {
+			logging.Logger.WithFields(log.Fields{
+				"removed":    s.Removed,
+				"compressed": s.Compressed,
+				"bytes":      s.Bytes,
+			}).Info("Applied the retention policy")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, kind string, day time.Time, name, content string) string {
+	path := filepath.Join(dir, kind, day.Format("2006/01/02"), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestCleaner_Clean(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	content := strings.Repeat("{\"UUID\":\"abc\"}\n", 100)
+	oldResult := writeFile(t, dir, "ndt7", now.AddDate(0, 0, -30), "ndt7-download.json", content)
+	recentResult := writeFile(t, dir, "ndt7", now.AddDate(0, 0, -3), "ndt7-download.json", content)
+	compressed := writeFile(t, dir, "ndt7", now.AddDate(0, 0, -3), "ndt7-upload.json.gz", "gz")
+	parquet := writeFile(t, dir, "ndt7", now.AddDate(0, 0, -3), "ndt7-20220307T000000Z.parquet", content)
+	yesterday := writeFile(t, dir, "ndt7", now.AddDate(0, 0, -1), "ndt7-download.json", content)
+	oldPcap := writeFile(t, dir, "pcap", now.AddDate(0, 0, -3), "pcap-abc.pcap", content)
+	other := filepath.Join(dir, "webhook-dead-letters.jsonl")
+	if err := os.WriteFile(other, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cleaner{
+		DataDir: dir,
+		Default: Policy{MaxAge: 7 * 24 * time.Hour, CompressAfter: 24 * time.Hour},
+		Kinds:   map[string]Policy{"pcap": {MaxAge: 24 * time.Hour}},
+	}
+	stats, err := c.Clean(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 2 || stats.Compressed != 1 || stats.Bytes <= int64(2*len(content)) {
+		t.Errorf("Clean() = %+v, want 2 removed and 1 compressed", stats)
+	}
+	for _, path := range []string{oldResult, oldPcap, recentResult} {
+		if exists(path) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	if exists(filepath.Join(dir, "ndt7", "2022", "02")) {
+		t.Errorf("empty directories were not removed")
+	}
+	for _, path := range []string{compressed, parquet, yesterday, other} {
+		if !exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+
+	fp, err := os.Open(recentResult + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil || string(b) != content {
+		t.Errorf("compressed file = %q, %v, want %q", b, err, content)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(recentResult))
+	if len(entries) != 3 {
+		t.Errorf("day directory has %d files, want 3", len(entries))
+	}
+}
+
+func TestCleaner_Clean_keepForever(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	path := writeFile(t, dir, "ndt5", now.AddDate(-1, 0, 0), "ndt5-result.json", "{}")
+	stats, err := (&Cleaner{DataDir: dir}).Clean(context.Background(), now)
+	if err != nil || stats != (Stats{}) {
+		t.Errorf("Clean() = %+v, %v, want nothing done", stats, err)
+	}
+	if !exists(path) {
+		t.Errorf("%s was removed", path)
+	}
+}
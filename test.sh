@@ -14,3 +14,6 @@ else
   go test -v -coverprofile=ndt.cov -coverpkg=./... -tags netgo ./...
   /go/bin/goveralls -coverprofile=ndt.cov -service=travis-ci
 fi
+
+# Run the end-to-end tests against the server binary.
+go test -v -tags e2e ./e2e
@@ -0,0 +1,145 @@
+// Package traceroute runs a traceroute toward the client of every test once
+// the test is over, with an external tool such as scamper, and saves the path
+// in the data directory next to the test results. Each client is traced at
+// most once per interval, so that frequent testers do not cause a flood of
+// traceroutes.
+package traceroute
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/live"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/metrics"
+)
+
+// maxRunning is the maximum number of traceroutes that run at once. Tests
+// that end while as many are running are not traced.
+const maxRunning = 8
+
+// Tracer traces the path to the clients of tests that are over. A nil *Tracer
+// traces nothing.
+type Tracer struct {
+	ctx      context.Context
+	datadir  string
+	command  []string
+	interval time.Duration
+	timeout  time.Duration
+	clock    clock.Clock
+	running  chan struct{}
+	wg       sync.WaitGroup
+
+	mu   sync.Mutex
+	last map[string]time.Time // When each client was last traced.
+}
+
+// New creates a Tracer that runs command, with the IP of the client appended
+// to its arguments, for at most timeout, and saves its output in datadir. The
+// command is e.g. "scamper -O json -i". Each client is traced at most once per
+// interval. Traceroutes stop when ctx is done.
+func New(ctx context.Context, datadir string, command []string, interval, timeout time.Duration) *Tracer {
+	return &Tracer{
+		ctx:      ctx,
+		datadir:  datadir,
+		command:  command,
+		interval: interval,
+		timeout:  timeout,
+		clock:    clock.Real,
+		running:  make(chan struct{}, maxRunning),
+		last:     map[string]time.Time{},
+	}
+}
+
+// WithClock makes t tell the time with c, e.g. a fake clock in tests, and
+// returns t.
+func (t *Tracer) WithClock(c clock.Clock) *Tracer {
+	t.clock = c
+	return t
+}
+
+// allow reports whether the client at ip may be traced now, and if so records
+// that it was.
+func (t *Tracer) allow(ip string) bool {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for client, last := range t.last {
+		if now.Sub(last) >= t.interval {
+			delete(t.last, client)
+		}
+	}
+	if _, ok := t.last[ip]; ok {
+		return false
+	}
+	t.last[ip] = now
+	return true
+}
+
+// TestStarted does nothing. With TestDone, it makes t a live.Observer.
+func (t *Tracer) TestStarted(live.Status) {}
+
+// TestDone starts a traceroute toward the client of the test s, unless the
+// client was traced recently or too many traceroutes are running.
+func (t *Tracer) TestDone(s live.Status) {
+	if t == nil || s.ClientIP == "" {
+		return
+	}
+	if !t.allow(s.ClientIP) {
+		metrics.Traceroutes.WithLabelValues("rate-limited").Inc()
+		return
+	}
+	select {
+	case t.running <- struct{}{}:
+	default:
+		metrics.Traceroutes.WithLabelValues("busy").Inc()
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() { <-t.running }()
+		t.trace(s.UUID, s.ClientIP)
+	}()
+}
+
+// trace runs the traceroute toward ip for the test uuid and saves its output.
+func (t *Tracer) trace(uuid, ip string) {
+	logger := logging.Logger.WithField("uuid", uuid)
+	start := t.clock.Now().UTC()
+	ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+	defer cancel()
+	args := append(append([]string{}, t.command[1:]...), ip)
+	out, err := exec.CommandContext(ctx, t.command[0], args...).Output()
+	if err != nil {
+		metrics.Traceroutes.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not trace the path to the client")
+		return
+	}
+	dir := path.Join(t.datadir, "traceroute", start.Format("2006/01/02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		metrics.Traceroutes.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not create the traceroute directory")
+		return
+	}
+	name := path.Join(dir, "traceroute-"+start.Format("20060102T150405.000000000Z")+"."+uuid+".jsonl")
+	if err := os.WriteFile(name, out, 0644); err != nil {
+		metrics.Traceroutes.WithLabelValues("error").Inc()
+		logger.WithError(err).Warn("Could not save the traceroute")
+		return
+	}
+	metrics.Traceroutes.WithLabelValues("ok").Inc()
+}
+
+// Wait waits until the running traceroutes are over.
+func (t *Tracer) Wait() {
+	if t == nil {
+		return
+	}
+	t.wg.Wait()
+}
@@ -0,0 +1,60 @@
+package traceroute
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/clock"
+	"github.com/m-lab/ndt-server/live"
+)
+
+func TestTracer(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewFake(time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC))
+	tr := New(context.Background(), dir, []string{"echo", "trace"}, 10*time.Minute, time.Minute).WithClock(c)
+
+	tr.TestDone(live.Status{UUID: "first", ClientIP: "192.0.2.1"})
+	// The same client is not traced again within the interval.
+	tr.TestDone(live.Status{UUID: "second", ClientIP: "192.0.2.1"})
+	c.Advance(10 * time.Minute)
+	tr.TestDone(live.Status{UUID: "third", ClientIP: "192.0.2.1"})
+	tr.Wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "traceroute", "2023", "04", "05", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got traceroutes %v, want 2", files)
+	}
+	for _, uuid := range []string{"first", "third"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, "traceroute", "2023", "04", "05", "traceroute-*."+uuid+".jsonl"))
+		if len(matches) != 1 {
+			t.Errorf("no traceroute for test %s", uuid)
+			continue
+		}
+		b, err := os.ReadFile(matches[0])
+		if err != nil || string(b) != "trace 192.0.2.1\n" {
+			t.Errorf("traceroute of test %s is %q, %v", uuid, b, err)
+		}
+	}
+}
+
+func TestTracer_Error(t *testing.T) {
+	dir := t.TempDir()
+	tr := New(context.Background(), dir, []string{"false"}, time.Minute, time.Minute)
+	tr.TestDone(live.Status{UUID: "uuid", ClientIP: "192.0.2.1"})
+	tr.Wait()
+	if _, err := os.Stat(filepath.Join(dir, "traceroute")); !os.IsNotExist(err) {
+		t.Errorf("a failed traceroute was saved: %v", err)
+	}
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tr *Tracer
+	tr.TestDone(live.Status{UUID: "uuid", ClientIP: "192.0.2.1"})
+	tr.Wait()
+}
@@ -0,0 +1,54 @@
+// Package tracing sends OpenTelemetry spans of the steps of a test to an
+// OTLP/HTTP collector, so that slow or failing tests can be traced end to end.
+//
+// The servers trace with otel.Tracer, so they use the global TracerProvider
+// and send nothing until one is set with otel.SetTracerProvider. Programs that
+// embed the servers can share their own provider the same way.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewProvider returns a TracerProvider that sends the spans of the named
+// service in batches to endpoint, the URL of the OTLP/HTTP traces endpoint of
+// a collector, such as http://localhost:4318/v1/traces. The provider must be
+// shut down to send the last batch.
+func NewProvider(ctx context.Context, endpoint, service string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL, semconv.ServiceName(service))),
+	), nil
+}
+
+// FromRequest returns the context of r with the trace context that the client
+// sent in its headers, such as a W3C traceparent, so that the spans of the
+// request join the client's trace. The global propagator reads the headers.
+func FromRequest(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// SetError records err on span and marks the span as failed. A nil err does
+// nothing.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,142 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewProvider(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("got path %q, want /v1/traces", r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+		requests <- req
+	}))
+	defer collector.Close()
+
+	ctx := context.Background()
+	tp, err := NewProvider(ctx, collector.URL+"/v1/traces", "ndt-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := tp.Tracer("test")
+	ctx, parent := tracer.Start(ctx, "parent", trace.WithSpanKind(trace.SpanKindServer))
+	parent.SetAttributes(attribute.String("uuid", "abc"))
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(attribute.Int("bytes", 10))
+	SetError(child, errors.New("failed"))
+	child.End()
+	parent.End()
+	// Shutting down sends the batch.
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %v, want one resource and scope", req)
+	}
+	found := false
+	for _, a := range req.ResourceSpans[0].Resource.Attributes {
+		if a.Key == "service.name" && a.Value.GetStringValue() == "ndt-server" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got resource attributes %v, want the service name", req.ResourceSpans[0].Resource.Attributes)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "parent" {
+		t.Errorf("got spans %q and %q, want child and parent", c.Name, p.Name)
+	}
+	if string(c.TraceId) != string(p.TraceId) || string(c.ParentSpanId) != string(p.SpanId) || len(p.ParentSpanId) != 0 {
+		t.Errorf("child %v is not a child of %v", c, p)
+	}
+	if p.Kind != tracepb.Span_SPAN_KIND_SERVER || c.Kind != tracepb.Span_SPAN_KIND_INTERNAL {
+		t.Errorf("got kinds %v and %v, want server and internal", p.Kind, c.Kind)
+	}
+	if c.Status.Code != tracepb.Status_STATUS_CODE_ERROR || c.Status.Message != "failed" {
+		t.Errorf("got child status %v, want the error", c.Status)
+	}
+	if a := c.Attributes[0]; a.Key != "bytes" || a.Value.GetIntValue() != 10 {
+		t.Errorf("got child attribute %v, want bytes=10", a)
+	}
+	if a := p.Attributes[0]; a.Key != "uuid" || a.Value.GetStringValue() != "abc" {
+		t.Errorf("got parent attribute %v, want uuid=abc", a)
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	r := httptest.NewRequest("GET", "/ndt_protocol", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	_, span := tp.Tracer("test").Start(FromRequest(r), "request")
+	span.End()
+
+	got := recorder.Ended()
+	if len(got) != 1 {
+		t.Fatalf("got %d spans, want 1", len(got))
+	}
+	if id := got[0].SpanContext().TraceID().String(); id != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("got trace %s, want the trace of the traceparent header", id)
+	}
+	if id := got[0].Parent().SpanID().String(); id != "b7ad6b7169203331" {
+		t.Errorf("got parent %s, want the span of the traceparent header", id)
+	}
+}
+
+func TestSetError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+
+	_, ok := tracer.Start(context.Background(), "ok")
+	SetError(ok, nil)
+	ok.End()
+	_, failed := tracer.Start(context.Background(), "failed")
+	SetError(failed, errors.New("failed"))
+	failed.End()
+
+	got := recorder.Ended()
+	if s := got[0].Status(); s.Code != codes.Unset {
+		t.Errorf("got status %v for a nil error, want unset", s)
+	}
+	if s := got[1].Status(); s.Code != codes.Error || s.Description != "failed" {
+		t.Errorf("got status %v, want the error", s)
+	}
+	if len(got[1].Events()) != 1 || got[1].Events()[0].Name != "exception" {
+		t.Errorf("got events %v, want the error", got[1].Events())
+	}
+}
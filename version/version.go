@@ -1,6 +1,34 @@
 // Package version contains ndt-server version
 package version
 
+import (
+	"runtime"
+
+	"github.com/m-lab/go/prometheusx"
+)
+
 // Version is the version of ndt-server. You override this at compile time
 // using `-ldflags "-X variable=value"` facility.
 var Version string
+
+// BuildTime is when ndt-server was built, in RFC 3339 format. Like Version, it
+// is set at compile time.
+var BuildTime string
+
+// Info describes the running build of ndt-server.
+type Info struct {
+	Version   string
+	GitCommit string
+	BuildTime string
+	GoVersion string
+}
+
+// Get returns the Info of the running build.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitCommit: prometheusx.GitShortCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}